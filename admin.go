@@ -0,0 +1,93 @@
+package thebus
+
+import (
+	"sort"
+	"strings"
+)
+
+// AdminBus is implemented by the Bus returned by New. It gives the
+// introspection and maintenance operations used by the admin package.
+type AdminBus interface {
+	Bus
+	// Config returns the configuration in effect.
+	Config() Config
+	// Subscriptions lists the subscriptions of topic, sorted by ID.
+	// It returns ErrTopicNotFound if the topic does not exist.
+	Subscriptions(topic string) ([]SubscriptionInfo, error)
+	// PurgeTopic drops the messages queued on topic (never fanned out) and its
+	// retained history. The subscriber buffers are left untouched. It returns
+	// the number of queued messages dropped.
+	PurgeTopic(topic string) (int, error)
+}
+
+// SubscriptionInfo describes a subscription returned by Subscriptions.
+type SubscriptionInfo struct {
+	ID     string             `json:"id"`
+	Topic  string             `json:"topic"`
+	Config SubscriptionConfig `json:"config"`
+	Stats  SubscriberStats    `json:"stats"`
+}
+
+var _ AdminBus = (*bus)(nil)
+
+func (b *bus) Config() Config {
+	return *b.cfg
+}
+
+func (b *bus) Subscriptions(topic string) ([]SubscriptionInfo, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	state, ok := b.subscriptions[topic]
+	if !ok {
+		return nil, ErrTopicNotFound
+	}
+	seq := state.seq.Load()
+	infos := make([]SubscriptionInfo, 0, len(state.subs))
+	for id, sub := range state.subs {
+		infos = append(infos, SubscriptionInfo{
+			ID:     id,
+			Topic:  topic,
+			Config: sub.cfg,
+			Stats:  subscriberStats(sub, seq),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos, nil
+}
+
+func (b *bus) PurgeTopic(topic string) (int, error) {
+	if len(strings.TrimSpace(topic)) == 0 {
+		return 0, ErrInvalidTopic
+	}
+	// the write lock keeps the publishers out while draining
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	state, ok := b.subscriptions[topic]
+	if !ok {
+		return 0, ErrTopicNotFound
+	}
+	purged := 0
+	for drained := false; !drained; {
+		select {
+		case mr, ok := <-state.inQueue:
+			if !ok {
+				drained = true
+				break
+			}
+			purged++
+			if mr.confirm != nil {
+				mr.confirm.resolve(mr.confirm.ack)
+			}
+		default:
+			drained = true
+		}
+	}
+	state.counters.Dropped.Add(uint64(purged))
+	b.totals.Dropped.Add(uint64(purged))
+	state.retainMu.Lock()
+	state.retained = nil
+	state.retainMu.Unlock()
+	return purged, nil
+}
@@ -0,0 +1,259 @@
+// Package admin provides an http.Handler to inspect and operate a live bus:
+// stats, topics, subscriptions with their lag, configuration in effect,
+// force-unsubscribe and topic purge.
+//
+// Mount it under a prefix with http.StripPrefix:
+//
+//	mux.Handle("/admin/bus/", http.StripPrefix("/admin/bus", admin.NewHandler(bus)))
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/sebundefined/thebus"
+)
+
+var errSubscriptionNotFound = errors.New("subscription not found")
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// Action is the kind of request checked by the Authorizer.
+//   - ActionRead: the GET endpoints
+//   - ActionWrite: force-unsubscribe and purge, refused in read-only mode
+type Action string
+
+const (
+	ActionUnknown Action = "UNKNOWN"
+	ActionRead    Action = "READ"
+	ActionWrite   Action = "WRITE"
+)
+
+func (enum Action) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(ActionUnknown)
+	}
+	return string(enum)
+}
+
+func ActionValues() []Action {
+	return []Action{
+		ActionRead,
+		ActionWrite,
+	}
+}
+
+func (enum Action) IsValid() bool {
+	if slices.Contains(ActionValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum Action) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *Action) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := Action(tmp)
+	if !fs.IsValid() {
+		fs = ActionUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+// Authorizer allows (nil) or denies (an error) a request.
+type Authorizer func(r *http.Request, action Action) error
+
+type config struct {
+	readOnly   bool
+	authorizer Authorizer
+}
+
+// Option configures the Handler.
+type Option func(cfg *config)
+
+// WithReadOnly refuses the write endpoints (force-unsubscribe and purge).
+func WithReadOnly() Option {
+	return func(cfg *config) {
+		cfg.readOnly = true
+	}
+}
+
+// WithAuthorizer checks every request with authorizer. A denied request
+// gets a 403 with the error message.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(cfg *config) {
+		cfg.authorizer = authorizer
+	}
+}
+
+// ##############################################################################
+// ################################   HANDLER   #################################
+// ##############################################################################
+
+// Handler serves the admin endpoints, all returning JSON:
+//
+//	GET    /stats                                  thebus.StatsResults
+//	GET    /config                                 thebus.Config
+//	GET    /topics                                 []thebus.TopicInfo
+//	GET    /topics/{topic}/subscriptions           []thebus.SubscriptionInfo
+//	DELETE /topics/{topic}/subscriptions/{id}      force-unsubscribe
+//	POST   /topics/{topic}/purge                   {"purged": n}
+//
+// The configuration and subscriptions endpoints need a thebus.AdminBus (the
+// Bus returned by thebus.New), they return 501 otherwise.
+type Handler struct {
+	bus thebus.Bus
+	cfg config
+	mux *http.ServeMux
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+// NewHandler returns the admin Handler of bus.
+func NewHandler(bus thebus.Bus, opts ...Option) *Handler {
+	h := &Handler{bus: bus, mux: http.NewServeMux()}
+	for _, opt := range opts {
+		opt(&h.cfg)
+	}
+	h.mux.HandleFunc("GET /stats", h.guard(ActionRead, h.stats))
+	h.mux.HandleFunc("GET /config", h.guard(ActionRead, h.config))
+	h.mux.HandleFunc("GET /topics", h.guard(ActionRead, h.topics))
+	h.mux.HandleFunc("GET /topics/{topic}/subscriptions", h.guard(ActionRead, h.subscriptions))
+	h.mux.HandleFunc("DELETE /topics/{topic}/subscriptions/{id}", h.guard(ActionWrite, h.unsubscribe))
+	h.mux.HandleFunc("POST /topics/{topic}/purge", h.guard(ActionWrite, h.purge))
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) guard(action Action, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if action == ActionWrite && h.cfg.readOnly {
+			writeError(w, http.StatusForbidden, errors.New("read-only"))
+			return
+		}
+		if h.cfg.authorizer != nil {
+			if err := h.cfg.authorizer(r, action); err != nil {
+				writeError(w, http.StatusForbidden, err)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.bus.Stats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (h *Handler) config(w http.ResponseWriter, r *http.Request) {
+	admin, ok := h.adminBus(w)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, admin.Config())
+}
+
+func (h *Handler) topics(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.bus.Topics())
+}
+
+func (h *Handler) subscriptions(w http.ResponseWriter, r *http.Request) {
+	admin, ok := h.adminBus(w)
+	if !ok {
+		return
+	}
+	subs, err := admin.Subscriptions(r.PathValue("topic"))
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, subs)
+}
+
+func (h *Handler) unsubscribe(w http.ResponseWriter, r *http.Request) {
+	topic, id := r.PathValue("topic"), r.PathValue("id")
+	// Unsubscribe ignores the unknown IDs, look it up first when the bus allows it
+	if admin, ok := h.bus.(thebus.AdminBus); ok {
+		subs, err := admin.Subscriptions(topic)
+		if err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		if !slices.ContainsFunc(subs, func(sub thebus.SubscriptionInfo) bool { return sub.ID == id }) {
+			writeError(w, http.StatusNotFound, errSubscriptionNotFound)
+			return
+		}
+	}
+	if err := h.bus.Unsubscribe(topic, id); err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) purge(w http.ResponseWriter, r *http.Request) {
+	admin, ok := h.adminBus(w)
+	if !ok {
+		return
+	}
+	purged, err := admin.PurgeTopic(r.PathValue("topic"))
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+func (h *Handler) adminBus(w http.ResponseWriter) (thebus.AdminBus, bool) {
+	admin, ok := h.bus.(thebus.AdminBus)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("the bus does not implement thebus.AdminBus"))
+	}
+	return admin, ok
+}
+
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, thebus.ErrTopicNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, thebus.ErrInvalidTopic), errors.Is(err, thebus.ErrInvalidSubscriberID):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,114 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sebundefined/thebus"
+)
+
+func do(t *testing.T, h http.Handler, method, path string, out any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	if out != nil && rec.Code < 300 {
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestHandler(t *testing.T) {
+	b, _ := thebus.New(thebus.WithSyncDelivery(true))
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, _ := b.Subscribe(ctx, "orders", thebus.WithSubscriberName("billing"),
+		thebus.WithHandler(func(thebus.Message) {}))
+	_ = b.DeclareTopic("audit", thebus.TopicOptions{Retention: 10})
+	_, _ = b.Publish("orders", []byte("x"))
+
+	h := NewHandler(b)
+
+	var stats thebus.StatsResults
+	if code := do(t, h, "GET", "/stats", &stats); code != http.StatusOK || stats.Totals.Published != 1 {
+		t.Fatalf("stats: %d %+v", code, stats.Totals)
+	}
+	var cfg thebus.Config
+	if code := do(t, h, "GET", "/config", &cfg); code != http.StatusOK || !cfg.SyncDelivery {
+		t.Fatalf("config: %d %+v", code, cfg)
+	}
+	var topics []thebus.TopicInfo
+	if code := do(t, h, "GET", "/topics", &topics); code != http.StatusOK || len(topics) != 2 {
+		t.Fatalf("topics: %d %+v", code, topics)
+	}
+	var subs []thebus.SubscriptionInfo
+	if code := do(t, h, "GET", "/topics/orders/subscriptions", &subs); code != http.StatusOK || len(subs) != 1 {
+		t.Fatalf("subscriptions: %d %+v", code, subs)
+	}
+	if subs[0].ID != sub.GetID() || subs[0].Config.Name != "billing" || subs[0].Stats.Delivered != 1 {
+		t.Fatalf("unexpected subscription %+v", subs[0])
+	}
+	if code := do(t, h, "GET", "/topics/unknown/subscriptions", nil); code != http.StatusNotFound {
+		t.Fatalf("unknown topic: want 404, got %d", code)
+	}
+
+	var purged map[string]int
+	if code := do(t, h, "POST", "/topics/audit/purge", &purged); code != http.StatusOK || purged["purged"] != 0 {
+		t.Fatalf("purge: %d %+v", code, purged)
+	}
+	if code := do(t, h, "DELETE", "/topics/orders/subscriptions/unknown", nil); code != http.StatusNotFound {
+		t.Fatalf("unknown subscription: want 404, got %d", code)
+	}
+	if code := do(t, h, "DELETE", "/topics/unknown/subscriptions/"+sub.GetID(), nil); code != http.StatusNotFound {
+		t.Fatalf("unknown topic: want 404, got %d", code)
+	}
+	if code := do(t, h, "DELETE", "/topics/orders/subscriptions/"+sub.GetID(), nil); code != http.StatusNoContent {
+		t.Fatalf("unsubscribe: want 204, got %d", code)
+	}
+	<-sub.Done()
+	if !errors.Is(sub.Err(), thebus.ErrUnsubscribed) {
+		t.Fatalf("want ErrUnsubscribed, got %v", sub.Err())
+	}
+}
+
+func TestHandlerReadOnlyAndAuthorizer(t *testing.T) {
+	b, _ := thebus.New()
+	defer b.Close()
+	_ = b.DeclareTopic("orders", thebus.TopicOptions{})
+
+	h := NewHandler(b, WithReadOnly())
+	if code := do(t, h, "GET", "/topics", nil); code != http.StatusOK {
+		t.Fatalf("read: want 200, got %d", code)
+	}
+	if code := do(t, h, "POST", "/topics/orders/purge", nil); code != http.StatusForbidden {
+		t.Fatalf("read-only purge: want 403, got %d", code)
+	}
+
+	var actions []Action
+	h = NewHandler(b, WithAuthorizer(func(r *http.Request, action Action) error {
+		actions = append(actions, action)
+		if r.Header.Get("Authorization") == "" {
+			return errors.New("unauthenticated")
+		}
+		return nil
+	}))
+	if code := do(t, h, "GET", "/stats", nil); code != http.StatusForbidden {
+		t.Fatalf("unauthenticated: want 403, got %d", code)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/topics/orders/purge", nil)
+	req.Header.Set("Authorization", "token")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("authorized purge: want 200, got %d", rec.Code)
+	}
+	if len(actions) != 2 || actions[0] != ActionRead || actions[1] != ActionWrite {
+		t.Fatalf("unexpected actions %v", actions)
+	}
+}
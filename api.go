@@ -15,7 +15,15 @@ type Bus interface {
 	// configuration: the call could return ErrQueueFull.
 	// Returns a PublishAck indicating whether the message was enqueued
 	// and how many subscribers were present at publish.
-	Publish(topic string, data []byte) (PublishAck, error)
+	Publish(topic string, data []byte, opts ...PublishOption) (PublishAck, error)
+	// PublishContext publishes like Publish. The span context found in ctx (see
+	// Tracer and ContextWithSpanContext) is carried by the message in the W3C
+	// traceparent/tracestate headers, see Message.TraceContext.
+	PublishContext(ctx context.Context, topic string, data []byte, opts ...PublishOption) (PublishAck, error)
+	// PublishConfirm publishes like Publish and returns a Confirmation that
+	// resolves, with the outcome per subscriber and the fan-out latency,
+	// once the message was fanned out.
+	PublishConfirm(topic string, data []byte, opts ...PublishOption) (*Confirmation, error)
 	// Subscribe registers a new subscription to the given topic.
 	// A subscription receives all messages published after it is created.
 	// Options (buffer size, drop policy, copy strategy, etc.) can be set
@@ -30,6 +38,18 @@ type Bus interface {
 	// After Close, no further publish or subscribe is allowed. Existing
 	// subscriptions are closed and workers are stopped. Close is idempotent.
 	Close() error
+	// Shutdown gracefully stops the bus: publishes and subscriptions are refused,
+	// then the queued messages are delivered and the subscriber buffers consumed
+	// until ctx is done. After the deadline the delivery is force-stopped and
+	// ctx.Err() is returned. The ShutdownReport gives the undelivered messages per topic.
+	Shutdown(ctx context.Context) (ShutdownReport, error)
+	// DeclareTopic creates a topic (or updates an existing one) with its own
+	// configuration. A declared topic exists even without subscribers.
+	DeclareTopic(topic string, opts TopicOptions) error
+	// DeleteTopic removes a topic and closes its subscriptions with ErrTopicDeleted.
+	DeleteTopic(topic string) error
+	// Topics lists the topics with their effective configuration.
+	Topics() []TopicInfo
 	// Stats returns runtime statistics about the bus, topics, and subscribers.
 	Stats() (StatsResults, error)
 }
@@ -0,0 +1,430 @@
+// Package bridge mirrors topics between two buses (per tenant, per module...)
+// instead of hand-written goroutines copying subscriptions to publishes:
+//
+//	b, err := bridge.New(ctx, orders, billing, []bridge.Rule{
+//		{Topic: "orders.*", Prefix: "remote."},                     // orders -> billing
+//		{Topic: "invoices", Direction: bridge.DirectionBoth},        // both ways
+//		{Topic: "audit.*", Filter: func(msg thebus.Message) bool {   // only the errors
+//			return msg.Headers["level"] == "error"
+//		}},
+//	})
+//	defer b.Close()
+//
+// Every forwarded message carries the names of the bridges it crossed in
+// HeaderHops: a bridge does not forward a message twice, nor a message which
+// crossed too many bridges (see WithMaxHops), so buses bridged both ways or
+// in a ring do not loop.
+//
+// The subscriptions of a bridge are named (see thebus.WithSubscriberName) so
+// their lag and drops show in the bus Stats, and Bridge.Stats sums them up per
+// rule and direction with the forwarding errors.
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sebundefined/thebus"
+	"github.com/sebundefined/thebus/internal/topicfeed"
+)
+
+const (
+	DefaultMaxHops      = 8
+	DefaultTopicRefresh = time.Second
+
+	// HeaderHops is the comma separated names of the bridges a message crossed.
+	HeaderHops = "Bus-Bridge-Hops"
+)
+
+var ErrInvalidRule = errors.New("bridge: invalid rule")
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// Direction is the direction of a Rule between the two buses of a bridge.
+//   - DirectionForward: from the source bus to the destination bus (default)
+//   - DirectionBackward: from the destination bus to the source bus
+//   - DirectionBoth: both ways, the rule applies as is in each direction
+type Direction string
+
+const (
+	DirectionUnknown  Direction = "UNKNOWN"
+	DirectionForward  Direction = "FORWARD"
+	DirectionBackward Direction = "BACKWARD"
+	DirectionBoth     Direction = "BOTH"
+)
+
+func (enum Direction) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(DirectionUnknown)
+	}
+	return string(enum)
+}
+
+func DirectionValues() []Direction {
+	return []Direction{
+		DirectionForward,
+		DirectionBackward,
+		DirectionBoth,
+	}
+}
+
+func (enum Direction) IsValid() bool {
+	if slices.Contains(DirectionValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum Direction) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *Direction) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := Direction(tmp)
+	if !fs.IsValid() {
+		fs = DirectionUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// ##############################################################################
+// #################################   RULES   ##################################
+// ##############################################################################
+
+// Rule selects the topics to mirror and how.
+type Rule struct {
+	// Topic is a topic or a pattern (path.Match syntax) of the topics to
+	// mirror. The topics of a pattern are found when the bridge starts, then
+	// periodically (see WithTopicRefresh). The system topics only match the
+	// patterns starting with thebus.SystemTopicPrefix.
+	Topic string
+	// Direction defaults to DirectionForward.
+	Direction Direction
+	// Rename returns the destination topic of a topic, the same by default.
+	Rename func(topic string) string
+	// Prefix is prepended to the destination topic, after Rename.
+	Prefix string
+	// Filter selects the messages to mirror, see thebus.WithFilter.
+	Filter thebus.Filter
+}
+
+func (r Rule) validate() error {
+	if len(strings.TrimSpace(r.Topic)) == 0 {
+		return fmt.Errorf("%w: empty topic", ErrInvalidRule)
+	}
+	if _, err := path.Match(r.Topic, ""); err != nil {
+		return fmt.Errorf("%w: %q: %v", ErrInvalidRule, r.Topic, err)
+	}
+	if r.Direction != "" && !r.Direction.IsValid() {
+		return fmt.Errorf("%w: direction %q", ErrInvalidRule, r.Direction)
+	}
+	return nil
+}
+
+// destination returns the topic of the other bus of topic.
+func (r Rule) destination(topic string) string {
+	if r.Rename != nil {
+		topic = r.Rename(topic)
+	}
+	return r.Prefix + topic
+}
+
+// matcher returns the topic matcher of a pattern, nil for a single topic.
+func (r Rule) matcher() func(topic string) bool {
+	if !strings.ContainsAny(r.Topic, `*?[\`) {
+		return nil
+	}
+	system := strings.HasPrefix(r.Topic, thebus.SystemTopicPrefix)
+	return func(topic string) bool {
+		if !system && strings.HasPrefix(topic, thebus.SystemTopicPrefix) {
+			return false
+		}
+		ok, _ := path.Match(r.Topic, topic)
+		return ok
+	}
+}
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+type config struct {
+	name          string
+	maxHops       int
+	topicRefresh  time.Duration
+	subscribeOpts []thebus.SubscribeOption
+	logger        thebus.Logger
+}
+
+// Option configures a Bridge.
+type Option func(cfg *config)
+
+// WithName sets the name of the bridge, in HeaderHops and in the names of its
+// subscriptions. A random ID by default.
+func WithName(name string) Option {
+	return func(cfg *config) {
+		cfg.name = name
+	}
+}
+
+// WithMaxHops drops the messages which crossed hops bridges already.
+func WithMaxHops(hops int) Option {
+	return func(cfg *config) {
+		cfg.maxHops = hops
+	}
+}
+
+// WithTopicRefresh sets the interval of the lookup of the topics matching
+// the rule patterns.
+func WithTopicRefresh(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.topicRefresh = interval
+	}
+}
+
+// WithSubscribeOptions sets the options of the subscriptions of the bridge,
+// e.g. thebus.WithDropIfFull(false) to slow the publishers down rather than
+// dropping messages.
+func WithSubscribeOptions(opts ...thebus.SubscribeOption) Option {
+	return func(cfg *config) {
+		cfg.subscribeOpts = append(cfg.subscribeOpts, opts...)
+	}
+}
+
+// WithLogger sets the logger of the bridge.
+func WithLogger(logger thebus.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
+
+// ##############################################################################
+// #################################   BRIDGE   #################################
+// ##############################################################################
+
+// Bridge mirrors topics between two buses until it is closed.
+type Bridge struct {
+	cfg    config
+	src    thebus.Bus
+	dst    thebus.Bus
+	cancel context.CancelFunc
+	links  []*link
+	once   sync.Once
+}
+
+// link is a rule in a direction.
+type link struct {
+	bridge     *Bridge
+	index      int
+	rule       Rule
+	direction  Direction // DirectionForward or DirectionBackward
+	from, to   thebus.Bus
+	subscriber string
+	registry   *topicfeed.Registry
+	feed       *topicfeed.Feed
+
+	forwarded atomic.Uint64
+	looped    atomic.Uint64
+	failed    atomic.Uint64
+
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// New starts a bridge between src and dst mirroring the topics of rules,
+// until Close or the end of ctx.
+func New(ctx context.Context, src, dst thebus.Bus, rules []Rule, opts ...Option) (*Bridge, error) {
+	cfg := config{
+		maxHops:      DefaultMaxHops,
+		topicRefresh: DefaultTopicRefresh,
+		logger:       thebus.NoopLogger(),
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.name == "" {
+		cfg.name = thebus.DefaultIDGenerator()
+	}
+	if strings.Contains(cfg.name, ",") {
+		return nil, fmt.Errorf("bridge: invalid name %q", cfg.name)
+	}
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	b := &Bridge{cfg: cfg, src: src, dst: dst, cancel: cancel}
+	for i, rule := range rules {
+		directions := []Direction{DirectionForward}
+		switch rule.Direction {
+		case DirectionBackward:
+			directions = []Direction{DirectionBackward}
+		case DirectionBoth:
+			directions = []Direction{DirectionForward, DirectionBackward}
+		}
+		for _, direction := range directions {
+			l := &link{bridge: b, index: i, rule: rule, direction: direction, from: src, to: dst}
+			if direction == DirectionBackward {
+				l.from, l.to = dst, src
+			}
+			if err := l.start(ctx); err != nil {
+				_ = b.Close()
+				return nil, err
+			}
+			b.links = append(b.links, l)
+		}
+	}
+	return b, nil
+}
+
+// Name returns the name of the bridge.
+func (b *Bridge) Name() string {
+	return b.cfg.name
+}
+
+// Close stops the bridge and waits for the messages being forwarded.
+func (b *Bridge) Close() error {
+	b.once.Do(func() {
+		b.cancel()
+		for _, l := range b.links {
+			l.feed.Close()
+			l.registry.Wait()
+		}
+	})
+	return nil
+}
+
+func (l *link) start(ctx context.Context) error {
+	l.subscriber = fmt.Sprintf("bridge:%s:%d:%s", l.bridge.cfg.name, l.index, strings.ToLower(l.direction.String()))
+	opts := append(l.bridge.cfg.subscribeOpts[:len(l.bridge.cfg.subscribeOpts):len(l.bridge.cfg.subscribeOpts)], thebus.WithSubscriberName(l.subscriber))
+	if l.rule.Filter != nil {
+		opts = append(opts, thebus.WithFilter(l.rule.Filter))
+	}
+	l.registry = topicfeed.NewRegistry(ctx, l.from, opts...)
+	match := l.rule.matcher()
+	feed, err := l.registry.Subscribe(l.rule.Topic, match, l.forward)
+	if err != nil {
+		return err
+	}
+	l.feed = feed
+	if match != nil && l.bridge.cfg.topicRefresh > 0 {
+		l.registry.RefreshEvery(l.bridge.cfg.topicRefresh)
+	}
+	return nil
+}
+
+func (l *link) forward(msg thebus.Message) {
+	name := l.bridge.cfg.name
+	var hops []string
+	if value := msg.Headers[HeaderHops]; value != "" {
+		hops = strings.Split(value, ",")
+	}
+	if slices.Contains(hops, name) || len(hops) >= l.bridge.cfg.maxHops {
+		l.looped.Add(1)
+		return
+	}
+	topic := l.rule.destination(msg.Topic)
+	_, err := l.to.Publish(topic, msg.Payload,
+		thebus.WithHeaders(msg.Headers),
+		thebus.WithHeader(HeaderHops, strings.Join(append(hops, name), ",")),
+	)
+	if err != nil {
+		l.failed.Add(1)
+		l.mu.Lock()
+		l.lastError = err.Error()
+		l.lastErrorAt = time.Now()
+		l.mu.Unlock()
+		l.bridge.cfg.logger.Warn("bridge forward failed", "bridge", name, "from", msg.Topic, "to", topic, "error", err)
+		return
+	}
+	l.forwarded.Add(1)
+}
+
+// ##############################################################################
+// #################################   STATS   ##################################
+// ##############################################################################
+
+// LinkStats are the stats of a rule in a direction.
+type LinkStats struct {
+	Rule      int       `json:"rule"` // index in the rules
+	Topic     string    `json:"topic"`
+	Direction Direction `json:"direction"` // DirectionForward or DirectionBackward
+	// Subscriber is the name of the subscriptions of the link in the bus Stats.
+	Subscriber string `json:"subscriber"`
+	Topics     int    `json:"topics"` // subscribed topics
+	Forwarded  uint64 `json:"forwarded"`
+	Looped     uint64 `json:"looped"` // not forwarded by the loop prevention
+	Failed     uint64 `json:"failed"` // refused by the destination bus
+	// Lag is the number of messages published on the subscribed topics not
+	// forwarded yet (or dropped), see thebus.SubscriberStats.Lag.
+	Lag         uint64    `json:"lag"`
+	Dropped     uint64    `json:"dropped"` // by the subscriptions, see thebus.SubscriberStats.Dropped
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitzero"`
+}
+
+// Stats are the stats of a Bridge.
+type Stats struct {
+	Name  string      `json:"name"`
+	Links []LinkStats `json:"links"`
+}
+
+// Stats returns the stats of the links of the bridge.
+func (b *Bridge) Stats() (Stats, error) {
+	srcStats, err := b.src.Stats()
+	if err != nil {
+		return Stats{}, err
+	}
+	dstStats, err := b.dst.Stats()
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{Name: b.cfg.name, Links: make([]LinkStats, 0, len(b.links))}
+	for _, l := range b.links {
+		ls := LinkStats{
+			Rule:       l.index,
+			Topic:      l.rule.Topic,
+			Direction:  l.direction,
+			Subscriber: l.subscriber,
+			Forwarded:  l.forwarded.Load(),
+			Looped:     l.looped.Load(),
+			Failed:     l.failed.Load(),
+		}
+		l.mu.Lock()
+		ls.LastError, ls.LastErrorAt = l.lastError, l.lastErrorAt
+		l.mu.Unlock()
+		perTopic := srcStats.PerTopic
+		if l.direction == DirectionBackward {
+			perTopic = dstStats.PerTopic
+		}
+		for _, topic := range perTopic {
+			for _, sub := range topic.Subscriptions {
+				if sub.Name == l.subscriber {
+					ls.Topics++
+					ls.Lag += sub.Lag
+					ls.Dropped += sub.Dropped
+				}
+			}
+		}
+		stats.Links = append(stats.Links, ls)
+	}
+	return stats, nil
+}
@@ -0,0 +1,210 @@
+package bridge
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+func newBus(t *testing.T) thebus.Bus {
+	t.Helper()
+	bus, err := thebus.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = bus.Close() })
+	return bus
+}
+
+func newBridge(t *testing.T, src, dst thebus.Bus, rules []Rule, opts ...Option) *Bridge {
+	t.Helper()
+	b, err := New(t.Context(), src, dst, rules, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = b.Close() })
+	return b
+}
+
+func subscribe(t *testing.T, bus thebus.Bus, topic string) thebus.Subscription {
+	t.Helper()
+	sub, err := bus.Subscribe(t.Context(), topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func receive(t *testing.T, sub thebus.Subscription) thebus.Message {
+	t.Helper()
+	select {
+	case msg := <-sub.Read():
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no message on %s", sub.GetTopic())
+		return thebus.Message{}
+	}
+}
+
+func expectNone(t *testing.T, sub thebus.Subscription) {
+	t.Helper()
+	select {
+	case msg := <-sub.Read():
+		t.Fatalf("unexpected message: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitSubscribers(t *testing.T, bus thebus.Bus, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		stats, _ := bus.Stats()
+		if stats.PerTopic[topic].Subscribers == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscribers on %s", n, topic)
+}
+
+func TestForward(t *testing.T) {
+	src, dst := newBus(t), newBus(t)
+	if err := src.DeclareTopic("orders.created", thebus.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	newBridge(t, src, dst, []Rule{{Topic: "orders.*", Prefix: "remote."}}, WithName("b1"), WithTopicRefresh(10*time.Millisecond))
+	created := subscribe(t, dst, "remote.orders.created")
+	if _, err := src.Publish("orders.created", []byte("42"), thebus.WithHeader("k", "v")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, created); string(msg.Payload) != "42" || msg.Headers["k"] != "v" || msg.Headers[HeaderHops] != "b1" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// a topic created later, found by the refresh
+	if err := src.DeclareTopic("orders.paid", thebus.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitSubscribers(t, src, "orders.paid", 1)
+	paid := subscribe(t, dst, "remote.orders.paid")
+	_, _ = src.Publish("orders.paid", []byte("43"))
+	if msg := receive(t, paid); string(msg.Payload) != "43" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
+
+func TestRenameAndFilter(t *testing.T) {
+	src, dst := newBus(t), newBus(t)
+	newBridge(t, src, dst, []Rule{{
+		Topic:  "audit",
+		Rename: strings.ToUpper,
+		Prefix: "tenant1.",
+		Filter: func(msg thebus.Message) bool { return msg.Headers["level"] == "error" },
+	}})
+	sub := subscribe(t, dst, "tenant1.AUDIT")
+	_, _ = src.Publish("audit", []byte("info"), thebus.WithHeader("level", "info"))
+	_, _ = src.Publish("audit", []byte("error"), thebus.WithHeader("level", "error"))
+	if msg := receive(t, sub); string(msg.Payload) != "error" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	expectNone(t, sub)
+}
+
+func TestBothDirections(t *testing.T) {
+	a, b := newBus(t), newBus(t)
+	br := newBridge(t, a, b, []Rule{{Topic: "invoices", Direction: DirectionBoth}})
+	onA := subscribe(t, a, "invoices")
+	onB := subscribe(t, b, "invoices")
+
+	_, _ = a.Publish("invoices", []byte("from a"))
+	if msg := receive(t, onB); string(msg.Payload) != "from a" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	if msg := receive(t, onA); string(msg.Payload) != "from a" || msg.Headers[HeaderHops] != "" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	expectNone(t, onA) // not sent back
+
+	_, _ = b.Publish("invoices", []byte("from b"))
+	if msg := receive(t, onA); string(msg.Payload) != "from b" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+
+	// the echo of "from b" reaches the forward link asynchronously
+	var stats Stats
+	eventually(t, func() bool {
+		stats, _ = br.Stats()
+		return len(stats.Links) == 2 && stats.Links[0].Looped == 1
+	})
+	forward, backward := stats.Links[0], stats.Links[1]
+	if forward.Direction != DirectionForward || forward.Forwarded != 1 || forward.Looped != 1 || forward.Topics != 1 {
+		t.Fatalf("unexpected forward stats: %+v", forward)
+	}
+	if backward.Direction != DirectionBackward || backward.Forwarded != 1 || backward.Looped != 1 {
+		t.Fatalf("unexpected backward stats: %+v", backward)
+	}
+}
+
+func TestMaxHops(t *testing.T) {
+	a, b, c := newBus(t), newBus(t), newBus(t)
+	rules := []Rule{{Topic: "t"}}
+	newBridge(t, a, b, rules, WithName("ab"), WithMaxHops(2))
+	newBridge(t, b, c, rules, WithName("bc"), WithMaxHops(2))
+	ca := newBridge(t, c, a, rules, WithName("ca"), WithMaxHops(2))
+	onA := subscribe(t, a, "t")
+	onC := subscribe(t, c, "t")
+
+	_, _ = a.Publish("t", []byte("x"))
+	if msg := receive(t, onC); msg.Headers[HeaderHops] != "ab,bc" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	receive(t, onA) // the original
+	expectNone(t, onA)
+	eventually(t, func() bool {
+		stats, _ := ca.Stats()
+		return stats.Links[0].Looped == 1 && stats.Links[0].Forwarded == 0
+	})
+}
+
+func TestErrors(t *testing.T) {
+	src, dst := newBus(t), newBus(t)
+	for _, rule := range []Rule{{}, {Topic: "a["}, {Topic: "a", Direction: "SIDEWAYS"}} {
+		if _, err := New(t.Context(), src, dst, []Rule{rule}); !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("%+v: expected ErrInvalidRule, got %v", rule, err)
+		}
+	}
+
+	b := newBridge(t, src, dst, []Rule{{Topic: "t", Prefix: thebus.SystemTopicPrefix}}, WithName("sys"))
+	_, _ = src.Publish("t", []byte("x"))
+	var stats Stats
+	eventually(t, func() bool {
+		stats, _ = b.Stats()
+		return stats.Links[0].Failed == 1
+	})
+	link := stats.Links[0]
+	if !strings.Contains(link.LastError, thebus.ErrInvalidTopicNameReserved.Error()) || link.Subscriber != "bridge:sys:0:forward" {
+		t.Fatalf("unexpected stats: %+v", link)
+	}
+	busStats, _ := src.Stats()
+	for _, sub := range busStats.PerTopic["t"].Subscriptions {
+		if sub.Name == link.Subscriber && sub.Lag == 0 {
+			return
+		}
+	}
+	t.Fatalf("the bridge subscription is not in the bus stats: %+v", busStats.PerTopic["t"])
+}
@@ -3,6 +3,7 @@ package thebus
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,6 +17,8 @@ type bus struct {
 	startedAt     time.Time
 	subscriptions map[string]*topicState
 	totals        atomicCounters
+	rates         rateRecorder
+	stop          chan struct{} // closed when the bus stops, ends the background goroutines
 }
 
 var _ Bus = (*bus)(nil)
@@ -26,35 +29,97 @@ var _ Bus = (*bus)(nil)
 func New(opts ...Option) (Bus, error) {
 	cfg := BuildConfig(opts...).Normalize()
 	b := &bus{
-		startedAt:     time.Now(),
+		startedAt:     cfg.Clock.Now(),
 		cfg:           cfg,
 		totals:        atomicCounters{},
 		subscriptions: make(map[string]*topicState),
+		stop:          make(chan struct{}),
 	}
 	b.open.Store(true)
+	if cfg.JanitorInterval > 0 {
+		go b.runJanitor(cfg.JanitorInterval)
+	}
+	if cfg.RateInterval > 0 {
+		go b.runRates(cfg.RateInterval)
+	}
 	return b, nil
 }
 
 // Publish a message on a specific topic. It returns a PublishAck and/or an error.
-func (b *bus) Publish(topic string, data []byte) (PublishAck, error) {
-	now := time.Now().UTC()
+func (b *bus) Publish(topic string, data []byte, opts ...PublishOption) (PublishAck, error) {
+	return b.PublishContext(context.Background(), topic, data, opts...)
+}
+
+// PublishContext publishes a message carrying the span context of ctx.
+func (b *bus) PublishContext(ctx context.Context, topic string, data []byte, opts ...PublishOption) (PublishAck, error) {
+	if err := validatePublishTopic(topic); err != nil {
+		return PublishAck{}, err
+	}
+	return b.publishContext(ctx, topic, data, opts, nil)
+}
+
+// publishContext starts the publish span, propagates the span context in the
+// headers then runs the interceptors and publishes.
+func (b *bus) publishContext(ctx context.Context, topic string, data []byte, opts []PublishOption, conf *Confirmation) (PublishAck, error) {
+	ctx, span := b.startSpan(ctx, SpanOperationPublish, topic)
+	sc, _ := SpanContextFromContext(ctx)
+	if span != nil && span.SpanContext().IsValid() {
+		sc = span.SpanContext()
+	}
+	// the headers set by the caller win
+	opts = append([]PublishOption{WithSpanContext(sc)}, opts...)
+	msg := Message{Topic: topic, Payload: data, Headers: BuildPublishConfig(opts...).Headers}
+	ack, err := b.publishIntercepted(ctx, msg, conf)
+	if span != nil {
+		span.SetAttribute("message.seq", strconv.FormatUint(ack.Seq, 10))
+	}
+	endSpan(span, err)
+	return ack, err
+}
+
+func validatePublishTopic(topic string) error {
 	if len(strings.TrimSpace(topic)) == 0 {
-		return PublishAck{}, ErrInvalidTopic
+		return ErrInvalidTopic
+	}
+	if strings.HasPrefix(topic, SystemTopicPrefix) {
+		return ErrInvalidTopicNameReserved
 	}
+	return nil
+}
+
+// publish is Publish without the topic name checks, used for the system topics.
+// If conf is not nil it is resolved once the fan-out of the message is done.
+func (b *bus) publish(topic string, data []byte, pc PublishConfig, conf *Confirmation) (PublishAck, error) {
+	now := b.cfg.Clock.Now().UTC()
 	if !b.open.Load() {
 		return PublishAck{}, ErrClosed
 	}
 	var ack PublishAck
 	var errOut error
+	var syncState *topicState
+	var syncCopy bool
 	err := b.withReadState(topic, func(st *topicState) error {
-		if st == nil || len(st.subs) == 0 {
+		if st == nil || (len(st.subs) == 0 && st.cfg.Retention <= 0) {
 			ack = PublishAck{Topic: topic, Enqueued: false, Subscribers: 0}
 			return nil
 		}
+		if st.closed.Load() {
+			// Shutdown or Close closed the queue after the open check, the
+			// queue is only closed under the write lock
+			return ErrClosed
+		}
+		st.lastActivity.Store(now.UnixNano())
+		if st.cfg.SyncDelivery {
+			// delivered out of the lock, see publishSync. The config is read
+			// here: DeclareTopic rewrites it under the write lock.
+			syncState = st
+			syncCopy = st.cfg.CopyOnPublish
+			return nil
+		}
 		seq := st.seq.Add(1)
 
 		payload := data
-		if b.cfg.CopyOnPublish {
+		if st.cfg.CopyOnPublish {
 			cp := make([]byte, len(data))
 			copy(cp, data)
 			payload = cp
@@ -65,23 +130,30 @@ func (b *bus) Publish(topic string, data []byte) (PublishAck, error) {
 			ts:      now,
 			seq:     seq,
 			payload: payload,
+			headers: pc.Headers,
+			confirm: conf,
+		}
+		if conf != nil {
+			mr.id = conf.ack.MessageID
+			conf.ack.Topic = topic
+			conf.ack.Seq = seq
+			conf.ack.Subscribers = len(st.subs)
 		}
 
-		select {
-		case st.inQueue <- mr:
+		ack = PublishAck{
+			Topic:       topic,
+			Seq:         seq,
+			MessageID:   mr.id,
+			Enqueued:    b.enqueueLocked(st, mr),
+			Subscribers: len(st.subs),
+		}
+		if ack.Enqueued {
 			st.counters.Published.Add(1)
 			b.totals.Published.Add(1)
-			ack = PublishAck{
-				Topic:       topic,
-				Enqueued:    true,
-				Subscribers: len(st.subs),
-			}
-		default:
-			ack = PublishAck{
-				Topic:       topic,
-				Enqueued:    false,
-				Subscribers: len(st.subs),
-			}
+		} else if st.cfg.PublishPolicy == PublishPolicyDropIfFull {
+			st.counters.Dropped.Add(1)
+			b.totals.Dropped.Add(1)
+		} else {
 			errOut = ErrQueueFull
 		}
 		return nil
@@ -89,9 +161,91 @@ func (b *bus) Publish(topic string, data []byte) (PublishAck, error) {
 	if err != nil {
 		return PublishAck{}, err
 	}
+	if syncState != nil {
+		return b.publishSync(topic, syncState, data, syncCopy, pc, now, conf), nil
+	}
 	return ack, errOut
 }
 
+// publishSync delivers the message in the caller goroutine. The topic syncMu
+// keeps the Seq order and a single sender per subscriber, like the fan-out worker.
+// copyOnPublish is the topic CopyOnPublish, read by the caller under the RLock.
+func (b *bus) publishSync(topic string, st *topicState, data []byte, copyOnPublish bool, pc PublishConfig, now time.Time, conf *Confirmation) PublishAck {
+	payload := data
+	if copyOnPublish {
+		payload = make([]byte, len(data))
+		copy(payload, data)
+	}
+	ack := PublishAck{Topic: topic, Enqueued: true, Sync: true}
+	if conf != nil {
+		ack.MessageID = conf.ack.MessageID
+	}
+
+	st.syncMu.Lock()
+	defer st.syncMu.Unlock()
+	if st.syncTimer == nil {
+		st.syncTimer = b.cfg.Clock.NewTimer(time.Hour)
+		if !st.syncTimer.Stop() {
+			<-st.syncTimer.C()
+		}
+	}
+	mr := messageRef{
+		id:      ack.MessageID,
+		topic:   topic,
+		ts:      now,
+		seq:     st.seq.Add(1),
+		payload: payload,
+		headers: pc.Headers,
+	}
+	ack.Seq = mr.seq
+	st.counters.Published.Add(1)
+	b.totals.Published.Add(1)
+	b.dispatch(topic, st, mr, st.syncTimer, &ack)
+	ack.Subscribers = len(ack.Deliveries)
+	ack.Latency = b.cfg.Clock.Now().Sub(now)
+	if conf != nil {
+		conf.resolve(ack)
+	}
+	return ack
+}
+
+// enqueueLocked puts mr in the topic queue according to the topic PublishPolicy.
+// Caller must hold the RLock.
+func (b *bus) enqueueLocked(st *topicState, mr messageRef) bool {
+	select {
+	case st.inQueue <- mr:
+		b.observeDepth(st)
+		return true
+	default:
+	}
+	if st.cfg.PublishPolicy != PublishPolicyDropOldest {
+		return false
+	}
+	select {
+	case evicted := <-st.inQueue:
+		st.counters.Dropped.Add(1)
+		b.totals.Dropped.Add(1)
+		if evicted.confirm != nil {
+			// never fanned out, no delivery to report
+			evicted.confirm.resolve(evicted.confirm.ack)
+		}
+	default:
+	}
+	select {
+	case st.inQueue <- mr:
+		b.observeDepth(st)
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *bus) observeDepth(st *topicState) {
+	depth := len(st.inQueue)
+	st.rates.observeDepth(depth)
+	b.rates.observeDepth(depth)
+}
+
 func (b *bus) Subscribe(ctx context.Context, topic string, opts ...SubscribeOption) (Subscription, error) {
 	// Standard checks
 	if !b.open.Load() {
@@ -107,14 +261,8 @@ func (b *bus) Subscribe(ctx context.Context, topic string, opts ...SubscribeOpti
 
 	// Building the subscription
 	id := b.cfg.IDGenerator()
-	msgChan := make(chan Message, cfg.BufferSize)
-	sub := &subscription{
-		subscriptionID: id,
-		cfg:            cfg,
-		topic:          topic,
-		messageChan:    msgChan,
-		messages:       (<-chan Message)(msgChan),
-	}
+	sub := newSubscription(id, topic, cfg)
+	sub.createdAt = b.cfg.Clock.Now().UTC()
 	// Saving, function under lock so ok
 	err := b.withWriteState(topic, true, func(state *topicState) error {
 		// Recheck in case of closed before the first lock
@@ -124,20 +272,35 @@ func (b *bus) Subscribe(ctx context.Context, topic string, opts ...SubscribeOpti
 			// unlock useless here because it is handled by withWriteState
 			return ErrClosed
 		}
-		if b.cfg.MaxSubscribersPerTopic > 0 && len(state.subs) >= b.cfg.MaxSubscribersPerTopic {
-			return fmt.Errorf("too many subscribers per topic (max: %d)", b.cfg.MaxSubscribersPerTopic)
+		if state.cfg.MaxSubscribers > 0 && len(state.subs) >= state.cfg.MaxSubscribers {
+			return fmt.Errorf("too many subscribers per topic (max: %d)", state.cfg.MaxSubscribers)
+		}
+		// the lag starts when the subscriber joined
+		sub.counters.lastSeq.Store(state.seq.Load())
+		if cfg.ReplayFrom > 0 {
+			if dropped := state.replayLocked(topic, sub, cfg.ReplayFrom, b.cfg.Clock.Now().UTC()); dropped > 0 {
+				state.counters.Dropped.Add(uint64(dropped))
+				b.totals.Dropped.Add(uint64(dropped))
+			}
 		}
+		if sub.spill != nil {
+			b.countSpill(state, sub)
+		}
+		state.lastActivity.Store(b.cfg.Clock.Now().UnixNano())
 		state.subs[id] = sub
 		return nil
 	})
 	if err != nil {
+		sub.release()
 		return nil, err
 	}
 	sub.unsubscribeFunc = b.buildUnsubscribeFunction(id, topic)
 	go func() {
 		select {
 		case <-ctx.Done():
-			_ = sub.Unsubscribe() // idempotent
+			_ = b.removeSubscription(id, topic, ctx.Err()) // idempotent
+		case <-sub.done:
+			// ended by Unsubscribe, Close or eviction
 		}
 	}()
 
@@ -146,19 +309,32 @@ func (b *bus) Subscribe(ctx context.Context, topic string, opts ...SubscribeOpti
 
 func (b *bus) buildUnsubscribeFunction(id string, topic string) func() error {
 	return func() error {
-		b.mutex.Lock()
-		if state, ok := b.subscriptions[topic]; ok {
-			delete(state.subs, id)
-			if len(state.subs) == 0 && len(state.inQueue) == 0 && b.cfg.AutoDeleteEmptyTopics {
-				if state.closed.CompareAndSwap(false, true) {
-					close(state.inQueue)
-					delete(b.subscriptions, topic)
-				}
-			}
-		}
+		return b.removeSubscription(id, topic, ErrUnsubscribed)
+	}
+}
+
+// removeSubscription removes the subscription from its topic and closes it
+// with the given reason. It is a no-op if the subscription is already gone.
+func (b *bus) removeSubscription(id string, topic string, reason error) error {
+	b.mutex.Lock()
+	state, ok := b.subscriptions[topic]
+	if !ok {
 		b.mutex.Unlock()
 		return nil
 	}
+	sub, ok := state.subs[id]
+	delete(state.subs, id)
+	if len(state.subs) == 0 && len(state.inQueue) == 0 && b.cfg.AutoDeleteEmptyTopics && !state.declared {
+		if state.closed.CompareAndSwap(false, true) {
+			close(state.inQueue)
+			delete(b.subscriptions, topic)
+		}
+	}
+	b.mutex.Unlock()
+	if ok {
+		sub.closeWithReason(reason)
+	}
+	return nil
 }
 
 func (b *bus) Unsubscribe(topic string, subscriberID string) error {
@@ -194,19 +370,21 @@ func (b *bus) Close() error {
 	if !b.open.CompareAndSwap(true, false) {
 		return nil
 	}
-	b.mutex.Lock()
-	states := make([]*topicState, 0, len(b.subscriptions))
+	close(b.stop)
+	b.mutex.RLock()
+	subs := make([]*subscription, 0)
 	for _, st := range b.subscriptions {
-		states = append(states, st)
+		subs = append(subs, snapshotSubsLocked(st.subs)...)
 	}
+	b.mutex.RUnlock()
 	// close the inQueue of each topic
-	for _, st := range states {
-		if st.closed.CompareAndSwap(false, true) { // ← idem ici
-			close(st.inQueue)
-		}
-	}
-	b.mutex.Unlock()
+	states := b.closeQueues()
 
+	// Closing the subscriptions first aborts the deliveries waiting on a full
+	// buffer (up to their SendTimeout), the workers then drop the queues.
+	for _, sub := range subs {
+		sub.closeWithReason(ErrClosed)
+	}
 	// Wait for the worker to stop
 	for _, st := range states {
 		st.wg.Wait()
@@ -227,19 +405,24 @@ func (b *bus) Stats() (StatsResults, error) {
 	subscriberCounts := 0
 	for topic, state := range b.subscriptions {
 		buffered := 0
-		for _, sub := range state.subs {
+		degraded := 0
+		subscriptions := make(map[string]SubscriberStats, len(state.subs))
+		seq := state.seq.Load()
+		for id, sub := range state.subs {
 			subscriberCounts++
 			buffered += len(sub.messageChan)
+			if sub.degraded.Load() {
+				degraded++
+			}
+			subscriptions[id] = subscriberStats(sub, seq)
 		}
 		perTopic[topic] = TopicStats{
-			Subscribers: len(state.subs),
-			Buffered:    buffered,
-			Counters: Counters{
-				Published: state.counters.Published.Load(),
-				Delivered: state.counters.Delivered.Load(),
-				Failed:    state.counters.Failed.Load(),
-				Dropped:   state.counters.Dropped.Load(),
-			},
+			Subscribers:   len(state.subs),
+			Buffered:      buffered,
+			Degraded:      degraded,
+			Subscriptions: subscriptions,
+			Counters:      state.counters.snapshot(),
+			Rates:         state.rates.snapshot(),
 		}
 	}
 	s := StatsResults{
@@ -247,13 +430,10 @@ func (b *bus) Stats() (StatsResults, error) {
 		Open:        b.open.Load(),
 		Topics:      len(b.subscriptions),
 		Subscribers: subscriberCounts,
-		Totals: Counters{
-			Published: b.totals.Published.Load(),
-			Delivered: b.totals.Delivered.Load(),
-			Failed:    b.totals.Failed.Load(),
-			Dropped:   b.totals.Dropped.Load(),
-		},
-		PerTopic: perTopic,
+		At:          b.cfg.Clock.Now(),
+		Totals:      b.totals.snapshot(),
+		Rates:       b.rates.snapshot(),
+		PerTopic:    perTopic,
 	}
 	return s, nil
 }
@@ -278,11 +458,8 @@ func (b *bus) withWriteState(topic string, createIfNotExists bool, writeFunc fun
 			b.mutex.Unlock()
 			return fmt.Errorf("too many topics (max=%d)", b.cfg.MaxTopics)
 		}
-		qSize := b.cfg.TopicQueueSize
-		if qSize <= 0 {
-			qSize = DefaultTopicQueueSize
-		}
-		state = newTopicState(qSize)
+		state = newTopicState(b.topicConfig(topic, nil))
+		state.lastActivity.Store(b.cfg.Clock.Now().UnixNano())
 		// add the state
 		b.subscriptions[topic] = state
 
@@ -150,7 +150,7 @@ func TestSnapshotSubsLocked(t *testing.T) {
 type testInputTryDelivery struct {
 	sub   *subscription
 	msg   Message
-	timer *time.Timer
+	timer Timer
 }
 
 func TestTryDeliver(t *testing.T) {
@@ -207,7 +207,7 @@ func TestTryDeliver(t *testing.T) {
 					messageChan: make(chan Message, 1),
 				},
 				Message{},
-				time.NewTimer(2 * time.Second),
+				SystemClock().NewTimer(2 * time.Second),
 			},
 			output: true,
 		},
@@ -228,7 +228,7 @@ func TestTryDeliver(t *testing.T) {
 					Timestamp: time.Now(),
 					Payload:   []byte("x"),
 				},
-				time.NewTimer(time.Hour),
+				SystemClock().NewTimer(time.Hour),
 			},
 			output: false,
 		},
@@ -0,0 +1,236 @@
+package thebus
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of the bus: message timestamps, delivery
+// timeouts, ID generation, janitor and every other scheduling.
+// See WithClock and ManualClock for deterministic tests.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the Clock counterpart of time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is the Clock counterpart of time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// ##############################################################################
+// ##############################   SYSTEM CLOCK   ##############################
+// ##############################################################################
+
+type systemClock struct{}
+
+// SystemClock returns the Clock based on the time package, the default one.
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{timer: time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return &systemTicker{ticker: time.NewTicker(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t *systemTimer) C() <-chan time.Time        { return t.timer.C }
+func (t *systemTimer) Stop() bool                 { return t.timer.Stop() }
+func (t *systemTimer) Reset(d time.Duration) bool { return t.timer.Reset(d) }
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *systemTicker) C() <-chan time.Time { return t.ticker.C }
+func (t *systemTicker) Stop()               { t.ticker.Stop() }
+
+// ##############################################################################
+// ##############################   MANUAL CLOCK   ##############################
+// ##############################################################################
+
+// ManualClock is a Clock that only moves when Advance or Set is called.
+// Timers and tickers fire (without blocking, like the time package) when the
+// clock reaches their deadline. It is safe for concurrent use.
+type ManualClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*manualWaiter
+}
+
+var _ Clock = (*ManualClock)(nil)
+
+// NewManualClock returns a ManualClock starting at start.
+func NewManualClock(start time.Time) *ManualClock {
+	c := &ManualClock{now: start}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d and fires the timers and tickers due.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(c.now.Add(d))
+}
+
+// Set moves the clock to t and fires the timers and tickers due.
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setLocked(t)
+}
+
+// BlockUntil waits until n timers or tickers are active. Useful to make sure
+// the code under test is waiting on the clock before calling Advance.
+func (c *ManualClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	w := &manualWaiter{clock: c, ch: make(chan time.Time, 1)}
+	c.mu.Lock()
+	c.scheduleLocked(w, d)
+	c.mu.Unlock()
+	return w
+}
+
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("thebus: non-positive interval for ManualClock.NewTicker")
+	}
+	w := &manualWaiter{clock: c, ch: make(chan time.Time, 1), period: d}
+	c.mu.Lock()
+	c.scheduleLocked(w, d)
+	c.mu.Unlock()
+	return manualTicker{w}
+}
+
+func (c *ManualClock) setLocked(t time.Time) {
+	if t.Before(c.now) {
+		c.now = t
+		return
+	}
+	c.now = t
+	// fire in deadline order
+	sort.Slice(c.waiters, func(i, j int) bool {
+		return c.waiters[i].deadline.Before(c.waiters[j].deadline)
+	})
+	kept := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(t) {
+			kept = append(kept, w)
+			continue
+		}
+		select {
+		case w.ch <- w.deadline:
+		default:
+		}
+		if w.period > 0 {
+			// like time.Ticker, the missed ticks are dropped
+			for !w.deadline.After(t) {
+				w.deadline = w.deadline.Add(w.period)
+			}
+			kept = append(kept, w)
+			continue
+		}
+		w.active = false
+	}
+	c.waiters = kept
+	c.cond.Broadcast()
+}
+
+func (c *ManualClock) scheduleLocked(w *manualWaiter, d time.Duration) {
+	w.deadline = c.now.Add(d)
+	if !w.active {
+		w.active = true
+		c.waiters = append(c.waiters, w)
+	}
+	if d <= 0 && w.period == 0 {
+		c.setLocked(c.now)
+	}
+	c.cond.Broadcast()
+}
+
+// removeLocked unregisters w, returns true if it was active
+func (c *ManualClock) removeLocked(w *manualWaiter) bool {
+	if !w.active {
+		return false
+	}
+	w.active = false
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			break
+		}
+	}
+	c.cond.Broadcast()
+	return true
+}
+
+// manualWaiter is a Timer (period == 0) or a Ticker of a ManualClock
+type manualWaiter struct {
+	clock    *ManualClock
+	ch       chan time.Time
+	deadline time.Time
+	period   time.Duration
+	active   bool
+}
+
+func (w *manualWaiter) C() <-chan time.Time {
+	return w.ch
+}
+
+func (w *manualWaiter) Stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	return w.clock.removeLocked(w)
+}
+
+func (w *manualWaiter) Reset(d time.Duration) bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	wasActive := w.active
+	w.clock.scheduleLocked(w, d)
+	return wasActive
+}
+
+type manualTicker struct {
+	*manualWaiter
+}
+
+func (t manualTicker) Stop() {
+	t.manualWaiter.Stop()
+}
@@ -0,0 +1,77 @@
+package thebus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestManualClockTimerAndTicker(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+
+	timer := clock.NewTimer(time.Second)
+	ticker := clock.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired too early")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if got := <-timer.C(); !got.Equal(start.Add(time.Second)) {
+		t.Fatalf("unexpected fire time %v", got)
+	}
+	<-ticker.C()
+	if timer.Stop() {
+		t.Fatal("fired timer should not be active")
+	}
+
+	// missed ticks are dropped
+	clock.Advance(5 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Fatal("only one tick expected")
+	default:
+	}
+}
+
+func TestManualClockDeliveryTimeout(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	b, _ := New(WithClock(clock))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, _ := b.Subscribe(ctx, "t", WithBufferSize(1), WithDropIfFull(false), WithSendTimeout(time.Minute))
+	_, _ = b.Publish("t", []byte("1"))
+	_, _ = b.Publish("t", []byte("2"))
+
+	// the fan-out waits for the buffer with a timeout. Other timers and tickers
+	// use the clock too, so advance until the send timeout fires rather than
+	// counting the waiters, and read only then to keep the buffer full.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		clock.Advance(time.Minute)
+		st, _ := b.Stats()
+		if st.Totals.Dropped == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 1 dropped, got %+v", st.Totals)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	msg := <-sub.Read()
+	if !msg.Timestamp.Equal(start) {
+		t.Fatalf("want timestamp %v, got %v", start, msg.Timestamp)
+	}
+	if st, _ := b.Stats(); st.Totals.Delivered != 1 {
+		t.Fatalf("expected 1 delivered, got %+v", st.Totals)
+	}
+}
@@ -17,27 +17,39 @@ const (
 // Config is the main configuration for thebus
 type Config struct {
 	// Topics / queues
-	TopicQueueSize        int           // default: 1024
-	AutoDeleteEmptyTopics bool          // default: true
-	TopicIdleTTL          time.Duration // if Janitor enabled (0 = off)
-	JanitorInterval       time.Duration // 0 = off
-	IDGenerator           IDGenerator   // default to DefaultIDGenerator
-	CopyOnPublish         bool          // default false
+	TopicQueueSize        int            `json:"topicQueueSize"`        // default: 1024
+	AutoDeleteEmptyTopics bool           `json:"autoDeleteEmptyTopics"` // default: true
+	TopicIdleTTL          time.Duration  `json:"topicIdleTTL"`          // if Janitor enabled (0 = off)
+	JanitorInterval       time.Duration  `json:"janitorInterval"`       // 0 = off
+	IDGenerator           IDGenerator    `json:"-"`                     // default to DefaultIDGenerator (or NewIDGenerator(Clock) with a custom Clock)
+	Clock                 Clock          `json:"-"`                     // default to SystemClock()
+	CopyOnPublish         bool           `json:"copyOnPublish"`         // default false
+	TopicPatterns         []TopicPattern `json:"topicPatterns"`         // per-topic defaults, first match wins
+	SyncDelivery          bool           `json:"syncDelivery"`          // default false, see WithSyncDelivery
 
 	// Default for subscribers (Can be overridden by sub)
-	DefaultSubBufferSize int                  // default: 128
-	DefaultSendTimeout   time.Duration        // default: 200ms
-	DefaultDropIfFull    bool                 // default: true
-	DefaultStrategy      SubscriptionStrategy // default: SubscriptionStrategyPayloadShared
+	DefaultSubBufferSize int                  `json:"defaultSubBufferSize"` // default: 128
+	DefaultSendTimeout   time.Duration        `json:"defaultSendTimeout"`   // default: 200ms
+	DefaultDropIfFull    bool                 `json:"defaultDropIfFull"`    // default: true
+	DefaultStrategy      SubscriptionStrategy `json:"defaultStrategy"`      // default: SubscriptionStrategyPayloadShared
 
 	// Limits (0 = unlimited)
-	MaxTopics              int // default : 0 (unlimited)
-	MaxSubscribersPerTopic int // default : 0 (unlimited)
+	MaxTopics              int `json:"maxTopics"`              // default : 0 (unlimited)
+	MaxSubscribersPerTopic int `json:"maxSubscribersPerTopic"` // default : 0 (unlimited)
+
+	// Slow consumers detection (disabled by default)
+	SlowConsumer SlowConsumerPolicy `json:"slowConsumer"`
+
+	// Interceptors, the first one is the outermost
+	PublishInterceptors  []PublishInterceptor  `json:"-"`
+	DeliveryInterceptors []DeliveryInterceptor `json:"-"`
 
 	// Observability
-	Logger       Logger                    // default: nopLogger
-	Metrics      MetricsHooks              // default: nopMetrics
-	PanicHandler func(topic string, v any) // default: nil (no recover)
+	RateInterval time.Duration             `json:"rateInterval"` // sampling interval of the rates (0 = off), see RateStats
+	Tracer       Tracer                    `json:"-"`            // default: nil (no spans)
+	Logger       Logger                    `json:"-"`            // default: nopLogger
+	Metrics      MetricsHooks              `json:"-"`            // default: nopMetrics
+	PanicHandler func(topic string, v any) `json:"-"`            // default: nil (no recover)
 }
 
 func (cfg *Config) Normalize() *Config {
@@ -50,8 +62,15 @@ func (cfg *Config) Normalize() *Config {
 	if cfg.JanitorInterval < 0 {
 		cfg.JanitorInterval = 0
 	}
+	if cfg.Clock == nil {
+		cfg.Clock = SystemClock()
+	}
 	if cfg.IDGenerator == nil {
-		cfg.IDGenerator = DefaultIDGenerator
+		if _, ok := cfg.Clock.(systemClock); ok {
+			cfg.IDGenerator = DefaultIDGenerator
+		} else {
+			cfg.IDGenerator = NewIDGenerator(cfg.Clock)
+		}
 	}
 	if cfg.DefaultSubBufferSize <= 0 {
 		cfg.DefaultSubBufferSize = DefaultSubBufferSize
@@ -84,7 +103,6 @@ func DefaultConfig() *Config {
 		DefaultSendTimeout:    DefaultSendTimeout,
 		DefaultDropIfFull:     true,
 		DefaultStrategy:       SubscriptionStrategyPayloadShared,
-		IDGenerator:           DefaultIDGenerator,
 		Logger:                NoopLogger(),
 	}
 }
@@ -155,6 +173,53 @@ func WithMaxSubscribersPerTopic(max int) Option {
 	}
 }
 
+func WithSlowConsumerPolicy(policy SlowConsumerPolicy) Option {
+	return func(cfg *Config) {
+		cfg.SlowConsumer = policy
+	}
+}
+
+// WithTopicDefaults applies opts to the topics matching pattern (path.Match syntax)
+// unless DeclareTopic overrides them. Patterns are evaluated in the order they were added.
+func WithTopicDefaults(pattern string, opts TopicOptions) Option {
+	return func(cfg *Config) {
+		cfg.TopicPatterns = append(cfg.TopicPatterns, TopicPattern{Pattern: pattern, Options: opts})
+	}
+}
+
+// WithPublishInterceptor appends interceptors to the chain around Publish and
+// PublishConfirm. The system topics are not intercepted.
+func WithPublishInterceptor(interceptors ...PublishInterceptor) Option {
+	return func(cfg *Config) {
+		cfg.PublishInterceptors = append(cfg.PublishInterceptors, interceptors...)
+	}
+}
+
+// WithDeliveryInterceptor appends interceptors to the chain around the delivery
+// to each subscriber. They run before the ones of the subscription
+// (see WithSubscriptionInterceptor).
+func WithDeliveryInterceptor(interceptors ...DeliveryInterceptor) Option {
+	return func(cfg *Config) {
+		cfg.DeliveryInterceptors = append(cfg.DeliveryInterceptors, interceptors...)
+	}
+}
+
+// WithTracer creates the spans of the publish, enqueue, fan-out and deliver
+// operations with tracer. See Tracer and PublishContext.
+func WithTracer(tracer Tracer) Option {
+	return func(cfg *Config) {
+		cfg.Tracer = tracer
+	}
+}
+
+// WithRateInterval maintains the publish, deliver and drop rates of RateStats,
+// sampling the counters every interval (1s or less for a meaningful 1s rate).
+func WithRateInterval(interval time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.RateInterval = interval
+	}
+}
+
 func WithLogger(logger Logger) Option {
 	return func(cfg *Config) {
 		cfg.Logger = logger
@@ -179,6 +244,24 @@ func WithIDGenerator(IDGenerator IDGenerator) Option {
 	}
 }
 
+// WithClock sets the Clock of the bus, see ManualClock for tests.
+// Unless WithIDGenerator is used, the IDs are generated from this Clock too.
+func WithClock(clock Clock) Option {
+	return func(cfg *Config) {
+		cfg.Clock = clock
+	}
+}
+
+// WithSyncDelivery delivers the messages in the publisher goroutine instead of
+// the topic fan-out worker: no queue hop, and the PublishAck reports the outcome
+// per subscriber. A subscriber with DropIfFull=false blocks Publish up to its
+// SendTimeout. Can be set per topic with TopicOptions.SyncDelivery.
+func WithSyncDelivery(b bool) Option {
+	return func(cfg *Config) {
+		cfg.SyncDelivery = b
+	}
+}
+
 func WithCopyOnPublish(b bool) Option {
 	return func(cfg *Config) {
 		cfg.CopyOnPublish = b
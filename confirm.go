@@ -0,0 +1,69 @@
+package thebus
+
+import (
+	"context"
+	"sync"
+)
+
+// Confirmation is returned by PublishConfirm. It resolves once the fan-out
+// of the message is done, with the delivery report of every subscriber.
+type Confirmation struct {
+	done chan struct{}
+	once sync.Once
+	ack  PublishAck // written by the fan-out until done is closed
+}
+
+// Done returns a channel closed once the fan-out is done.
+func (c *Confirmation) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the fan-out is done or ctx is done.
+func (c *Confirmation) Wait(ctx context.Context) (PublishAck, error) {
+	select {
+	case <-c.done:
+		return c.ack, nil
+	case <-ctx.Done():
+		return PublishAck{}, ctx.Err()
+	}
+}
+
+// resolve sets the outcome, only the first call is taken into account.
+func (c *Confirmation) resolve(ack PublishAck) {
+	c.once.Do(func() {
+		c.ack = ack
+		close(c.done)
+	})
+}
+
+// PublishConfirm publishes like Publish, and gives the message an ID. The
+// returned Confirmation resolves once the message was handed to every
+// subscriber (or dropped, failed, expired). Without subscriber it is resolved
+// straight away.
+func (b *bus) PublishConfirm(topic string, data []byte, opts ...PublishOption) (*Confirmation, error) {
+	if err := validatePublishTopic(topic); err != nil {
+		return nil, err
+	}
+	conf := &Confirmation{done: make(chan struct{})}
+	conf.ack.MessageID = b.cfg.IDGenerator()
+	if _, err := b.publishContext(context.Background(), topic, data, opts, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// NewResolvedConfirmation returns a Confirmation already resolved with ack,
+// for the Bus implementations delivering synchronously (see testkit).
+func NewResolvedConfirmation(ack PublishAck) *Confirmation {
+	conf := &Confirmation{done: make(chan struct{})}
+	conf.resolve(ack)
+	return conf
+}
+
+// NewConfirmation returns a pending Confirmation and the function resolving
+// it, for the Bus implementations confirming asynchronously (see remote).
+// Only the first call of resolve is taken into account.
+func NewConfirmation() (*Confirmation, func(ack PublishAck)) {
+	conf := &Confirmation{done: make(chan struct{})}
+	return conf, conf.resolve
+}
@@ -0,0 +1,116 @@
+package thebus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPublishConfirm(t *testing.T) {
+	b, _ := New()
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader, _ := b.Subscribe(ctx, "t", WithBufferSize(4))
+	full, _ := b.Subscribe(ctx, "t", WithBufferSize(1), WithDropIfFull(true))
+	_, _ = b.Publish("t", []byte("1"))
+
+	conf, err := b.PublishConfirm("t", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wctx, wcancel := context.WithTimeout(ctx, time.Second)
+	defer wcancel()
+	ack, err := conf.Wait(wctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Seq != 2 || ack.MessageID == "" || ack.Subscribers != 2 || ack.Delivered != 1 || ack.Dropped != 1 {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	statuses := make(map[string]DeliveryStatus)
+	for _, d := range ack.Deliveries {
+		statuses[d.SubscriptionID] = d.Status
+	}
+	if statuses[reader.GetID()] != DeliveryStatusDelivered || statuses[full.GetID()] != DeliveryStatusDropped {
+		t.Fatalf("unexpected deliveries %+v", ack.Deliveries)
+	}
+	<-reader.Read()
+	if msg := <-reader.Read(); msg.ID != ack.MessageID {
+		t.Fatalf("expected message ID %q, got %q", ack.MessageID, msg.ID)
+	}
+}
+
+func TestPublishConfirmNoSubscriber(t *testing.T) {
+	b, _ := New()
+	defer b.Close()
+
+	conf, err := b.PublishConfirm("t", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-conf.Done():
+	default:
+		t.Fatal("expected the confirmation to be resolved")
+	}
+	if ack, _ := conf.Wait(context.Background()); ack.Enqueued || len(ack.Deliveries) != 0 {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	if _, err := b.PublishConfirm(SystemTopicSlowConsumer, nil); err != ErrInvalidTopicNameReserved {
+		t.Fatalf("expected ErrInvalidTopicNameReserved, got %v", err)
+	}
+}
+
+func TestPublishConfirmExpired(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	b, _ := New(WithClock(clock))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_ = b.DeclareTopic("t", TopicOptions{MessageTTL: time.Second})
+	// blocks the worker on the first message
+	_, _ = b.Subscribe(ctx, "t", WithBufferSize(1), WithDropIfFull(false), WithSendTimeout(time.Minute))
+	_, _ = b.Publish("t", []byte("1"))
+	_, _ = b.Publish("t", []byte("2"))
+	conf, err := b.PublishConfirm("t", []byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the worker waits on the send timeout of "2"
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+
+	wctx, wcancel := context.WithTimeout(ctx, time.Second)
+	defer wcancel()
+	ack, err := conf.Wait(wctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ack.Expired || len(ack.Deliveries) != 0 || ack.Latency != time.Minute {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+}
+
+func TestPublishConfirmSync(t *testing.T) {
+	b, _ := New(WithSyncDelivery(true))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = b.Subscribe(ctx, "t")
+	conf, err := b.PublishConfirm("t", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-conf.Done():
+	default:
+		t.Fatal("expected the confirmation to be resolved")
+	}
+	if ack, _ := conf.Wait(ctx); !ack.Sync || ack.Seq != 1 || ack.Delivered != 1 || ack.MessageID == "" {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+}
@@ -0,0 +1,231 @@
+package connector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sebundefined/thebus"
+	"github.com/sebundefined/thebus/webhook"
+)
+
+// appendJSONL appends the thebus.Record of each message of batch, one per
+// line: the ndjson of the httpstream package.
+func appendJSONL(buf *bytes.Buffer, batch []thebus.Message) error {
+	encoder := json.NewEncoder(buf)
+	for _, msg := range batch {
+		if err := encoder.Encode(thebus.MakeRecord(msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ##############################################################################
+// #############################   WRITER / FILE   ##############################
+// ##############################################################################
+
+// WriterSink writes the messages to an io.Writer as JSON lines (see thebus.Record),
+// a single Write per batch.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var _ Sink = (*WriterSink)(nil)
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// NewStdoutSink returns a WriterSink of the standard output.
+func NewStdoutSink() *WriterSink {
+	return NewWriterSink(os.Stdout)
+}
+
+func (s *WriterSink) Write(ctx context.Context, batch []thebus.Message) error {
+	var buf bytes.Buffer
+	if err := appendJSONL(&buf, batch); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// FileSink appends the messages to a JSON lines file (see thebus.Record), synced
+// after each batch.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+var _ Sink = (*FileSink)(nil)
+
+// NewFileSink opens (or creates) the file at path in append mode.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Write(ctx context.Context, batch []thebus.Message) error {
+	var buf bytes.Buffer
+	if err := appendJSONL(&buf, batch); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Close closes the file, once the connector stopped.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// FileSource reads the messages of a JSON lines file (see thebus.Record), e.g.
+// written by a FileSink. The Seq, ID and Timestamp of the records are not
+// kept: the bus sets them on publish.
+type FileSource struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	line    int
+}
+
+var _ Source = (*FileSource)(nil)
+
+// NewFileSource opens the file at path.
+func NewFileSource(path string) (*FileSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	return &FileSource{file: file, scanner: scanner}, nil
+}
+
+func (s *FileSource) Read(ctx context.Context) (thebus.Message, error) {
+	for s.scanner.Scan() {
+		s.line++
+		if len(bytes.TrimSpace(s.scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec thebus.Record
+		if err := json.Unmarshal(s.scanner.Bytes(), &rec); err != nil {
+			return thebus.Message{}, fmt.Errorf("%s:%d: %w", s.file.Name(), s.line, err)
+		}
+		return rec.Message(), nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return thebus.Message{}, err
+	}
+	return thebus.Message{}, io.EOF
+}
+
+// Close closes the file, once the connector stopped.
+func (s *FileSource) Close() error {
+	return s.file.Close()
+}
+
+// ##############################################################################
+// ################################   WEBHOOK   #################################
+// ##############################################################################
+
+// WebhookOption configures a WebhookSink.
+type WebhookOption func(s *WebhookSink)
+
+// WithHTTPClient sets the client of the requests, http.DefaultClient by default.
+func WithHTTPClient(client *http.Client) WebhookOption {
+	return func(s *WebhookSink) {
+		s.client = client
+	}
+}
+
+// WithWebhookHeader sets a header of the requests (e.g. Authorization).
+func WithWebhookHeader(key, value string) WebhookOption {
+	return func(s *WebhookSink) {
+		s.header.Set(key, value)
+	}
+}
+
+// WithWebhookSecret signs the requests with secret, see webhook.Sign.
+func WithWebhookSecret(secret []byte) WebhookOption {
+	return func(s *WebhookSink) {
+		s.secret = secret
+	}
+}
+
+// WebhookSink POSTs each message of a batch, in order, like a webhook
+// Subscriber: the payload is the body and the message is described by the
+// webhook headers (see webhook.SetHeaders), so the same endpoint serves both.
+// A response status other than 2xx fails the batch: retried, the messages
+// already accepted are sent again (Bus-Topic and Bus-Seq identify them).
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	header http.Header
+	secret []byte
+}
+
+var _ Sink = (*WebhookSink)(nil)
+
+func NewWebhookSink(url string, opts ...WebhookOption) *WebhookSink {
+	s := &WebhookSink{url: url, client: http.DefaultClient, header: make(http.Header)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *WebhookSink) Write(ctx context.Context, batch []thebus.Message) error {
+	for _, msg := range batch {
+		if err := s.post(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WebhookSink) post(ctx context.Context, msg thebus.Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return err
+	}
+	for key, values := range s.header {
+		req.Header[key] = values
+	}
+	webhook.SetHeaders(req.Header, msg)
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if s.secret != nil {
+		req.Header.Set(webhook.HeaderSignature, webhook.Sign(s.secret, time.Now(), msg.Payload))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("connector: webhook %s: %s", s.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package connector
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Checkpointer stores the Seq of the last message of a topic written by a
+// connector.
+type Checkpointer interface {
+	Load(connector, topic string) (seq uint64, ok bool, err error)
+	Save(connector, topic string, seq uint64) error
+}
+
+// checkpoints are the Seq by connector then topic.
+type checkpoints map[string]map[string]uint64
+
+func (c checkpoints) load(connector, topic string) (uint64, bool) {
+	seq, ok := c[connector][topic]
+	return seq, ok
+}
+
+func (c checkpoints) save(connector, topic string, seq uint64) {
+	if c[connector] == nil {
+		c[connector] = make(map[string]uint64)
+	}
+	c[connector][topic] = seq
+}
+
+// ##############################################################################
+// #################################   MEMORY   #################################
+// ##############################################################################
+
+// MemoryCheckpointer keeps the checkpoints in memory, for the connectors
+// restarted by a Runner.
+type MemoryCheckpointer struct {
+	mu          sync.Mutex
+	checkpoints checkpoints
+}
+
+var _ Checkpointer = (*MemoryCheckpointer)(nil)
+
+func NewMemoryCheckpointer() *MemoryCheckpointer {
+	return &MemoryCheckpointer{checkpoints: make(checkpoints)}
+}
+
+func (m *MemoryCheckpointer) Load(connector, topic string) (uint64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seq, ok := m.checkpoints.load(connector, topic)
+	return seq, ok, nil
+}
+
+func (m *MemoryCheckpointer) Save(connector, topic string, seq uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoints.save(connector, topic, seq)
+	return nil
+}
+
+// ##############################################################################
+// ##################################   FILE   ##################################
+// ##############################################################################
+
+// FileCheckpointer keeps the checkpoints in a JSON file, rewritten (atomically)
+// on every Save.
+type FileCheckpointer struct {
+	path string
+
+	mu          sync.Mutex
+	checkpoints checkpoints // nil until loaded
+}
+
+var _ Checkpointer = (*FileCheckpointer)(nil)
+
+func NewFileCheckpointer(path string) *FileCheckpointer {
+	return &FileCheckpointer{path: path}
+}
+
+func (f *FileCheckpointer) Load(connector, topic string) (uint64, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.read(); err != nil {
+		return 0, false, err
+	}
+	seq, ok := f.checkpoints.load(connector, topic)
+	return seq, ok, nil
+}
+
+func (f *FileCheckpointer) Save(connector, topic string, seq uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.read(); err != nil {
+		return err
+	}
+	f.checkpoints.save(connector, topic, seq)
+	data, err := json.Marshal(f.checkpoints)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// read loads the file once, called with f.mu held.
+func (f *FileCheckpointer) read() error {
+	if f.checkpoints != nil {
+		return nil
+	}
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		f.checkpoints = make(checkpoints)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c := make(checkpoints)
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	f.checkpoints = c
+	return nil
+}
@@ -0,0 +1,242 @@
+// Package connector mirrors bus topics to external systems and back, so that
+// an integration is configuration rather than goroutines around sub.Read().
+//
+// A sink connector subscribes to topics and writes the messages in batches to
+// a Sink, retrying with backoff and checkpointing the last written Seq of each
+// topic. A source connector reads the messages of a Source and publishes them.
+// The Runner runs the connectors and restarts the failed ones:
+//
+//	file, _ := connector.NewFileSink("orders.jsonl")
+//	runner := connector.NewRunner(bus)
+//	runner.Add(connector.NewSinkConnector("archive", file, []string{"orders"},
+//		connector.WithBatchSize(500),
+//		connector.WithCheckpointer(connector.NewFileCheckpointer("checkpoints.json")),
+//	))
+//	runner.Start(ctx)
+//	defer runner.Stop(shutdownCtx)
+//
+// Built-in connectors: JSONL files (NewFileSink, NewFileSource), stdout
+// (NewStdoutSink) and HTTP webhooks (NewWebhookSink).
+package connector
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+const (
+	DefaultBatchSize     = 100
+	DefaultBatchInterval = time.Second
+	DefaultMaxAttempts   = 5
+	DefaultMinBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff    = 10 * time.Second
+)
+
+// ##############################################################################
+// ###############################   INTERFACES   ###############################
+// ##############################################################################
+
+// Connector moves messages between a bus and an external system.
+type Connector interface {
+	// Name identifies the connector (logs, stats and checkpoints).
+	Name() string
+	// Run runs the connector until ctx is done. A nil error means the
+	// connector is done (e.g. end of its source) and is not restarted.
+	Run(ctx context.Context, bus thebus.Bus) error
+}
+
+// Sink writes batches of messages to an external system. A failed Write is
+// retried with the same batch. The batch is reused once Write returned.
+type Sink interface {
+	Write(ctx context.Context, batch []thebus.Message) error
+}
+
+// Source reads the messages to publish. The message is published on its
+// Topic, or on the topic of the connector if empty. io.EOF ends the source.
+type Source interface {
+	Read(ctx context.Context) (thebus.Message, error)
+}
+
+// Stats are the counters of a connector.
+type Stats struct {
+	Received    uint64    `json:"received"`
+	Written     uint64    `json:"written"`
+	Failed      uint64    `json:"failed"` // messages dropped after the last retry
+	Batches     uint64    `json:"batches"`
+	Retries     uint64    `json:"retries"`
+	Restarts    uint64    `json:"restarts"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitzero"`
+}
+
+// StatsProvider is implemented by the connectors reporting Stats.
+type StatsProvider interface {
+	Stats() Stats
+}
+
+// ##############################################################################
+// #################################   RUNNER   #################################
+// ##############################################################################
+
+type runnerConfig struct {
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	logger     thebus.Logger
+}
+
+// RunnerOption configures a Runner.
+type RunnerOption func(cfg *runnerConfig)
+
+// WithRestartBackoff sets the delay before restarting a failed connector,
+// doubled up to max while it keeps failing.
+func WithRestartBackoff(min, max time.Duration) RunnerOption {
+	return func(cfg *runnerConfig) {
+		cfg.minBackoff = min
+		cfg.maxBackoff = max
+	}
+}
+
+// WithRunnerLogger sets the logger of the runner.
+func WithRunnerLogger(logger thebus.Logger) RunnerOption {
+	return func(cfg *runnerConfig) {
+		cfg.logger = logger
+	}
+}
+
+// Runner runs connectors against a bus.
+type Runner struct {
+	bus thebus.Bus
+	cfg runnerConfig
+
+	mu         sync.Mutex
+	connectors []Connector
+	restarts   map[string]uint64
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// NewRunner returns a Runner of the connectors of bus.
+func NewRunner(bus thebus.Bus, opts ...RunnerOption) *Runner {
+	r := &Runner{
+		bus: bus,
+		cfg: runnerConfig{
+			minBackoff: DefaultMinBackoff,
+			maxBackoff: DefaultMaxBackoff,
+			logger:     thebus.NoopLogger(),
+		},
+		restarts: make(map[string]uint64),
+	}
+	for _, opt := range opts {
+		opt(&r.cfg)
+	}
+	return r
+}
+
+// Add adds a connector, started right away if the runner is started.
+func (r *Runner) Add(c Connector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connectors = append(r.connectors, c)
+	if r.ctx != nil {
+		r.run(c)
+	}
+}
+
+// Start starts the connectors, until Stop or the end of ctx.
+func (r *Runner) Start(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ctx != nil {
+		return
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	for _, c := range r.connectors {
+		r.run(c)
+	}
+}
+
+// Stop stops the connectors and waits for them, at most until ctx is done.
+func (r *Runner) Stop(ctx context.Context) error {
+	r.mu.Lock()
+	cancel := r.cancel
+	r.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns the stats of the connectors implementing StatsProvider, by name.
+func (r *Runner) Stats() map[string]Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make(map[string]Stats, len(r.connectors))
+	for _, c := range r.connectors {
+		if provider, ok := c.(StatsProvider); ok {
+			s := provider.Stats()
+			s.Restarts = r.restarts[c.Name()]
+			stats[c.Name()] = s
+		}
+	}
+	return stats
+}
+
+// run runs c until it is done, restarting it on errors. Called with r.mu held.
+func (r *Runner) run(c Connector) {
+	ctx := r.ctx
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		backoff := r.cfg.minBackoff
+		for {
+			started := time.Now()
+			err := c.Run(ctx, r.bus)
+			if err == nil || ctx.Err() != nil {
+				r.cfg.logger.Debug("connector stopped", "connector", c.Name())
+				return
+			}
+			if errors.Is(err, thebus.ErrClosed) {
+				r.cfg.logger.Info("connector stopped, bus closed", "connector", c.Name())
+				return
+			}
+			if time.Since(started) > r.cfg.maxBackoff {
+				backoff = r.cfg.minBackoff // it ran for a while
+			}
+			r.cfg.logger.Warn("connector failed, restarting", "connector", c.Name(), "error", err, "backoff", backoff)
+			if !sleep(ctx, backoff) {
+				return
+			}
+			backoff = min(2*backoff, r.cfg.maxBackoff)
+			r.mu.Lock()
+			r.restarts[c.Name()]++
+			r.mu.Unlock()
+		}
+	}()
+}
+
+// sleep waits for d, false if ctx ended first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
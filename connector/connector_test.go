@@ -0,0 +1,303 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+	"github.com/sebundefined/thebus/webhook"
+)
+
+// memorySink records the batches, failing the first failures writes.
+type memorySink struct {
+	mu       sync.Mutex
+	batches  [][]string
+	failures int
+}
+
+func (s *memorySink) Write(ctx context.Context, batch []thebus.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	payloads := make([]string, len(batch))
+	for i, msg := range batch {
+		payloads[i] = string(msg.Payload)
+	}
+	s.batches = append(s.batches, payloads)
+	return nil
+}
+
+func (s *memorySink) payloads() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Concat(s.batches...)
+}
+
+func newBus(t *testing.T) thebus.Bus {
+	t.Helper()
+	bus, err := thebus.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = bus.Close() })
+	return bus
+}
+
+// start runs the connectors until the end of the test.
+func start(t *testing.T, bus thebus.Bus, connectors ...Connector) *Runner {
+	t.Helper()
+	runner := NewRunner(bus, WithRestartBackoff(time.Millisecond, 10*time.Millisecond))
+	for _, c := range connectors {
+		runner.Add(c)
+	}
+	runner.Start(t.Context())
+	t.Cleanup(func() { _ = runner.Stop(context.Background()) })
+	return runner
+}
+
+func waitSubscribers(t *testing.T, bus thebus.Bus, topic string, n int) {
+	t.Helper()
+	eventually(t, func() bool {
+		stats, _ := bus.Stats()
+		return stats.PerTopic[topic].Subscribers == n
+	})
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func publish(t *testing.T, bus thebus.Bus, topic string, payloads ...string) {
+	t.Helper()
+	for _, payload := range payloads {
+		if _, err := bus.Publish(topic, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSinkConnectorBatches(t *testing.T) {
+	bus := newBus(t)
+	sink := &memorySink{}
+	c := NewSinkConnector("mirror", sink, []string{"a", "b"},
+		WithBatchSize(3),
+		WithBatchInterval(20*time.Millisecond),
+		WithSubscribeOptions(thebus.WithDropIfFull(false)),
+	)
+	start(t, bus, c)
+	waitSubscribers(t, bus, "a", 1)
+	waitSubscribers(t, bus, "b", 1)
+
+	publish(t, bus, "a", "1", "2", "3", "4", "5", "6", "7")
+	eventually(t, func() bool { return len(sink.payloads()) == 7 })
+	sink.mu.Lock()
+	batches := slices.Clone(sink.batches)
+	sink.mu.Unlock()
+	if !slices.Equal(sink.payloads(), []string{"1", "2", "3", "4", "5", "6", "7"}) || len(batches[0]) != 3 || len(batches[1]) != 3 {
+		t.Fatalf("unexpected batches: %v", batches)
+	}
+
+	publish(t, bus, "b", "x")
+	eventually(t, func() bool { return len(sink.payloads()) == 8 })
+	if stats := c.Stats(); stats.Received != 8 || stats.Written != 8 || stats.Failed != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSinkConnectorRetries(t *testing.T) {
+	bus := newBus(t)
+	flaky := &memorySink{failures: 2}
+	down := &memorySink{failures: 1 << 30}
+	retry := WithRetry(3, time.Millisecond, time.Millisecond)
+	c1 := NewSinkConnector("flaky", flaky, []string{"t"}, WithBatchSize(1), retry)
+	c2 := NewSinkConnector("down", down, []string{"t"}, WithBatchSize(1), retry)
+	start(t, bus, c1, c2)
+	waitSubscribers(t, bus, "t", 2)
+
+	publish(t, bus, "t", "m")
+	eventually(t, func() bool { return c1.Stats().Written == 1 && c2.Stats().Failed == 1 })
+	if stats := c1.Stats(); stats.Retries != 2 || stats.LastError != "unavailable" {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if stats := c2.Stats(); stats.Retries != 2 || stats.Written != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestSinkConnectorCheckpoint(t *testing.T) {
+	bus := newBus(t)
+	if err := bus.DeclareTopic("orders", thebus.TopicOptions{Retention: 100}); err != nil {
+		t.Fatal(err)
+	}
+	checkpointer := NewFileCheckpointer(filepath.Join(t.TempDir(), "checkpoints.json"))
+	sink := &memorySink{}
+	newConnector := func() Connector {
+		return NewSinkConnector("archive", sink, []string{"orders"}, WithBatchSize(1), WithCheckpointer(checkpointer))
+	}
+
+	runner := start(t, bus, newConnector())
+	waitSubscribers(t, bus, "orders", 1)
+	publish(t, bus, "orders", "1", "2")
+	eventually(t, func() bool { return len(sink.payloads()) == 2 })
+	if err := runner.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// published while the connector is stopped, replayed from the checkpoint
+	publish(t, bus, "orders", "3", "4")
+	start(t, bus, newConnector())
+	eventually(t, func() bool { return len(sink.payloads()) == 4 })
+	if got := sink.payloads(); !slices.Equal(got, []string{"1", "2", "3", "4"}) {
+		t.Fatalf("unexpected payloads: %v", got)
+	}
+
+	// the checkpoints are in the file
+	seq, ok, err := NewFileCheckpointer(checkpointer.path).Load("archive", "orders")
+	if err != nil || !ok || seq != 4 {
+		t.Fatalf("unexpected checkpoint: %d %v %v", seq, ok, err)
+	}
+}
+
+func TestFileSinkAndSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.jsonl")
+	src := newBus(t)
+	file, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sinkConnector := NewSinkConnector("file", file, []string{"orders"}, WithBatchSize(2))
+	runner := start(t, src, sinkConnector)
+	waitSubscribers(t, src, "orders", 1)
+	if _, err := src.Publish("orders", []byte("one"), thebus.WithHeader("k", "v")); err != nil {
+		t.Fatal(err)
+	}
+	publish(t, src, "orders", "two")
+	eventually(t, func() bool { return sinkConnector.Stats().Written == 2 })
+	_ = runner.Stop(context.Background())
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// replay the file into another bus
+	dst := newBus(t)
+	sub, err := dst.Subscribe(t.Context(), "orders", thebus.WithDropIfFull(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := NewFileSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	sourceConnector := NewSourceConnector("replay", source, "unused")
+	start(t, dst, sourceConnector)
+	for _, want := range []string{"one", "two"} {
+		select {
+		case msg := <-sub.Read():
+			if string(msg.Payload) != want || (want == "one" && msg.Headers["k"] != "v") {
+				t.Fatalf("unexpected message: %+v", msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message")
+		}
+	}
+	eventually(t, func() bool { return sourceConnector.Stats().Written == 2 })
+}
+
+func TestWebhookSink(t *testing.T) {
+	secret := []byte("s3cr3t")
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	var mu sync.Mutex
+	var received []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// the checks of a webhook endpoint
+		if r.Header.Get("Authorization") != "Bearer token" || webhook.Verify(secret, r.Header.Get(webhook.HeaderSignature), body, time.Minute) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		code := int(status.Load())
+		if code == http.StatusOK {
+			mu.Lock()
+			received = append(received, r.Header.Get(webhook.HeaderTopic)+"/"+r.Header.Get(webhook.HeaderSeq)+"/"+
+				r.Header.Get(webhook.HeaderPrefix+"K")+"/"+string(body))
+			mu.Unlock()
+		}
+		status.Store(http.StatusOK) // the retry succeeds
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	sink := NewWebhookSink(srv.URL, WithWebhookHeader("Authorization", "Bearer token"), WithWebhookSecret(secret), WithHTTPClient(srv.Client()))
+	batch := []thebus.Message{
+		{Topic: "orders", Seq: 1, Payload: []byte("one"), Headers: map[string]string{"k": "v"}},
+		{Topic: "orders", Seq: 2, Payload: []byte("two")},
+	}
+	if err := sink.Write(t.Context(), batch); err == nil {
+		t.Fatal("expected an error on 503")
+	}
+	if err := sink.Write(t.Context(), batch); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"orders/1/v/one", "orders/2//two"}; !slices.Equal(received, want) {
+		t.Fatalf("unexpected requests: %q", received)
+	}
+}
+
+// failingConnector fails its first runs.
+type failingConnector struct {
+	runs atomic.Int32
+}
+
+func (c *failingConnector) Name() string {
+	return "failing"
+}
+
+func (c *failingConnector) Run(ctx context.Context, bus thebus.Bus) error {
+	if c.runs.Add(1) <= 2 {
+		return errors.New("boom")
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (c *failingConnector) Stats() Stats {
+	return Stats{}
+}
+
+func TestRunnerRestarts(t *testing.T) {
+	bus := newBus(t)
+	c := &failingConnector{}
+	runner := start(t, bus, c)
+	eventually(t, func() bool { return c.runs.Load() == 3 })
+	if stats := runner.Stats()["failing"]; stats.Restarts != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := runner.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
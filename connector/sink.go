@@ -0,0 +1,301 @@
+package connector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+type config struct {
+	batchSize     int
+	batchInterval time.Duration
+	maxAttempts   int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	checkpointer  Checkpointer
+	subscribeOpts []thebus.SubscribeOption
+	publishOpts   []thebus.PublishOption
+	logger        thebus.Logger
+}
+
+func defaultConfig() config {
+	return config{
+		batchSize:     DefaultBatchSize,
+		batchInterval: DefaultBatchInterval,
+		maxAttempts:   DefaultMaxAttempts,
+		minBackoff:    DefaultMinBackoff,
+		maxBackoff:    DefaultMaxBackoff,
+		logger:        thebus.NoopLogger(),
+	}
+}
+
+// Option configures a sink or source connector.
+type Option func(cfg *config)
+
+// WithBatchSize sets the maximum size of the batches written to the sink.
+func WithBatchSize(size int) Option {
+	return func(cfg *config) {
+		if size < 1 {
+			return
+		}
+		cfg.batchSize = size
+	}
+}
+
+// WithBatchInterval sets the maximum delay before writing a partial batch.
+func WithBatchInterval(interval time.Duration) Option {
+	return func(cfg *config) {
+		if interval <= 0 {
+			return
+		}
+		cfg.batchInterval = interval
+	}
+}
+
+// WithRetry sets the attempts to write a batch (or publish a message of a
+// source), the delay between two attempts doubling from minBackoff up to
+// maxBackoff. The messages are counted as Failed and skipped after the last
+// attempt.
+func WithRetry(maxAttempts int, minBackoff, maxBackoff time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxAttempts = max(maxAttempts, 1)
+		cfg.minBackoff = minBackoff
+		cfg.maxBackoff = maxBackoff
+	}
+}
+
+// WithCheckpointer saves the Seq of the last written message of each topic. A
+// restarted sink connector resumes after it, from the retained history of the
+// topic (see thebus.TopicOptions.Retention).
+func WithCheckpointer(checkpointer Checkpointer) Option {
+	return func(cfg *config) {
+		cfg.checkpointer = checkpointer
+	}
+}
+
+// WithSubscribeOptions sets the options of the subscriptions of a sink connector.
+func WithSubscribeOptions(opts ...thebus.SubscribeOption) Option {
+	return func(cfg *config) {
+		cfg.subscribeOpts = append(cfg.subscribeOpts, opts...)
+	}
+}
+
+// WithPublishOptions sets the options of the messages published by a source connector.
+func WithPublishOptions(opts ...thebus.PublishOption) Option {
+	return func(cfg *config) {
+		cfg.publishOpts = append(cfg.publishOpts, opts...)
+	}
+}
+
+// WithLogger sets the logger of the connector.
+func WithLogger(logger thebus.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
+
+// ##############################################################################
+// #################################   STATS   ##################################
+// ##############################################################################
+
+type stats struct {
+	mu sync.Mutex
+	s  Stats
+}
+
+func (s *stats) update(fn func(s *Stats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.s)
+}
+
+func (s *stats) fail(err error) {
+	s.update(func(s *Stats) {
+		s.LastError = err.Error()
+		s.LastErrorAt = time.Now()
+	})
+}
+
+func (s *stats) get() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.s
+}
+
+// ##############################################################################
+// ##############################   SINK CONNECTOR   ############################
+// ##############################################################################
+
+// SinkConnector writes the messages of topics to a Sink.
+type SinkConnector struct {
+	name   string
+	sink   Sink
+	topics []string
+	cfg    config
+	stats  stats
+}
+
+var (
+	_ Connector     = (*SinkConnector)(nil)
+	_ StatsProvider = (*SinkConnector)(nil)
+)
+
+// NewSinkConnector returns a connector writing the messages of topics to sink.
+func NewSinkConnector(name string, sink Sink, topics []string, opts ...Option) *SinkConnector {
+	c := &SinkConnector{name: name, sink: sink, topics: topics, cfg: defaultConfig()}
+	for _, opt := range opts {
+		opt(&c.cfg)
+	}
+	return c
+}
+
+func (c *SinkConnector) Name() string {
+	return c.name
+}
+
+func (c *SinkConnector) Stats() Stats {
+	return c.stats.get()
+}
+
+// Run subscribes to the topics and writes the messages until ctx is done or
+// every subscription ended. The pending batch is written (a single attempt)
+// when ctx is done.
+func (c *SinkConnector) Run(ctx context.Context, bus thebus.Bus) error {
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	subs := make([]thebus.Subscription, 0, len(c.topics))
+	for _, topic := range c.topics {
+		opts := append(c.cfg.subscribeOpts[:len(c.cfg.subscribeOpts):len(c.cfg.subscribeOpts)], thebus.WithSubscriberName(c.name))
+		if c.cfg.checkpointer != nil {
+			seq, ok, err := c.cfg.checkpointer.Load(c.name, topic)
+			if err != nil {
+				return err
+			}
+			if ok {
+				opts = append(opts, thebus.WithReplay(seq+1))
+			}
+		}
+		sub, err := bus.Subscribe(subCtx, topic, opts...)
+		if err != nil {
+			return err
+		}
+		subs = append(subs, sub)
+	}
+
+	messages := merge(subCtx, subs)
+	ticker := time.NewTicker(c.cfg.batchInterval)
+	defer ticker.Stop()
+	batch := make([]thebus.Message, 0, c.cfg.batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			if len(batch) > 0 {
+				_ = c.flush(context.WithoutCancel(ctx), batch, 1)
+			}
+			return ctx.Err()
+		case msg, ok := <-messages:
+			if !ok {
+				if err := c.flush(ctx, batch, c.cfg.maxAttempts); err != nil {
+					return err
+				}
+				return subsErr(subs)
+			}
+			c.stats.update(func(s *Stats) { s.Received++ })
+			batch = append(batch, msg)
+			if len(batch) < c.cfg.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if err := c.flush(ctx, batch, c.cfg.maxAttempts); err != nil {
+			return err
+		}
+		batch = batch[:0]
+	}
+}
+
+// flush writes batch, retrying up to attempts times. The batch is skipped after
+// the last attempt, the error is only returned if ctx ended.
+func (c *SinkConnector) flush(ctx context.Context, batch []thebus.Message, attempts int) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	backoff := c.cfg.minBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.sink.Write(ctx, batch)
+		if err == nil {
+			break
+		}
+		c.stats.fail(err)
+		if attempt >= attempts {
+			c.cfg.logger.Error("connector batch dropped", "connector", c.name, "messages", len(batch), "error", err)
+			c.stats.update(func(s *Stats) { s.Failed += uint64(len(batch)) })
+			return nil
+		}
+		c.cfg.logger.Warn("connector write failed, retrying", "connector", c.name, "attempt", attempt, "error", err)
+		c.stats.update(func(s *Stats) { s.Retries++ })
+		if !sleep(ctx, backoff) {
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, c.cfg.maxBackoff)
+	}
+	c.stats.update(func(s *Stats) {
+		s.Written += uint64(len(batch))
+		s.Batches++
+	})
+	if c.cfg.checkpointer == nil {
+		return nil
+	}
+	last := make(map[string]uint64)
+	for _, msg := range batch {
+		last[msg.Topic] = max(last[msg.Topic], msg.Seq)
+	}
+	for topic, seq := range last {
+		if err := c.cfg.checkpointer.Save(c.name, topic, seq); err != nil {
+			c.cfg.logger.Warn("connector checkpoint failed", "connector", c.name, "topic", topic, "error", err)
+			c.stats.fail(err)
+		}
+	}
+	return nil
+}
+
+// merge forwards the messages of subs on a single channel, closed once every
+// subscription ended.
+func merge(ctx context.Context, subs []thebus.Subscription) <-chan thebus.Message {
+	out := make(chan thebus.Message)
+	var wg sync.WaitGroup
+	wg.Add(len(subs))
+	for _, sub := range subs {
+		go func() {
+			defer wg.Done()
+			for msg := range sub.Read() {
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// subsErr is the reason of the end of the first subscription that ended with one.
+func subsErr(subs []thebus.Subscription) error {
+	for _, sub := range subs {
+		if err := sub.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/sebundefined/thebus"
+)
+
+// ##############################################################################
+// ############################   SOURCE CONNECTOR   ############################
+// ##############################################################################
+
+// SourceConnector publishes the messages of a Source.
+type SourceConnector struct {
+	name   string
+	source Source
+	topic  string
+	cfg    config
+	stats  stats
+}
+
+var (
+	_ Connector     = (*SourceConnector)(nil)
+	_ StatsProvider = (*SourceConnector)(nil)
+)
+
+// NewSourceConnector returns a connector publishing the messages of source,
+// on topic for the messages without one.
+func NewSourceConnector(name string, source Source, topic string, opts ...Option) *SourceConnector {
+	c := &SourceConnector{name: name, source: source, topic: topic, cfg: defaultConfig()}
+	for _, opt := range opts {
+		opt(&c.cfg)
+	}
+	return c
+}
+
+func (c *SourceConnector) Name() string {
+	return c.name
+}
+
+func (c *SourceConnector) Stats() Stats {
+	return c.stats.get()
+}
+
+// Run publishes the messages of the source until its end (io.EOF, nil is
+// returned), an error of the source or the end of ctx.
+func (c *SourceConnector) Run(ctx context.Context, bus thebus.Bus) error {
+	for {
+		msg, err := c.source.Read(ctx)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			c.stats.fail(err)
+			return err
+		}
+		c.stats.update(func(s *Stats) { s.Received++ })
+		if err := c.publish(ctx, bus, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// publish publishes msg, retrying the transient errors. The error is only
+// returned if ctx ended or the bus is closed.
+func (c *SourceConnector) publish(ctx context.Context, bus thebus.Bus, msg thebus.Message) error {
+	topic := msg.Topic
+	if topic == "" {
+		topic = c.topic
+	}
+	opts := c.cfg.publishOpts
+	if len(msg.Headers) > 0 {
+		opts = append(opts[:len(opts):len(opts)], thebus.WithHeaders(msg.Headers))
+	}
+	backoff := c.cfg.minBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := bus.PublishContext(ctx, topic, msg.Payload, opts...)
+		if err == nil {
+			c.stats.update(func(s *Stats) { s.Written++ })
+			return nil
+		}
+		c.stats.fail(err)
+		if errors.Is(err, thebus.ErrClosed) {
+			return err
+		}
+		if attempt >= c.cfg.maxAttempts || !errors.Is(err, thebus.ErrQueueFull) {
+			c.cfg.logger.Error("connector message dropped", "connector", c.name, "topic", topic, "error", err)
+			c.stats.update(func(s *Stats) { s.Failed++ })
+			return nil
+		}
+		c.stats.update(func(s *Stats) { s.Retries++ })
+		if !sleep(ctx, backoff) {
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, c.cfg.maxBackoff)
+	}
+}
@@ -10,4 +10,9 @@ var (
 	ErrInvalidTopicName         = errors.New("thebus.invalid.topic.name")
 	ErrInvalidTopicNameReserved = errors.New("thebus.invalid.topic.name.reserved")
 	ErrIDGeneratorNotSet        = errors.New("thebus.idGenerator.not_set")
+	ErrUnsubscribed             = errors.New("thebus.subscription.unsubscribed")
+	ErrTopicDeleted             = errors.New("thebus.topic.deleted")
+	ErrSlowConsumer             = errors.New("thebus.subscription.slow_consumer")
+	ErrRejected                 = errors.New("thebus.message.rejected")
+	ErrTopicNotFound            = errors.New("thebus.topic.not_found")
 )
@@ -0,0 +1,30 @@
+package thebus
+
+// FailureReporter is implemented by the Bus returned by New. A subscriber
+// processing its messages asynchronously (e.g. the webhook package) reports
+// the messages it failed to process for good: they are counted as Failed in
+// the stats of the bus, of the topic and of the subscription, on top of the
+// Delivered count of their hand-off to the subscriber.
+type FailureReporter interface {
+	// ReportFailure counts a failed message of the subscription. The bus
+	// totals are counted even if the topic no longer exists, ErrTopicNotFound
+	// is returned then.
+	ReportFailure(topic, subscriptionID string) error
+}
+
+var _ FailureReporter = (*bus)(nil)
+
+func (b *bus) ReportFailure(topic, subscriptionID string) error {
+	b.totals.Failed.Add(1)
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	state, ok := b.subscriptions[topic]
+	if !ok {
+		return ErrTopicNotFound
+	}
+	state.counters.Failed.Add(1)
+	if sub, ok := state.subs[subscriptionID]; ok {
+		sub.counters.Failed.Add(1)
+	}
+	return nil
+}
@@ -1,34 +1,176 @@
 package thebus
 
-import "time"
+import (
+	"context"
+	"strconv"
+	"time"
+)
 
 func (b *bus) runFanOut(topic string, state *topicState) {
 	defer state.wg.Done()
 
-	timer := time.NewTimer(time.Hour)
+	timer := b.cfg.Clock.NewTimer(time.Hour)
 	if !timer.Stop() {
-		<-timer.C
+		<-timer.C()
 	}
 
 	for mr := range state.inQueue {
-		// snapshot sous RLock
-		b.mutex.RLock()
-		subs := snapshotSubsLocked(state.subs)
+		b.dispatch(topic, state, mr, timer, nil)
+	}
+}
+
+// dispatch delivers mr to the current subscribers of the topic, from the
+// fan-out worker or from the publisher goroutine in sync mode (under syncMu).
+// If report is not nil, the outcome per subscriber is added to it. The
+// confirmation of mr (if any) is resolved once every subscriber was served.
+func (b *bus) dispatch(topic string, state *topicState, mr messageRef, timer Timer, report *PublishAck) {
+	if report == nil && mr.confirm != nil {
+		report = &mr.confirm.ack
+		defer func() {
+			report.Latency = b.cfg.Clock.Now().Sub(mr.ts)
+			mr.confirm.resolve(*report)
+		}()
+	}
+	ctx, span := b.startFanOutSpan(topic, mr)
+	defer endSpan(span, nil)
+
+	// snapshot sous RLock
+	b.mutex.RLock()
+	if state.expired(mr, b.cfg.Clock.Now()) {
 		b.mutex.RUnlock()
+		state.counters.Expired.Add(1)
+		b.totals.Expired.Add(1)
+		if report != nil {
+			report.Expired = true
+		}
+		if span != nil {
+			span.SetAttribute("message.expired", "true")
+		}
+		return
+	}
+	state.retainLocked(mr)
+	subs := snapshotSubsLocked(state.subs)
+	b.mutex.RUnlock()
 
-		for _, sub := range subs {
-			msg := makeMessage(topic, mr, sub)
-			if tryDeliver(sub, msg, timer) {
-				state.counters.Delivered.Add(1)
-				b.totals.Delivered.Add(1)
-			} else {
-				state.counters.Dropped.Add(1)
-				b.totals.Dropped.Add(1)
-			}
+	for _, sub := range subs {
+		_, deliverSpan := b.startSpan(ctx, SpanOperationDeliver, topic)
+		status, err := b.dispatchTo(topic, state, sub, mr, timer, report)
+		if deliverSpan != nil {
+			deliverSpan.SetAttribute("subscription.id", sub.subscriptionID)
+			deliverSpan.SetAttribute("delivery.status", status.String())
+			deliverSpan.End(err)
 		}
 	}
 }
 
+// dispatchTo delivers mr to sub and reports the outcome in the counters and in report.
+func (b *bus) dispatchTo(topic string, state *topicState, sub *subscription, mr messageRef, timer Timer, report *PublishAck) (DeliveryStatus, error) {
+	msg := makeMessage(topic, mr, sub)
+	if !sub.cfg.Accepts(msg) {
+		b.countSkipped(state, sub, mr.seq, DeliveryStatusFiltered, report)
+		return DeliveryStatusFiltered, nil
+	}
+	res, called, err := b.deliverIntercepted(topic, sub, msg, timer)
+	switch {
+	case err != nil:
+		b.countSkipped(state, sub, mr.seq, DeliveryStatusRejected, report)
+		return DeliveryStatusRejected, err
+	case !called:
+		// skipped by an interceptor
+		b.countSkipped(state, sub, mr.seq, DeliveryStatusFiltered, report)
+		return DeliveryStatusFiltered, nil
+	}
+	b.countDelivery(state, res)
+	sub.counters.record(res.status(), mr.seq)
+	if res.delivered {
+		latency := b.cfg.Clock.Now().Sub(mr.ts)
+		state.rates.observeLatency(latency)
+		b.rates.observeLatency(latency)
+	}
+	b.checkSlowConsumer(topic, state, sub, mr.seq, res)
+	if report != nil {
+		report.addDelivery(sub.subscriptionID, res)
+	}
+	return res.status(), nil
+}
+
+// startFanOutSpan starts the fan-out span, child of the span context carried by mr.
+func (b *bus) startFanOutSpan(topic string, mr messageRef) (context.Context, Span) {
+	if b.cfg.Tracer == nil {
+		return context.Background(), nil
+	}
+	ctx := Message{Headers: mr.headers}.TraceContext(context.Background())
+	ctx, span := b.startSpan(ctx, SpanOperationFanOut, topic)
+	span.SetAttribute("message.seq", strconv.FormatUint(mr.seq, 10))
+	return ctx, span
+}
+
+// invokeHandler calls the Handler of sub. A panic is recovered and counted
+// as failed only if a PanicHandler is configured.
+// The handler is not called under sub.mu so it can unsubscribe itself.
+func (b *bus) invokeHandler(topic string, sub *subscription, msg Message) (res deliveryResult) {
+	select {
+	case <-sub.done:
+		return deliveryResult{}
+	default:
+	}
+	if b.cfg.PanicHandler != nil {
+		defer func() {
+			if v := recover(); v != nil {
+				b.cfg.PanicHandler(topic, v)
+				res = deliveryResult{failed: true}
+			}
+		}()
+	}
+	sub.cfg.Handler(msg)
+	return deliveryResult{delivered: true}
+}
+
+// countDelivery reports a deliveryResult in the topic and bus counters
+func (b *bus) countDelivery(state *topicState, res deliveryResult) {
+	switch {
+	case res.failed:
+		state.counters.Failed.Add(1)
+		b.totals.Failed.Add(1)
+	case res.spilled:
+		// counted as Delivered or Dropped later, see countSpill
+		state.counters.Spilled.Add(1)
+		b.totals.Spilled.Add(1)
+	case res.delivered:
+		state.counters.Delivered.Add(1)
+		b.totals.Delivered.Add(1)
+	default:
+		state.counters.Dropped.Add(1)
+		b.totals.Dropped.Add(1)
+	}
+	if res.evicted > 0 {
+		state.counters.Evicted.Add(res.evicted)
+		b.totals.Evicted.Add(res.evicted)
+	}
+	if res.coalesced > 0 {
+		state.counters.Coalesced.Add(res.coalesced)
+		b.totals.Coalesced.Add(res.coalesced)
+	}
+}
+
+// countSkipped reports a message not delivered on purpose to sub:
+// DeliveryStatusFiltered or DeliveryStatusRejected.
+func (b *bus) countSkipped(state *topicState, sub *subscription, seq uint64, status DeliveryStatus, report *PublishAck) {
+	if status == DeliveryStatusRejected {
+		state.counters.Rejected.Add(1)
+		b.totals.Rejected.Add(1)
+	} else {
+		state.counters.Filtered.Add(1)
+		b.totals.Filtered.Add(1)
+	}
+	// not a lag for the slow consumer detection
+	sub.slow.lastSeq = seq
+	sub.counters.record(status, seq)
+	if report != nil {
+		report.addSkipped(sub.subscriptionID, status)
+	}
+}
+
 // snapshotSubsLocked caller must hold RLock
 func snapshotSubsLocked(m map[string]*subscription) []*subscription {
 	subs := make([]*subscription, 0, len(m))
@@ -38,7 +180,7 @@ func snapshotSubsLocked(m map[string]*subscription) []*subscription {
 	return subs
 }
 
-func tryDeliver(sub *subscription, msg Message, timer *time.Timer) bool {
+func tryDeliver(sub *subscription, msg Message, timer Timer) bool {
 	cfg := sub.cfg
 	if cfg.DropIfFull {
 		select {
@@ -51,7 +193,7 @@ func tryDeliver(sub *subscription, msg Message, timer *time.Timer) bool {
 	// timeout
 	if !timer.Stop() {
 		select {
-		case <-timer.C:
+		case <-timer.C():
 		default:
 		}
 	}
@@ -62,12 +204,21 @@ func tryDeliver(sub *subscription, msg Message, timer *time.Timer) bool {
 		// flosh timer if needed
 		if !timer.Stop() {
 			select {
-			case <-timer.C:
+			case <-timer.C():
 			default:
 			}
 		}
 		return true
-	case <-timer.C:
+	case <-timer.C():
+		return false
+	case <-sub.done:
+		// closing, do not wait for the timeout
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
 		return false
 	}
 }
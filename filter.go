@@ -0,0 +1,131 @@
+package thebus
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// HeaderMatch defines how a HeaderFilter compares a header value.
+//   - HeaderMatchEquals: the value equals Values[0]
+//   - HeaderMatchPrefix: the value starts with Values[0]
+//   - HeaderMatchIn: the value is one of Values
+//   - HeaderMatchExists: the header is set, whatever its value
+type HeaderMatch string
+
+const (
+	HeaderMatchUnknown HeaderMatch = "UNKNOWN"
+	HeaderMatchEquals  HeaderMatch = "EQUALS"
+	HeaderMatchPrefix  HeaderMatch = "PREFIX"
+	HeaderMatchIn      HeaderMatch = "IN"
+	HeaderMatchExists  HeaderMatch = "EXISTS"
+)
+
+func (enum HeaderMatch) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(HeaderMatchUnknown)
+	}
+	return string(enum)
+}
+
+func HeaderMatchValues() []HeaderMatch {
+	return []HeaderMatch{
+		HeaderMatchEquals,
+		HeaderMatchPrefix,
+		HeaderMatchIn,
+		HeaderMatchExists,
+	}
+}
+
+func (enum HeaderMatch) IsValid() bool {
+	if slices.Contains(HeaderMatchValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum HeaderMatch) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *HeaderMatch) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := HeaderMatch(tmp)
+	if !fs.IsValid() {
+		fs = HeaderMatchUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// ##############################################################################
+// ################################   FILTERS   #################################
+// ##############################################################################
+
+// Filter selects the messages delivered to a subscriber, see WithFilter.
+type Filter func(msg Message) bool
+
+// HeaderFilter is a declarative filter on a message header, see WithHeaderFilter.
+type HeaderFilter struct {
+	Key    string      `json:"key"`
+	Match  HeaderMatch `json:"match"`
+	Values []string    `json:"values,omitempty"`
+}
+
+// HeaderEquals matches the messages whose header key equals value.
+func HeaderEquals(key, value string) HeaderFilter {
+	return HeaderFilter{Key: key, Match: HeaderMatchEquals, Values: []string{value}}
+}
+
+// HeaderPrefix matches the messages whose header key starts with prefix.
+func HeaderPrefix(key, prefix string) HeaderFilter {
+	return HeaderFilter{Key: key, Match: HeaderMatchPrefix, Values: []string{prefix}}
+}
+
+// HeaderIn matches the messages whose header key is one of values.
+func HeaderIn(key string, values ...string) HeaderFilter {
+	return HeaderFilter{Key: key, Match: HeaderMatchIn, Values: values}
+}
+
+// HeaderExists matches the messages with the header key set.
+func HeaderExists(key string) HeaderFilter {
+	return HeaderFilter{Key: key, Match: HeaderMatchExists}
+}
+
+// Matches reports whether headers match the filter. An unknown Match never matches.
+func (f HeaderFilter) Matches(headers map[string]string) bool {
+	value, ok := headers[f.Key]
+	if !ok {
+		return false
+	}
+	switch f.Match {
+	case HeaderMatchEquals:
+		return len(f.Values) > 0 && value == f.Values[0]
+	case HeaderMatchPrefix:
+		return len(f.Values) > 0 && strings.HasPrefix(value, f.Values[0])
+	case HeaderMatchIn:
+		return slices.Contains(f.Values, value)
+	case HeaderMatchExists:
+		return true
+	default:
+		return false
+	}
+}
+
+// Accepts reports whether msg passes the HeaderFilters and the Filter of the config.
+func (cfg SubscriptionConfig) Accepts(msg Message) bool {
+	for _, f := range cfg.HeaderFilters {
+		if !f.Matches(msg.Headers) {
+			return false
+		}
+	}
+	return cfg.Filter == nil || cfg.Filter(msg)
+}
@@ -0,0 +1,101 @@
+package thebus
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestHeaderFilterMatches(t *testing.T) {
+	headers := map[string]string{"region": "eu-west", "kind": "order"}
+	tests := []struct {
+		filter HeaderFilter
+		want   bool
+	}{
+		{HeaderEquals("kind", "order"), true},
+		{HeaderEquals("kind", "refund"), false},
+		{HeaderPrefix("region", "eu-"), true},
+		{HeaderPrefix("region", "us-"), false},
+		{HeaderIn("kind", "refund", "order"), true},
+		{HeaderIn("kind"), false},
+		{HeaderExists("region"), true},
+		{HeaderExists("tenant"), false},
+		{HeaderFilter{Key: "kind", Match: "REGEX", Values: []string{".*"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Matches(headers); got != tt.want {
+			t.Errorf("%+v: want %v, got %v", tt.filter, tt.want, got)
+		}
+	}
+
+	var f HeaderFilter
+	if err := json.Unmarshal([]byte(`{"key":"kind","match":"PREFIX","values":["o"]}`), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Match != HeaderMatchPrefix || !f.Matches(headers) {
+		t.Fatalf("unexpected filter %+v", f)
+	}
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	b, _ := New(WithSyncDelivery(true))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	eu, _ := b.Subscribe(ctx, "orders", WithHeaderFilter(HeaderPrefix("region", "eu-")))
+	big, _ := b.Subscribe(ctx, "orders",
+		WithHeaderFilter(HeaderExists("region")),
+		WithFilter(func(msg Message) bool { return len(msg.Payload) > 3 }),
+	)
+
+	ack, err := b.Publish("orders", []byte("small"), WithHeader("region", "eu-west"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Delivered != 2 || ack.Filtered != 0 {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	ack, _ = b.Publish("orders", []byte("x"), WithHeaders(map[string]string{"region": "us-east"}))
+	if ack.Delivered != 0 || ack.Filtered != 2 || ack.Dropped != 0 {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	for _, d := range ack.Deliveries {
+		if d.Status != DeliveryStatusFiltered {
+			t.Fatalf("unexpected deliveries %+v", ack.Deliveries)
+		}
+	}
+	_, _ = b.Publish("orders", []byte("abcd"))
+
+	if len(eu.Read()) != 1 || len(big.Read()) != 1 {
+		t.Fatalf("unexpected buffered: eu=%d big=%d", len(eu.Read()), len(big.Read()))
+	}
+	if msg := <-eu.Read(); msg.Headers["region"] != "eu-west" {
+		t.Fatalf("unexpected headers %+v", msg.Headers)
+	}
+
+	stats, _ := b.Stats()
+	if stats.Totals.Filtered != 4 || stats.Totals.Dropped != 0 || stats.PerTopic["orders"].Filtered != 4 {
+		t.Fatalf("unexpected counters %+v", stats.Totals)
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	b, _ := New(WithSyncDelivery(true))
+	defer b.Close()
+
+	_ = b.DeclareTopic("t", TopicOptions{Retention: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = b.Subscribe(ctx, "t")
+	_, _ = b.Publish("t", []byte("a"), WithHeader("keep", "1"))
+	_, _ = b.Publish("t", []byte("b"))
+
+	sub, _ := b.Subscribe(ctx, "t", WithReplay(1), WithHeaderFilter(HeaderExists("keep")))
+	if len(sub.Read()) != 1 {
+		t.Fatalf("want 1 replayed message, got %d", len(sub.Read()))
+	}
+	if msg := <-sub.Read(); string(msg.Payload) != "a" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+}
@@ -0,0 +1,555 @@
+// Package httpstream exposes a bus over plain HTTP, so that services written in
+// any language integrate without a client library. It works over HTTP/1.1
+// (chunked responses) and HTTP/2 with the standard library server.
+//
+// Mount it under a prefix with http.StripPrefix:
+//
+//	mux.Handle("/bus/", http.StripPrefix("/bus", httpstream.NewHandler(bus)))
+//
+// Publish, the request body is the payload and the response an Ack:
+//
+//	POST /topics/orders/messages
+//	Bus-Header-Tenant: acme
+//
+//	{"id":42}
+//
+// Publish a stream of messages, one Record per line, each answered by an Ack
+// line (full duplex over HTTP/2):
+//
+//	POST /topics/orders/messages
+//	Content-Type: application/x-ndjson
+//
+// Subscribe, the response streams the messages until the client goes away or
+// the subscription ends:
+//
+//	GET /topics/orders/messages?buffer=256&strategy=PAYLOAD_CLONED_PER_SUBSCRIBER
+//	Accept: application/x-ndjson (default) or application/octet-stream
+//
+// See Record for the two encodings of the stream and subscribeOptions for the
+// query parameters mapped to thebus.SubscribeOption.
+package httpstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+const (
+	DefaultMaxPayloadSize = 1 << 20
+	DefaultHeartbeat      = 15 * time.Second
+	DefaultMaxBufferSize  = 4096
+	DefaultMaxSendTimeout = 5 * time.Second
+
+	// HeaderPrefix is the prefix of the HTTP headers published as message
+	// headers ("Bus-Header-Tenant: acme" is the header "Tenant").
+	HeaderPrefix = "Bus-Header-"
+
+	ContentTypeNDJSON = "application/x-ndjson"
+	ContentTypeBinary = "application/octet-stream"
+)
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// Action is the kind of request checked by the Authorizer.
+type Action string
+
+const (
+	ActionUnknown   Action = "UNKNOWN"
+	ActionPublish   Action = "PUBLISH"
+	ActionSubscribe Action = "SUBSCRIBE"
+)
+
+func (enum Action) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(ActionUnknown)
+	}
+	return string(enum)
+}
+
+func ActionValues() []Action {
+	return []Action{
+		ActionPublish,
+		ActionSubscribe,
+	}
+}
+
+func (enum Action) IsValid() bool {
+	if slices.Contains(ActionValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum Action) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *Action) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := Action(tmp)
+	if !fs.IsValid() {
+		fs = ActionUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+// Authorizer allows (nil) or denies (an error) a publish or subscribe request on topic.
+type Authorizer func(r *http.Request, action Action, topic string) error
+
+type config struct {
+	maxPayloadSize int64
+	maxBufferSize  int
+	maxSendTimeout time.Duration
+	heartbeat      time.Duration
+	authorizer     Authorizer
+	subscribeOpts  []thebus.SubscribeOption
+}
+
+// Option configures the Handler.
+type Option func(cfg *config)
+
+// WithMaxPayloadSize limits the size of a published payload (a line in ndjson).
+func WithMaxPayloadSize(size int64) Option {
+	return func(cfg *config) {
+		cfg.maxPayloadSize = size
+	}
+}
+
+// WithMaxBufferSize limits the buffer query parameter of a subscription, a
+// larger one gets a 400.
+func WithMaxBufferSize(size int) Option {
+	return func(cfg *config) {
+		cfg.maxBufferSize = size
+	}
+}
+
+// WithMaxSendTimeout limits the send_timeout query parameter of a
+// subscription, a larger one gets a 400.
+func WithMaxSendTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxSendTimeout = timeout
+	}
+}
+
+// WithHeartbeat sets the interval of the keep-alive of the streams (0 = off):
+// an empty line in ndjson, an empty frame in binary.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.heartbeat = interval
+	}
+}
+
+// WithAuthorizer checks every request. A denied request gets a 403 with the
+// error message.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(cfg *config) {
+		cfg.authorizer = authorizer
+	}
+}
+
+// WithSubscribeOptions sets the options of the subscriptions, applied before
+// the ones of the query parameters.
+func WithSubscribeOptions(opts ...thebus.SubscribeOption) Option {
+	return func(cfg *config) {
+		cfg.subscribeOpts = append(cfg.subscribeOpts, opts...)
+	}
+}
+
+// ##############################################################################
+// ################################   HANDLER   #################################
+// ##############################################################################
+
+// Handler serves the publish and subscribe endpoints:
+//
+//	POST /topics/{topic}/messages    publish, Ack (or a stream of Ack in ndjson)
+//	GET  /topics/{topic}/messages    subscribe, a stream of Record
+type Handler struct {
+	bus thebus.Bus
+	cfg config
+	mux *http.ServeMux
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+// NewHandler returns the streaming Handler of bus.
+func NewHandler(bus thebus.Bus, opts ...Option) *Handler {
+	h := &Handler{
+		bus: bus,
+		cfg: config{
+			maxPayloadSize: DefaultMaxPayloadSize,
+			maxBufferSize:  DefaultMaxBufferSize,
+			maxSendTimeout: DefaultMaxSendTimeout,
+			heartbeat:      DefaultHeartbeat,
+		},
+		mux: http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(&h.cfg)
+	}
+	h.mux.HandleFunc("POST /topics/{topic}/messages", h.guard(ActionPublish, h.publish))
+	h.mux.HandleFunc("GET /topics/{topic}/messages", h.guard(ActionSubscribe, h.subscribe))
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) guard(action Action, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.cfg.authorizer != nil {
+			if err := h.cfg.authorizer(r, action, r.PathValue("topic")); err != nil {
+				writeError(w, http.StatusForbidden, err)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// ##############################################################################
+// ################################   PUBLISH   #################################
+// ##############################################################################
+
+// Ack is the result of a publish. With ?confirm=true the publish waits for the
+// fan-out and the delivery counters are set.
+type Ack struct {
+	Topic       string `json:"topic"`
+	Seq         uint64 `json:"seq,omitempty"`
+	ID          string `json:"id,omitempty"`
+	Subscribers int    `json:"subscribers"`
+	Delivered   int    `json:"delivered,omitempty"`
+	Dropped     int    `json:"dropped,omitempty"`
+	Failed      int    `json:"failed,omitempty"`
+	Filtered    int    `json:"filtered,omitempty"`
+	Rejected    int    `json:"rejected,omitempty"`
+	Expired     bool   `json:"expired,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func makeAck(ack thebus.PublishAck) Ack {
+	return Ack{
+		Topic:       ack.Topic,
+		Seq:         ack.Seq,
+		ID:          ack.MessageID,
+		Subscribers: ack.Subscribers,
+		Delivered:   ack.Delivered,
+		Dropped:     ack.Dropped,
+		Failed:      ack.Failed,
+		Filtered:    ack.Filtered,
+		Rejected:    ack.Rejected,
+		Expired:     ack.Expired,
+	}
+}
+
+func (h *Handler) publish(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	confirm, _ := strconv.ParseBool(r.URL.Query().Get("confirm"))
+	var opts []thebus.PublishOption
+	if sc, err := thebus.ParseTraceParent(r.Header.Get("traceparent")); err == nil {
+		opts = append(opts, thebus.WithSpanContext(sc))
+	}
+	if mediaType(r.Header.Get("Content-Type")) == ContentTypeNDJSON {
+		h.publishStream(w, r, topic, confirm, opts)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.cfg.maxPayloadSize))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if headers := busHeaders(r.Header); len(headers) > 0 {
+		opts = append(opts, thebus.WithHeaders(headers))
+	}
+	ack, err := h.send(r.Context(), topic, payload, confirm, opts)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ack)
+}
+
+// publishStream publishes a Record per line of the body and answers an Ack
+// per line. The errors of a message are reported in its Ack.
+func (h *Handler) publishStream(w http.ResponseWriter, r *http.Request, topic string, confirm bool, opts []thebus.PublishOption) {
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex() // HTTP/1.1, HTTP/2 is always full duplex
+	w.Header().Set("Content-Type", ContentTypeNDJSON)
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	scanner := bufio.NewScanner(r.Body)
+	// a base64 payload is 4/3 of its size, plus the other fields
+	scanner.Buffer(nil, int(h.cfg.maxPayloadSize*4/3)+64<<10)
+	encoder := json.NewEncoder(w)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var ack Ack
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			ack = Ack{Topic: topic, Error: err.Error()}
+		} else if rec.Topic != "" && rec.Topic != topic {
+			ack = Ack{Topic: topic, Error: fmt.Sprintf("topic %q in a stream of %q", rec.Topic, topic)}
+		} else {
+			msgOpts := opts
+			if len(rec.Headers) > 0 {
+				msgOpts = append(opts[:len(opts):len(opts)], thebus.WithHeaders(rec.Headers))
+			}
+			ack, err = h.send(r.Context(), topic, rec.Payload, confirm, msgOpts)
+			if err != nil {
+				ack = Ack{Topic: topic, Error: err.Error()}
+			}
+		}
+		if err := encoder.Encode(ack); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = encoder.Encode(Ack{Topic: topic, Error: err.Error()})
+	}
+}
+
+func (h *Handler) send(ctx context.Context, topic string, payload []byte, confirm bool, opts []thebus.PublishOption) (Ack, error) {
+	if !confirm {
+		ack, err := h.bus.PublishContext(ctx, topic, payload, opts...)
+		if err != nil {
+			return Ack{}, err
+		}
+		return makeAck(ack), nil
+	}
+	confirmation, err := h.bus.PublishConfirm(topic, payload, opts...)
+	if err != nil {
+		return Ack{}, err
+	}
+	ack, err := confirmation.Wait(ctx)
+	if err != nil {
+		return Ack{}, err
+	}
+	return makeAck(ack), nil
+}
+
+func busHeaders(h http.Header) map[string]string {
+	var headers map[string]string
+	for name, values := range h {
+		key, ok := strings.CutPrefix(name, HeaderPrefix)
+		if !ok || key == "" || len(values) == 0 {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[key] = values[0]
+	}
+	return headers
+}
+
+// ##############################################################################
+// ###############################   SUBSCRIBE   ################################
+// ##############################################################################
+
+func (h *Handler) subscribe(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" && mediaType(r.Header.Get("Accept")) == ContentTypeBinary {
+		format = "binary"
+	}
+	var write func(w io.Writer, rec Record) error
+	var contentType string
+	switch format {
+	case "", "ndjson":
+		write, contentType = writeNDJSON, ContentTypeNDJSON
+	case "binary":
+		write, contentType = writeBinary, ContentTypeBinary
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q", format))
+		return
+	}
+	queryOpts, err := h.cfg.subscribeOptions(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rc := http.NewResponseController(w)
+
+	// the subscription ends with the request (client disconnect)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	opts := append(h.cfg.subscribeOpts[:len(h.cfg.subscribeOpts):len(h.cfg.subscribeOpts)], queryOpts...)
+	sub, err := h.bus.Subscribe(ctx, topic, opts...)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	var heartbeat <-chan time.Time
+	if h.cfg.heartbeat > 0 {
+		ticker := time.NewTicker(h.cfg.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat:
+			if err := writeHeartbeat(w, format); err != nil {
+				return
+			}
+		case msg, ok := <-sub.Read():
+			if !ok {
+				// the subscription ended (bus closed, topic deleted...)
+				return
+			}
+			if err := write(w, thebus.MakeRecord(msg)); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// subscribeOptions maps the query parameters to subscribe options:
+//
+//	buffer=256                              thebus.WithBufferSize
+//	strategy=PAYLOAD_CLONED_PER_SUBSCRIBER  thebus.WithStrategy
+//	overflow=DROP_OLDEST                    thebus.WithOverflowPolicy
+//	drop_if_full=false                      thebus.WithDropIfFull
+//	send_timeout=100ms                      thebus.WithSendTimeout
+//	replay=1                                thebus.WithReplay
+//	name=billing                            thebus.WithSubscriberName
+//
+// The buffer and send_timeout are limited by WithMaxBufferSize and WithMaxSendTimeout.
+func (cfg config) subscribeOptions(query map[string][]string) ([]thebus.SubscribeOption, error) {
+	var opts []thebus.SubscribeOption
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch key {
+		case "buffer":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 1 {
+				return nil, fmt.Errorf("invalid buffer %q", value)
+			}
+			if size > cfg.maxBufferSize {
+				return nil, fmt.Errorf("buffer %d above the maximum %d", size, cfg.maxBufferSize)
+			}
+			opts = append(opts, thebus.WithBufferSize(size))
+		case "strategy":
+			strategy := thebus.SubscriptionStrategy(value)
+			if !strategy.IsValid() {
+				return nil, fmt.Errorf("invalid strategy %q", value)
+			}
+			opts = append(opts, thebus.WithStrategy(strategy))
+		case "overflow":
+			policy := thebus.OverflowPolicy(value)
+			if !policy.IsValid() || policy == thebus.OverflowPolicyCoalesce || policy == thebus.OverflowPolicySpillToDisk {
+				// they need a key function or a directory, see WithSubscribeOptions
+				return nil, fmt.Errorf("invalid overflow %q", value)
+			}
+			opts = append(opts, thebus.WithOverflowPolicy(policy))
+		case "drop_if_full":
+			dropIfFull, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid drop_if_full %q", value)
+			}
+			opts = append(opts, thebus.WithDropIfFull(dropIfFull))
+		case "send_timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout < 0 {
+				return nil, fmt.Errorf("invalid send_timeout %q", value)
+			}
+			if timeout > cfg.maxSendTimeout {
+				return nil, fmt.Errorf("send_timeout %s above the maximum %s", timeout, cfg.maxSendTimeout)
+			}
+			opts = append(opts, thebus.WithSendTimeout(timeout))
+		case "replay":
+			seq, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid replay %q", value)
+			}
+			opts = append(opts, thebus.WithReplay(seq))
+		case "name":
+			opts = append(opts, thebus.WithSubscriberName(value))
+		}
+	}
+	return opts, nil
+}
+
+// ##############################################################################
+// #################################   ERRORS   #################################
+// ##############################################################################
+
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, thebus.ErrTopicNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, thebus.ErrInvalidTopic), errors.Is(err, thebus.ErrInvalidTopicName), errors.Is(err, thebus.ErrInvalidTopicNameReserved):
+		return http.StatusBadRequest
+	case errors.Is(err, thebus.ErrRejected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, thebus.ErrClosed), errors.Is(err, thebus.ErrQueueFull):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusRequestTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func mediaType(value string) string {
+	mt, _, _ := strings.Cut(value, ";")
+	return strings.ToLower(strings.TrimSpace(mt))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,273 @@
+package httpstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+// newServer serves the handler of a new bus over HTTP/2 (TLS).
+func newServer(t *testing.T, opts ...Option) (thebus.Bus, *httptest.Server) {
+	t.Helper()
+	bus, err := thebus.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(NewHandler(bus, opts...))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(func() {
+		srv.Close()
+		_ = bus.Close()
+	})
+	return bus, srv
+}
+
+// waitSubscribers waits for n subscribers on topic
+func waitSubscribers(t *testing.T, bus thebus.Bus, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		stats, _ := bus.Stats()
+		if stats.PerTopic[topic].Subscribers == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscribers on %s", n, topic)
+}
+
+func TestPublish(t *testing.T) {
+	bus, srv := newServer(t)
+	sub, err := bus.Subscribe(t.Context(), "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/topics/orders/messages?confirm=true", strings.NewReader("hello"))
+	req.Header.Set(HeaderPrefix+"Tenant", "acme")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var ack Ack
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || ack.Seq != 1 || ack.ID == "" || ack.Subscribers != 1 || ack.Delivered != 1 {
+		t.Fatalf("unexpected ack: %d %+v", resp.StatusCode, ack)
+	}
+	select {
+	case msg := <-sub.Read():
+		if string(msg.Payload) != "hello" || msg.Headers["Tenant"] != "acme" {
+			t.Fatalf("unexpected message: %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message")
+	}
+}
+
+func TestSubscribeNDJSON(t *testing.T) {
+	bus, srv := newServer(t)
+	resp, err := srv.Client().Get(srv.URL + "/topics/orders/messages?buffer=8&name=billing&strategy=PAYLOAD_CLONED_PER_SUBSCRIBER")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.Header.Get("Content-Type") != ContentTypeNDJSON {
+		t.Fatalf("unexpected response: %s %v", resp.Proto, resp.Header)
+	}
+	waitSubscribers(t, bus, "orders", 1)
+	subs, err := bus.(thebus.AdminBus).Subscriptions("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg := subs[0].Config; cfg.BufferSize != 8 || cfg.Name != "billing" || cfg.Strategy != thebus.SubscriptionStrategyPayloadClonedPerSubscriber {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+
+	_, _ = bus.Publish("orders", []byte("one"), thebus.WithHeader("k", "v"))
+	_, _ = bus.Publish("orders", []byte("two"))
+	decoder := json.NewDecoder(resp.Body)
+	for i, want := range []string{"one", "two"} {
+		var rec Record
+		if err := decoder.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Topic != "orders" || rec.Seq != uint64(i+1) || string(rec.Payload) != want || rec.Timestamp.IsZero() {
+			t.Fatalf("unexpected record: %+v", rec)
+		}
+	}
+
+	// the stream ends with the subscription
+	if err := bus.DeleteTopic("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("expected the end of the stream, got %v", err)
+	}
+}
+
+func TestSubscribeBinary(t *testing.T) {
+	bus, srv := newServer(t, WithHeartbeat(10*time.Millisecond))
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/topics/orders/messages", nil)
+	req.Header.Set("Accept", ContentTypeBinary)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != ContentTypeBinary {
+		t.Fatalf("unexpected content type: %v", resp.Header)
+	}
+	waitSubscribers(t, bus, "orders", 1)
+	time.Sleep(30 * time.Millisecond) // a few heartbeats first
+
+	confirmation, err := bus.PublishConfirm("orders", []byte{0, 1, 2}, thebus.WithHeaders(map[string]string{"a": "1", "b": ""}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, _ := confirmation.Wait(t.Context())
+	rec, err := ReadBinary(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Topic != "orders" || rec.Seq != 1 || rec.ID != ack.MessageID || !bytes.Equal(rec.Payload, []byte{0, 1, 2}) ||
+		len(rec.Headers) != 2 || rec.Headers["a"] != "1" || rec.Timestamp.IsZero() {
+		t.Fatalf("unexpected record: %+v", rec)
+	}
+}
+
+func TestPublishStream(t *testing.T) {
+	bus, srv := newServer(t)
+	sub, err := bus.Subscribe(t.Context(), "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, input := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/topics/orders/messages", body)
+	req.Header.Set("Content-Type", ContentTypeNDJSON)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	acks := bufio.NewScanner(resp.Body)
+
+	// each line is answered before the next one is sent
+	for i, line := range []string{
+		`{"payload":"aGVsbG8=","headers":{"k":"v"}}`,
+		`{"topic":"other"}`,
+		`not json`,
+		`{"topic":"orders","payload":"Ynll"}`,
+	} {
+		if _, err := io.WriteString(input, line+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		if !acks.Scan() {
+			t.Fatalf("no ack for line %d: %v", i, acks.Err())
+		}
+		var ack Ack
+		if err := json.Unmarshal(acks.Bytes(), &ack); err != nil {
+			t.Fatal(err)
+		}
+		if failed := i == 1 || i == 2; failed != (ack.Error != "") {
+			t.Fatalf("unexpected ack for line %d: %+v", i, ack)
+		}
+	}
+	_ = input.Close()
+	if acks.Scan() {
+		t.Fatalf("unexpected line: %s", acks.Text())
+	}
+
+	for _, want := range []string{"hello", "bye"} {
+		select {
+		case msg := <-sub.Read():
+			if string(msg.Payload) != want {
+				t.Fatalf("unexpected message: %+v", msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message")
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	denied := errors.New("denied")
+	_, srv := newServer(t, WithMaxPayloadSize(4), WithMaxBufferSize(64), WithMaxSendTimeout(time.Second), WithAuthorizer(func(r *http.Request, action Action, topic string) error {
+		if topic == "secret" {
+			return denied
+		}
+		return nil
+	}))
+
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/topics/$thebus.x/messages", "x", http.StatusBadRequest},
+		{http.MethodPost, "/topics/orders/messages", "12345", http.StatusRequestEntityTooLarge},
+		{http.MethodPost, "/topics/secret/messages", "x", http.StatusForbidden},
+		{http.MethodGet, "/topics/secret/messages", "", http.StatusForbidden},
+		{http.MethodGet, "/topics/orders/messages?buffer=0", "", http.StatusBadRequest},
+		{http.MethodGet, "/topics/orders/messages?buffer=65", "", http.StatusBadRequest},
+		{http.MethodGet, "/topics/orders/messages?buffer=1000000000", "", http.StatusBadRequest},
+		{http.MethodGet, "/topics/orders/messages?send_timeout=2s", "", http.StatusBadRequest},
+		{http.MethodGet, "/topics/orders/messages?send_timeout=1000h", "", http.StatusBadRequest},
+		{http.MethodGet, "/topics/orders/messages?strategy=NOPE", "", http.StatusBadRequest},
+		{http.MethodGet, "/topics/orders/messages?overflow=COALESCE", "", http.StatusBadRequest},
+		{http.MethodGet, "/topics/orders/messages?format=xml", "", http.StatusBadRequest},
+		{http.MethodDelete, "/topics/orders/messages", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	rec := Record{
+		Topic:     "orders",
+		Seq:       42,
+		ID:        "id",
+		Timestamp: time.Unix(0, 1234567890),
+		Headers:   map[string]string{"k": "v"},
+		Payload:   []byte("payload"),
+	}
+	var buf bytes.Buffer
+	_ = writeHeartbeat(&buf, "binary")
+	if err := writeBinary(&buf, rec); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBinary(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Topic != rec.Topic || got.Seq != rec.Seq || got.ID != rec.ID || !got.Timestamp.Equal(rec.Timestamp) ||
+		got.Headers["k"] != "v" || string(got.Payload) != "payload" {
+		t.Fatalf("unexpected record: %+v", got)
+	}
+	if _, err := parseBinary([]byte{0, 0, 0}); !errors.Is(err, errMalformed) {
+		t.Fatalf("expected errMalformed, got %v", err)
+	}
+	if _, err := ReadBinary(&buf); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
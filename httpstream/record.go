@@ -0,0 +1,144 @@
+package httpstream
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+var errMalformed = errors.New("httpstream: malformed frame")
+
+// Record is a message of a stream.
+//
+// In ndjson it is the JSON of thebus.Record, an object per line.
+//
+// In binary it is a frame, the integers big endian:
+//
+//	u32 length of the rest of the frame (0 = heartbeat)
+//	u64 seq
+//	i64 timestamp (Unix nanoseconds)
+//	u16 length + topic
+//	u16 length + id
+//	u16 header count, then per header u16 length + key, u32 length + value
+//	payload (the rest of the frame)
+type Record = thebus.Record
+
+func writeNDJSON(w io.Writer, rec Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func writeBinary(w io.Writer, rec Record) error {
+	if len(rec.Topic) > math.MaxUint16 || len(rec.ID) > math.MaxUint16 || len(rec.Headers) > math.MaxUint16 {
+		return errMalformed
+	}
+	frame := make([]byte, 4, 64+len(rec.Topic)+len(rec.Payload))
+	frame = binary.BigEndian.AppendUint64(frame, rec.Seq)
+	frame = binary.BigEndian.AppendUint64(frame, uint64(rec.Timestamp.UnixNano()))
+	frame = appendString16(frame, rec.Topic)
+	frame = appendString16(frame, rec.ID)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(rec.Headers)))
+	for key, value := range rec.Headers {
+		if len(key) > math.MaxUint16 {
+			return errMalformed
+		}
+		frame = appendString16(frame, key)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(value)))
+		frame = append(frame, value...)
+	}
+	frame = append(frame, rec.Payload...)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	_, err := w.Write(frame)
+	return err
+}
+
+func writeHeartbeat(w io.Writer, format string) error {
+	heartbeat := []byte("\n")
+	if format == "binary" {
+		heartbeat = []byte{0, 0, 0, 0}
+	}
+	_, err := w.Write(heartbeat)
+	return err
+}
+
+func appendString16(b []byte, s string) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(s))), s...)
+}
+
+// ReadBinary reads the next Record of a binary stream, skipping the heartbeats.
+func ReadBinary(r io.Reader) (Record, error) {
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return Record{}, err
+		}
+		if n := binary.BigEndian.Uint32(size[:]); n > 0 {
+			frame := make([]byte, n)
+			if _, err := io.ReadFull(r, frame); err != nil {
+				return Record{}, err
+			}
+			return parseBinary(frame)
+		}
+	}
+}
+
+func parseBinary(frame []byte) (Record, error) {
+	var rec Record
+	if len(frame) < 16 {
+		return rec, errMalformed
+	}
+	rec.Seq = binary.BigEndian.Uint64(frame)
+	rec.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(frame[8:])))
+	frame = frame[16:]
+	var ok bool
+	if rec.Topic, frame, ok = cutString16(frame); !ok {
+		return rec, errMalformed
+	}
+	if rec.ID, frame, ok = cutString16(frame); !ok {
+		return rec, errMalformed
+	}
+	if len(frame) < 2 {
+		return rec, errMalformed
+	}
+	count := binary.BigEndian.Uint16(frame)
+	frame = frame[2:]
+	if count > 0 {
+		rec.Headers = make(map[string]string, count)
+	}
+	for range count {
+		var key string
+		if key, frame, ok = cutString16(frame); !ok || len(frame) < 4 {
+			return rec, errMalformed
+		}
+		n := binary.BigEndian.Uint32(frame)
+		if uint64(len(frame)-4) < uint64(n) {
+			return rec, errMalformed
+		}
+		rec.Headers[key] = string(frame[4 : 4+n])
+		frame = frame[4+n:]
+	}
+	if len(frame) > 0 {
+		rec.Payload = frame
+	}
+	return rec, nil
+}
+
+func cutString16(b []byte) (string, []byte, bool) {
+	if len(b) < 2 {
+		return "", nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b)-2 < n {
+		return "", nil, false
+	}
+	return string(b[2 : 2+n]), b[2+n:], true
+}
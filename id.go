@@ -24,6 +24,7 @@ const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
 // generate the entropy again in case we change millisecond
 type stateIDGenerator struct {
 	mu      sync.Mutex
+	clock   Clock
 	lastTs  int64
 	entropy [10]byte
 }
@@ -31,7 +32,7 @@ type stateIDGenerator struct {
 // next generate again the entropy if the ms increased.
 // Get the latest if decrease and increase it if we are in the same ms
 func (s *stateIDGenerator) next() (ts int64, e [10]byte) {
-	now := time.Now().UnixMilli()
+	now := s.clock.Now().UnixMilli()
 	if now > s.lastTs {
 		s.lastTs = now
 		_, err := rand.Read(s.entropy[:])
@@ -50,6 +51,7 @@ func (s *stateIDGenerator) next() (ts int64, e [10]byte) {
 // stateIDGen - global var for the state
 // see init for the default entropy
 var stateIDGen = &stateIDGenerator{
+	clock:  SystemClock(),
 	lastTs: time.Now().UnixMilli(),
 }
 
@@ -62,6 +64,24 @@ func DefaultIDGenerator() string {
 	return encodeULIDLike(ts, e)
 }
 
+// NewIDGenerator returns a generator with its own state whose timestamps
+// come from clock. Used by default when WithClock is set.
+func NewIDGenerator(clock Clock) IDGenerator {
+	state := &stateIDGenerator{
+		clock:  clock,
+		lastTs: clock.Now().UnixMilli(),
+	}
+	if _, err := rand.Read(state.entropy[:]); err != nil {
+		panic(err)
+	}
+	return func() string {
+		state.mu.Lock()
+		ts, e := state.next()
+		state.mu.Unlock()
+		return encodeULIDLike(ts, e)
+	}
+}
+
 // incrementEntropyBE increment the entropy.
 // See it as a km/miles counter on a car. The latest number on the counter is increased
 // each km/miles. If the increase operation result is 0, it means we have to increase the next number (index - 1)
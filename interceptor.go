@@ -0,0 +1,132 @@
+package thebus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ##############################################################################
+// ##############################   INTERCEPTORS   ##############################
+// ##############################################################################
+
+// PublishHandler publishes msg. Only Topic, Payload and Headers are set.
+type PublishHandler func(msg Message) (PublishAck, error)
+
+// PublishInterceptor wraps Publish and PublishConfirm (see WithPublishInterceptor).
+// It can change msg (topic, payload, headers) before calling next, reject the
+// message by returning an error (see Reject) or short-circuit it by returning
+// without calling next: the message is then not published.
+type PublishInterceptor func(msg Message, next PublishHandler) (PublishAck, error)
+
+// DeliverFunc delivers msg to the subscriber.
+type DeliverFunc func(msg Message) error
+
+// DeliveryInterceptor wraps the delivery of a message to a subscriber (see
+// WithDeliveryInterceptor and WithSubscriptionInterceptor). It can change msg
+// before calling next, reject it by returning an error (counted as Rejected)
+// or skip it by returning nil without calling next (counted as Filtered).
+// It is called by the goroutine delivering the message and must be fast.
+type DeliveryInterceptor func(subscriptionID string, msg Message, next DeliverFunc) error
+
+// RejectedError is returned by an interceptor to reject a message, see Reject.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrRejected, e.Reason)
+}
+
+func (e *RejectedError) Is(target error) bool {
+	return target == ErrRejected
+}
+
+// Reject returns a RejectedError, matching ErrRejected with errors.Is.
+func Reject(reason string) error {
+	return &RejectedError{Reason: reason}
+}
+
+// ChainPublish returns final wrapped by the interceptors, the first one being the outermost.
+func ChainPublish(interceptors []PublishInterceptor, final PublishHandler) PublishHandler {
+	next := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func(msg Message) (PublishAck, error) {
+			return interceptor(msg, inner)
+		}
+	}
+	return next
+}
+
+// ChainDelivery returns final wrapped by the interceptors, the first one being the outermost.
+func ChainDelivery(interceptors []DeliveryInterceptor, subscriptionID string, final DeliverFunc) DeliverFunc {
+	next := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func(msg Message) error {
+			return interceptor(subscriptionID, msg, inner)
+		}
+	}
+	return next
+}
+
+// publishIntercepted runs the publish interceptors then publishes the message.
+// If conf is not nil and the message is not fanned out (no subscriber, dropped,
+// short-circuited by an interceptor), conf is resolved straight away.
+func (b *bus) publishIntercepted(ctx context.Context, msg Message, conf *Confirmation) (PublishAck, error) {
+	enqueued := false
+	final := func(msg Message) (PublishAck, error) {
+		// the topic may have been changed by an interceptor
+		if err := validatePublishTopic(msg.Topic); err != nil {
+			return PublishAck{}, err
+		}
+		// an interceptor may call next more than once (retries): the
+		// confirmation follows the first message enqueued only
+		c := conf
+		if enqueued {
+			c = nil
+		}
+		_, span := b.startSpan(ctx, SpanOperationEnqueue, msg.Topic)
+		ack, err := b.publish(msg.Topic, msg.Payload, PublishConfig{Headers: msg.Headers}, c)
+		endSpan(span, err)
+		enqueued = enqueued || ack.Enqueued
+		return ack, err
+	}
+	var ack PublishAck
+	var err error
+	if len(b.cfg.PublishInterceptors) == 0 {
+		ack, err = final(msg)
+	} else {
+		ack, err = ChainPublish(b.cfg.PublishInterceptors, final)(msg)
+		if errors.Is(err, ErrRejected) {
+			b.totals.Rejected.Add(1)
+		}
+	}
+	if conf != nil && !enqueued {
+		conf.resolve(ack)
+	}
+	return ack, err
+}
+
+// deliverIntercepted delivers msg to sub through the delivery interceptors.
+// called is false if an interceptor skipped the delivery.
+func (b *bus) deliverIntercepted(topic string, sub *subscription, msg Message, timer Timer) (res deliveryResult, called bool, err error) {
+	final := func(msg Message) error {
+		called = true
+		if sub.cfg.Handler != nil {
+			res = b.invokeHandler(topic, sub, msg)
+		} else {
+			res = deliver(sub, msg, timer)
+		}
+		return nil
+	}
+	if len(b.cfg.DeliveryInterceptors) == 0 && len(sub.cfg.Interceptors) == 0 {
+		_ = final(msg)
+		return res, called, nil
+	}
+	chain := ChainDelivery(sub.cfg.Interceptors, sub.subscriptionID, final)
+	chain = ChainDelivery(b.cfg.DeliveryInterceptors, sub.subscriptionID, chain)
+	err = chain(msg)
+	return res, called, err
+}
@@ -0,0 +1,171 @@
+package thebus
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPublishInterceptor(t *testing.T) {
+	var order []string
+	tag := func(msg Message, next PublishHandler) (PublishAck, error) {
+		order = append(order, "tag")
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers["tenant"] = "acme"
+		return next(msg)
+	}
+	validate := func(msg Message, next PublishHandler) (PublishAck, error) {
+		order = append(order, "validate")
+		if len(msg.Payload) == 0 {
+			return PublishAck{}, Reject("empty payload")
+		}
+		msg.Payload = []byte(strings.ToUpper(string(msg.Payload)))
+		return next(msg)
+	}
+	b, _ := New(WithSyncDelivery(true), WithPublishInterceptor(tag, validate))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, _ := b.Subscribe(ctx, "t")
+
+	if _, err := b.Publish("t", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-sub.Read()
+	if string(msg.Payload) != "HELLO" || msg.Headers["tenant"] != "acme" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if len(order) != 2 || order[0] != "tag" || order[1] != "validate" {
+		t.Fatalf("unexpected order %v", order)
+	}
+
+	_, err := b.Publish("t", nil)
+	var rejected *RejectedError
+	if !errors.Is(err, ErrRejected) || !errors.As(err, &rejected) || rejected.Reason != "empty payload" {
+		t.Fatalf("expected a RejectedError, got %v", err)
+	}
+	if _, err := b.PublishConfirm("t", nil); !errors.Is(err, ErrRejected) {
+		t.Fatalf("expected ErrRejected, got %v", err)
+	}
+	stats, _ := b.Stats()
+	if stats.Totals.Rejected != 2 || stats.Totals.Published != 1 {
+		t.Fatalf("unexpected counters %+v", stats.Totals)
+	}
+}
+
+func TestPublishInterceptorShortCircuit(t *testing.T) {
+	drop := func(msg Message, next PublishHandler) (PublishAck, error) {
+		if msg.Headers["debug"] != "" {
+			return PublishAck{Topic: msg.Topic}, nil
+		}
+		return next(msg)
+	}
+	b, _ := New(WithPublishInterceptor(drop))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = b.Subscribe(ctx, "t")
+	conf, err := b.PublishConfirm("t", []byte("x"), WithHeader("debug", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// never enqueued, resolved straight away
+	select {
+	case <-conf.Done():
+	default:
+		t.Fatal("expected the confirmation to be resolved")
+	}
+	if stats, _ := b.Stats(); stats.Totals.Published != 0 {
+		t.Fatalf("unexpected counters %+v", stats.Totals)
+	}
+}
+
+func TestPublishInterceptorCallingNextTwice(t *testing.T) {
+	twice := func(msg Message, next PublishHandler) (PublishAck, error) {
+		if _, err := next(msg); err != nil {
+			return PublishAck{}, err
+		}
+		return next(msg)
+	}
+	for _, sync := range []bool{false, true} {
+		b, _ := New(WithSyncDelivery(sync), WithPublishInterceptor(twice))
+		sub, _ := b.Subscribe(context.Background(), "t", WithBufferSize(4))
+		conf, err := b.PublishConfirm("t", []byte("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the confirmation follows the first message
+		ack, err := conf.Wait(context.Background())
+		if err != nil || ack.Seq != 1 || ack.Delivered != 1 {
+			t.Fatalf("sync=%v: unexpected ack %+v %v", sync, ack, err)
+		}
+		<-sub.Read()
+		<-sub.Read()
+		_ = b.Close()
+	}
+}
+
+func TestDeliveryInterceptor(t *testing.T) {
+	var order []string
+	audit := func(subscriptionID string, msg Message, next DeliverFunc) error {
+		order = append(order, "bus")
+		return next(msg)
+	}
+	b, _ := New(WithSyncDelivery(true), WithDeliveryInterceptor(audit))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	decrypt := func(subscriptionID string, msg Message, next DeliverFunc) error {
+		order = append(order, "sub")
+		switch string(msg.Payload) {
+		case "secret":
+			msg.Payload = []byte("plain")
+		case "skip":
+			return nil
+		case "bad":
+			return Reject("bad payload")
+		}
+		return next(msg)
+	}
+	plain, _ := b.Subscribe(ctx, "t")
+	decrypted, _ := b.Subscribe(ctx, "t", WithSubscriptionInterceptor(decrypt))
+
+	ack, _ := b.Publish("t", []byte("secret"))
+	if ack.Delivered != 2 {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	if msg := <-plain.Read(); string(msg.Payload) != "secret" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if msg := <-decrypted.Read(); string(msg.Payload) != "plain" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	// bus interceptors run first
+	if strings.Join(order, ",") != "bus,bus,sub" && strings.Join(order, ",") != "bus,sub,bus" {
+		t.Fatalf("unexpected order %v", order)
+	}
+
+	ack, _ = b.Publish("t", []byte("skip"))
+	if ack.Delivered != 1 || ack.Filtered != 1 {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	ack, _ = b.Publish("t", []byte("bad"))
+	if ack.Delivered != 1 || ack.Rejected != 1 {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	for _, d := range ack.Deliveries {
+		if d.SubscriptionID == decrypted.GetID() && d.Status != DeliveryStatusRejected {
+			t.Fatalf("unexpected deliveries %+v", ack.Deliveries)
+		}
+	}
+	stats, _ := b.Stats()
+	if stats.Totals.Filtered != 1 || stats.Totals.Rejected != 1 || stats.Totals.Dropped != 0 {
+		t.Fatalf("unexpected counters %+v", stats.Totals)
+	}
+}
@@ -0,0 +1,177 @@
+// Package topicfeed subscribes a bus by topic pattern, for the protocol
+// front-ends (nats, mqtt) whose clients use wildcards: the bus itself only
+// subscribes topics by name.
+//
+// A pattern feed subscribes the matching topics existing when it is created,
+// then the ones given to Attach (the front-end calls it before publishing)
+// and the ones found by the periodic refresh (see RefreshEvery).
+package topicfeed
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+// Registry creates the feeds of a front-end and keeps the pattern ones.
+type Registry struct {
+	bus  thebus.Bus
+	opts []thebus.SubscribeOption
+	ctx  context.Context
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	patterns map[*Feed]struct{}
+}
+
+// NewRegistry returns a Registry of bus. The feeds end when ctx is done.
+func NewRegistry(ctx context.Context, bus thebus.Bus, opts ...thebus.SubscribeOption) *Registry {
+	return &Registry{
+		bus:      bus,
+		opts:     opts,
+		ctx:      ctx,
+		patterns: make(map[*Feed]struct{}),
+	}
+}
+
+// Feed hands the messages of a topic, or of the topics matching a pattern, to deliver.
+type Feed struct {
+	registry *Registry
+	match    func(topic string) bool // nil for a single topic
+	deliver  func(msg thebus.Message)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	subs map[string]thebus.Subscription // by topic
+}
+
+// Subscribe returns the Feed of topic when match is nil, or else of the topics matched.
+// deliver is called concurrently for the different topics.
+func (r *Registry) Subscribe(topic string, match func(topic string) bool, deliver func(msg thebus.Message)) (*Feed, error) {
+	f := &Feed{
+		registry: r,
+		match:    match,
+		deliver:  deliver,
+		subs:     make(map[string]thebus.Subscription),
+	}
+	f.ctx, f.cancel = context.WithCancel(r.ctx)
+	if match == nil {
+		if err := f.attach(topic); err != nil {
+			f.cancel()
+			return nil, err
+		}
+		return f, nil
+	}
+	r.mu.Lock()
+	r.patterns[f] = struct{}{}
+	r.mu.Unlock()
+	for _, info := range r.bus.Topics() {
+		if match(info.Name) {
+			_ = f.attach(info.Name)
+		}
+	}
+	return f, nil
+}
+
+// Attach subscribes the pattern feeds matching topic.
+func (r *Registry) Attach(topic string) {
+	r.mu.Lock()
+	var feeds []*Feed
+	for f := range r.patterns {
+		if f.match(topic) {
+			feeds = append(feeds, f)
+		}
+	}
+	r.mu.Unlock()
+	for _, f := range feeds {
+		_ = f.attach(topic)
+	}
+}
+
+// Refresh attaches the topics of the bus to the pattern feeds.
+func (r *Registry) Refresh() {
+	r.mu.Lock()
+	idle := len(r.patterns) == 0
+	r.mu.Unlock()
+	if idle {
+		return
+	}
+	for _, info := range r.bus.Topics() {
+		r.Attach(info.Name)
+	}
+}
+
+// RefreshEvery calls Refresh every interval until the Registry context is done.
+func (r *Registry) RefreshEvery(interval time.Duration) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+				r.Refresh()
+			}
+		}
+	}()
+}
+
+// Release closes f in the background, it can be called by deliver.
+func (r *Registry) Release(f *Feed) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f.Close()
+	}()
+}
+
+// Wait waits for the refresh and the feeds released.
+func (r *Registry) Wait() {
+	r.wg.Wait()
+}
+
+// attach subscribes the topic unless already done
+func (f *Feed) attach(topic string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[topic]; ok || f.ctx.Err() != nil {
+		return nil
+	}
+	sub, err := f.registry.bus.Subscribe(f.ctx, topic, f.registry.opts...)
+	if err != nil {
+		return err
+	}
+	f.subs[topic] = sub
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for msg := range sub.Read() {
+			f.deliver(msg)
+		}
+		// the topic was deleted: a pattern feed attaches it again if it comes back
+		f.mu.Lock()
+		if f.subs[topic] == sub {
+			delete(f.subs, topic)
+		}
+		f.mu.Unlock()
+	}()
+	return nil
+}
+
+// Close ends the subscriptions of f and waits for the deliveries in progress,
+// it must not be called by deliver (see Release).
+func (f *Feed) Close() {
+	f.registry.mu.Lock()
+	delete(f.registry.patterns, f)
+	f.registry.mu.Unlock()
+	f.cancel()
+	f.wg.Wait()
+}
@@ -0,0 +1,41 @@
+package thebus
+
+import "time"
+
+// runJanitor deletes the idle topics every JanitorInterval until the bus is closed.
+func (b *bus) runJanitor(interval time.Duration) {
+	ticker := b.cfg.Clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case now := <-ticker.C():
+			b.sweepIdleTopics(now)
+		}
+	}
+}
+
+// sweepIdleTopics deletes the topics without subscribers nor queued messages
+// whose last activity is older than their IdleTTL.
+func (b *bus) sweepIdleTopics(now time.Time) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	deleted := 0
+	for topic, st := range b.subscriptions {
+		ttl := st.cfg.IdleTTL
+		if ttl <= 0 || len(st.subs) > 0 || len(st.inQueue) > 0 {
+			continue
+		}
+		if now.Sub(time.Unix(0, st.lastActivity.Load())) < ttl {
+			continue
+		}
+		if st.closed.CompareAndSwap(false, true) {
+			close(st.inQueue)
+		}
+		delete(b.subscriptions, topic)
+		deleted++
+		b.cfg.Logger.Debug("thebus: idle topic deleted", "topic", topic)
+	}
+	return deleted
+}
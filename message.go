@@ -1,27 +1,37 @@
 package thebus
 
-import "time"
+import (
+	"maps"
+	"time"
+)
 
 // Message represents a message delivered to a subscriber.
 type Message struct {
+	ID        string // only set for the messages published with PublishConfirm
 	Topic     string
 	Timestamp time.Time
 	Payload   []byte
 	Seq       uint64
+	Headers   map[string]string // see WithHeaders
 }
 
 type messageRef struct {
+	id      string
 	topic   string
 	ts      time.Time
 	seq     uint64
 	payload []byte
+	headers map[string]string
+	confirm *Confirmation
 }
 
 func makeMessage(topic string, mr messageRef, sub *subscription) Message {
 	msg := Message{
+		ID:        mr.id,
 		Topic:     topic,
 		Timestamp: mr.ts,
 		Seq:       mr.seq,
+		Headers:   mr.headers,
 	}
 	if sub.cfg.Strategy == SubscriptionStrategyPayloadShared {
 		msg.Payload = mr.payload
@@ -29,6 +39,7 @@ func makeMessage(topic string, mr messageRef, sub *subscription) Message {
 		buf := make([]byte, len(mr.payload))
 		copy(buf, mr.payload)
 		msg.Payload = buf
+		msg.Headers = maps.Clone(mr.headers)
 	}
 	return msg
 }
@@ -1,6 +1,8 @@
 package thebus
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -61,3 +63,28 @@ func TestMakeMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestRecord(t *testing.T) {
+	msg := Message{
+		ID:        "id",
+		Topic:     "orders",
+		Timestamp: time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC),
+		Payload:   []byte("hello"),
+		Seq:       1,
+		Headers:   map[string]string{"k": "v"},
+	}
+	data, err := json.Marshal(MakeRecord(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"topic":"orders","seq":1,"id":"id","ts":"2025-01-02T15:04:05Z","headers":{"k":"v"},"payload":"aGVsbG8="}`; string(data) != want {
+		t.Fatalf("unexpected JSON: %s", data)
+	}
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.Message(); !reflect.DeepEqual(got, msg) {
+		t.Fatalf("unexpected message: %+v", got)
+	}
+}
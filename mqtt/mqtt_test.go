@@ -0,0 +1,389 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func newServer(t *testing.T, opts ...Option) (thebus.Bus, string) {
+	t.Helper()
+	bus, err := thebus.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(bus, opts...)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		_ = bus.Close()
+	})
+	return bus, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+// connectBody returns a CONNECT body, with a will when willTopic is set
+func connectBody(level, flags byte, clientID, willTopic, willPayload string) []byte {
+	body := appendString(nil, "MQTT")
+	if willTopic != "" {
+		flags |= 0x04
+	}
+	body = append(body, level, flags, 0, 0) // no keep alive
+	body = appendString(body, clientID)
+	if willTopic != "" {
+		body = appendString(body, willTopic)
+		body = appendString(body, willPayload)
+	}
+	return body
+}
+
+func connect(t *testing.T, addr, clientID string) *client {
+	t.Helper()
+	c := dial(t, addr)
+	c.send(packetConnect, 0, connectBody(protocolLevel, 0x02, clientID, "", ""))
+	if p := c.read(); p.typ != packetConnack || p.body[1] != connackAccepted {
+		t.Fatalf("unexpected CONNACK: %+v", p)
+	}
+	return c
+}
+
+func (c *client) send(typ, flags byte, body []byte) {
+	c.t.Helper()
+	if err := writePacket(c.w, typ, flags, body); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+func (c *client) read() packet {
+	c.t.Helper()
+	p, err := readPacket(c.r, 1<<20)
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return p
+}
+
+func (c *client) subscribe(id uint16, filters map[string]byte) []byte {
+	c.t.Helper()
+	body := binary.BigEndian.AppendUint16(nil, id)
+	for filter, qos := range filters {
+		body = append(appendString(body, filter), qos)
+	}
+	c.send(packetSubscribe, 0x02, body)
+	p := c.read()
+	if p.typ != packetSuback || binary.BigEndian.Uint16(p.body) != id {
+		c.t.Fatalf("unexpected SUBACK: %+v", p)
+	}
+	return p.body[2:]
+}
+
+func (c *client) publish(topic, payload string, qos byte, retain bool, id uint16) {
+	c.t.Helper()
+	body := appendString(nil, topic)
+	if qos > 0 {
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	c.send(packetPublish, flags, append(body, payload...))
+	if qos > 0 {
+		if p := c.read(); p.typ != packetPuback || binary.BigEndian.Uint16(p.body) != id {
+			c.t.Fatalf("unexpected PUBACK: %+v", p)
+		}
+	}
+}
+
+type received struct {
+	topic, payload string
+	qos            byte
+	retain         bool
+	id             uint16
+}
+
+func (c *client) receive() received {
+	c.t.Helper()
+	p := c.read()
+	if p.typ != packetPublish {
+		c.t.Fatalf("expected PUBLISH, got %+v", p)
+	}
+	return decodePublish(p)
+}
+
+func decodePublish(p packet) received {
+	r := &bodyReader{buf: p.body}
+	m := received{topic: r.string(), qos: (p.flags >> 1) & 0x03, retain: p.flags&0x01 != 0}
+	if m.qos > 0 {
+		m.id = r.uint16()
+	}
+	m.payload = string(r.rest())
+	return m
+}
+
+// sync waits for the previous packets to be processed
+func (c *client) sync() {
+	c.t.Helper()
+	c.send(packetPingreq, 0, nil)
+	if p := c.read(); p.typ != packetPingresp {
+		c.t.Fatalf("expected PINGRESP, got %+v", p)
+	}
+}
+
+// waitSubscribers waits for n subscribers on topic
+func waitSubscribers(t *testing.T, bus thebus.Bus, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		stats, _ := bus.Stats()
+		if stats.PerTopic[topic].Subscribers == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscribers on %s", n, topic)
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+/+", "/b", true},
+		{"#", "$SYS/x", false},
+		{"+/x", "$SYS/x", false},
+		{"$SYS/#", "$SYS/x", true},
+	}
+	for _, tt := range tests {
+		if got := matchTopic(tt.filter, tt.topic); got != tt.match {
+			t.Errorf("matchTopic(%q, %q) = %v", tt.filter, tt.topic, got)
+		}
+	}
+	for filter, valid := range map[string]bool{"a/#": true, "#": true, "+/a/+": true, "a/#/b": false, "a+/b": false, "": false} {
+		if validFilter(filter) != valid {
+			t.Errorf("validFilter(%q) != %v", filter, valid)
+		}
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	bus, addr := newServer(t)
+	c := connect(t, addr, "c1")
+
+	if codes := c.subscribe(1, map[string]byte{"a/b": 0}); len(codes) != 1 || codes[0] != 0 {
+		t.Fatalf("unexpected codes: %v", codes)
+	}
+	if _, err := bus.Publish("a/b", []byte("in-process")); err != nil {
+		t.Fatal(err)
+	}
+	if m := c.receive(); m.topic != "a/b" || m.payload != "in-process" || m.qos != 0 {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+
+	sub, err := bus.Subscribe(t.Context(), "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the PUBACK and the echo through the bus fan-out come in any order
+	c.send(packetPublish, 1<<1, append(binary.BigEndian.AppendUint16(appendString(nil, "a/b"), 10), "qos1"...))
+	for range 2 {
+		switch p := c.read(); p.typ {
+		case packetPuback:
+			if binary.BigEndian.Uint16(p.body) != 10 {
+				t.Fatalf("unexpected PUBACK: %+v", p)
+			}
+		case packetPublish:
+			if m := decodePublish(p); m.payload != "qos1" || m.qos != 0 {
+				t.Fatalf("unexpected message: %+v", m)
+			}
+		default:
+			t.Fatalf("unexpected packet: %+v", p)
+		}
+	}
+	select {
+	case msg := <-sub.Read():
+		if msg.Headers[HeaderQoS] != "1" || string(msg.Payload) != "qos1" {
+			t.Fatalf("unexpected bus message: %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no bus message")
+	}
+
+	c.send(packetUnsubscribe, 0x02, appendString(binary.BigEndian.AppendUint16(nil, 2), "a/b"))
+	if p := c.read(); p.typ != packetUnsuback || binary.BigEndian.Uint16(p.body) != 2 {
+		t.Fatalf("unexpected UNSUBACK: %+v", p)
+	}
+	waitSubscribers(t, bus, "a/b", 1)
+}
+
+func TestQoS1Inflight(t *testing.T) {
+	bus, addr := newServer(t, WithMaxInflight(1))
+	c := connect(t, addr, "c1")
+	if codes := c.subscribe(1, map[string]byte{"q": 2}); codes[0] != 1 {
+		t.Fatalf("expected QoS 1 granted, got %v", codes)
+	}
+	_, _ = bus.Publish("q", []byte("1"))
+	_, _ = bus.Publish("q", []byte("2"))
+
+	first := c.receive()
+	if first.qos != 1 || first.id == 0 || first.payload != "1" {
+		t.Fatalf("unexpected message: %+v", first)
+	}
+	// the window is full until PUBACK
+	_ = c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := readPacket(c.r, 1<<20); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected no packet, got %v", err)
+	}
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	c.send(packetPuback, 0, binary.BigEndian.AppendUint16(nil, first.id))
+	if m := c.receive(); m.payload != "2" || m.id == first.id {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	bus, addr := newServer(t, WithTopicRefresh(10*time.Millisecond))
+	c := connect(t, addr, "c1")
+	c.subscribe(1, map[string]byte{"sensors/+/temp": 0})
+	c.subscribe(2, map[string]byte{"sensors/#": 0})
+
+	p := connect(t, addr, "p1")
+	p.publish("sensors/k1/temp", "21", 0, false, 0)
+	p.sync()
+	for range 2 {
+		if m := c.receive(); m.topic != "sensors/k1/temp" || m.payload != "21" {
+			t.Fatalf("unexpected message: %+v", m)
+		}
+	}
+
+	// a topic created in-process, found by the refresh
+	if err := bus.DeclareTopic("sensors/k2/hum", thebus.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitSubscribers(t, bus, "sensors/k2/hum", 1)
+	_, _ = bus.Publish("sensors/k2/hum", []byte("40"))
+	if m := c.receive(); m.topic != "sensors/k2/hum" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+}
+
+func TestRetained(t *testing.T) {
+	_, addr := newServer(t)
+	p := connect(t, addr, "p1")
+	p.publish("cfg/a", "v1", 1, true, 1)
+	p.publish("cfg/b", "v2", 0, true, 0)
+	p.sync()
+
+	c := connect(t, addr, "c1")
+	c.subscribe(1, map[string]byte{"cfg/#": 1})
+	got := map[string]received{}
+	for range 2 {
+		m := c.receive()
+		got[m.topic] = m
+	}
+	if m := got["cfg/a"]; !m.retain || m.payload != "v1" || m.qos != 1 {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	if m := got["cfg/b"]; !m.retain || m.payload != "v2" || m.qos != 0 {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+
+	// a live message is not flagged retained, an empty one clears the topic
+	p.publish("cfg/a", "", 0, true, 0)
+	if m := c.receive(); m.retain || m.payload != "" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	other := connect(t, addr, "c2")
+	other.subscribe(1, map[string]byte{"cfg/a": 0})
+	other.sync()
+}
+
+func TestWill(t *testing.T) {
+	_, addr := newServer(t)
+	c := connect(t, addr, "watcher")
+	c.subscribe(1, map[string]byte{"status/+": 0})
+
+	for _, graceful := range []bool{true, false} {
+		// distinct client IDs: a takeover could close the first connection before its DISCONNECT is read
+		device := dial(t, addr)
+		device.send(packetConnect, 0, connectBody(protocolLevel, 0x02, "device-"+strconv.FormatBool(graceful), "status/device", "offline"))
+		device.read()
+		device.sync()
+		if graceful {
+			device.send(packetDisconnect, 0, nil)
+		}
+		_ = device.conn.Close()
+	}
+	// only the abrupt close publishes the will
+	if m := c.receive(); m.topic != "status/device" || m.payload != "offline" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	c.sync()
+}
+
+func TestConnect(t *testing.T) {
+	_, addr := newServer(t)
+
+	c := dial(t, addr)
+	c.send(packetConnect, 0, connectBody(3, 0x02, "old", "", ""))
+	if p := c.read(); p.typ != packetConnack || p.body[1] != connackUnacceptableProtocol {
+		t.Fatalf("unexpected CONNACK: %+v", p)
+	}
+
+	c = dial(t, addr)
+	c.send(packetConnect, 0, connectBody(protocolLevel, 0, "", "", ""))
+	if p := c.read(); p.typ != packetConnack || p.body[1] != connackIdentifierRejected {
+		t.Fatalf("unexpected CONNACK: %+v", p)
+	}
+
+	// a second connection with the same client ID takes over
+	first := connect(t, addr, "same")
+	connect(t, addr, "same")
+	if _, err := readPacket(first.r, 1<<20); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the first connection closed, got %v", err)
+	}
+
+	// a packet before CONNECT closes the connection
+	c = dial(t, addr)
+	c.send(packetPingreq, 0, nil)
+	if _, err := readPacket(c.r, 1<<20); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the connection closed, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	packetConnect     byte = 1
+	packetConnack     byte = 2
+	packetPublish     byte = 3
+	packetPuback      byte = 4
+	packetSubscribe   byte = 8
+	packetSuback      byte = 9
+	packetUnsubscribe byte = 10
+	packetUnsuback    byte = 11
+	packetPingreq     byte = 12
+	packetPingresp    byte = 13
+	packetDisconnect  byte = 14
+)
+
+// CONNACK and SUBACK return codes
+const (
+	connackAccepted             byte = 0
+	connackUnacceptableProtocol byte = 1
+	connackIdentifierRejected   byte = 2
+	subackFailure               byte = 0x80
+)
+
+const (
+	protocolLevel        byte = 4 // MQTT 3.1.1
+	maxRemainingLengthSz      = 4 // bytes of the remaining length
+)
+
+var (
+	errMalformed = errors.New("mqtt: malformed packet")
+	errTooBig    = errors.New("mqtt: packet too big")
+)
+
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader, maxSize int) (packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == maxRemainingLengthSz {
+			return packet{}, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxSize {
+		return packet{}, errTooBig
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{typ: first >> 4, flags: first & 0x0f, body: body}, nil
+}
+
+func writePacket(w *bufio.Writer, typ, flags byte, body []byte) error {
+	header := []byte{typ<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		header = append(header, b)
+		if length == 0 {
+			break
+		}
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// bodyReader reads a packet body, the first error is kept in err.
+type bodyReader struct {
+	buf []byte
+	err error
+}
+
+func (r *bodyReader) fail() {
+	if r.err == nil {
+		r.err = errMalformed
+	}
+	r.buf = nil
+}
+
+func (r *bodyReader) byte() byte {
+	if len(r.buf) < 1 {
+		r.fail()
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *bodyReader) uint16() uint16 {
+	if len(r.buf) < 2 {
+		r.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.buf)
+	r.buf = r.buf[2:]
+	return v
+}
+
+func (r *bodyReader) bytes() []byte {
+	n := int(r.uint16())
+	if n > len(r.buf) {
+		r.fail()
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *bodyReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *bodyReader) rest() []byte {
+	b := r.buf
+	r.buf = nil
+	return b
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
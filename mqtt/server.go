@@ -0,0 +1,699 @@
+// Package mqtt is an MQTT 3.1.1 broker front-end of a bus, for the MQTT
+// clients (IoT devices, simulators) of the tests and the development setups.
+//
+// The MQTT topic names are the bus topics. CONNECT, PUBLISH (QoS 0 and 1),
+// PUBACK, SUBSCRIBE, UNSUBSCRIBE, PINGREQ, DISCONNECT, the retained messages
+// and the last will are supported. The sessions are not persisted (a client
+// asking for a persistent session gets a clean one) and QoS 2 is not
+// supported: it is granted as QoS 1 and a QoS 2 PUBLISH closes the connection.
+//
+// The bus has no wildcard subscription: a "+" or "#" filter subscribes the
+// matching topics existing at SUBSCRIBE time, the ones published through this
+// broker, and the ones found every WithTopicRefresh interval.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sebundefined/thebus"
+	"github.com/sebundefined/thebus/internal/topicfeed"
+)
+
+const (
+	DefaultMaxPacketSize  = 1 << 20
+	DefaultMaxInflight    = 64
+	DefaultTopicRefresh   = time.Second
+	DefaultWriteTimeout   = 10 * time.Second
+	DefaultConnectTimeout = 10 * time.Second
+
+	// HeaderQoS carries the QoS of the messages published by the MQTT clients.
+	// The messages without it (published in-process) are delivered with the
+	// QoS granted to the subscription.
+	HeaderQoS = "Mqtt-Qos"
+)
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+type config struct {
+	maxPacketSize  int
+	maxInflight    int
+	topicRefresh   time.Duration
+	writeTimeout   time.Duration
+	connectTimeout time.Duration
+	subscribeOpts  []thebus.SubscribeOption
+	logger         thebus.Logger
+}
+
+// Option configures the Server.
+type Option func(cfg *config)
+
+// WithMaxPacketSize limits the size of the packets sent by the clients,
+// a client sending a bigger packet is disconnected.
+func WithMaxPacketSize(size int) Option {
+	return func(cfg *config) {
+		cfg.maxPacketSize = size
+	}
+}
+
+// WithMaxInflight limits the QoS 1 messages sent to a client and not yet
+// acknowledged. Above, the messages wait in the bus subscription, where its
+// overflow policy applies (see WithSubscribeOptions).
+func WithMaxInflight(max int) Option {
+	return func(cfg *config) {
+		cfg.maxInflight = max
+	}
+}
+
+// WithTopicRefresh sets the interval of the lookup of the new topics for the
+// wildcard subscriptions (0 = off).
+func WithTopicRefresh(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.topicRefresh = interval
+	}
+}
+
+// WithWriteTimeout sets the deadline of a write to a client, the client is disconnected above.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.writeTimeout = timeout
+	}
+}
+
+// WithConnectTimeout sets the delay given to a new connection to send CONNECT.
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.connectTimeout = timeout
+	}
+}
+
+// WithSubscribeOptions sets the options of the bus subscriptions made for the
+// clients (buffer size, overflow policy...).
+func WithSubscribeOptions(opts ...thebus.SubscribeOption) Option {
+	return func(cfg *config) {
+		cfg.subscribeOpts = append(cfg.subscribeOpts, opts...)
+	}
+}
+
+// WithLogger logs the protocol errors of the clients.
+func WithLogger(logger thebus.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
+
+// ##############################################################################
+// ################################   SERVER   ##################################
+// ##############################################################################
+
+// Server is an MQTT broker whose topics live in a bus.
+type Server struct {
+	bus thebus.Bus
+	cfg config
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	feeds  *topicfeed.Registry
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	clients   map[string]*conn // by client ID
+	retained  map[string]message
+}
+
+// message is a retained message or a last will
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+// NewServer returns an MQTT broker of bus.
+func NewServer(bus thebus.Bus, opts ...Option) *Server {
+	s := &Server{
+		bus: bus,
+		cfg: config{
+			maxPacketSize:  DefaultMaxPacketSize,
+			maxInflight:    DefaultMaxInflight,
+			topicRefresh:   DefaultTopicRefresh,
+			writeTimeout:   DefaultWriteTimeout,
+			connectTimeout: DefaultConnectTimeout,
+			logger:         thebus.NoopLogger(),
+		},
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*conn]struct{}),
+		clients:   make(map[string]*conn),
+		retained:  make(map[string]message),
+	}
+	for _, opt := range opts {
+		opt(&s.cfg)
+	}
+	if s.cfg.maxInflight < 1 {
+		s.cfg.maxInflight = 1
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.feeds = topicfeed.NewRegistry(s.ctx, bus, s.cfg.subscribeOpts...)
+	if s.cfg.topicRefresh > 0 {
+		s.feeds.RefreshEvery(s.cfg.topicRefresh)
+	}
+	return s
+}
+
+// ListenAndServe listens on the TCP address, then calls Serve.
+func (s *Server) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts the connections of l until Close. It returns nil after Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return thebus.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = netConn.Close()
+			return nil
+		}
+		c := &conn{
+			server:   s,
+			netConn:  netConn,
+			reader:   bufio.NewReader(netConn),
+			writer:   bufio.NewWriter(netConn),
+			subs:     make(map[string]*subscription),
+			inflight: make(chan struct{}, s.cfg.maxInflight),
+			pending:  make(map[uint16]struct{}),
+			done:     make(chan struct{}),
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close closes the listeners, the connections and their subscriptions.
+// The bus itself is not closed.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	for c := range s.conns {
+		_ = c.netConn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.feeds.Wait()
+	return nil
+}
+
+// publish stores the retained message and publishes it on the bus.
+func (s *Server) publish(msg message) error {
+	if msg.retain {
+		s.mu.Lock()
+		if len(msg.payload) == 0 {
+			delete(s.retained, msg.topic)
+		} else {
+			s.retained[msg.topic] = msg
+		}
+		s.mu.Unlock()
+	}
+	s.feeds.Attach(msg.topic)
+	_, err := s.bus.Publish(msg.topic, msg.payload, thebus.WithHeader(HeaderQoS, strconv.Itoa(int(msg.qos))))
+	return err
+}
+
+// retainedMatching returns the retained messages matching filter
+func (s *Server) retainedMatching(filter string) []message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matching []message
+	for topic, msg := range s.retained {
+		if matchTopic(filter, topic) {
+			matching = append(matching, msg)
+		}
+	}
+	return matching
+}
+
+// register makes c the connection of its client ID, the previous one is closed.
+func (s *Server) register(c *conn) {
+	s.mu.Lock()
+	previous := s.clients[c.clientID]
+	s.clients[c.clientID] = c
+	s.mu.Unlock()
+	if previous != nil {
+		_ = previous.netConn.Close()
+	}
+}
+
+func (s *Server) unregister(c *conn) {
+	s.mu.Lock()
+	if s.clients[c.clientID] == c {
+		delete(s.clients, c.clientID)
+	}
+	s.mu.Unlock()
+}
+
+// ##############################################################################
+// ###############################   CONNECTION   ###############################
+// ##############################################################################
+
+type conn struct {
+	server   *Server
+	netConn  net.Conn
+	reader   *bufio.Reader
+	clientID string
+	will     *message
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	// QoS 1 window, see WithMaxInflight
+	inflight  chan struct{}
+	pendingMu sync.Mutex
+	pending   map[uint16]struct{}
+	packetID  atomic.Uint32
+
+	mu   sync.Mutex
+	subs map[string]*subscription // by filter
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type subscription struct {
+	filter string
+	qos    byte
+	feed   *topicfeed.Feed
+}
+
+// errProtocol closes the connection without answer, as required by the spec.
+var errProtocol = errors.New("mqtt: protocol violation")
+
+func (c *conn) serve() {
+	graceful := false
+	defer func() {
+		close(c.done)
+		_ = c.netConn.Close()
+		c.wg.Wait()
+		c.mu.Lock()
+		for filter, sub := range c.subs {
+			delete(c.subs, filter)
+			c.server.feeds.Release(sub.feed)
+		}
+		c.mu.Unlock()
+		if c.clientID == "" {
+			return
+		}
+		c.server.unregister(c)
+		if !graceful && c.will != nil {
+			_ = c.server.publish(*c.will)
+		}
+	}()
+	keepAlive, err := c.connect()
+	if err != nil {
+		c.server.cfg.logger.Warn("mqtt: connect refused", "remote", c.netConn.RemoteAddr().String(), "err", err)
+		return
+	}
+	for {
+		if keepAlive > 0 {
+			_ = c.netConn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+		p, err := readPacket(c.reader, c.server.cfg.maxPacketSize)
+		if err != nil {
+			if errors.Is(err, errMalformed) || errors.Is(err, errTooBig) {
+				c.server.cfg.logger.Warn("mqtt: closing connection", "client", c.clientID, "err", err)
+			}
+			return
+		}
+		if p.typ == packetDisconnect {
+			graceful = true
+			return
+		}
+		if err := c.handle(p); err != nil {
+			c.server.cfg.logger.Warn("mqtt: closing connection", "client", c.clientID, "err", err)
+			return
+		}
+	}
+}
+
+// connect reads the CONNECT packet and answers CONNACK, it returns the keep alive
+func (c *conn) connect() (time.Duration, error) {
+	if c.server.cfg.connectTimeout > 0 {
+		_ = c.netConn.SetReadDeadline(time.Now().Add(c.server.cfg.connectTimeout))
+	}
+	p, err := readPacket(c.reader, c.server.cfg.maxPacketSize)
+	if err != nil {
+		return 0, err
+	}
+	if p.typ != packetConnect {
+		return 0, errProtocol
+	}
+	r := &bodyReader{buf: p.body}
+	name, level, flags, keepAlive := r.string(), r.byte(), r.byte(), r.uint16()
+	if r.err != nil || name != "MQTT" || flags&0x01 != 0 {
+		return 0, errProtocol
+	}
+	if level != protocolLevel {
+		_ = c.connack(connackUnacceptableProtocol)
+		return 0, fmt.Errorf("unsupported protocol level %d", level)
+	}
+	clientID := r.string()
+	if flags&0x04 != 0 {
+		c.will = &message{
+			topic:   r.string(),
+			payload: r.bytes(),
+			qos:     min((flags>>3)&0x03, 1),
+			retain:  flags&0x20 != 0,
+		}
+	}
+	// the username and password are not checked
+	if r.err != nil {
+		return 0, r.err
+	}
+	cleanSession := flags&0x02 != 0
+	if clientID == "" {
+		if !cleanSession {
+			_ = c.connack(connackIdentifierRejected)
+			return 0, errors.New("empty client identifier without clean session")
+		}
+		clientID = "thebus-" + thebus.DefaultIDGenerator()
+	}
+	c.clientID = clientID
+	c.server.register(c)
+	_ = c.netConn.SetReadDeadline(time.Time{})
+	return time.Duration(keepAlive) * time.Second, c.connack(connackAccepted)
+}
+
+func (c *conn) handle(p packet) error {
+	r := &bodyReader{buf: p.body}
+	switch p.typ {
+	case packetPublish:
+		qos, retain := (p.flags>>1)&0x03, p.flags&0x01 != 0
+		topic := r.string()
+		var id uint16
+		if qos > 0 {
+			id = r.uint16()
+		}
+		payload := r.rest()
+		if r.err != nil {
+			return r.err
+		}
+		if qos > 1 {
+			return fmt.Errorf("unsupported QoS %d", qos)
+		}
+		if !validTopic(topic) {
+			return fmt.Errorf("invalid topic name %q", topic)
+		}
+		err := c.server.publish(message{topic: topic, payload: payload, qos: qos, retain: retain})
+		if qos == 0 {
+			return nil
+		}
+		if err != nil {
+			// the message cannot be acknowledged
+			return err
+		}
+		return c.write(packetPuback, 0, binary.BigEndian.AppendUint16(nil, id))
+	case packetPuback:
+		id := r.uint16()
+		if r.err != nil {
+			return r.err
+		}
+		c.pendingMu.Lock()
+		_, ok := c.pending[id]
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+		if ok {
+			<-c.inflight
+		}
+		return nil
+	case packetSubscribe:
+		if p.flags != 0x02 {
+			return errProtocol
+		}
+		return c.subscribe(r)
+	case packetUnsubscribe:
+		if p.flags != 0x02 {
+			return errProtocol
+		}
+		id := r.uint16()
+		for r.err == nil && len(r.buf) > 0 {
+			c.unsubscribe(r.string())
+		}
+		if r.err != nil {
+			return r.err
+		}
+		return c.write(packetUnsuback, 0, binary.BigEndian.AppendUint16(nil, id))
+	case packetPingreq:
+		return c.write(packetPingresp, 0, nil)
+	default:
+		return errProtocol
+	}
+}
+
+func (c *conn) subscribe(r *bodyReader) error {
+	id := r.uint16()
+	var filters []string
+	var codes []byte
+	for r.err == nil && len(r.buf) > 0 {
+		filter, requested := r.string(), r.byte()
+		if r.err != nil || requested > 2 {
+			return errMalformed
+		}
+		granted := min(requested, 1)
+		if !validFilter(filter) {
+			granted = subackFailure
+		} else if err := c.addSubscription(filter, granted); err != nil {
+			c.server.cfg.logger.Warn("mqtt: subscribe failed", "client", c.clientID, "filter", filter, "err", err)
+			granted = subackFailure
+		}
+		filters = append(filters, filter)
+		codes = append(codes, granted)
+	}
+	if r.err != nil || len(filters) == 0 {
+		return errMalformed
+	}
+	if err := c.write(packetSuback, 0, append(binary.BigEndian.AppendUint16(nil, id), codes...)); err != nil {
+		return err
+	}
+	// the retained messages are sent after SUBACK, not by the reader: the QoS 1
+	// ones can wait for the PUBACK of the previous ones
+	var retained []message
+	for i, filter := range filters {
+		if codes[i] == subackFailure {
+			continue
+		}
+		for _, msg := range c.server.retainedMatching(filter) {
+			msg.qos = min(msg.qos, codes[i])
+			retained = append(retained, msg)
+		}
+	}
+	if len(retained) > 0 {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for _, msg := range retained {
+				if err := c.sendPublish(msg.topic, msg.payload, msg.qos, true); err != nil {
+					_ = c.netConn.Close()
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// addSubscription subscribes filter, replacing the subscription with the same filter
+func (c *conn) addSubscription(filter string, qos byte) error {
+	sub := &subscription{filter: filter, qos: qos}
+	var match func(topic string) bool
+	if isWildcard(filter) {
+		match = func(topic string) bool {
+			return matchTopic(filter, topic)
+		}
+	}
+	feed, err := c.server.feeds.Subscribe(filter, match, func(msg thebus.Message) {
+		qos := sub.qos
+		if h, ok := msg.Headers[HeaderQoS]; ok && h == "0" {
+			qos = 0
+		}
+		if err := c.sendPublish(msg.Topic, msg.Payload, qos, false); err != nil {
+			_ = c.netConn.Close()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sub.feed = feed
+	c.mu.Lock()
+	previous := c.subs[filter]
+	c.subs[filter] = sub
+	c.mu.Unlock()
+	if previous != nil {
+		c.server.feeds.Release(previous.feed)
+	}
+	return nil
+}
+
+func (c *conn) unsubscribe(filter string) {
+	c.mu.Lock()
+	sub, ok := c.subs[filter]
+	delete(c.subs, filter)
+	c.mu.Unlock()
+	if ok {
+		c.server.feeds.Release(sub.feed)
+	}
+}
+
+// ##############################################################################
+// ################################   WRITES   ##################################
+// ##############################################################################
+
+func (c *conn) connack(code byte) error {
+	return c.write(packetConnack, 0, []byte{0, code})
+}
+
+// sendPublish sends a PUBLISH, a QoS 1 one waits for room in the inflight window.
+func (c *conn) sendPublish(topic string, payload []byte, qos byte, retain bool) error {
+	body := appendString(nil, topic)
+	if qos > 0 {
+		select {
+		case c.inflight <- struct{}{}:
+		case <-c.done:
+			return net.ErrClosed
+		}
+		body = binary.BigEndian.AppendUint16(body, c.nextPacketID())
+	}
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	return c.write(packetPublish, flags, append(body, payload...))
+}
+
+// nextPacketID returns a non zero packet ID not in use, and marks it pending
+func (c *conn) nextPacketID() uint16 {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for {
+		id := uint16(c.packetID.Add(1))
+		if _, used := c.pending[id]; id != 0 && !used {
+			c.pending[id] = struct{}{}
+			return id
+		}
+	}
+}
+
+func (c *conn) write(typ, flags byte, body []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.server.cfg.writeTimeout > 0 {
+		_ = c.netConn.SetWriteDeadline(time.Now().Add(c.server.cfg.writeTimeout))
+	}
+	return writePacket(c.writer, typ, flags, body)
+}
+
+// ##############################################################################
+// #################################   TOPICS   #################################
+// ##############################################################################
+
+// validTopic checks a topic name: not empty and without wildcard
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// validFilter checks a topic filter: "+" is a whole level, "#" is the whole last level
+func validFilter(filter string) bool {
+	if filter == "" || strings.Contains(filter, "\x00") {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return false
+		case level != "#" && level != "+" && strings.ContainsAny(level, "+#"):
+			return false
+		}
+	}
+	return true
+}
+
+func isWildcard(filter string) bool {
+	return strings.ContainsAny(filter, "+#")
+}
+
+// matchTopic reports whether topic matches filter. The wildcards of the first
+// level do not match the topics starting with "$".
+func matchTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	fLevels, tLevels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range fLevels {
+		switch {
+		case level == "#":
+			// "a/#" matches "a" too
+			return true
+		case i >= len(tLevels):
+			return false
+		case level != "+" && level != tLevels[i]:
+			return false
+		}
+	}
+	return len(fLevels) == len(tLevels)
+}
@@ -0,0 +1,339 @@
+package nats
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type msg struct {
+	subject, sid, reply string
+	header, payload     string
+}
+
+func newServer(t *testing.T, opts ...Option) (thebus.Bus, string) {
+	t.Helper()
+	bus, err := thebus.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(bus, opts...)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		_ = bus.Close()
+	})
+	return bus, l.Addr().String()
+}
+
+func connect(t *testing.T, addr string, options string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	if line := c.line(); !strings.HasPrefix(line, "INFO {") || !strings.Contains(line, `"headers":true`) {
+		t.Fatalf("unexpected INFO: %q", line)
+	}
+	c.send("CONNECT " + options + "\r\n")
+	c.sync()
+	return c
+}
+
+func (c *client) send(s string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, s); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+func (c *client) line() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// sync waits for the previous operations to be processed
+func (c *client) sync() {
+	c.t.Helper()
+	c.send("PING\r\n")
+	line := c.line()
+	for line == "+OK" { // verbose
+		line = c.line()
+	}
+	if line != "PONG" {
+		c.t.Fatalf("expected PONG, got %q", line)
+	}
+}
+
+func (c *client) msg() msg {
+	c.t.Helper()
+	line := c.line()
+	args := strings.Fields(line)
+	var m msg
+	switch {
+	case len(args) >= 4 && args[0] == "MSG":
+		m = msg{subject: args[1], sid: args[2]}
+		if len(args) == 5 {
+			m.reply = args[3]
+		}
+		m.payload = c.read(args[len(args)-1])
+	case len(args) >= 5 && args[0] == "HMSG":
+		m = msg{subject: args[1], sid: args[2]}
+		if len(args) == 6 {
+			m.reply = args[3]
+		}
+		hdrLen, _ := strconv.Atoi(args[len(args)-2])
+		data := c.read(args[len(args)-1])
+		m.header, m.payload = data[:hdrLen], data[hdrLen:]
+	default:
+		c.t.Fatalf("expected a message, got %q", line)
+	}
+	return m
+}
+
+func (c *client) read(size string) string {
+	c.t.Helper()
+	n, _ := strconv.Atoi(size)
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return string(data[:n])
+}
+
+// waitSubscribers waits for n subscribers on topic
+func waitSubscribers(t *testing.T, bus thebus.Bus, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		stats, _ := bus.Stats()
+		if stats.PerTopic[topic].Subscribers == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscribers on %s", n, topic)
+}
+
+func TestPubSub(t *testing.T) {
+	bus, addr := newServer(t)
+	c := connect(t, addr, `{"verbose":false}`)
+
+	c.send("SUB foo 1\r\n")
+	c.send("PUB foo 5\r\nhello\r\n")
+	if m := c.msg(); m.subject != "foo" || m.sid != "1" || m.payload != "hello" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	if _, err := bus.Publish("foo", []byte("in-process")); err != nil {
+		t.Fatal(err)
+	}
+	if m := c.msg(); m.payload != "in-process" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+
+	c.send("UNSUB 1\r\n")
+	c.sync()
+	waitSubscribers(t, bus, "foo", 0)
+}
+
+func TestHeadersAndReply(t *testing.T) {
+	bus, addr := newServer(t)
+	c := connect(t, addr, `{"headers":true}`)
+	sub, err := bus.Subscribe(t.Context(), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.send("SUB svc 7\r\n")
+	header := "NATS/1.0\r\nK: v\r\n\r\n"
+	c.send("HPUB svc inbox.1 " + strconv.Itoa(len(header)) + " " + strconv.Itoa(len(header)+2) + "\r\n" + header + "hi\r\n")
+
+	m := c.msg()
+	if m.reply != "inbox.1" || m.header != header || m.payload != "hi" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	select {
+	case msg := <-sub.Read():
+		if msg.Headers["K"] != "v" || msg.Headers[HeaderReplyTo] != "inbox.1" || string(msg.Payload) != "hi" {
+			t.Fatalf("unexpected bus message: %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no bus message")
+	}
+
+	// without headers support, MSG only
+	plain := connect(t, addr, `{}`)
+	plain.send("SUB svc 1\r\n")
+	plain.sync()
+	c.send("HPUB svc " + strconv.Itoa(len(header)) + " " + strconv.Itoa(len(header)+2) + "\r\n" + header + "hi\r\n")
+	if m := plain.msg(); m.header != "" || m.payload != "hi" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	_, addr := newServer(t)
+	requester := connect(t, addr, `{}`)
+	responder := connect(t, addr, `{}`)
+
+	requester.send("SUB _INBOX.abc.* 1\r\n")
+	responder.send("SUB svc 1\r\n")
+	requester.sync()
+	responder.sync()
+
+	requester.send("PUB svc _INBOX.abc.1 4\r\nping\r\n")
+	m := responder.msg()
+	if m.reply != "_INBOX.abc.1" || m.payload != "ping" {
+		t.Fatalf("unexpected request: %+v", m)
+	}
+	responder.send("PUB " + m.reply + " 4\r\npong\r\n")
+	if m := requester.msg(); m.subject != "_INBOX.abc.1" || m.sid != "1" || m.payload != "pong" {
+		t.Fatalf("unexpected reply: %+v", m)
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	bus, addr := newServer(t, WithTopicRefresh(10*time.Millisecond))
+	if err := bus.DeclareTopic("orders.old", thebus.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c := connect(t, addr, `{}`)
+	c.send("SUB orders.* 1\r\n")
+	c.send("SUB > 2\r\n")
+	c.sync()
+
+	// an existing topic
+	_, _ = bus.Publish("orders.old", []byte("old"))
+	got := map[string]bool{}
+	for range 2 {
+		m := c.msg()
+		got[m.sid+" "+m.payload] = true
+	}
+	if !got["1 old"] || !got["2 old"] {
+		t.Fatalf("unexpected messages: %v", got)
+	}
+
+	// a topic published through the server
+	c.send("PUB orders.new 3\r\nnew\r\n")
+	got = map[string]bool{}
+	for range 2 {
+		m := c.msg()
+		got[m.sid+" "+m.payload] = true
+	}
+	if !got["1 new"] || !got["2 new"] {
+		t.Fatalf("unexpected messages: %v", got)
+	}
+
+	// a topic created in-process, found by the refresh
+	if err := bus.DeclareTopic("other.late", thebus.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitSubscribers(t, bus, "other.late", 1)
+	_, _ = bus.Publish("other.late", []byte("late"))
+	if m := c.msg(); m.sid != "2" || m.payload != "late" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+}
+
+func TestQueueGroup(t *testing.T) {
+	bus, addr := newServer(t)
+	a := connect(t, addr, `{}`)
+	b := connect(t, addr, `{}`)
+	a.send("SUB jobs workers 1\r\n")
+	b.send("SUB jobs workers 1\r\n")
+	a.sync()
+	b.sync()
+	waitSubscribers(t, bus, "jobs", 1)
+
+	for range 4 {
+		_, _ = bus.Publish("jobs", []byte("job"))
+	}
+	for _, c := range []*client{a, b} {
+		for range 2 {
+			if m := c.msg(); m.payload != "job" {
+				t.Fatalf("unexpected message: %+v", m)
+			}
+		}
+	}
+
+	a.send("UNSUB 1\r\n")
+	a.sync()
+	_, _ = bus.Publish("jobs", []byte("last"))
+	if m := b.msg(); m.payload != "last" {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+	b.send("UNSUB 1\r\n")
+	b.sync()
+	waitSubscribers(t, bus, "jobs", 0)
+}
+
+func TestUnsubMax(t *testing.T) {
+	bus, addr := newServer(t)
+	c := connect(t, addr, `{}`)
+	c.send("SUB foo 1\r\nUNSUB 1 2\r\n")
+	c.sync()
+	for range 3 {
+		_, _ = bus.Publish("foo", []byte("x"))
+	}
+	c.msg()
+	c.msg()
+	waitSubscribers(t, bus, "foo", 0)
+	c.sync() // no third message
+}
+
+func TestErrors(t *testing.T) {
+	_, addr := newServer(t, WithMaxPayload(8))
+	c := connect(t, addr, `{"verbose":true}`)
+
+	c.send("SUB a..b 1\r\n")
+	if line := c.line(); line != "-ERR 'Invalid Subject'" {
+		t.Fatalf("unexpected line: %q", line)
+	}
+	c.send("PUB a.* 1\r\nx\r\n")
+	if line := c.line(); line != "-ERR 'Invalid Publish Subject'" {
+		t.Fatalf("unexpected line: %q", line)
+	}
+	c.send("PUB $thebus.x 1\r\nx\r\n")
+	if line := c.line(); !strings.HasPrefix(line, "-ERR '"+thebus.ErrInvalidTopicNameReserved.Error()) {
+		t.Fatalf("unexpected line: %q", line)
+	}
+	c.send("PUB a 1\r\nx\r\n")
+	if line := c.line(); line != "+OK" {
+		t.Fatalf("expected +OK, got %q", line)
+	}
+	c.send("PUB a 9\r\n123456789\r\n")
+	if line := c.line(); line != "-ERR 'Maximum Payload Violation'" {
+		t.Fatalf("unexpected line: %q", line)
+	}
+	if _, err := c.r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+
+	other := connect(t, addr, `{}`)
+	other.send("NOPE\r\n")
+	if line := other.line(); line != "-ERR 'Unknown Protocol Operation'" {
+		t.Fatalf("unexpected line: %q", line)
+	}
+}
@@ -0,0 +1,683 @@
+// Package nats serves the core NATS text protocol on top of a bus, so that
+// the NATS clients and tools can talk to an in-process thebus in development
+// and tests.
+//
+// The subjects are the topics. The supported operations are INFO, CONNECT,
+// PUB, HPUB, SUB (with queue groups), UNSUB (with max messages), MSG, HMSG,
+// PING and PONG; there is no authentication, clustering or JetStream.
+//
+// The reply subject of a published message is carried by the HeaderReplyTo
+// header, multi-valued NATS headers keep their last value only.
+// The bus has no wildcard subscription: a wildcard SUB subscribes the
+// matching topics existing at SUB time, the ones published through this
+// server, and the ones found every WithTopicRefresh interval.
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sebundefined/thebus"
+	"github.com/sebundefined/thebus/internal/topicfeed"
+)
+
+const (
+	DefaultMaxPayload   = 1 << 20
+	DefaultTopicRefresh = time.Second
+	DefaultWriteTimeout = 10 * time.Second
+
+	// HeaderReplyTo carries the reply subject of the messages published by the NATS clients.
+	HeaderReplyTo = "Nats-Reply-To"
+
+	maxControlLine = 4096
+	serverVersion  = "2.10.0"
+)
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+type config struct {
+	name          string
+	maxPayload    int
+	topicRefresh  time.Duration
+	writeTimeout  time.Duration
+	subscribeOpts []thebus.SubscribeOption
+	logger        thebus.Logger
+}
+
+// Option configures the Server.
+type Option func(cfg *config)
+
+// WithServerName sets the server_name given in INFO.
+func WithServerName(name string) Option {
+	return func(cfg *config) {
+		cfg.name = name
+	}
+}
+
+// WithMaxPayload sets the max_payload given in INFO, a client publishing
+// a bigger message is disconnected.
+func WithMaxPayload(size int) Option {
+	return func(cfg *config) {
+		cfg.maxPayload = size
+	}
+}
+
+// WithTopicRefresh sets the interval of the lookup of the new topics for the
+// wildcard subscriptions (0 = off).
+func WithTopicRefresh(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.topicRefresh = interval
+	}
+}
+
+// WithWriteTimeout sets the deadline of a write to a client, the client is disconnected above.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.writeTimeout = timeout
+	}
+}
+
+// WithSubscribeOptions sets the options of the bus subscriptions made for the
+// clients (buffer size, overflow policy...).
+func WithSubscribeOptions(opts ...thebus.SubscribeOption) Option {
+	return func(cfg *config) {
+		cfg.subscribeOpts = append(cfg.subscribeOpts, opts...)
+	}
+}
+
+// WithLogger logs the protocol errors of the clients.
+func WithLogger(logger thebus.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
+
+// ##############################################################################
+// ################################   SERVER   ##################################
+// ##############################################################################
+
+// Server serves the NATS protocol on top of a bus.
+type Server struct {
+	bus thebus.Bus
+	cfg config
+	id  string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	closed    bool
+	nextID    uint64
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	groups    map[string]*group // by subject and queue
+
+	feeds *topicfeed.Registry
+}
+
+// NewServer returns a NATS Server of bus.
+func NewServer(bus thebus.Bus, opts ...Option) *Server {
+	s := &Server{
+		bus: bus,
+		cfg: config{
+			name:         "thebus",
+			maxPayload:   DefaultMaxPayload,
+			topicRefresh: DefaultTopicRefresh,
+			writeTimeout: DefaultWriteTimeout,
+			logger:       thebus.NoopLogger(),
+		},
+		id:        "THEBUS" + strings.ToUpper(thebus.DefaultIDGenerator()),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*conn]struct{}),
+		groups:    make(map[string]*group),
+	}
+	for _, opt := range opts {
+		opt(&s.cfg)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.feeds = topicfeed.NewRegistry(s.ctx, bus, s.cfg.subscribeOpts...)
+	if s.cfg.topicRefresh > 0 {
+		s.feeds.RefreshEvery(s.cfg.topicRefresh)
+	}
+	return s
+}
+
+// ListenAndServe listens on the TCP address, then calls Serve.
+func (s *Server) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts the connections of l until Close. It returns nil after Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return thebus.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = netConn.Close()
+			return nil
+		}
+		s.nextID++
+		c := &conn{
+			server:  s,
+			id:      s.nextID,
+			netConn: netConn,
+			reader:  bufio.NewReaderSize(netConn, maxControlLine),
+			writer:  bufio.NewWriter(netConn),
+			subs:    make(map[string]*subscription),
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close closes the listeners, the connections and their subscriptions.
+// The bus itself is not closed.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	for c := range s.conns {
+		_ = c.netConn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.feeds.Wait()
+	return nil
+}
+
+// ##############################################################################
+// ###############################   CONNECTION   ###############################
+// ##############################################################################
+
+type connectOptions struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Headers  bool   `json:"headers"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+}
+
+type info struct {
+	ServerID   string `json:"server_id"`
+	ServerName string `json:"server_name"`
+	Version    string `json:"version"`
+	Proto      int    `json:"proto"`
+	Go         string `json:"go"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	Headers    bool   `json:"headers"`
+	MaxPayload int    `json:"max_payload"`
+	ClientID   uint64 `json:"client_id"`
+	ClientIP   string `json:"client_ip,omitempty"`
+}
+
+type conn struct {
+	server  *Server
+	id      uint64
+	netConn net.Conn
+	reader  *bufio.Reader
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	verbose atomic.Bool
+	headers atomic.Bool
+
+	mu   sync.Mutex
+	subs map[string]*subscription // by sid
+}
+
+// subscription is a SUB of a client. A queue group member has no feed of its own.
+type subscription struct {
+	conn    *conn
+	sid     string
+	subject string
+	queue   string
+	feed    *topicfeed.Feed
+
+	max       atomic.Uint64 // see UNSUB
+	delivered atomic.Uint64
+	removed   atomic.Bool
+}
+
+func (c *conn) serve() {
+	defer func() {
+		_ = c.netConn.Close()
+		c.mu.Lock()
+		sids := make([]string, 0, len(c.subs))
+		for sid := range c.subs {
+			sids = append(sids, sid)
+		}
+		c.mu.Unlock()
+		for _, sid := range sids {
+			c.unsubscribe(sid)
+		}
+	}()
+	if err := c.sendInfo(); err != nil {
+		return
+	}
+	for {
+		line, err := c.reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			_ = c.sendErr("Maximum Control Line Exceeded")
+			return
+		}
+		if err != nil {
+			return
+		}
+		if err := c.handle(strings.TrimRight(string(line), "\r\n")); err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				c.server.cfg.logger.Warn("nats: closing connection", "client", c.id, "err", err)
+				_ = c.sendErr(string(perr))
+			}
+			return
+		}
+	}
+}
+
+// protocolError is a fatal error, sent in -ERR before closing the connection.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return string(e)
+}
+
+// clientError is sent in -ERR, then the connection goes on.
+type clientError string
+
+func (e clientError) Error() string {
+	return string(e)
+}
+
+// handle runs an operation and answers +OK (verbose) or -ERR
+func (c *conn) handle(line string) error {
+	switch trimmed := strings.TrimSpace(line); {
+	case trimmed == "":
+		return nil
+	case strings.EqualFold(trimmed, "PING"):
+		// answered by PONG only
+		return c.write([]byte("PONG\r\n"))
+	}
+	err := c.dispatch(line)
+	var cerr clientError
+	switch {
+	case errors.As(err, &cerr):
+		return c.sendErr(string(cerr))
+	case err != nil:
+		return err
+	default:
+		return c.ok()
+	}
+}
+
+func (c *conn) dispatch(line string) error {
+	op, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	args := strings.Fields(rest)
+	switch strings.ToUpper(op) {
+	case "PONG":
+	case "CONNECT":
+		var opts connectOptions
+		if err := json.Unmarshal([]byte(rest), &opts); err != nil {
+			return protocolError("Invalid CONNECT")
+		}
+		c.verbose.Store(opts.Verbose)
+		c.headers.Store(opts.Headers)
+	case "PUB", "HPUB":
+		return c.publish(strings.ToUpper(op) == "HPUB", args)
+	case "SUB":
+		if len(args) != 2 && len(args) != 3 {
+			return protocolError("Parser Error")
+		}
+		subject, queue, sid := args[0], "", args[len(args)-1]
+		if len(args) == 3 {
+			queue = args[1]
+		}
+		if !validSubject(subject, true) {
+			return clientError("Invalid Subject")
+		}
+		if err := c.subscribe(subject, queue, sid); err != nil {
+			return clientError(err.Error())
+		}
+	case "UNSUB":
+		if len(args) != 1 && len(args) != 2 {
+			return protocolError("Parser Error")
+		}
+		var max uint64
+		if len(args) == 2 {
+			n, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				return protocolError("Parser Error")
+			}
+			max = n
+		}
+		c.unsubscribeAfter(args[0], max)
+	default:
+		return protocolError("Unknown Protocol Operation")
+	}
+	return nil
+}
+
+// publish reads the payload of a PUB or HPUB and publishes it on the bus
+func (c *conn) publish(withHeaders bool, args []string) error {
+	sizes := 1
+	if withHeaders {
+		sizes = 2
+	}
+	if len(args) != 1+sizes && len(args) != 2+sizes {
+		return protocolError("Parser Error")
+	}
+	subject, reply := args[0], ""
+	if len(args) == 2+sizes {
+		reply = args[1]
+	}
+	total, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || total < 0 {
+		return protocolError("Parser Error")
+	}
+	headerSize := 0
+	if withHeaders {
+		if headerSize, err = strconv.Atoi(args[len(args)-2]); err != nil || headerSize < 0 || headerSize > total {
+			return protocolError("Parser Error")
+		}
+	}
+	if total > c.server.cfg.maxPayload {
+		return protocolError("Maximum Payload Violation")
+	}
+	data := make([]byte, total+2)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return protocolError("Parser Error")
+	}
+	var headers map[string]string
+	if withHeaders {
+		if headers, err = parseHeaders(data[:headerSize]); err != nil {
+			return protocolError("Parser Error")
+		}
+	}
+	if !validSubject(subject, false) {
+		return clientError("Invalid Publish Subject")
+	}
+	if reply != "" {
+		if headers == nil {
+			headers = make(map[string]string, 1)
+		}
+		headers[HeaderReplyTo] = reply
+	}
+	c.server.feeds.Attach(subject)
+	payload := data[headerSize:total:total]
+	if _, err := c.server.bus.Publish(subject, payload, thebus.WithHeaders(headers)); err != nil {
+		return clientError(err.Error())
+	}
+	return nil
+}
+
+func (c *conn) subscribe(subject, queue, sid string) error {
+	sub := &subscription{conn: c, sid: sid, subject: subject, queue: queue}
+	c.mu.Lock()
+	if _, ok := c.subs[sid]; ok {
+		c.mu.Unlock()
+		return fmt.Errorf("duplicate sid %s", sid)
+	}
+	c.subs[sid] = sub
+	c.mu.Unlock()
+
+	var err error
+	if queue != "" {
+		err = c.server.joinGroup(sub)
+	} else {
+		sub.feed, err = c.server.feed(subject, sub.deliver)
+	}
+	if err != nil {
+		c.mu.Lock()
+		delete(c.subs, sid)
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// unsubscribeAfter removes the subscription once max messages were delivered (0 = now).
+func (c *conn) unsubscribeAfter(sid string, max uint64) {
+	c.mu.Lock()
+	sub, ok := c.subs[sid]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	if max > 0 {
+		sub.max.Store(max)
+		if sub.delivered.Load() < max {
+			return
+		}
+	}
+	c.unsubscribe(sid)
+}
+
+func (c *conn) unsubscribe(sid string) {
+	c.mu.Lock()
+	sub, ok := c.subs[sid]
+	delete(c.subs, sid)
+	c.mu.Unlock()
+	if !ok || !sub.removed.CompareAndSwap(false, true) {
+		return
+	}
+	if sub.queue != "" {
+		c.server.leaveGroup(sub)
+	} else if sub.feed != nil {
+		c.server.feeds.Release(sub.feed)
+	}
+}
+
+// deliver sends msg to the client, up to the max messages of UNSUB.
+func (sub *subscription) deliver(msg thebus.Message) {
+	if sub.removed.Load() {
+		return
+	}
+	n := sub.delivered.Add(1)
+	max := sub.max.Load()
+	if max > 0 && n > max {
+		return
+	}
+	if err := sub.conn.sendMsg(sub.sid, msg); err != nil {
+		_ = sub.conn.netConn.Close()
+		return
+	}
+	if max > 0 && n == max {
+		sub.conn.unsubscribe(sub.sid)
+	}
+}
+
+// ##############################################################################
+// ################################   WRITES   ##################################
+// ##############################################################################
+
+func (c *conn) sendInfo() error {
+	in := info{
+		ServerID:   c.server.id,
+		ServerName: c.server.cfg.name,
+		Version:    serverVersion,
+		Proto:      1,
+		Go:         runtime.Version(),
+		Headers:    true,
+		MaxPayload: c.server.cfg.maxPayload,
+		ClientID:   c.id,
+	}
+	if addr, ok := c.netConn.LocalAddr().(*net.TCPAddr); ok {
+		in.Host, in.Port = addr.IP.String(), addr.Port
+	}
+	if addr, ok := c.netConn.RemoteAddr().(*net.TCPAddr); ok {
+		in.ClientIP = addr.IP.String()
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return c.write(slices.Concat([]byte("INFO "), data, []byte("\r\n")))
+}
+
+func (c *conn) sendMsg(sid string, msg thebus.Message) error {
+	reply := msg.Headers[HeaderReplyTo]
+	var header []byte
+	if c.headers.Load() {
+		header = encodeHeaders(msg.Headers)
+	}
+	var b bytes.Buffer
+	if header != nil {
+		b.WriteString("HMSG ")
+	} else {
+		b.WriteString("MSG ")
+	}
+	b.WriteString(msg.Topic)
+	b.WriteByte(' ')
+	b.WriteString(sid)
+	if reply != "" {
+		b.WriteByte(' ')
+		b.WriteString(reply)
+	}
+	if header != nil {
+		fmt.Fprintf(&b, " %d %d\r\n", len(header), len(header)+len(msg.Payload))
+		b.Write(header)
+	} else {
+		fmt.Fprintf(&b, " %d\r\n", len(msg.Payload))
+	}
+	b.Write(msg.Payload)
+	b.WriteString("\r\n")
+	return c.write(b.Bytes())
+}
+
+func (c *conn) ok() error {
+	if !c.verbose.Load() {
+		return nil
+	}
+	return c.write([]byte("+OK\r\n"))
+}
+
+// sendErr sends a non fatal error
+func (c *conn) sendErr(msg string) error {
+	return c.write([]byte("-ERR '" + msg + "'\r\n"))
+}
+
+func (c *conn) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.server.cfg.writeTimeout > 0 {
+		_ = c.netConn.SetWriteDeadline(time.Now().Add(c.server.cfg.writeTimeout))
+	}
+	if _, err := c.writer.Write(data); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// ##############################################################################
+// ################################   HEADERS   #################################
+// ##############################################################################
+
+// parseHeaders parses a "NATS/1.0" header block
+func parseHeaders(block []byte) (map[string]string, error) {
+	line, rest, ok := strings.Cut(string(block), "\r\n")
+	if !ok || !strings.HasPrefix(line, "NATS/1.0") {
+		return nil, errors.New("invalid header block")
+	}
+	var headers map[string]string
+	for {
+		line, rest, ok = strings.Cut(rest, "\r\n")
+		if !ok || line == "" {
+			return headers, nil
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, errors.New("invalid header line")
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+}
+
+// encodeHeaders returns the header block of the headers but HeaderReplyTo, nil if there is none.
+func encodeHeaders(headers map[string]string) []byte {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		if k != HeaderReplyTo {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	slices.Sort(keys)
+	var b bytes.Buffer
+	b.WriteString("NATS/1.0\r\n")
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString(": ")
+		b.WriteString(headers[k])
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
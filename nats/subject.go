@@ -0,0 +1,145 @@
+package nats
+
+import (
+	"strings"
+
+	"github.com/sebundefined/thebus"
+	"github.com/sebundefined/thebus/internal/topicfeed"
+)
+
+// validSubject checks a NATS subject: non empty tokens separated by dots,
+// the wildcards "*" (one token) and ">" (the remaining tokens, last) only if wildcard.
+func validSubject(subject string, wildcard bool) bool {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return false
+	}
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return false
+		case token == "*" || token == ">":
+			if !wildcard || (token == ">" && i != len(tokens)-1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isWildcard(subject string) bool {
+	for _, token := range strings.Split(subject, ".") {
+		if token == "*" || token == ">" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSubject reports whether subject matches the wildcard pattern.
+// Like NATS, the wildcards do not match the system topics unless the pattern
+// starts with the same "$" token.
+func matchSubject(pattern, subject string) bool {
+	if strings.HasPrefix(subject, "$") && !strings.HasPrefix(pattern, "$") {
+		return false
+	}
+	pTokens, sTokens := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, p := range pTokens {
+		switch {
+		case p == ">":
+			return len(sTokens) > i
+		case i >= len(sTokens):
+			return false
+		case p != "*" && p != sTokens[i]:
+			return false
+		}
+	}
+	return len(pTokens) == len(sTokens)
+}
+
+// feed subscribes subject, a wildcard one topic by topic (see topicfeed).
+func (s *Server) feed(subject string, deliver func(msg thebus.Message)) (*topicfeed.Feed, error) {
+	var match func(topic string) bool
+	if isWildcard(subject) {
+		match = func(topic string) bool {
+			return matchSubject(subject, topic)
+		}
+	}
+	return s.feeds.Subscribe(subject, match, deliver)
+}
+
+// ##############################################################################
+// ################################   GROUPS   ##################################
+// ##############################################################################
+
+// group is a queue group: a single feed whose messages go to one member at a time (round-robin).
+type group struct {
+	key     string
+	feed    *topicfeed.Feed
+	members []*subscription
+	next    int
+}
+
+func (s *Server) joinGroup(sub *subscription) error {
+	key := sub.subject + " " + sub.queue
+	s.mu.Lock()
+	g, ok := s.groups[key]
+	if ok {
+		g.members = append(g.members, sub)
+		s.mu.Unlock()
+		return nil
+	}
+	g = &group{key: key, members: []*subscription{sub}}
+	s.groups[key] = g
+	s.mu.Unlock()
+
+	f, err := s.feed(sub.subject, func(msg thebus.Message) {
+		s.mu.Lock()
+		if len(g.members) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		member := g.members[g.next%len(g.members)]
+		g.next++
+		s.mu.Unlock()
+		member.deliver(msg)
+	})
+	if err != nil {
+		s.leaveGroup(sub)
+		return err
+	}
+	s.mu.Lock()
+	g.feed = f
+	left := s.groups[key] != g // every member left in the meantime
+	s.mu.Unlock()
+	if left {
+		s.feeds.Release(f)
+	}
+	return nil
+}
+
+func (s *Server) leaveGroup(sub *subscription) {
+	key := sub.subject + " " + sub.queue
+	s.mu.Lock()
+	g, ok := s.groups[key]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	for i, member := range g.members {
+		if member == sub {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	if len(g.members) > 0 {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.groups, key)
+	f := g.feed
+	s.mu.Unlock()
+	if f != nil {
+		s.feeds.Release(f)
+	}
+}
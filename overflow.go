@@ -0,0 +1,397 @@
+package thebus
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// OverflowPolicy defines what happens when a subscriber buffer is full
+// (after SendTimeout if DropIfFull is false).
+//   - OverflowPolicyDropNewest (the default) drops the incoming message
+//   - OverflowPolicyDropOldest evicts the head of the buffer to make room
+//   - OverflowPolicyCoalesce keeps only the latest buffered message per key
+//   - OverflowPolicySpillToDisk writes the overflow to a temporary file and
+//     replays it in order when the consumer catches up
+type OverflowPolicy string
+
+const (
+	OverflowPolicyUnknown     OverflowPolicy = "UNKNOWN"
+	OverflowPolicyDropNewest  OverflowPolicy = "DROP_NEWEST"
+	OverflowPolicyDropOldest  OverflowPolicy = "DROP_OLDEST"
+	OverflowPolicyCoalesce    OverflowPolicy = "COALESCE"
+	OverflowPolicySpillToDisk OverflowPolicy = "SPILL_TO_DISK"
+)
+
+func (enum OverflowPolicy) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(OverflowPolicyUnknown)
+	}
+	return string(enum)
+}
+
+func OverflowPolicyValues() []OverflowPolicy {
+	return []OverflowPolicy{
+		OverflowPolicyDropNewest,
+		OverflowPolicyDropOldest,
+		OverflowPolicyCoalesce,
+		OverflowPolicySpillToDisk,
+	}
+}
+
+func (enum OverflowPolicy) IsValid() bool {
+	if slices.Contains(OverflowPolicyValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum OverflowPolicy) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *OverflowPolicy) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := OverflowPolicy(tmp)
+	if !fs.IsValid() {
+		fs = OverflowPolicyUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// CoalesceKeyFunc returns the key used by OverflowPolicyCoalesce.
+// Buffered messages sharing the same key are replaced by the latest one.
+type CoalesceKeyFunc func(msg Message) string
+
+// defaultCoalesceKey coalesces on the topic, i.e. only the latest message is kept
+func defaultCoalesceKey(msg Message) string {
+	return msg.Topic
+}
+
+// ##############################################################################
+// ################################   DELIVERY   ################################
+// ##############################################################################
+
+// deliveryResult is the outcome of deliver for a single subscriber.
+type deliveryResult struct {
+	delivered bool
+	spilled   bool
+	failed    bool
+	evicted   uint64
+	coalesced uint64
+}
+
+func (res deliveryResult) status() DeliveryStatus {
+	switch {
+	case res.failed:
+		return DeliveryStatusFailed
+	case res.spilled:
+		return DeliveryStatusSpilled
+	case res.delivered:
+		return DeliveryStatusDelivered
+	default:
+		return DeliveryStatusDropped
+	}
+}
+
+// deliver hands msg to the subscriber and applies its OverflowPolicy when
+// the buffer is full. It must only be called by the topic fan-out worker.
+func deliver(sub *subscription, msg Message, timer Timer) deliveryResult {
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+	if sub.closed {
+		return deliveryResult{}
+	}
+	if sub.spill != nil && sub.spill.Len() > 0 {
+		// keep the order: once we started spilling, everything goes to disk
+		// until the consumer caught up
+		return spillMessage(sub, msg)
+	}
+	if tryDeliver(sub, msg, timer) {
+		return deliveryResult{delivered: true}
+	}
+	switch sub.cfg.OverflowPolicy {
+	case OverflowPolicyDropOldest:
+		return dropOldest(sub, msg)
+	case OverflowPolicyCoalesce:
+		return coalesce(sub, msg)
+	case OverflowPolicySpillToDisk:
+		return spillMessage(sub, msg)
+	default:
+		return deliveryResult{}
+	}
+}
+
+// dropOldest evicts the head of the buffer and enqueues msg instead
+func dropOldest(sub *subscription, msg Message) deliveryResult {
+	res := deliveryResult{}
+	select {
+	case <-sub.messageChan:
+		res.evicted++
+	default:
+		// consumer read in the meantime, room is available
+	}
+	select {
+	case sub.messageChan <- msg:
+		res.delivered = true
+	default:
+	}
+	return res
+}
+
+// coalesce drains the buffer, keeps only the latest message per key
+// (including msg) in their original order, then refills the buffer.
+// If every key is distinct the oldest messages are evicted.
+func coalesce(sub *subscription, msg Message) deliveryResult {
+	keyOf := sub.cfg.CoalesceKey
+	if keyOf == nil {
+		keyOf = defaultCoalesceKey
+	}
+	pending := make([]Message, 0, cap(sub.messageChan)+1)
+drain:
+	for {
+		select {
+		case m := <-sub.messageChan:
+			pending = append(pending, m)
+		default:
+			break drain
+		}
+	}
+	pending = append(pending, msg)
+
+	// walk backward so the latest message per key wins
+	seen := make(map[string]struct{}, len(pending))
+	kept := make([]Message, 0, len(pending))
+	for i := len(pending) - 1; i >= 0; i-- {
+		key := keyOf(pending[i])
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		kept = append(kept, pending[i])
+	}
+	slices.Reverse(kept)
+
+	res := deliveryResult{coalesced: uint64(len(pending) - len(kept))}
+	for len(kept) > cap(sub.messageChan) {
+		kept = kept[1:]
+		res.evicted++
+	}
+	for _, m := range kept {
+		select {
+		case sub.messageChan <- m:
+		default:
+			res.evicted++
+		}
+	}
+	// msg is always the last kept one
+	res.delivered = true
+	return res
+}
+
+func spillMessage(sub *subscription, msg Message) deliveryResult {
+	if sub.spill == nil {
+		return deliveryResult{}
+	}
+	if err := sub.spill.push(msg); err != nil {
+		return deliveryResult{failed: true}
+	}
+	// delivered once the pump hands it to the subscriber, see countSpill
+	return deliveryResult{spilled: true}
+}
+
+// countSpill counts the spilled messages of sub as Delivered once replayed
+// into its buffer, or as Dropped if discarded when the subscription ends.
+func (b *bus) countSpill(state *topicState, sub *subscription) {
+	sub.spill.delivered = func(msg Message) {
+		state.counters.Delivered.Add(1)
+		b.totals.Delivered.Add(1)
+		sub.counters.record(DeliveryStatusDelivered, msg.Seq)
+	}
+	sub.spill.dropped = func(n int) {
+		state.counters.Dropped.Add(uint64(n))
+		b.totals.Dropped.Add(uint64(n))
+		sub.counters.Dropped.Add(uint64(n))
+	}
+}
+
+// ##############################################################################
+// ###############################   SPILL QUEUE   ##############################
+// ##############################################################################
+
+// spillQueue is a temporary file-backed FIFO used by OverflowPolicySpillToDisk.
+// Records are length-prefixed JSON encoded messages. A pump goroutine replays
+// them into the subscriber channel as soon as there is room and exits when the
+// queue is empty. The file is created lazily and removed on close.
+// delivered and dropped, if set, report the records replayed and discarded.
+type spillQueue struct {
+	mu       sync.Mutex
+	dir      string
+	file     *os.File
+	readOff  int64
+	writeOff int64
+	count    int
+	pumping  bool
+	closed   bool
+	out      chan<- Message
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	delivered func(msg Message)
+	dropped   func(n int)
+}
+
+func newSpillQueue(dir string, out chan<- Message) *spillQueue {
+	return &spillQueue{
+		dir:  dir,
+		out:  out,
+		stop: make(chan struct{}),
+	}
+}
+
+// Len returns the number of messages waiting on disk
+func (q *spillQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+func (q *spillQueue) push(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	if q.file == nil {
+		f, err := os.CreateTemp(q.dir, "thebus-spill-*")
+		if err != nil {
+			return err
+		}
+		q.file = f
+	}
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	copy(record[4:], data)
+	if _, err := q.file.WriteAt(record, q.writeOff); err != nil {
+		return err
+	}
+	q.writeOff += int64(len(record))
+	q.count++
+	if !q.pumping {
+		q.pumping = true
+		q.wg.Add(1)
+		go q.pump()
+	}
+	return nil
+}
+
+// readLocked reads the record at readOff, caller must hold the lock
+func (q *spillQueue) readLocked() (Message, int64, error) {
+	var msg Message
+	var size [4]byte
+	if _, err := q.file.ReadAt(size[:], q.readOff); err != nil {
+		return msg, 0, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := q.file.ReadAt(data, q.readOff+4); err != nil && err != io.EOF {
+		return msg, 0, err
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, 0, err
+	}
+	return msg, int64(4 + len(data)), nil
+}
+
+func (q *spillQueue) pump() {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		if q.closed || q.count == 0 {
+			q.pumping = false
+			if !q.closed && q.file != nil {
+				// everything was replayed, reuse the file from the start
+				_ = q.file.Truncate(0)
+				q.readOff, q.writeOff = 0, 0
+			}
+			q.mu.Unlock()
+			return
+		}
+		msg, n, err := q.readLocked()
+		if err != nil {
+			// corrupted spill, nothing sensible to replay
+			lost := q.count
+			q.count = 0
+			q.mu.Unlock()
+			q.drop(lost)
+			continue
+		}
+		q.mu.Unlock()
+
+		select {
+		case q.out <- msg:
+		case <-q.stop:
+			q.mu.Lock()
+			q.pumping = false
+			q.mu.Unlock()
+			return
+		}
+
+		q.mu.Lock()
+		q.readOff += n
+		q.count--
+		q.mu.Unlock()
+		if q.delivered != nil {
+			q.delivered(msg)
+		}
+	}
+}
+
+func (q *spillQueue) drop(n int) {
+	if n > 0 && q.dropped != nil {
+		q.dropped(n)
+	}
+}
+
+// close stops the pump and removes the backing file. It is idempotent.
+// Once close returns the pump no longer writes to the output channel.
+func (q *spillQueue) close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.stop)
+	q.mu.Unlock()
+	q.wg.Wait()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// the records never replayed are lost with the file
+	q.drop(q.count)
+	q.count = 0
+	if q.file == nil {
+		return nil
+	}
+	name := q.file.Name()
+	err := q.file.Close()
+	_ = os.Remove(name)
+	return err
+}
@@ -0,0 +1,134 @@
+package thebus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeliverDropOldest(t *testing.T) {
+	sub := &subscription{
+		cfg:         SubscriptionConfig{DropIfFull: true, OverflowPolicy: OverflowPolicyDropOldest},
+		messageChan: make(chan Message, 2),
+	}
+	for i := uint64(1); i <= 3; i++ {
+		deliver(sub, Message{Seq: i}, nil)
+	}
+	if got := (<-sub.messageChan).Seq; got != 2 {
+		t.Fatalf("want seq 2 at head, got %d", got)
+	}
+	if got := (<-sub.messageChan).Seq; got != 3 {
+		t.Fatalf("want seq 3, got %d", got)
+	}
+}
+
+func TestDeliverCoalesce(t *testing.T) {
+	sub := &subscription{
+		cfg: SubscriptionConfig{
+			DropIfFull:     true,
+			OverflowPolicy: OverflowPolicyCoalesce,
+			CoalesceKey: func(msg Message) string {
+				return string(msg.Payload)
+			},
+		},
+		messageChan: make(chan Message, 2),
+	}
+	deliver(sub, Message{Seq: 1, Payload: []byte("a")}, nil)
+	deliver(sub, Message{Seq: 2, Payload: []byte("b")}, nil)
+	res := deliver(sub, Message{Seq: 3, Payload: []byte("a")}, nil)
+	if !res.delivered || res.coalesced != 1 || res.evicted != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if got := (<-sub.messageChan).Seq; got != 2 {
+		t.Fatalf("want seq 2, got %d", got)
+	}
+	if got := (<-sub.messageChan).Seq; got != 3 {
+		t.Fatalf("want seq 3, got %d", got)
+	}
+}
+
+func TestSpillToDiskReplayInOrder(t *testing.T) {
+	b, _ := New()
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, err := b.Subscribe(ctx, "t",
+		WithBufferSize(2),
+		WithOverflowPolicy(OverflowPolicySpillToDisk),
+		WithSpillDir(t.TempDir()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20
+	for i := 0; i < n; i++ {
+		if _, err := b.Publish("t", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for want := uint64(1); want <= n; want++ {
+		select {
+		case msg := <-sub.Read():
+			if msg.Seq != want {
+				t.Fatalf("want seq %d, got %d", want, msg.Seq)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting seq %d", want)
+		}
+	}
+	// a spilled message is Delivered once replayed, after the read returned
+	deadline := time.Now().Add(2 * time.Second)
+	st, _ := b.Stats()
+	for st.Totals.Delivered != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d delivered, got %+v", n, st.Totals)
+		}
+		time.Sleep(5 * time.Millisecond)
+		st, _ = b.Stats()
+	}
+	if st.Totals.Spilled == 0 {
+		t.Fatal("expected Spilled > 0")
+	}
+	if st.Totals.Dropped != 0 {
+		t.Fatalf("expected no drop, got %d", st.Totals.Dropped)
+	}
+}
+
+func TestSpillToDiskDiscardedOnClose(t *testing.T) {
+	b, _ := New()
+	defer b.Close()
+
+	sub, err := b.Subscribe(context.Background(), "t",
+		WithBufferSize(2),
+		WithOverflowPolicy(OverflowPolicySpillToDisk),
+		WithSpillDir(t.TempDir()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 10
+	var spilled int
+	for i := 0; i < n; i++ {
+		conf, err := b.PublishConfirm("t", []byte("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, _ := conf.Wait(context.Background())
+		spilled += ack.Spilled
+	}
+	// nobody reads: the buffer holds 2 messages, the rest waits on disk
+	if spilled != n-2 {
+		t.Fatalf("want %d spilled, got %d", n-2, spilled)
+	}
+	st, _ := b.Stats()
+	if st.Totals.Spilled != n-2 || st.Totals.Delivered != 2 || st.Totals.Dropped != 0 {
+		t.Fatalf("unexpected counters %+v", st.Totals)
+	}
+
+	_ = sub.Unsubscribe()
+	st, _ = b.Stats()
+	if st.Totals.Delivered != 2 || st.Totals.Dropped != n-2 {
+		t.Fatalf("want the spilled messages dropped, got %+v", st.Totals)
+	}
+}
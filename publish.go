@@ -1,11 +1,170 @@
 package thebus
 
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
 // PublishAck is returned when your client Publish a message on a topic.
 // It returns the Topic, if the message is Enqueued or not and the number of
 // subscribers. Note that Subscribers is a snapshot when published.
 // it may not reflect the real subscribers count
+//
+// In sync mode (see WithSyncDelivery) the message is delivered before Publish
+// returns: Enqueued is true, Sync is set and the counts and Deliveries give the
+// actual outcome per subscriber. The same report is given by the Confirmation
+// of PublishConfirm once the fan-out is done.
 type PublishAck struct {
 	Topic       string
+	Seq         uint64
+	MessageID   string // only set by PublishConfirm
 	Enqueued    bool
 	Subscribers int
+
+	Sync       bool
+	Delivered  int
+	Dropped    int
+	Failed     int
+	Filtered   int           // subscribers whose filters rejected the message
+	Rejected   int           // subscribers whose delivery interceptors rejected the message
+	Spilled    int           // subscribers whose copy was written to disk, delivered later
+	Expired    bool          // the message expired (topic MessageTTL) before its fan-out
+	Latency    time.Duration // from publish to the end of the fan-out
+	Deliveries []SubscriberDelivery
+}
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// DeliveryStatus is the outcome of a delivery to a subscriber.
+type DeliveryStatus string
+
+const (
+	DeliveryStatusUnknown   DeliveryStatus = "UNKNOWN"
+	DeliveryStatusDelivered DeliveryStatus = "DELIVERED"
+	DeliveryStatusDropped   DeliveryStatus = "DROPPED"
+	DeliveryStatusFailed    DeliveryStatus = "FAILED"
+	DeliveryStatusFiltered  DeliveryStatus = "FILTERED"
+	DeliveryStatusRejected  DeliveryStatus = "REJECTED"
+	DeliveryStatusSpilled   DeliveryStatus = "SPILLED"
+)
+
+func (enum DeliveryStatus) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(DeliveryStatusUnknown)
+	}
+	return string(enum)
+}
+
+func DeliveryStatusValues() []DeliveryStatus {
+	return []DeliveryStatus{
+		DeliveryStatusDelivered,
+		DeliveryStatusDropped,
+		DeliveryStatusFailed,
+		DeliveryStatusFiltered,
+		DeliveryStatusRejected,
+		DeliveryStatusSpilled,
+	}
+}
+
+func (enum DeliveryStatus) IsValid() bool {
+	if slices.Contains(DeliveryStatusValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum DeliveryStatus) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *DeliveryStatus) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := DeliveryStatus(tmp)
+	if !fs.IsValid() {
+		fs = DeliveryStatusUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// SubscriberDelivery is the outcome of a delivery for a subscription.
+type SubscriberDelivery struct {
+	SubscriptionID string
+	Status         DeliveryStatus
+}
+
+func (ack *PublishAck) addDelivery(subscriptionID string, res deliveryResult) {
+	status := res.status()
+	switch status {
+	case DeliveryStatusFailed:
+		ack.Failed++
+	case DeliveryStatusDelivered:
+		ack.Delivered++
+	case DeliveryStatusSpilled:
+		ack.Spilled++
+	default:
+		ack.Dropped++
+	}
+	ack.Deliveries = append(ack.Deliveries, SubscriberDelivery{SubscriptionID: subscriptionID, Status: status})
+}
+
+// addSkipped reports a DeliveryStatusFiltered or DeliveryStatusRejected delivery
+func (ack *PublishAck) addSkipped(subscriptionID string, status DeliveryStatus) {
+	if status == DeliveryStatusRejected {
+		ack.Rejected++
+	} else {
+		ack.Filtered++
+	}
+	ack.Deliveries = append(ack.Deliveries, SubscriberDelivery{SubscriptionID: subscriptionID, Status: status})
+}
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+// PublishConfig is the configuration of a single Publish call.
+type PublishConfig struct {
+	Headers map[string]string
+}
+
+// PublishOption configures a single Publish call.
+type PublishOption func(cfg *PublishConfig)
+
+// WithHeaders adds headers to the published message. The map is copied.
+func WithHeaders(headers map[string]string) PublishOption {
+	return func(cfg *PublishConfig) {
+		for k, v := range headers {
+			cfg.setHeader(k, v)
+		}
+	}
+}
+
+// WithHeader adds a single header to the published message.
+func WithHeader(key, value string) PublishOption {
+	return func(cfg *PublishConfig) {
+		cfg.setHeader(key, value)
+	}
+}
+
+func (cfg *PublishConfig) setHeader(key, value string) {
+	if cfg.Headers == nil {
+		cfg.Headers = make(map[string]string)
+	}
+	cfg.Headers[key] = value
+}
+
+func BuildPublishConfig(opts ...PublishOption) PublishConfig {
+	var cfg PublishConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
 }
@@ -0,0 +1,242 @@
+package thebus
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Windows of the rates (see Rate)
+var rateWindows = [...]time.Duration{time.Second, time.Minute, 5 * time.Minute}
+
+// latencyBuckets is the number of buckets of a LatencyHistogram: bucket i
+// counts the latencies <= latencyBucketBase << i, the last one the others.
+const (
+	latencyBuckets    = 32
+	latencyBucketBase = time.Microsecond
+)
+
+// ##############################################################################
+// #################################   STATS   ##################################
+// ##############################################################################
+
+// Rate is a rate in messages per second, as exponentially weighted moving
+// averages over 1 second, 1 minute and 5 minutes.
+type Rate struct {
+	Per1s float64
+	Per1m float64
+	Per5m float64
+}
+
+// RateStats gives the rates of a topic or of the whole bus. The rates are only
+// maintained with WithRateInterval, the other fields are always set.
+type RateStats struct {
+	Publish        Rate
+	Deliver        Rate
+	Drop           Rate
+	PeakQueueDepth int              // highest topic queue length observed
+	Latency        LatencyHistogram // publish-to-delivery latency
+}
+
+// LatencyHistogram is a histogram of latencies with exponential buckets:
+// Buckets[i] counts the latencies up to 1µs << i, the last bucket the higher ones.
+type LatencyHistogram struct {
+	Count   uint64
+	Buckets []uint64
+}
+
+// Quantile returns the upper bound of the bucket holding the q quantile
+// (0 < q <= 1), 0 if the histogram is empty.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.Count)))
+	var cumulative uint64
+	for i, n := range h.Buckets {
+		cumulative += n
+		if cumulative >= rank {
+			return latencyBucketBase << i
+		}
+	}
+	return latencyBucketBase << (len(h.Buckets) - 1)
+}
+
+// P50 returns the median latency.
+func (h LatencyHistogram) P50() time.Duration {
+	return h.Quantile(0.50)
+}
+
+// P99 returns the 99th percentile latency.
+func (h LatencyHistogram) P99() time.Duration {
+	return h.Quantile(0.99)
+}
+
+// Sub returns the histogram of the latencies observed since prev.
+func (h LatencyHistogram) Sub(prev LatencyHistogram) LatencyHistogram {
+	out := LatencyHistogram{Count: h.Count - prev.Count, Buckets: make([]uint64, len(h.Buckets))}
+	for i := range h.Buckets {
+		out.Buckets[i] = h.Buckets[i]
+		if i < len(prev.Buckets) {
+			out.Buckets[i] -= prev.Buckets[i]
+		}
+	}
+	return out
+}
+
+// ##############################################################################
+// ##################################   DIFF   ##################################
+// ##############################################################################
+
+// StatsDiff is the difference between two Stats snapshots, see StatsResults.Diff.
+type StatsDiff struct {
+	Interval time.Duration
+	Totals   CountersDiff
+	PerTopic map[string]CountersDiff
+}
+
+// CountersDiff gives the counters increments over a StatsDiff interval, the
+// average rates (messages per second) and the latencies observed.
+type CountersDiff struct {
+	Counters
+	PublishRate float64
+	DeliverRate float64
+	DropRate    float64
+	Latency     LatencyHistogram
+}
+
+// Sub returns the increments of the counters since prev.
+func (c Counters) Sub(prev Counters) Counters {
+	return Counters{
+		Published:             c.Published - prev.Published,
+		Delivered:             c.Delivered - prev.Delivered,
+		Failed:                c.Failed - prev.Failed,
+		Dropped:               c.Dropped - prev.Dropped,
+		Evicted:               c.Evicted - prev.Evicted,
+		Coalesced:             c.Coalesced - prev.Coalesced,
+		Spilled:               c.Spilled - prev.Spilled,
+		Expired:               c.Expired - prev.Expired,
+		Filtered:              c.Filtered - prev.Filtered,
+		Rejected:              c.Rejected - prev.Rejected,
+		SlowConsumerEvictions: c.SlowConsumerEvictions - prev.SlowConsumerEvictions,
+	}
+}
+
+// Diff returns what happened between prev and s, two snapshots of the same bus.
+// The topics missing from prev are diffed against zero counters.
+func (s StatsResults) Diff(prev StatsResults) StatsDiff {
+	d := StatsDiff{
+		Interval: s.At.Sub(prev.At),
+		Totals:   diffCounters(s.Totals, prev.Totals, s.Rates.Latency, prev.Rates.Latency, s.At.Sub(prev.At)),
+		PerTopic: make(map[string]CountersDiff, len(s.PerTopic)),
+	}
+	for topic, ts := range s.PerTopic {
+		before := prev.PerTopic[topic]
+		d.PerTopic[topic] = diffCounters(ts.Counters, before.Counters, ts.Rates.Latency, before.Rates.Latency, d.Interval)
+	}
+	return d
+}
+
+func diffCounters(c, prev Counters, latency, prevLatency LatencyHistogram, interval time.Duration) CountersDiff {
+	d := CountersDiff{Counters: c.Sub(prev), Latency: latency.Sub(prevLatency)}
+	if seconds := interval.Seconds(); seconds > 0 {
+		d.PublishRate = float64(d.Published) / seconds
+		d.DeliverRate = float64(d.Delivered) / seconds
+		d.DropRate = float64(d.Dropped) / seconds
+	}
+	return d
+}
+
+// ##############################################################################
+// ################################   INTERNAL   ################################
+// ##############################################################################
+
+// rateRecorder maintains the RateStats of a topic or of the bus.
+type rateRecorder struct {
+	peakDepth atomic.Int64
+	latency   [latencyBuckets]atomic.Uint64
+
+	mu      sync.Mutex // guards the rates, updated by runRates
+	last    Counters
+	lastAt  time.Time
+	publish [len(rateWindows)]float64
+	deliver [len(rateWindows)]float64
+	drop    [len(rateWindows)]float64
+}
+
+func (r *rateRecorder) observeDepth(depth int) {
+	for {
+		peak := r.peakDepth.Load()
+		if int64(depth) <= peak || r.peakDepth.CompareAndSwap(peak, int64(depth)) {
+			return
+		}
+	}
+}
+
+func (r *rateRecorder) observeLatency(d time.Duration) {
+	i := 0
+	for i < latencyBuckets-1 && d > latencyBucketBase<<i {
+		i++
+	}
+	r.latency[i].Add(1)
+}
+
+// sample updates the rates with the counters at now.
+func (r *rateRecorder) sample(c Counters, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.lastAt.IsZero() {
+		if dt := now.Sub(r.lastAt).Seconds(); dt > 0 {
+			delta := c.Sub(r.last)
+			for i, window := range rateWindows {
+				alpha := 1 - math.Exp(-dt/window.Seconds())
+				r.publish[i] += alpha * (float64(delta.Published)/dt - r.publish[i])
+				r.deliver[i] += alpha * (float64(delta.Delivered)/dt - r.deliver[i])
+				r.drop[i] += alpha * (float64(delta.Dropped)/dt - r.drop[i])
+			}
+		}
+	}
+	r.last = c
+	r.lastAt = now
+}
+
+func (r *rateRecorder) snapshot() RateStats {
+	s := RateStats{
+		PeakQueueDepth: int(r.peakDepth.Load()),
+		Latency:        LatencyHistogram{Buckets: make([]uint64, latencyBuckets)},
+	}
+	for i := range r.latency {
+		s.Latency.Buckets[i] = r.latency[i].Load()
+		s.Latency.Count += s.Latency.Buckets[i]
+	}
+	r.mu.Lock()
+	s.Publish = Rate{Per1s: r.publish[0], Per1m: r.publish[1], Per5m: r.publish[2]}
+	s.Deliver = Rate{Per1s: r.deliver[0], Per1m: r.deliver[1], Per5m: r.deliver[2]}
+	s.Drop = Rate{Per1s: r.drop[0], Per1m: r.drop[1], Per5m: r.drop[2]}
+	r.mu.Unlock()
+	return s
+}
+
+// runRates samples the counters every interval to update the rates until the bus is closed.
+func (b *bus) runRates(interval time.Duration) {
+	ticker := b.cfg.Clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case now := <-ticker.C():
+			b.sampleRates(now)
+		}
+	}
+}
+
+func (b *bus) sampleRates(now time.Time) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	b.rates.sample(b.totals.snapshot(), now)
+	for _, st := range b.subscriptions {
+		st.rates.sample(st.counters.snapshot(), now)
+	}
+}
@@ -0,0 +1,104 @@
+package thebus
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var r rateRecorder
+	for i := 0; i < 98; i++ {
+		r.observeLatency(time.Microsecond)
+	}
+	r.observeLatency(3 * time.Millisecond)
+	r.observeLatency(time.Hour)
+	h := r.snapshot().Latency
+	if h.Count != 100 || h.P50() != time.Microsecond {
+		t.Fatalf("unexpected histogram %+v p50=%v", h, h.P50())
+	}
+	// 3ms is in the (2.048ms, 4.096ms] bucket
+	if h.P99() != 4096*time.Microsecond {
+		t.Fatalf("unexpected p99 %v", h.P99())
+	}
+	if h.Quantile(1) != time.Microsecond<<(latencyBuckets-1) {
+		t.Fatalf("unexpected max %v", h.Quantile(1))
+	}
+	if (LatencyHistogram{}).P99() != 0 {
+		t.Fatal("empty histogram must return 0")
+	}
+}
+
+func TestRates(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	b, _ := New(WithSyncDelivery(true), WithClock(clock), WithRateInterval(time.Second))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = b.Subscribe(ctx, "t", WithHandler(func(Message) {}))
+	clock.BlockUntil(1) // the rates ticker
+	inner := b.(*bus)
+
+	// 100 msg/s during 10 minutes, sampled each second
+	for i := 0; i < 600; i++ {
+		for j := 0; j < 100; j++ {
+			_, _ = b.Publish("t", []byte("x"))
+		}
+		inner.sampleRates(clock.Now().Add(time.Duration(i+1) * time.Second))
+	}
+	st, _ := b.Stats()
+	for name, rate := range map[string]Rate{"totals": st.Rates.Publish, "topic": st.PerTopic["t"].Rates.Deliver} {
+		if math.Abs(rate.Per1s-100) > 1 || math.Abs(rate.Per1m-100) > 1 || math.Abs(rate.Per5m-100) > 15 {
+			t.Fatalf("%s: unexpected rate %+v", name, rate)
+		}
+	}
+	if st.Rates.Drop.Per1m != 0 || st.Rates.Latency.Count != 60000 || st.Rates.PeakQueueDepth != 0 {
+		t.Fatalf("unexpected rates %+v", st.Rates)
+	}
+}
+
+func TestPeakQueueDepth(t *testing.T) {
+	b, _ := New(WithTopicQueueSize(8))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	block := make(chan struct{})
+	_, _ = b.Subscribe(ctx, "t", WithHandler(func(Message) { <-block }))
+	for i := 0; i < 5; i++ {
+		_, _ = b.Publish("t", []byte("x"))
+	}
+	close(block)
+	st, _ := b.Stats()
+	// the worker holds the first message
+	if peak := st.PerTopic["t"].Rates.PeakQueueDepth; peak < 4 || peak > 5 || st.Rates.PeakQueueDepth != peak {
+		t.Fatalf("unexpected peak %d (bus %d)", peak, st.Rates.PeakQueueDepth)
+	}
+}
+
+func TestStatsDiff(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	b, _ := New(WithSyncDelivery(true), WithClock(clock))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = b.Subscribe(ctx, "t", WithBufferSize(4))
+	_, _ = b.Publish("t", []byte("x"))
+	before, _ := b.Stats()
+
+	clock.Advance(2 * time.Second)
+	for i := 0; i < 6; i++ {
+		_, _ = b.Publish("t", []byte("x"))
+	}
+	after, _ := b.Stats()
+	d := after.Diff(before)
+	if d.Interval != 2*time.Second || d.Totals.Published != 6 || d.Totals.Delivered != 3 || d.Totals.Dropped != 3 {
+		t.Fatalf("unexpected diff %+v", d.Totals)
+	}
+	if d.Totals.PublishRate != 3 || d.PerTopic["t"].DropRate != 1.5 || d.Totals.Latency.Count != 3 {
+		t.Fatalf("unexpected diff %+v", d.Totals)
+	}
+}
@@ -0,0 +1,41 @@
+package thebus
+
+import "time"
+
+// Record is the JSON encoding of a Message shared by the packages moving the
+// messages out of the process (httpstream, connector...), the payload base64
+// encoded:
+//
+//	{"topic":"orders","seq":1,"ts":"2025-01-02T15:04:05Z","headers":{"k":"v"},"payload":"aGVsbG8="}
+type Record struct {
+	Topic     string            `json:"topic,omitempty"`
+	Seq       uint64            `json:"seq,omitempty"`
+	ID        string            `json:"id,omitempty"`
+	Timestamp time.Time         `json:"ts,omitzero"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Payload   []byte            `json:"payload,omitempty"`
+}
+
+// MakeRecord returns the Record of msg.
+func MakeRecord(msg Message) Record {
+	return Record{
+		Topic:     msg.Topic,
+		Seq:       msg.Seq,
+		ID:        msg.ID,
+		Timestamp: msg.Timestamp,
+		Headers:   msg.Headers,
+		Payload:   msg.Payload,
+	}
+}
+
+// Message returns the message of the Record.
+func (r Record) Message() Message {
+	return Message{
+		ID:        r.ID,
+		Topic:     r.Topic,
+		Timestamp: r.Timestamp,
+		Payload:   r.Payload,
+		Seq:       r.Seq,
+		Headers:   r.Headers,
+	}
+}
@@ -0,0 +1,734 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+const (
+	DefaultDialTimeout = 5 * time.Second
+	DefaultMinBackoff  = 50 * time.Millisecond
+	DefaultMaxBackoff  = 5 * time.Second
+)
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+type clientConfig struct {
+	maxFrameSize int
+	dialTimeout  time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	idGenerator  thebus.IDGenerator
+	logger       thebus.Logger
+}
+
+// ClientOption configures the Client.
+type ClientOption func(cfg *clientConfig)
+
+// WithMaxFrameSize limits the size of the frames sent by the server.
+func WithMaxFrameSize(size int) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.maxFrameSize = size
+	}
+}
+
+// WithDialTimeout sets the timeout of each connection attempt.
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.dialTimeout = timeout
+	}
+}
+
+// WithReconnectBackoff sets the delay between two connection attempts,
+// doubled after each failure from min up to max.
+func WithReconnectBackoff(min, max time.Duration) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.minBackoff = min
+		cfg.maxBackoff = max
+	}
+}
+
+// WithIDGenerator sets the generator of the subscription IDs of the client.
+func WithIDGenerator(generator thebus.IDGenerator) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.idGenerator = generator
+	}
+}
+
+// WithLogger logs the connection losses and the reconnections.
+func WithLogger(logger thebus.Logger) ClientOption {
+	return func(cfg *clientConfig) {
+		cfg.logger = logger
+	}
+}
+
+// ##############################################################################
+// ################################   CLIENT   ##################################
+// ##############################################################################
+
+// Client is a thebus.Bus whose topics live in the bus of a Server.
+//
+// It reconnects after a connection loss and subscribes again its
+// subscriptions, replaying the messages missed in the meantime when the topic
+// retains them (see TopicOptions.Retention). While disconnected, the calls
+// fail with ErrDisconnected, and a pending Confirmation is never resolved.
+//
+// The subscription IDs are the ones of the client; the Stats of the server
+// give the IDs of the subscriptions made on the behalf of the clients.
+type Client struct {
+	network string
+	address string
+	cfg     clientConfig
+
+	mu      sync.Mutex
+	conn    *clientConn // nil while disconnected
+	closed  bool
+	nextReq uint64
+	nextKey uint64
+	subs    map[uint64]*clientSub
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ thebus.Bus = (*Client)(nil)
+
+// Dial connects to the Server listening on network and address.
+// Only the first connection attempt is synchronous.
+func Dial(network, address string, opts ...ClientOption) (*Client, error) {
+	c := &Client{
+		network: network,
+		address: address,
+		cfg: clientConfig{
+			maxFrameSize: DefaultMaxFrameSize,
+			dialTimeout:  DefaultDialTimeout,
+			minBackoff:   DefaultMinBackoff,
+			maxBackoff:   DefaultMaxBackoff,
+			idGenerator:  thebus.DefaultIDGenerator,
+			logger:       thebus.NoopLogger(),
+		},
+		subs: make(map[uint64]*clientSub),
+		done: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&c.cfg)
+	}
+	cc, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = cc
+	c.wg.Add(1)
+	go c.run(cc)
+	return c, nil
+}
+
+type clientConn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	// guarded by the Client mu
+	pending  map[uint64]chan response
+	confirms map[uint64]func(thebus.PublishAck)
+
+	closed chan struct{}
+}
+
+type response struct {
+	ack    thebus.PublishAck
+	result []byte
+	err    error
+}
+
+func (c *Client) dial() (*clientConn, error) {
+	netConn, err := net.DialTimeout(c.network, c.address, c.cfg.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &clientConn{
+		netConn:  netConn,
+		reader:   bufio.NewReader(netConn),
+		writer:   bufio.NewWriter(netConn),
+		pending:  make(map[uint64]chan response),
+		confirms: make(map[uint64]func(thebus.PublishAck)),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+func (cc *clientConn) write(typ byte, body []byte) error {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+	return writeFrame(cc.writer, typ, body)
+}
+
+// run reads the frames of the connection, and reconnects until Close.
+func (c *Client) run(cc *clientConn) {
+	defer c.wg.Done()
+	for cc != nil {
+		err := c.readLoop(cc)
+		c.mu.Lock()
+		c.conn = nil
+		close(cc.closed)
+		closed := c.closed
+		c.mu.Unlock()
+		_ = cc.netConn.Close()
+		if closed {
+			return
+		}
+		c.cfg.logger.Warn("remote: connection lost", "address", c.address, "err", err)
+		cc = c.reconnect()
+	}
+}
+
+// reconnect dials until it succeeds or the Client is closed (nil)
+func (c *Client) reconnect() *clientConn {
+	backoff := c.cfg.minBackoff
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-c.done:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		cc, err := c.dial()
+		if err == nil {
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				_ = cc.netConn.Close()
+				return nil
+			}
+			c.conn = cc
+			subs := make([]*clientSub, 0, len(c.subs))
+			for _, s := range c.subs {
+				subs = append(subs, s)
+			}
+			c.mu.Unlock()
+			c.cfg.logger.Info("remote: reconnected", "address", c.address, "subscriptions", len(subs))
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				for _, s := range subs {
+					if err := s.subscribe(context.Background()); err != nil && err != ErrDisconnected {
+						s.close(err)
+					}
+				}
+			}()
+			return cc
+		}
+		backoff = min(2*backoff, c.cfg.maxBackoff)
+	}
+}
+
+func (c *Client) readLoop(cc *clientConn) error {
+	for {
+		typ, body, err := readFrame(cc.reader, c.cfg.maxFrameSize)
+		if err != nil {
+			return err
+		}
+		d := &decoder{buf: body}
+		switch typ {
+		case frameAck, frameError, frameResult:
+			reqID := d.uvarint()
+			var resp response
+			switch typ {
+			case frameAck:
+				resp.ack = d.ack()
+			case frameError:
+				resp.err = d.error()
+			default:
+				resp.result = d.bytes()
+			}
+			if d.err != nil {
+				return d.err
+			}
+			c.mu.Lock()
+			ch := cc.pending[reqID]
+			delete(cc.pending, reqID)
+			if typ == frameError {
+				delete(cc.confirms, reqID)
+			}
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- resp
+			}
+		case frameConfirm:
+			reqID, ack := d.uvarint(), d.ack()
+			if d.err != nil {
+				return d.err
+			}
+			c.mu.Lock()
+			resolve := cc.confirms[reqID]
+			delete(cc.confirms, reqID)
+			c.mu.Unlock()
+			if resolve != nil {
+				resolve(ack)
+			}
+		case frameMessage, frameEnd:
+			key := d.uvarint()
+			var msg thebus.Message
+			var reason error
+			if typ == frameMessage {
+				msg = d.message()
+			} else {
+				reason = d.error()
+			}
+			if d.err != nil {
+				return d.err
+			}
+			c.mu.Lock()
+			s := c.subs[key]
+			c.mu.Unlock()
+			switch {
+			case s == nil:
+			case typ == frameMessage:
+				s.push(msg)
+			default:
+				s.close(reason)
+			}
+		default:
+			return errMalformed
+		}
+	}
+}
+
+// send writes a request on the current connection, the response is given by the returned channel.
+func (c *Client) send(typ byte, body func(e *encoder), confirm func(thebus.PublishAck)) (*clientConn, uint64, chan response, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, 0, nil, thebus.ErrClosed
+	}
+	cc := c.conn
+	if cc == nil {
+		c.mu.Unlock()
+		return nil, 0, nil, ErrDisconnected
+	}
+	c.nextReq++
+	reqID := c.nextReq
+	ch := make(chan response, 1)
+	cc.pending[reqID] = ch
+	if confirm != nil {
+		cc.confirms[reqID] = confirm
+	}
+	c.mu.Unlock()
+
+	e := encoder{}
+	e.uvarint(reqID)
+	body(&e)
+	if err := cc.write(typ, e.buf); err != nil {
+		c.forget(cc, reqID)
+		return nil, 0, nil, ErrDisconnected
+	}
+	return cc, reqID, ch, nil
+}
+
+func (c *Client) wait(ctx context.Context, cc *clientConn, reqID uint64, ch chan response) (response, error) {
+	select {
+	case resp := <-ch:
+		return resp, resp.err
+	case <-cc.closed:
+		c.forget(cc, reqID)
+		return response{}, ErrDisconnected
+	case <-ctx.Done():
+		c.forget(cc, reqID)
+		return response{}, ctx.Err()
+	}
+}
+
+func (c *Client) forget(cc *clientConn, reqID uint64) {
+	c.mu.Lock()
+	delete(cc.pending, reqID)
+	delete(cc.confirms, reqID)
+	c.mu.Unlock()
+}
+
+func (c *Client) roundTrip(ctx context.Context, typ byte, body func(e *encoder), confirm func(thebus.PublishAck)) (response, error) {
+	cc, reqID, ch, err := c.send(typ, body, confirm)
+	if err != nil {
+		return response{}, err
+	}
+	return c.wait(ctx, cc, reqID, ch)
+}
+
+// call runs a method of the server bus, its result is decoded in result (if not nil).
+func (c *Client) call(method byte, args any, result any) error {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	resp, err := c.roundTrip(context.Background(), frameCall, func(e *encoder) {
+		e.buf = append(e.buf, method)
+		e.bytes(data)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.result, result)
+}
+
+// ##############################################################################
+// #################################   BUS   ####################################
+// ##############################################################################
+
+func (c *Client) Publish(topic string, data []byte, opts ...thebus.PublishOption) (thebus.PublishAck, error) {
+	return c.PublishContext(context.Background(), topic, data, opts...)
+}
+
+// PublishContext publishes like Publish. The span context of ctx is carried by
+// the message headers, and the call gives up waiting for the ack when ctx is done.
+func (c *Client) PublishContext(ctx context.Context, topic string, data []byte, opts ...thebus.PublishOption) (thebus.PublishAck, error) {
+	if sc, ok := thebus.SpanContextFromContext(ctx); ok {
+		opts = append([]thebus.PublishOption{thebus.WithSpanContext(sc)}, opts...)
+	}
+	resp, err := c.roundTrip(ctx, framePublish, publishBody(topic, data, 0, opts), nil)
+	return resp.ack, err
+}
+
+func (c *Client) PublishConfirm(topic string, data []byte, opts ...thebus.PublishOption) (*thebus.Confirmation, error) {
+	conf, resolve := thebus.NewConfirmation()
+	if _, err := c.roundTrip(context.Background(), framePublish, publishBody(topic, data, flagConfirm, opts), resolve); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func publishBody(topic string, data []byte, flags uint64, opts []thebus.PublishOption) func(e *encoder) {
+	pc := thebus.BuildPublishConfig(opts...)
+	return func(e *encoder) {
+		e.uvarint(flags)
+		e.string(topic)
+		e.headers(pc.Headers)
+		e.bytes(data)
+	}
+}
+
+// Subscribe subscribes on the server. The Filter, Handler and interceptors of
+// the subscription run in the client, the other options are applied by the server.
+func (c *Client) Subscribe(ctx context.Context, topic string, opts ...thebus.SubscribeOption) (thebus.Subscription, error) {
+	if len(strings.TrimSpace(topic)) == 0 {
+		return nil, thebus.ErrInvalidTopic
+	}
+	cfg := thebus.BuildSubscriptionConfig(opts...).Normalize()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, thebus.ErrClosed
+	}
+	c.nextKey++
+	s := newClientSub(c, c.nextKey, c.cfg.idGenerator(), topic, cfg)
+	c.subs[s.key] = s
+	c.mu.Unlock()
+
+	if err := s.subscribe(ctx); err != nil {
+		s.close(err)
+		return nil, err
+	}
+	c.wg.Add(1)
+	go s.run(ctx)
+	return s, nil
+}
+
+// Unsubscribe ends a subscription of the client, or else of the server bus.
+func (c *Client) Unsubscribe(topic string, subscriberID string) error {
+	c.mu.Lock()
+	var found *clientSub
+	for _, s := range c.subs {
+		if s.id == subscriberID && s.topic == topic {
+			found = s
+			break
+		}
+	}
+	c.mu.Unlock()
+	if found != nil {
+		found.close(thebus.ErrUnsubscribed)
+		return nil
+	}
+	return c.call(callUnsubscribe, struct{ Topic, ID string }{topic, subscriberID}, nil)
+}
+
+// Close closes the connection and the subscriptions of the client with
+// thebus.ErrClosed. The server bus is not closed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	cc := c.conn
+	subs := make([]*clientSub, 0, len(c.subs))
+	for _, s := range c.subs {
+		subs = append(subs, s)
+	}
+	c.mu.Unlock()
+	for _, s := range subs {
+		s.close(thebus.ErrClosed)
+	}
+	if cc != nil {
+		_ = cc.netConn.Close()
+	}
+	c.wg.Wait()
+	return nil
+}
+
+// Shutdown closes the client like Close, the server bus is not shut down.
+func (c *Client) Shutdown(ctx context.Context) (thebus.ShutdownReport, error) {
+	_ = c.Close()
+	return thebus.ShutdownReport{Drained: true}, nil
+}
+
+func (c *Client) DeclareTopic(topic string, opts thebus.TopicOptions) error {
+	return c.call(callDeclareTopic, struct {
+		Topic   string
+		Options thebus.TopicOptions
+	}{topic, opts}, nil)
+}
+
+func (c *Client) DeleteTopic(topic string) error {
+	return c.call(callDeleteTopic, topic, nil)
+}
+
+// Topics returns the topics of the server bus, nil when it cannot be reached.
+func (c *Client) Topics() []thebus.TopicInfo {
+	var topics []thebus.TopicInfo
+	if err := c.call(callTopics, nil, &topics); err != nil {
+		return nil
+	}
+	return topics
+}
+
+// Stats returns the stats of the server bus.
+func (c *Client) Stats() (thebus.StatsResults, error) {
+	var stats thebus.StatsResults
+	err := c.call(callStats, nil, &stats)
+	return stats, err
+}
+
+// ##############################################################################
+// ##############################   SUBSCRIPTION   ##############################
+// ##############################################################################
+
+// clientSub receives the messages of a server subscription in inbox (at most
+// BufferSize, see credits) and hands them to the consumer, giving back a
+// credit to the server for each one.
+type clientSub struct {
+	client   *Client
+	key      uint64
+	id       string
+	topic    string
+	cfg      thebus.SubscriptionConfig
+	inbox    chan thebus.Message
+	messages chan thebus.Message
+
+	// frameMu orders the subscribe, credit and unsubscribe frames of the
+	// subscription. It is taken before mu and never by push, so the
+	// connection reader does not wait behind a write blocked by the socket.
+	frameMu sync.Mutex
+
+	// flow control
+	mu        sync.Mutex
+	held      int // received and not yet consumed
+	ungranted int // consumed and not yet given back
+	lastSeq   uint64
+	closed    bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+	reason    error
+}
+
+var _ thebus.Subscription = (*clientSub)(nil)
+
+func newClientSub(c *Client, key uint64, id, topic string, cfg thebus.SubscriptionConfig) *clientSub {
+	return &clientSub{
+		client:   c,
+		key:      key,
+		id:       id,
+		topic:    topic,
+		cfg:      cfg,
+		inbox:    make(chan thebus.Message, cfg.BufferSize),
+		messages: make(chan thebus.Message),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *clientSub) GetID() string {
+	return s.id
+}
+
+func (s *clientSub) GetTopic() string {
+	return s.topic
+}
+
+func (s *clientSub) Read() <-chan thebus.Message {
+	return s.messages
+}
+
+func (s *clientSub) Unsubscribe() error {
+	s.close(thebus.ErrUnsubscribed)
+	return nil
+}
+
+func (s *clientSub) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *clientSub) Err() error {
+	select {
+	case <-s.done:
+		return s.reason
+	default:
+		return nil
+	}
+}
+
+// subscribe (re)creates the subscription on the current connection. The
+// credit given is the free room of inbox, and the replay starts after the
+// last message received.
+func (s *clientSub) subscribe(ctx context.Context) error {
+	cfg := s.cfg
+	// under frameMu: no credit for this key can be sent before the subscribe frame
+	s.frameMu.Lock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		s.frameMu.Unlock()
+		return nil
+	}
+	credit := cfg.BufferSize - s.held
+	s.ungranted = 0
+	if s.lastSeq > 0 {
+		cfg.ReplayFrom = s.lastSeq + 1
+	}
+	s.mu.Unlock()
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		s.frameMu.Unlock()
+		return err
+	}
+	cc, reqID, ch, err := s.client.send(frameSubscribe, func(e *encoder) {
+		e.uvarint(s.key)
+		e.uvarint(uint64(credit))
+		e.string(s.topic)
+		e.bytes(data)
+	}, nil)
+	s.frameMu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = s.client.wait(ctx, cc, reqID, ch)
+	return err
+}
+
+// push is called by the connection reader, the credits guarantee the room in inbox.
+func (s *clientSub) push(msg thebus.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.inbox <- msg:
+		s.held++
+		s.lastSeq = msg.Seq
+	default:
+	}
+}
+
+// consumed gives back the credits by batches of a quarter of the buffer.
+// The frame is written under frameMu only, see clientSub.
+func (s *clientSub) consumed() {
+	s.frameMu.Lock()
+	defer s.frameMu.Unlock()
+	s.mu.Lock()
+	s.held--
+	s.ungranted++
+	if s.ungranted < max(1, s.cfg.BufferSize/4) {
+		s.mu.Unlock()
+		return
+	}
+	s.client.mu.Lock()
+	cc := s.client.conn
+	s.client.mu.Unlock()
+	if cc == nil {
+		s.mu.Unlock()
+		return
+	}
+	var e encoder
+	e.uvarint(s.key)
+	e.uvarint(uint64(s.ungranted))
+	s.ungranted = 0
+	s.mu.Unlock()
+	_ = cc.write(frameCredit, e.buf)
+}
+
+// run hands the messages to the consumer until the subscription ends.
+func (s *clientSub) run(ctx context.Context) {
+	defer s.client.wg.Done()
+	defer close(s.messages)
+	deliver := thebus.ChainDelivery(s.cfg.Interceptors, s.id, func(msg thebus.Message) error {
+		if s.cfg.Handler != nil {
+			s.cfg.Handler(msg)
+			return nil
+		}
+		select {
+		case s.messages <- msg:
+		case <-s.done:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	for {
+		select {
+		case msg := <-s.inbox:
+			if s.cfg.Accepts(msg) {
+				_ = deliver(msg)
+			}
+			s.consumed()
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			s.close(ctx.Err())
+			return
+		}
+	}
+}
+
+// close ends the subscription and the server one (if connected).
+func (s *clientSub) close(reason error) {
+	s.closeOnce.Do(func() {
+		c := s.client
+		c.mu.Lock()
+		delete(c.subs, s.key)
+		cc := c.conn
+		c.mu.Unlock()
+		// under frameMu: ordered after a pending subscribe frame
+		s.frameMu.Lock()
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		if cc != nil {
+			var e encoder
+			e.uvarint(s.key)
+			_ = cc.write(frameUnsubscribe, e.buf)
+		}
+		s.frameMu.Unlock()
+		s.reason = reason
+		close(s.done)
+	})
+}
@@ -0,0 +1,353 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+// A frame is [length uint32 big endian][type byte][body], length counting the
+// type and the body. The bodies are made of uvarints, length-prefixed strings
+// and bytes; the rarely used structures (configs, stats) are JSON encoded.
+const (
+	framePublish     byte = iota + 1 // c->s: reqID, flags, topic, headers, payload
+	frameAck                         // s->c: reqID, ack
+	frameConfirm                     // s->c: reqID, ack (resolution of a PublishConfirm)
+	frameError                       // s->c: reqID, error
+	frameSubscribe                   // c->s: reqID, key, credit, topic, JSON SubscriptionConfig
+	frameUnsubscribe                 // c->s: key
+	frameResult                      // s->c: reqID, JSON result
+	frameMessage                     // s->c: key, message
+	frameCredit                      // c->s: key, n
+	frameEnd                         // s->c: key, error
+	frameCall                        // c->s: reqID, method, JSON arguments
+)
+
+// publish flags
+const flagConfirm = 1
+
+// methods of frameCall
+const (
+	callDeclareTopic byte = iota + 1
+	callDeleteTopic
+	callTopics
+	callStats
+	callUnsubscribe
+)
+
+const DefaultMaxFrameSize = 16 << 20
+
+var (
+	ErrDisconnected = errors.New("thebus.remote.disconnected")
+	errMalformed    = errors.New("thebus.remote.malformed_frame")
+	errFrameTooBig  = errors.New("thebus.remote.frame_too_big")
+)
+
+func writeFrame(w *bufio.Writer, typ byte, body []byte) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(body)+1))
+	header[4] = typ
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func readFrame(r *bufio.Reader, maxSize int) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length == 0 {
+		return 0, nil, errMalformed
+	}
+	if int64(length) > int64(maxSize) {
+		return 0, nil, errFrameTooBig
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+// ##############################################################################
+// ################################   ENCODING   ################################
+// ##############################################################################
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) headers(headers map[string]string) {
+	e.uvarint(uint64(len(headers)))
+	for k, v := range headers {
+		e.string(k)
+		e.string(v)
+	}
+}
+
+func (e *encoder) error(err error) {
+	code, msg := errorCode(err)
+	e.uvarint(code)
+	e.string(msg)
+}
+
+func (e *encoder) ack(ack thebus.PublishAck) {
+	e.string(ack.Topic)
+	e.uvarint(ack.Seq)
+	e.string(ack.MessageID)
+	e.bool(ack.Enqueued)
+	e.uvarint(uint64(ack.Subscribers))
+	e.bool(ack.Sync)
+	e.uvarint(uint64(ack.Delivered))
+	e.uvarint(uint64(ack.Dropped))
+	e.uvarint(uint64(ack.Failed))
+	e.uvarint(uint64(ack.Filtered))
+	e.uvarint(uint64(ack.Rejected))
+	e.bool(ack.Expired)
+	e.varint(int64(ack.Latency))
+	e.uvarint(uint64(len(ack.Deliveries)))
+	for _, d := range ack.Deliveries {
+		e.string(d.SubscriptionID)
+		e.string(string(d.Status))
+	}
+}
+
+func (e *encoder) message(msg thebus.Message) {
+	e.string(msg.Topic)
+	e.uvarint(msg.Seq)
+	e.string(msg.ID)
+	e.varint(msg.Timestamp.UnixNano())
+	e.headers(msg.Headers)
+	e.bytes(msg.Payload)
+}
+
+// decoder reads a body, the first error is kept in err and the next reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errMalformed
+	}
+	d.buf = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) int() int {
+	return int(d.uvarint())
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) bool() bool {
+	return d.byte() == 1
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) headers() map[string]string {
+	n := d.uvarint()
+	if n == 0 {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return nil
+	}
+	headers := make(map[string]string, n)
+	for range n {
+		k := d.string()
+		headers[k] = d.string()
+	}
+	return headers
+}
+
+func (d *decoder) error() error {
+	code := d.uvarint()
+	return remoteError(code, d.string())
+}
+
+func (d *decoder) ack() thebus.PublishAck {
+	ack := thebus.PublishAck{
+		Topic:       d.string(),
+		Seq:         d.uvarint(),
+		MessageID:   d.string(),
+		Enqueued:    d.bool(),
+		Subscribers: d.int(),
+		Sync:        d.bool(),
+		Delivered:   d.int(),
+		Dropped:     d.int(),
+		Failed:      d.int(),
+		Filtered:    d.int(),
+		Rejected:    d.int(),
+		Expired:     d.bool(),
+		Latency:     time.Duration(d.varint()),
+	}
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail()
+		return ack
+	}
+	for range n {
+		ack.Deliveries = append(ack.Deliveries, thebus.SubscriberDelivery{
+			SubscriptionID: d.string(),
+			Status:         thebus.DeliveryStatus(d.string()),
+		})
+	}
+	return ack
+}
+
+func (d *decoder) message() thebus.Message {
+	return thebus.Message{
+		Topic:     d.string(),
+		Seq:       d.uvarint(),
+		ID:        d.string(),
+		Timestamp: time.Unix(0, d.varint()).UTC(),
+		Headers:   d.headers(),
+		Payload:   d.bytes(),
+	}
+}
+
+// ##############################################################################
+// #################################   ERRORS   #################################
+// ##############################################################################
+
+// errorCodes are the errors carried across the connection, by index.
+// The other errors are given by message only.
+var errorCodes = []error{
+	nil,
+	thebus.ErrClosed,
+	thebus.ErrQueueFull,
+	thebus.ErrInvalidTopic,
+	thebus.ErrInvalidSubscriberID,
+	thebus.ErrInvalidTopicName,
+	thebus.ErrInvalidTopicNameReserved,
+	thebus.ErrUnsubscribed,
+	thebus.ErrTopicDeleted,
+	thebus.ErrSlowConsumer,
+	thebus.ErrRejected,
+	thebus.ErrTopicNotFound,
+	context.Canceled,
+	context.DeadlineExceeded,
+}
+
+const codeUnknown = 255
+
+func errorCode(err error) (uint64, string) {
+	if err == nil {
+		return 0, ""
+	}
+	for code, target := range errorCodes[1:] {
+		if errors.Is(err, target) {
+			return uint64(code + 1), err.Error()
+		}
+	}
+	return codeUnknown, err.Error()
+}
+
+// RemoteError is an error returned by the server. It matches the bus errors
+// (ErrQueueFull, ErrTopicDeleted...) with errors.Is.
+type RemoteError struct {
+	Message string
+	err     error
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.err
+}
+
+func remoteError(code uint64, msg string) error {
+	if code == 0 {
+		return nil
+	}
+	if code >= uint64(len(errorCodes)) {
+		return &RemoteError{Message: msg}
+	}
+	if target := errorCodes[code]; target.Error() != msg {
+		return &RemoteError{Message: msg, err: target}
+	}
+	return errorCodes[code]
+}
@@ -0,0 +1,315 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+func newBus(t *testing.T) thebus.Bus {
+	t.Helper()
+	bus, err := thebus.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = bus.Close() })
+	return bus
+}
+
+// serve starts a Server of bus on network and address, and returns its address.
+func serve(t *testing.T, bus thebus.Bus, network, address string, opts ...ServerOption) (*Server, string) {
+	t.Helper()
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(bus, opts...)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return srv, l.Addr().String()
+}
+
+func dial(t *testing.T, network, address string, opts ...ClientOption) *Client {
+	t.Helper()
+	c, err := Dial(network, address, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func receive(t *testing.T, sub thebus.Subscription) thebus.Message {
+	t.Helper()
+	select {
+	case msg := <-sub.Read():
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message")
+		return thebus.Message{}
+	}
+}
+
+// waitFor polls cond up to 2s
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func subscribers(bus thebus.Bus, topic string) int {
+	stats, _ := bus.Stats()
+	return stats.PerTopic[topic].Subscribers
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			address := "127.0.0.1:0"
+			if network == "unix" {
+				address = filepath.Join(t.TempDir(), "bus.sock")
+			}
+			bus := newBus(t)
+			_, addr := serve(t, bus, network, address)
+			c := dial(t, network, addr)
+
+			sub, err := c.Subscribe(context.Background(), "orders")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ack, err := c.Publish("orders", []byte("hello"), thebus.WithHeader("k", "v"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ack.Enqueued || ack.Seq != 1 || ack.Subscribers != 1 {
+				t.Fatalf("unexpected ack: %+v", ack)
+			}
+			msg := receive(t, sub)
+			if string(msg.Payload) != "hello" || msg.Seq != 1 || msg.Headers["k"] != "v" || msg.Timestamp.IsZero() {
+				t.Fatalf("unexpected message: %+v", msg)
+			}
+
+			// published in the server process
+			_, _ = bus.Publish("orders", []byte("local"))
+			if msg := receive(t, sub); string(msg.Payload) != "local" {
+				t.Fatalf("unexpected message: %+v", msg)
+			}
+
+			if err := sub.Unsubscribe(); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool { return subscribers(bus, "orders") == 0 })
+			if _, ok := <-sub.Read(); ok {
+				t.Fatal("expected the channel to be closed")
+			}
+			if !errors.Is(sub.Err(), thebus.ErrUnsubscribed) {
+				t.Fatalf("unexpected err: %v", sub.Err())
+			}
+		})
+	}
+}
+
+func TestPublishConfirmAndCalls(t *testing.T) {
+	bus := newBus(t)
+	_, addr := serve(t, bus, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr)
+
+	if err := c.DeclareTopic("events", thebus.TopicOptions{Retention: 10}); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := c.Subscribe(context.Background(), "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := c.PublishConfirm("events", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, sub)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ack, err := conf.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Delivered != 1 || ack.MessageID == "" || len(ack.Deliveries) != 1 {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+
+	topics := c.Topics()
+	if len(topics) != 1 || topics[0].Name != "events" || topics[0].Config.Retention != 10 {
+		t.Fatalf("unexpected topics: %+v", topics)
+	}
+	stats, err := c.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Totals.Published != 1 || stats.PerTopic["events"].Subscribers != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// errors keep their identity
+	if _, err := c.Publish("$thebus.x", nil); !errors.Is(err, thebus.ErrInvalidTopicNameReserved) {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// a subscription ended by the server bus
+	if err := c.DeleteTopic("events"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription not ended")
+	}
+	if !errors.Is(sub.Err(), thebus.ErrTopicDeleted) {
+		t.Fatalf("unexpected err: %v", sub.Err())
+	}
+}
+
+func TestContextAndClose(t *testing.T) {
+	bus := newBus(t)
+	_, addr := serve(t, bus, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := c.Subscribe(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := c.Subscribe(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return subscribers(bus, "t") == 2 })
+	cancel()
+	<-sub.Done()
+	if !errors.Is(sub.Err(), context.Canceled) {
+		t.Fatalf("unexpected err: %v", sub.Err())
+	}
+	waitFor(t, func() bool { return subscribers(bus, "t") == 1 })
+
+	_ = c.Close()
+	<-other.Done()
+	if !errors.Is(other.Err(), thebus.ErrClosed) {
+		t.Fatalf("unexpected err: %v", other.Err())
+	}
+	if _, err := c.Publish("t", nil); !errors.Is(err, thebus.ErrClosed) {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	waitFor(t, func() bool { return subscribers(bus, "t") == 0 })
+}
+
+func TestFlowControl(t *testing.T) {
+	bus := newBus(t)
+	_, addr := serve(t, bus, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr)
+
+	sub, err := c.Subscribe(context.Background(), "t", thebus.WithBufferSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 50 {
+		if _, err := c.Publish("t", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the consumer does not read: the server buffer overflows
+	waitFor(t, func() bool {
+		stats, _ := bus.Stats()
+		return stats.Totals.Delivered+stats.Totals.Dropped == 50
+	})
+	stats, _ := bus.Stats()
+	if stats.Totals.Dropped == 0 {
+		t.Fatalf("expected drops: %+v", stats.Totals)
+	}
+	received := 0
+	for done := false; !done; {
+		select {
+		case <-sub.Read():
+			received++
+		case <-time.After(100 * time.Millisecond):
+			done = true
+		}
+	}
+	// the server buffer, the message waiting for a credit and the client buffer
+	if uint64(received) != stats.Totals.Delivered || received > 4+1+4 {
+		t.Fatalf("received %d, delivered %d", received, stats.Totals.Delivered)
+	}
+
+	// the credits were given back
+	_, _ = c.Publish("t", []byte("after"))
+	if msg := receive(t, sub); string(msg.Payload) != "after" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
+
+func TestSubscriptionLimits(t *testing.T) {
+	bus := newBus(t)
+	_, addr := serve(t, bus, "tcp", "127.0.0.1:0", WithServerMaxBufferSize(8))
+	c := dial(t, "tcp", addr)
+
+	// the client config is not trusted: capped buffer, no spill directory
+	_, err := c.Subscribe(context.Background(), "t",
+		thebus.WithBufferSize(1<<16),
+		thebus.WithOverflowPolicy(thebus.OverflowPolicySpillToDisk),
+		thebus.WithSpillDir(t.TempDir()),
+		thebus.WithSubscriberName("limited"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs, err := bus.(thebus.AdminBus).Subscriptions("t")
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("unexpected subscriptions: %+v %v", subs, err)
+	}
+	if cfg := subs[0].Config; cfg.BufferSize != 8 || cfg.SpillDir != "" || cfg.Name != "limited" || cfg.OverflowPolicy != thebus.OverflowPolicySpillToDisk {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	bus := newBus(t)
+	if err := bus.DeclareTopic("t", thebus.TopicOptions{Retention: 10}); err != nil {
+		t.Fatal(err)
+	}
+	srv, addr := serve(t, bus, "tcp", "127.0.0.1:0")
+	c := dial(t, "tcp", addr, WithReconnectBackoff(10*time.Millisecond, 50*time.Millisecond))
+
+	sub, err := c.Subscribe(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = c.Publish("t", []byte("1"))
+	receive(t, sub)
+
+	_ = srv.Close()
+	waitFor(t, func() bool {
+		_, err := c.Publish("probe", nil)
+		return errors.Is(err, ErrDisconnected)
+	})
+	waitFor(t, func() bool { return subscribers(bus, "t") == 0 })
+	_, _ = bus.Publish("t", []byte("2")) // missed, then replayed
+
+	serve(t, bus, "tcp", addr)
+	if msg := receive(t, sub); string(msg.Payload) != "2" || msg.Seq != 2 {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+	waitFor(t, func() bool { return subscribers(bus, "t") == 1 })
+	if _, err := c.Publish("t", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, sub); string(msg.Payload) != "3" {
+		t.Fatalf("unexpected message: %+v", msg)
+	}
+}
@@ -0,0 +1,461 @@
+// Package remote shares a bus across processes: a Server exposes a Bus on
+// TCP or Unix domain sockets, and the Client returned by Dial implements
+// thebus.Bus on top of the connection.
+//
+// The protocol is made of length-prefixed binary frames. The deliveries are
+// flow controlled: the server sends at most BufferSize messages ahead of the
+// client consumption, the next ones wait in the server side subscription,
+// where its overflow policy (DropIfFull, SendTimeout, OverflowPolicy) applies.
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/sebundefined/thebus"
+)
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+// DefaultMaxBufferSize is the largest subscription buffer a client gets by default.
+const DefaultMaxBufferSize = 4096
+
+type serverConfig struct {
+	maxFrameSize  int
+	maxBufferSize int
+	logger        thebus.Logger
+}
+
+// ServerOption configures the Server.
+type ServerOption func(cfg *serverConfig)
+
+// WithServerMaxFrameSize limits the size of the frames sent by the clients,
+// a client sending a bigger frame is disconnected.
+func WithServerMaxFrameSize(size int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.maxFrameSize = size
+	}
+}
+
+// WithServerMaxBufferSize caps the BufferSize (and the credits) asked by the
+// clients for their subscriptions.
+func WithServerMaxBufferSize(size int) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.maxBufferSize = size
+	}
+}
+
+// WithServerLogger logs the connection errors.
+func WithServerLogger(logger thebus.Logger) ServerOption {
+	return func(cfg *serverConfig) {
+		cfg.logger = logger
+	}
+}
+
+// ##############################################################################
+// ################################   SERVER   ##################################
+// ##############################################################################
+
+// Server exposes a Bus to the clients of its listeners.
+type Server struct {
+	bus thebus.Bus
+	cfg serverConfig
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a Server exposing bus.
+func NewServer(bus thebus.Bus, opts ...ServerOption) *Server {
+	s := &Server{
+		bus: bus,
+		cfg: serverConfig{
+			maxFrameSize:  DefaultMaxFrameSize,
+			maxBufferSize: DefaultMaxBufferSize,
+			logger:        thebus.NoopLogger(),
+		},
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*serverConn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(&s.cfg)
+	}
+	return s
+}
+
+// ListenAndServe listens on network ("tcp", "unix"...) and address, then calls Serve.
+func (s *Server) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts the connections of l until Close. It returns nil after Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return thebus.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		c := s.newConn(netConn)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = netConn.Close()
+			return nil
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close closes the listeners and the connections, and waits for their
+// subscriptions to be released. The bus itself is not closed.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	for c := range s.conns {
+		_ = c.netConn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// ##############################################################################
+// ###############################   CONNECTION   ###############################
+// ##############################################################################
+
+type serverConn struct {
+	server  *Server
+	netConn net.Conn
+	reader  *bufio.Reader
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	subs map[uint64]*serverSub
+}
+
+// serverSub is a subscription of a client, key is chosen by the client.
+type serverSub struct {
+	key     uint64
+	sub     thebus.Subscription
+	credits chan struct{}
+}
+
+func (s *Server) newConn(netConn net.Conn) *serverConn {
+	c := &serverConn{
+		server:  s,
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+		subs:    make(map[uint64]*serverSub),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	return c
+}
+
+func (c *serverConn) serve() {
+	defer func() {
+		// the subscriptions are bound to ctx
+		c.cancel()
+		_ = c.netConn.Close()
+		c.wg.Wait()
+	}()
+	for {
+		typ, body, err := readFrame(c.reader, c.server.cfg.maxFrameSize)
+		if err != nil {
+			if errors.Is(err, errFrameTooBig) || errors.Is(err, errMalformed) {
+				c.server.cfg.logger.Warn("remote: closing connection", "remote", c.netConn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+		if err := c.handle(typ, &decoder{buf: body}); err != nil {
+			c.server.cfg.logger.Warn("remote: closing connection", "remote", c.netConn.RemoteAddr().String(), "err", err)
+			return
+		}
+	}
+}
+
+func (c *serverConn) handle(typ byte, d *decoder) error {
+	switch typ {
+	case framePublish:
+		reqID, flags := d.uvarint(), d.uvarint()
+		topic, headers, payload := d.string(), d.headers(), d.bytes()
+		if d.err != nil {
+			return d.err
+		}
+		c.publish(reqID, flags&flagConfirm != 0, topic, headers, payload)
+	case frameSubscribe:
+		reqID, key, credit, topic := d.uvarint(), d.uvarint(), d.int(), d.string()
+		var cfg thebus.SubscriptionConfig
+		if d.err == nil {
+			if err := json.Unmarshal(d.bytes(), &cfg); err != nil {
+				return err
+			}
+		}
+		if d.err != nil {
+			return d.err
+		}
+		c.subscribe(reqID, key, credit, topic, cfg)
+	case frameUnsubscribe:
+		key := d.uvarint()
+		if d.err != nil {
+			return d.err
+		}
+		c.mu.Lock()
+		ss := c.subs[key]
+		delete(c.subs, key)
+		c.mu.Unlock()
+		if ss != nil {
+			_ = ss.sub.Unsubscribe()
+		}
+	case frameCredit:
+		key, n := d.uvarint(), d.int()
+		if d.err != nil {
+			return d.err
+		}
+		c.mu.Lock()
+		ss := c.subs[key]
+		c.mu.Unlock()
+		if ss != nil {
+			ss.grant(n)
+		}
+	case frameCall:
+		reqID, method, args := d.uvarint(), d.byte(), d.bytes()
+		if d.err != nil {
+			return d.err
+		}
+		c.call(reqID, method, args)
+	default:
+		return errMalformed
+	}
+	return nil
+}
+
+func (c *serverConn) publish(reqID uint64, confirm bool, topic string, headers map[string]string, payload []byte) {
+	if !confirm {
+		ack, err := c.server.bus.Publish(topic, payload, thebus.WithHeaders(headers))
+		if err != nil {
+			c.writeError(reqID, err)
+			return
+		}
+		c.writeAck(frameAck, reqID, ack)
+		return
+	}
+	conf, err := c.server.bus.PublishConfirm(topic, payload, thebus.WithHeaders(headers))
+	if err != nil {
+		c.writeError(reqID, err)
+		return
+	}
+	c.writeAck(frameAck, reqID, thebus.PublishAck{Topic: topic, Enqueued: true})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		if ack, err := conf.Wait(c.ctx); err == nil {
+			c.writeAck(frameConfirm, reqID, ack)
+		}
+	}()
+}
+
+// Only the fields safe to take from a client are kept from cfg: the buffer is
+// capped by the server and the spill files go to the server default directory.
+func (c *serverConn) subscribe(reqID, key uint64, credit int, topic string, cfg thebus.SubscriptionConfig) {
+	maxBuffer := max(c.server.cfg.maxBufferSize, 1)
+	bufferSize := min(max(cfg.BufferSize, 1), maxBuffer)
+	credit = min(credit, maxBuffer)
+	sub, err := c.server.bus.Subscribe(c.ctx, topic, func(subCfg *thebus.SubscriptionConfig) {
+		subCfg.Name = cfg.Name
+		subCfg.Strategy = cfg.Strategy
+		subCfg.BufferSize = bufferSize
+		subCfg.SendTimeout = cfg.SendTimeout
+		subCfg.DropIfFull = cfg.DropIfFull
+		subCfg.ReplayFrom = cfg.ReplayFrom
+		subCfg.OverflowPolicy = cfg.OverflowPolicy
+		subCfg.HeaderFilters = cfg.HeaderFilters
+	})
+	if err != nil {
+		c.writeError(reqID, err)
+		return
+	}
+	ss := &serverSub{key: key, sub: sub, credits: make(chan struct{}, max(bufferSize, credit, 1))}
+	ss.grant(credit)
+	c.mu.Lock()
+	old := c.subs[key]
+	c.subs[key] = ss
+	c.mu.Unlock()
+	if old != nil {
+		_ = old.sub.Unsubscribe()
+	}
+	c.writeResult(reqID, nil)
+	c.wg.Add(1)
+	go c.forward(ss)
+}
+
+// forward sends the messages of ss as long as the client gives credits.
+func (c *serverConn) forward(ss *serverSub) {
+	defer c.wg.Done()
+	for msg := range ss.sub.Read() {
+		select {
+		case <-ss.credits:
+		case <-c.ctx.Done():
+			return
+		}
+		var e encoder
+		e.uvarint(ss.key)
+		e.message(msg)
+		if err := c.write(frameMessage, e.buf); err != nil {
+			c.cancel()
+			return
+		}
+	}
+	// ended by the bus (topic deleted, evicted, closed...) unless by the client
+	err := ss.sub.Err()
+	if c.ctx.Err() != nil || errors.Is(err, thebus.ErrUnsubscribed) {
+		return
+	}
+	c.mu.Lock()
+	if c.subs[ss.key] == ss {
+		delete(c.subs, ss.key)
+	}
+	c.mu.Unlock()
+	var e encoder
+	e.uvarint(ss.key)
+	e.error(err)
+	_ = c.write(frameEnd, e.buf)
+}
+
+func (ss *serverSub) grant(n int) {
+	for range n {
+		select {
+		case ss.credits <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+func (c *serverConn) call(reqID uint64, method byte, args []byte) {
+	var (
+		result any
+		err    error
+	)
+	switch method {
+	case callDeclareTopic:
+		var req struct {
+			Topic   string
+			Options thebus.TopicOptions
+		}
+		if err = json.Unmarshal(args, &req); err == nil {
+			err = c.server.bus.DeclareTopic(req.Topic, req.Options)
+		}
+	case callDeleteTopic:
+		var topic string
+		if err = json.Unmarshal(args, &topic); err == nil {
+			err = c.server.bus.DeleteTopic(topic)
+		}
+	case callTopics:
+		result = c.server.bus.Topics()
+	case callStats:
+		result, err = c.server.bus.Stats()
+	case callUnsubscribe:
+		var req struct{ Topic, ID string }
+		if err = json.Unmarshal(args, &req); err == nil {
+			err = c.server.bus.Unsubscribe(req.Topic, req.ID)
+		}
+	default:
+		err = errMalformed
+	}
+	if err != nil {
+		c.writeError(reqID, err)
+		return
+	}
+	c.writeResult(reqID, result)
+}
+
+func (c *serverConn) writeAck(typ byte, reqID uint64, ack thebus.PublishAck) {
+	var e encoder
+	e.uvarint(reqID)
+	e.ack(ack)
+	_ = c.write(typ, e.buf)
+}
+
+func (c *serverConn) writeError(reqID uint64, err error) {
+	var e encoder
+	e.uvarint(reqID)
+	e.error(err)
+	_ = c.write(frameError, e.buf)
+}
+
+func (c *serverConn) writeResult(reqID uint64, result any) {
+	var e encoder
+	e.uvarint(reqID)
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			c.writeError(reqID, err)
+			return
+		}
+		e.bytes(data)
+	} else {
+		e.bytes(nil)
+	}
+	_ = c.write(frameResult, e.buf)
+}
+
+func (c *serverConn) write(typ byte, body []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return writeFrame(c.writer, typ, body)
+}
@@ -0,0 +1,267 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newServer(t *testing.T, opts ...Option) (thebus.Bus, string) {
+	t.Helper()
+	bus, err := thebus.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(bus, opts...)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() {
+		_ = srv.Close()
+		_ = bus.Close()
+	})
+	return bus, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns its reply
+func (c *client) do(args ...string) any {
+	c.t.Helper()
+	c.send(args...)
+	return c.reply()
+}
+
+func (c *client) send(args ...string) {
+	c.t.Helper()
+	cmd := appendArray(nil, len(args))
+	for _, arg := range args {
+		cmd = appendBulk(cmd, arg)
+	}
+	if _, err := c.conn.Write(cmd); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// reply reads a reply: string (simple), error, int, []byte (bulk), nil or []any
+func (c *client) reply() any {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return errors.New(line[1:])
+	case ':':
+		n, _ := strconv.Atoi(line[1:])
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatalf("read: %v", err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]any, n)
+		for i := range items {
+			items[i] = c.reply()
+		}
+		return items
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func (c *client) expect(want any, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); !reflect.DeepEqual(got, want) {
+		c.t.Fatalf("%v: expected %#v, got %#v", args, want, got)
+	}
+}
+
+func (c *client) expectReply(want any) {
+	c.t.Helper()
+	if got := c.reply(); !reflect.DeepEqual(got, want) {
+		c.t.Fatalf("expected %#v, got %#v", want, got)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"news.*", "news.sport", true},
+		{"news.*", "news.sport.foot", true},
+		{"news.*", "weather", false},
+		{"*", "", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.s); got != tt.match {
+			t.Errorf("matchGlob(%q, %q) = %v", tt.pattern, tt.s, got)
+		}
+	}
+	if matchPattern("*", "$thebus.slow_consumer") || !matchPattern("$thebus.*", "$thebus.slow_consumer") {
+		t.Error("the system topics must only match the $ patterns")
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	bus, addr := newServer(t)
+	sub := dial(t, addr)
+	pub := dial(t, addr)
+
+	sub.expect([]any{"subscribe", "news", 1}, "SUBSCRIBE", "news")
+	sub.expect([]any{"subscribe", "other", 2}, "subscribe", "other")
+	pub.expect(1, "PUBLISH", "news", "hello")
+	sub.expectReply([]any{"message", "news", "hello"})
+
+	if _, err := bus.Publish("news", []byte("in-process")); err != nil {
+		t.Fatal(err)
+	}
+	sub.expectReply([]any{"message", "news", "in-process"})
+
+	// only the pub/sub commands while subscribed
+	if err, ok := sub.do("PUBLISH", "news", "x").(error); !ok || !strings.Contains(err.Error(), "only (P)SUBSCRIBE") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+	sub.expect([]any{"pong", ""}, "PING")
+
+	sub.send("UNSUBSCRIBE")
+	sub.expectReply([]any{"unsubscribe", "news", 1})
+	sub.expectReply([]any{"unsubscribe", "other", 0})
+	sub.expect("PONG", "PING")
+	pub.expect(0, "PUBLISH", "news", "nobody")
+}
+
+func TestPatterns(t *testing.T) {
+	bus, addr := newServer(t)
+	if err := bus.DeclareTopic("news.existing", thebus.TopicOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	sub := dial(t, addr)
+	pub := dial(t, addr)
+
+	sub.expect([]any{"psubscribe", "news.*", 1}, "PSUBSCRIBE", "news.*")
+	pub.expect(1, "PUBLISH", "news.existing", "a")
+	sub.expectReply([]any{"pmessage", "news.*", "news.existing", "a"})
+	pub.expect(1, "PUBLISH", "news.new", "b") // attached before the publish
+	sub.expectReply([]any{"pmessage", "news.*", "news.new", "b"})
+	pub.expect(0, "PUBLISH", "weather", "c")
+
+	pub.expect(1, "PUBSUB", "NUMPAT")
+	pub.expect([]any{"news.existing", "news.new"}, "PUBSUB", "CHANNELS", "news.*")
+	pub.expect([]any{"news.new", 1, "weather", 0}, "PUBSUB", "NUMSUB", "news.new", "weather")
+
+	sub.expect([]any{"punsubscribe", "news.*", 0}, "PUNSUBSCRIBE", "news.*")
+	sub.expect([]any{"punsubscribe", nil, 0}, "PUNSUBSCRIBE")
+	pub.expect(0, "PUBSUB", "NUMPAT")
+
+	// RESET releases everything before its reply
+	sub.expect([]any{"psubscribe", "news.*", 1}, "PSUBSCRIBE", "news.*")
+	sub.expect([]any{"subscribe", "weather", 2}, "SUBSCRIBE", "weather")
+	sub.expect("RESET", "RESET")
+	pub.expect(0, "PUBSUB", "NUMPAT")
+	pub.expect(0, "PUBLISH", "weather", "d")
+	pub.expect(0, "PUBLISH", "news.new", "e")
+	sub.expect("PONG", "PING")
+}
+
+func TestCommands(t *testing.T) {
+	_, addr := newServer(t)
+	c := dial(t, addr)
+
+	// inline command
+	if _, err := io.WriteString(c.conn, "PING\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.expectReply("PONG")
+	c.expect("hi", "PING", "hi")
+	c.expect("hi", "ECHO", "hi")
+	c.expect("OK", "SELECT", "0")
+	c.expect("OK", "CLIENT", "SETNAME", "svc")
+	if err, ok := c.do("GET", "k").(error); !ok || err.Error() != "ERR unknown command 'GET'" {
+		t.Fatalf("expected an error, got %v", err)
+	}
+	if err, ok := c.do("PUBLISH", "$thebus.x", "m").(error); !ok || !strings.Contains(err.Error(), thebus.ErrInvalidTopicNameReserved.Error()) {
+		t.Fatalf("expected an error, got %v", err)
+	}
+	c.expect("OK", "QUIT")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection closed, got %v", err)
+	}
+
+	c = dial(t, addr)
+	if _, err := io.WriteString(c.conn, "*1\r\n+PING\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := c.reply().(error); !ok || !strings.HasPrefix(err.Error(), "ERR Protocol error") {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection closed, got %v", err)
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	read := func(input string, maxBulkSize int) ([]string, error) {
+		return readCommand(bufio.NewReader(strings.NewReader(input)), maxBulkSize)
+	}
+	if args, err := read("*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n", DefaultMaxBulkSize); err != nil || !reflect.DeepEqual(args, []string{"ECHO", "hi"}) {
+		t.Fatalf("unexpected command: %q %v", args, err)
+	}
+	// the declared length is not allocated up front, the missing data ends the read
+	if _, err := read("*1\r\n$1000000\r\nshort", DefaultMaxBulkSize); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+	var perr errProtocol
+	if _, err := read("*1\r\n$11\r\nhello world\r\n", 10); !errors.As(err, &perr) {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+	if _, err := read("*"+strconv.Itoa(maxArgs+1)+"\r\n", DefaultMaxBulkSize); !errors.As(err, &perr) {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+}
@@ -0,0 +1,549 @@
+// Package resp is a Redis Pub/Sub compatible listener of a bus (RESP2
+// protocol), so that the services using Redis PUBLISH/SUBSCRIBE can be
+// pointed at an embedded bus in the local environments.
+//
+// The channels are the topics. The supported commands are PUBLISH,
+// SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE, PUNSUBSCRIBE, PUBSUB (CHANNELS, NUMSUB,
+// NUMPAT), PING, ECHO, SELECT, CLIENT, RESET and QUIT; the other commands are
+// answered with an error.
+//
+// The bus has no pattern subscription: a PSUBSCRIBE subscribes the matching
+// topics existing at PSUBSCRIBE time, the ones published through this
+// listener, and the ones found every WithTopicRefresh interval. Like the
+// NATS and MQTT wildcards, the patterns do not match the topics starting
+// with "$" unless they start with "$" too.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sebundefined/thebus"
+	"github.com/sebundefined/thebus/internal/topicfeed"
+)
+
+const (
+	DefaultMaxBulkSize  = 1 << 20
+	DefaultTopicRefresh = time.Second
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+type config struct {
+	maxBulkSize   int
+	topicRefresh  time.Duration
+	writeTimeout  time.Duration
+	subscribeOpts []thebus.SubscribeOption
+	logger        thebus.Logger
+}
+
+// Option configures the Server.
+type Option func(cfg *config)
+
+// WithMaxBulkSize limits the size of the arguments sent by the clients,
+// a client sending a bigger one is disconnected.
+func WithMaxBulkSize(size int) Option {
+	return func(cfg *config) {
+		cfg.maxBulkSize = size
+	}
+}
+
+// WithTopicRefresh sets the interval of the lookup of the new topics for the
+// pattern subscriptions (0 = off).
+func WithTopicRefresh(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.topicRefresh = interval
+	}
+}
+
+// WithWriteTimeout sets the deadline of a write to a client, the client is disconnected above.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.writeTimeout = timeout
+	}
+}
+
+// WithSubscribeOptions sets the options of the bus subscriptions made for the
+// clients (buffer size, overflow policy...).
+func WithSubscribeOptions(opts ...thebus.SubscribeOption) Option {
+	return func(cfg *config) {
+		cfg.subscribeOpts = append(cfg.subscribeOpts, opts...)
+	}
+}
+
+// WithLogger logs the protocol errors of the clients.
+func WithLogger(logger thebus.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
+
+// ##############################################################################
+// ################################   SERVER   ##################################
+// ##############################################################################
+
+// Server serves the Redis Pub/Sub commands on top of a bus.
+type Server struct {
+	bus thebus.Bus
+	cfg config
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	feeds  *topicfeed.Registry
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+}
+
+// NewServer returns a RESP listener of bus.
+func NewServer(bus thebus.Bus, opts ...Option) *Server {
+	s := &Server{
+		bus: bus,
+		cfg: config{
+			maxBulkSize:  DefaultMaxBulkSize,
+			topicRefresh: DefaultTopicRefresh,
+			writeTimeout: DefaultWriteTimeout,
+			logger:       thebus.NoopLogger(),
+		},
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*conn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(&s.cfg)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.feeds = topicfeed.NewRegistry(s.ctx, bus, s.cfg.subscribeOpts...)
+	if s.cfg.topicRefresh > 0 {
+		s.feeds.RefreshEvery(s.cfg.topicRefresh)
+	}
+	return s
+}
+
+// ListenAndServe listens on network ("tcp", "unix") and address, then calls Serve.
+func (s *Server) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts the connections of l until Close. It returns nil after Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return thebus.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = netConn.Close()
+			return nil
+		}
+		c := &conn{
+			server:   s,
+			netConn:  netConn,
+			reader:   bufio.NewReaderSize(netConn, maxInlineSize),
+			writer:   bufio.NewWriter(netConn),
+			channels: make(map[string]*topicfeed.Feed),
+			patterns: make(map[string]*topicfeed.Feed),
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close closes the listeners, the connections and their subscriptions.
+// The bus itself is not closed.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	for c := range s.conns {
+		_ = c.netConn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.feeds.Wait()
+	return nil
+}
+
+// numPat returns the number of pattern subscriptions of the clients
+func (s *Server) numPat() int {
+	s.mu.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	n := 0
+	for _, c := range conns {
+		c.mu.Lock()
+		n += len(c.patterns)
+		c.mu.Unlock()
+	}
+	return n
+}
+
+// ##############################################################################
+// ###############################   CONNECTION   ###############################
+// ##############################################################################
+
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	reader  *bufio.Reader
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	mu       sync.Mutex
+	channels map[string]*topicfeed.Feed
+	patterns map[string]*topicfeed.Feed
+}
+
+// errQuit closes the connection once answered
+var errQuit = errors.New("quit")
+
+func (c *conn) serve() {
+	defer func() {
+		_ = c.netConn.Close()
+		for _, feed := range c.unsubscribeAll() {
+			c.server.feeds.Release(feed)
+		}
+	}()
+	for {
+		args, err := readCommand(c.reader, c.server.cfg.maxBulkSize)
+		var perr errProtocol
+		if errors.As(err, &perr) {
+			c.server.cfg.logger.Warn("resp: closing connection", "remote", c.netConn.RemoteAddr().String(), "err", err)
+			_ = c.write(appendError(nil, "ERR "+perr.Error()))
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if err := c.handle(args); err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) subscribed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+// subscriptions returns the count given in the (un)subscribe replies, under mu
+func (c *conn) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+func (c *conn) handle(args []string) error {
+	name := strings.ToLower(args[0])
+	if c.subscribed() && !slices.Contains([]string{"subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ping", "quit", "reset"}, name) {
+		return c.write(appendError(nil, fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", name)))
+	}
+	switch name {
+	case "publish":
+		if len(args) != 3 {
+			return c.wrongArgs(name)
+		}
+		c.server.feeds.Attach(args[1])
+		ack, err := c.server.bus.Publish(args[1], []byte(args[2]))
+		if err != nil {
+			return c.write(appendError(nil, "ERR "+err.Error()))
+		}
+		return c.write(appendInt(nil, ack.Subscribers))
+	case "subscribe", "psubscribe":
+		if len(args) < 2 {
+			return c.wrongArgs(name)
+		}
+		return c.subscribe(name == "psubscribe", args[1:])
+	case "unsubscribe", "punsubscribe":
+		return c.unsubscribe(name == "punsubscribe", args[1:])
+	case "pubsub":
+		return c.pubsub(args[1:])
+	case "ping":
+		if c.subscribed() {
+			reply := appendArray(nil, 2)
+			reply = appendBulk(reply, "pong")
+			if len(args) > 1 {
+				return c.write(appendBulk(reply, args[1]))
+			}
+			return c.write(appendBulk(reply, ""))
+		}
+		if len(args) > 1 {
+			return c.write(appendBulk(nil, args[1]))
+		}
+		return c.write(appendSimple(nil, "PONG"))
+	case "echo":
+		if len(args) != 2 {
+			return c.wrongArgs(name)
+		}
+		return c.write(appendBulk(nil, args[1]))
+	case "select", "client":
+		// no database and no client state: accepted for the client libraries
+		return c.write(appendSimple(nil, "OK"))
+	case "reset":
+		// closed before the reply, like in unsubscribe
+		for _, feed := range c.unsubscribeAll() {
+			feed.Close()
+		}
+		return c.write(appendSimple(nil, "RESET"))
+	case "quit":
+		_ = c.write(appendSimple(nil, "OK"))
+		return errQuit
+	default:
+		return c.write(appendError(nil, fmt.Sprintf("ERR unknown command '%s'", args[0])))
+	}
+}
+
+func (c *conn) wrongArgs(name string) error {
+	return c.write(appendError(nil, fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)))
+}
+
+// subscribe subscribes the channels or patterns. The write lock is held until
+// the replies are sent: the messages of the new subscriptions come after.
+func (c *conn) subscribe(pattern bool, names []string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+	}
+	var reply []byte
+	for _, name := range names {
+		if err := c.addFeed(pattern, name); err != nil {
+			reply = appendError(reply, "ERR "+err.Error())
+			continue
+		}
+		c.mu.Lock()
+		count := c.subscriptions()
+		c.mu.Unlock()
+		reply = appendArray(reply, 3)
+		reply = appendBulk(reply, kind)
+		reply = appendBulk(reply, name)
+		reply = appendInt(reply, count)
+	}
+	return c.writeLocked(reply)
+}
+
+func (c *conn) addFeed(pattern bool, name string) error {
+	feeds := c.channels
+	if pattern {
+		feeds = c.patterns
+	}
+	c.mu.Lock()
+	_, ok := feeds[name]
+	c.mu.Unlock()
+	if ok {
+		return nil
+	}
+	var (
+		feed *topicfeed.Feed
+		err  error
+	)
+	if pattern {
+		feed, err = c.server.feeds.Subscribe(name, func(topic string) bool {
+			return matchPattern(name, topic)
+		}, func(msg thebus.Message) {
+			reply := appendArray(nil, 4)
+			reply = appendBulk(reply, "pmessage")
+			reply = appendBulk(reply, name)
+			reply = appendBulk(reply, msg.Topic)
+			c.deliver(appendBulk(reply, string(msg.Payload)))
+		})
+	} else {
+		feed, err = c.server.feeds.Subscribe(name, nil, func(msg thebus.Message) {
+			reply := appendArray(nil, 3)
+			reply = appendBulk(reply, "message")
+			reply = appendBulk(reply, msg.Topic)
+			c.deliver(appendBulk(reply, string(msg.Payload)))
+		})
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	feeds[name] = feed
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) deliver(reply []byte) {
+	if err := c.write(reply); err != nil {
+		_ = c.netConn.Close()
+	}
+}
+
+// unsubscribe removes the channels or patterns, all of them without names.
+func (c *conn) unsubscribe(pattern bool, names []string) error {
+	kind := "unsubscribe"
+	feeds := c.channels
+	if pattern {
+		kind = "punsubscribe"
+		feeds = c.patterns
+	}
+	c.mu.Lock()
+	if len(names) == 0 {
+		for name := range feeds {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+	var reply []byte
+	if len(names) == 0 {
+		reply = appendArray(reply, 3)
+		reply = appendBulk(reply, kind)
+		reply = appendNull(reply)
+		reply = appendInt(reply, c.subscriptions())
+	}
+	var closing []*topicfeed.Feed
+	for _, name := range names {
+		if feed, ok := feeds[name]; ok {
+			delete(feeds, name)
+			closing = append(closing, feed)
+		}
+		reply = appendArray(reply, 3)
+		reply = appendBulk(reply, kind)
+		reply = appendBulk(reply, name)
+		reply = appendInt(reply, c.subscriptions())
+	}
+	c.mu.Unlock()
+	// closed before the reply: a PUBLISH after it no longer counts this connection
+	for _, feed := range closing {
+		feed.Close()
+	}
+	return c.write(reply)
+}
+
+// unsubscribeAll forgets all the feeds of the connection and returns them,
+// to be closed by the caller once c.mu is released.
+func (c *conn) unsubscribeAll() []*topicfeed.Feed {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var closing []*topicfeed.Feed
+	for _, feeds := range []map[string]*topicfeed.Feed{c.channels, c.patterns} {
+		for name, feed := range feeds {
+			delete(feeds, name)
+			closing = append(closing, feed)
+		}
+	}
+	return closing
+}
+
+// pubsub answers PUBSUB CHANNELS, NUMSUB and NUMPAT from the bus Stats.
+func (c *conn) pubsub(args []string) error {
+	if len(args) == 0 {
+		return c.wrongArgs("pubsub")
+	}
+	sub := strings.ToLower(args[0])
+	if sub == "numpat" {
+		return c.write(appendInt(nil, c.server.numPat()))
+	}
+	if sub != "channels" && sub != "numsub" {
+		return c.write(appendError(nil, fmt.Sprintf("ERR unknown subcommand '%s'", args[0])))
+	}
+	stats, err := c.server.bus.Stats()
+	if err != nil {
+		return c.write(appendError(nil, "ERR "+err.Error()))
+	}
+	var reply []byte
+	if sub == "numsub" {
+		reply = appendArray(reply, 2*len(args[1:]))
+		for _, channel := range args[1:] {
+			reply = appendBulk(reply, channel)
+			reply = appendInt(reply, stats.PerTopic[channel].Subscribers)
+		}
+		return c.write(reply)
+	}
+	var channels []string
+	for topic, ts := range stats.PerTopic {
+		if ts.Subscribers > 0 && (len(args) < 2 || matchPattern(args[1], topic)) {
+			channels = append(channels, topic)
+		}
+	}
+	slices.Sort(channels)
+	reply = appendArray(reply, len(channels))
+	for _, channel := range channels {
+		reply = appendBulk(reply, channel)
+	}
+	return c.write(reply)
+}
+
+// matchPattern is matchGlob, not matching the system topics unless the pattern starts with "$"
+func matchPattern(pattern, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(pattern, "$") {
+		return false
+	}
+	return matchGlob(pattern, topic)
+}
+
+func (c *conn) write(reply []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeLocked(reply)
+}
+
+func (c *conn) writeLocked(reply []byte) error {
+	if c.server.cfg.writeTimeout > 0 {
+		_ = c.netConn.SetWriteDeadline(time.Now().Add(c.server.cfg.writeTimeout))
+	}
+	if _, err := c.writer.Write(reply); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
@@ -0,0 +1,144 @@
+package thebus
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown checks if the subscriber buffers are drained
+const shutdownPollInterval = 5 * time.Millisecond
+
+// ShutdownReport is returned by Shutdown. It gives the messages left
+// undelivered when the bus stopped.
+type ShutdownReport struct {
+	// Drained is true if everything was delivered and consumed before the deadline
+	Drained bool
+	// Undelivered is the total of undelivered messages (sum of PerTopic)
+	Undelivered int
+	// PerTopic contains only the topics with undelivered messages
+	PerTopic map[string]TopicShutdownReport
+	// Running is the number of fan-out workers still running when Shutdown
+	// returned, e.g. blocked in a Handler past the deadline
+	Running int
+}
+
+// TopicShutdownReport gives the undelivered messages of a topic.
+type TopicShutdownReport struct {
+	Queued   int // still in the topic queue, never fanned out
+	Buffered int // in the subscriber buffers (or spilled on disk), never read
+}
+
+// Shutdown stops accepting publishes and subscriptions, then waits until the
+// topic queues are fanned out and the subscriber buffers are consumed, or until
+// ctx is done. In the latter case the delivery is force-stopped and the
+// returned error is ctx.Err(). In both cases all subscriptions are closed with
+// ErrClosed and the report tells how many messages were left undelivered, and
+// how many fan-out workers were still running past the deadline.
+// Calling Shutdown or Close on a stopped bus is a no-op.
+func (b *bus) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	if !b.open.CompareAndSwap(true, false) {
+		return ShutdownReport{Drained: true}, nil
+	}
+	close(b.stop)
+	states := b.closeQueues()
+
+	workersDone := make(chan struct{})
+	var running atomic.Int64
+	running.Store(int64(len(states)))
+	if len(states) == 0 {
+		close(workersDone)
+	}
+	for _, st := range states {
+		go func() {
+			st.wg.Wait()
+			if running.Add(-1) == 0 {
+				close(workersDone)
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case <-workersDone:
+		err = b.waitBuffersDrained(ctx, states)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	report := b.undeliveredReport(states)
+	// Closing the subscriptions aborts the in-flight deliveries, the workers
+	// then drop what is left in the queues.
+	for _, st := range states {
+		b.mutex.RLock()
+		subs := snapshotSubsLocked(st.subs)
+		b.mutex.RUnlock()
+		for _, sub := range subs {
+			sub.closeWithReason(ErrClosed)
+		}
+	}
+	// a Handler ignores the closed subscription, do not wait past the deadline
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		report.Running = int(running.Load())
+	}
+
+	b.mutex.Lock()
+	b.subscriptions = make(map[string]*topicState)
+	b.mutex.Unlock()
+	return report, err
+}
+
+// closeQueues closes the inQueue of each topic so the workers stop once
+// the queue is drained. It returns the topics by name.
+func (b *bus) closeQueues() map[string]*topicState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	states := make(map[string]*topicState, len(b.subscriptions))
+	for topic, st := range b.subscriptions {
+		states[topic] = st
+		if st.closed.CompareAndSwap(false, true) {
+			close(st.inQueue)
+		}
+	}
+	return states
+}
+
+// waitBuffersDrained polls the subscriber buffers until they are empty or ctx is done.
+func (b *bus) waitBuffersDrained(ctx context.Context, states map[string]*topicState) error {
+	ticker := b.cfg.Clock.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if b.undeliveredReport(states).Undelivered == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C():
+		}
+	}
+}
+
+func (b *bus) undeliveredReport(states map[string]*topicState) ShutdownReport {
+	report := ShutdownReport{PerTopic: make(map[string]TopicShutdownReport)}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for topic, st := range states {
+		tr := TopicShutdownReport{Queued: len(st.inQueue)}
+		for _, sub := range st.subs {
+			tr.Buffered += len(sub.messageChan)
+			if sub.spill != nil {
+				tr.Buffered += sub.spill.Len()
+			}
+		}
+		if tr.Queued+tr.Buffered == 0 {
+			continue
+		}
+		report.PerTopic[topic] = tr
+		report.Undelivered += tr.Queued + tr.Buffered
+	}
+	report.Drained = report.Undelivered == 0
+	return report
+}
@@ -0,0 +1,218 @@
+package thebus
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SystemTopicPrefix is the prefix of the topics reserved by thebus.
+// Publishing on them returns ErrInvalidTopicNameReserved, subscribing is allowed.
+const SystemTopicPrefix = "$thebus."
+
+// SystemTopicSlowConsumer receives a SlowConsumerEvent (JSON encoded) each time
+// a subscriber is detected as slow and SlowConsumerActionEvent is enabled.
+const SystemTopicSlowConsumer = SystemTopicPrefix + "slow_consumer"
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// SlowConsumerAction is what the bus does once a subscriber is detected as slow.
+type SlowConsumerAction string
+
+const (
+	SlowConsumerActionUnknown SlowConsumerAction = "UNKNOWN"
+	// SlowConsumerActionWarn logs a warning with the configured Logger
+	SlowConsumerActionWarn SlowConsumerAction = "WARN"
+	// SlowConsumerActionEvent publishes a SlowConsumerEvent on SystemTopicSlowConsumer
+	SlowConsumerActionEvent SlowConsumerAction = "EVENT"
+	// SlowConsumerActionDegrade marks the subscriber as degraded in Stats
+	SlowConsumerActionDegrade SlowConsumerAction = "DEGRADE"
+	// SlowConsumerActionEvict unsubscribes the subscriber and closes its channel
+	SlowConsumerActionEvict SlowConsumerAction = "EVICT"
+)
+
+func (enum SlowConsumerAction) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(SlowConsumerActionUnknown)
+	}
+	return string(enum)
+}
+
+func SlowConsumerActionValues() []SlowConsumerAction {
+	return []SlowConsumerAction{
+		SlowConsumerActionWarn,
+		SlowConsumerActionEvent,
+		SlowConsumerActionDegrade,
+		SlowConsumerActionEvict,
+	}
+}
+
+func (enum SlowConsumerAction) IsValid() bool {
+	if slices.Contains(SlowConsumerActionValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum SlowConsumerAction) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *SlowConsumerAction) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := SlowConsumerAction(tmp)
+	if !fs.IsValid() {
+		fs = SlowConsumerActionUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// ##############################################################################
+// ################################   POLICY   ##################################
+// ##############################################################################
+
+// SlowConsumerPolicy configures the slow consumer detection.
+// A subscriber is slow as soon as one of the enabled thresholds is reached
+// (0 = threshold disabled). The Actions are applied once when the subscriber
+// becomes slow, it recovers as soon as a message is delivered with room left
+// in its buffer.
+type SlowConsumerPolicy struct {
+	MaxConsecutiveTimeouts int           // deliveries in a row that timed out or were dropped because the buffer was full
+	MaxBufferFullDuration  time.Duration // how long the buffer can stay full
+	MaxLag                 uint64        // topic Seq minus the last Seq delivered to the subscriber
+	Actions                []SlowConsumerAction
+}
+
+// Enabled reports if at least one threshold and one action are set
+func (p SlowConsumerPolicy) Enabled() bool {
+	if len(p.Actions) == 0 {
+		return false
+	}
+	return p.MaxConsecutiveTimeouts > 0 || p.MaxBufferFullDuration > 0 || p.MaxLag > 0
+}
+
+func (p SlowConsumerPolicy) has(action SlowConsumerAction) bool {
+	return slices.Contains(p.Actions, action)
+}
+
+// SlowConsumerEvent is the payload published on SystemTopicSlowConsumer.
+type SlowConsumerEvent struct {
+	Topic               string        `json:"topic"`
+	SubscriptionID      string        `json:"subscriptionId"`
+	Reason              string        `json:"reason"`
+	ConsecutiveTimeouts int           `json:"consecutiveTimeouts"`
+	BufferFullFor       time.Duration `json:"bufferFullFor"`
+	Lag                 uint64        `json:"lag"`
+	Evicted             bool          `json:"evicted"`
+	At                  time.Time     `json:"at"`
+}
+
+// slowConsumerState is the detection state of a subscription.
+// It is only accessed by the topic fan-out worker.
+type slowConsumerState struct {
+	consecutiveTimeouts int
+	fullSince           time.Time
+	lastSeq             uint64
+	reported            bool
+}
+
+// checkSlowConsumer updates the detection state of sub after a delivery and
+// applies the configured actions. It returns true if sub was evicted.
+func (b *bus) checkSlowConsumer(topic string, state *topicState, sub *subscription, seq uint64, res deliveryResult) bool {
+	policy := b.cfg.SlowConsumer
+	if !policy.Enabled() {
+		return false
+	}
+	now := b.cfg.Clock.Now()
+	sc := &sub.slow
+	full := len(sub.messageChan) == cap(sub.messageChan)
+	if sc.lastSeq == 0 {
+		// the lag starts when the subscriber joined, not at the topic creation
+		sc.lastSeq = seq - 1
+	}
+	if res.delivered || res.spilled {
+		sc.lastSeq = seq
+	}
+	if res.delivered && res.evicted == 0 {
+		sc.consecutiveTimeouts = 0
+	} else {
+		sc.consecutiveTimeouts++
+	}
+	if full {
+		if sc.fullSince.IsZero() {
+			sc.fullSince = now
+		}
+	} else {
+		sc.fullSince = time.Time{}
+	}
+
+	event := SlowConsumerEvent{
+		Topic:               topic,
+		SubscriptionID:      sub.subscriptionID,
+		ConsecutiveTimeouts: sc.consecutiveTimeouts,
+		Lag:                 state.seq.Load() - sc.lastSeq,
+		At:                  now,
+	}
+	if !sc.fullSince.IsZero() {
+		event.BufferFullFor = now.Sub(sc.fullSince)
+	}
+	switch {
+	case policy.MaxConsecutiveTimeouts > 0 && event.ConsecutiveTimeouts >= policy.MaxConsecutiveTimeouts:
+		event.Reason = "consecutive_timeouts"
+	case policy.MaxBufferFullDuration > 0 && event.BufferFullFor >= policy.MaxBufferFullDuration:
+		event.Reason = "buffer_full"
+	case policy.MaxLag > 0 && event.Lag >= policy.MaxLag:
+		event.Reason = "lag"
+	}
+
+	if event.Reason == "" {
+		if sc.reported && sc.consecutiveTimeouts == 0 && !full {
+			sc.reported = false
+			sub.degraded.Store(false)
+			b.cfg.Logger.Info("thebus: subscriber recovered", "topic", topic, "subscriptionID", sub.subscriptionID)
+		}
+		return false
+	}
+	// already reported, wait for the recovery
+	if sc.reported {
+		return false
+	}
+	sc.reported = true
+	event.Evicted = policy.has(SlowConsumerActionEvict)
+	if policy.has(SlowConsumerActionDegrade) {
+		sub.degraded.Store(true)
+	}
+
+	if policy.has(SlowConsumerActionWarn) {
+		b.cfg.Logger.Warn("thebus: slow subscriber detected",
+			"topic", topic,
+			"subscriptionID", sub.subscriptionID,
+			"reason", event.Reason,
+			"consecutiveTimeouts", event.ConsecutiveTimeouts,
+			"bufferFullFor", event.BufferFullFor,
+			"lag", event.Lag,
+			"evicted", event.Evicted,
+		)
+	}
+	if policy.has(SlowConsumerActionEvent) {
+		if data, err := json.Marshal(event); err == nil {
+			_, _ = b.publish(SystemTopicSlowConsumer, data, PublishConfig{}, nil)
+		}
+	}
+	if event.Evicted {
+		// counted first: a reader seeing the channel closed must see the eviction
+		state.counters.SlowConsumerEvictions.Add(1)
+		b.totals.SlowConsumerEvictions.Add(1)
+		_ = b.removeSubscription(sub.subscriptionID, topic, ErrSlowConsumer)
+		return true
+	}
+	return false
+}
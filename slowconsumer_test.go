@@ -0,0 +1,94 @@
+package thebus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPublishReservedTopic(t *testing.T) {
+	b, _ := New()
+	defer b.Close()
+	if _, err := b.Publish(SystemTopicSlowConsumer, []byte("x")); !errors.Is(err, ErrInvalidTopicNameReserved) {
+		t.Fatalf("want ErrInvalidTopicNameReserved, got %v", err)
+	}
+}
+
+func TestSlowConsumerEvict(t *testing.T) {
+	b, _ := New(WithSlowConsumerPolicy(SlowConsumerPolicy{
+		MaxConsecutiveTimeouts: 3,
+		Actions:                []SlowConsumerAction{SlowConsumerActionEvent, SlowConsumerActionEvict},
+	}))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := b.Subscribe(ctx, SystemTopicSlowConsumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := b.Subscribe(ctx, "t", WithBufferSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := b.Publish("t", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case msg := <-events.Read():
+		var event SlowConsumerEvent
+		if err := json.Unmarshal(msg.Payload, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.SubscriptionID != slow.GetID() || event.Reason != "consecutive_timeouts" || !event.Evicted {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting slow consumer event")
+	}
+
+	// the buffered message is still readable, then the channel is closed
+	<-slow.Read()
+	select {
+	case _, ok := <-slow.Read():
+		if ok {
+			t.Fatal("expected closed channel")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("channel not closed after eviction")
+	}
+	st, _ := b.Stats()
+	if st.Totals.SlowConsumerEvictions != 1 {
+		t.Fatalf("want 1 eviction, got %d", st.Totals.SlowConsumerEvictions)
+	}
+}
+
+func TestSlowConsumerDegradeAndRecover(t *testing.T) {
+	b, _ := New(WithSlowConsumerPolicy(SlowConsumerPolicy{
+		MaxConsecutiveTimeouts: 2,
+		Actions:                []SlowConsumerAction{SlowConsumerActionDegrade},
+	}))
+	defer b.Close()
+	bb := b.(*bus)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, _ := b.Subscribe(ctx, "t", WithBufferSize(1))
+	sb := sub.(*subscription)
+	state := bb.subscriptions["t"]
+
+	bb.checkSlowConsumer("t", state, sb, 1, deliveryResult{})
+	bb.checkSlowConsumer("t", state, sb, 2, deliveryResult{})
+	if !sb.degraded.Load() {
+		t.Fatal("subscriber should be degraded")
+	}
+	bb.checkSlowConsumer("t", state, sb, 3, deliveryResult{delivered: true})
+	if sb.degraded.Load() {
+		t.Fatal("subscriber should have recovered")
+	}
+}
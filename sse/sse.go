@@ -0,0 +1,279 @@
+// Package sse bridges bus topics to browsers with Server-Sent Events.
+//
+// A client subscribes with one or more topic query parameters:
+//
+//	GET /events?topic=orders&topic=payments
+//
+// Each message is sent as an event named after its topic, with the message
+// Seq as event ID. On reconnect the browser sends the Last-Event-ID header and
+// the stream resumes from the retained history of the topics (see
+// thebus.TopicOptions.Retention). Topic patterns are not supported.
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+// DefaultHeartbeat is the default interval of the keep-alive comments.
+const DefaultHeartbeat = 15 * time.Second
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+// Encoder returns the data of the event sent for msg.
+type Encoder func(msg thebus.Message) (string, error)
+
+// Authorizer allows (nil) or denies (an error) the subscription of a request to topic.
+type Authorizer func(r *http.Request, topic string) error
+
+type config struct {
+	heartbeat     time.Duration
+	encoder       Encoder
+	authorizer    Authorizer
+	subscribeOpts []thebus.SubscribeOption
+}
+
+// Option configures the Handler.
+type Option func(cfg *config)
+
+// WithHeartbeat sets the interval of the keep-alive comments (0 = off).
+func WithHeartbeat(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.heartbeat = interval
+	}
+}
+
+// WithEncoder sets the encoding of the event data, the payload as is by default.
+func WithEncoder(encoder Encoder) Option {
+	return func(cfg *config) {
+		cfg.encoder = encoder
+	}
+}
+
+// WithAuthorizer checks the subscription of a request to each topic. A denied
+// subscription gets a 403 with the error message.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(cfg *config) {
+		cfg.authorizer = authorizer
+	}
+}
+
+// WithSubscribeOptions sets the options of the subscriptions of the clients.
+func WithSubscribeOptions(opts ...thebus.SubscribeOption) Option {
+	return func(cfg *config) {
+		cfg.subscribeOpts = append(cfg.subscribeOpts, opts...)
+	}
+}
+
+func rawPayload(msg thebus.Message) (string, error) {
+	return string(msg.Payload), nil
+}
+
+// ##############################################################################
+// ################################   HANDLER   #################################
+// ##############################################################################
+
+// Handler streams the messages of the requested topics as Server-Sent Events.
+type Handler struct {
+	bus thebus.Bus
+	cfg config
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+// NewHandler returns the SSE Handler of bus.
+func NewHandler(bus thebus.Bus, opts ...Option) *Handler {
+	h := &Handler{
+		bus: bus,
+		cfg: config{heartbeat: DefaultHeartbeat, encoder: rawPayload},
+	}
+	for _, opt := range opts {
+		opt(&h.cfg)
+	}
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	topics := dedupe(r.URL.Query()["topic"])
+	if len(topics) == 0 {
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if h.cfg.authorizer != nil {
+		for _, topic := range topics {
+			if err := h.cfg.authorizer(r, topic); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	cursor := parseCursor(lastEventID, topics)
+
+	// the subscriptions end with the request (client disconnect)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	subs := make([]thebus.Subscription, 0, len(topics))
+	for _, topic := range topics {
+		opts := h.cfg.subscribeOpts
+		if seq, ok := cursor[topic]; ok {
+			opts = append(opts[:len(opts):len(opts)], thebus.WithReplay(seq+1))
+		}
+		sub, err := h.bus.Subscribe(ctx, topic, opts...)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, thebus.ErrInvalidTopic) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		subs = append(subs, sub)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	messages := merge(ctx, subs)
+	var heartbeat <-chan time.Time
+	if h.cfg.heartbeat > 0 {
+		ticker := time.NewTicker(h.cfg.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case msg, ok := <-messages:
+			if !ok {
+				// every subscription ended (bus closed, topic deleted...)
+				return
+			}
+			data, err := h.cfg.encoder(msg)
+			if err != nil {
+				continue
+			}
+			cursor[msg.Topic] = msg.Seq
+			if err := writeEvent(w, cursor.id(msg, topics), msg.Topic, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func dedupe(topics []string) []string {
+	out := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if topic != "" && !slices.Contains(out, topic) {
+			out = append(out, topic)
+		}
+	}
+	return out
+}
+
+// merge forwards the messages of subs on a single channel, closed once every
+// subscription ended.
+func merge(ctx context.Context, subs []thebus.Subscription) <-chan thebus.Message {
+	out := make(chan thebus.Message)
+	var wg sync.WaitGroup
+	wg.Add(len(subs))
+	for _, sub := range subs {
+		go func() {
+			defer wg.Done()
+			for msg := range sub.Read() {
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+func writeEvent(w http.ResponseWriter, id, event, data string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "id: %s\nevent: %s\n", id, event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&sb, "data: %s\n", strings.TrimSuffix(line, "\r"))
+	}
+	sb.WriteString("\n")
+	_, err := fmt.Fprint(w, sb.String())
+	return err
+}
+
+// ##############################################################################
+// #################################   CURSOR   #################################
+// ##############################################################################
+
+// cursor is the last Seq sent per topic. The event ID is the Seq with a single
+// topic, else the cursor of every topic ("orders=12&payments=7").
+type cursor map[string]uint64
+
+func parseCursor(id string, topics []string) cursor {
+	c := make(cursor)
+	if id == "" {
+		return c
+	}
+	if seq, err := strconv.ParseUint(id, 10, 64); err == nil {
+		if len(topics) == 1 {
+			c[topics[0]] = seq
+		}
+		return c
+	}
+	values, err := url.ParseQuery(id)
+	if err != nil {
+		return c
+	}
+	for _, topic := range topics {
+		if seq, err := strconv.ParseUint(values.Get(topic), 10, 64); err == nil {
+			c[topic] = seq
+		}
+	}
+	return c
+}
+
+func (c cursor) id(msg thebus.Message, topics []string) string {
+	if len(topics) == 1 {
+		return strconv.FormatUint(msg.Seq, 10)
+	}
+	values := make(url.Values, len(c))
+	for topic, seq := range c {
+		values.Set(topic, strconv.FormatUint(seq, 10))
+	}
+	return values.Encode()
+}
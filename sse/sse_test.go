@@ -0,0 +1,154 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+type event struct {
+	id, name, data string
+}
+
+// readEvent reads the next event, skipping the comments
+func readEvent(t *testing.T, r *bufio.Reader) event {
+	t.Helper()
+	var ev event
+	var data []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if ev.id != "" || len(data) > 0 {
+				ev.data = strings.Join(data, "\n")
+				return ev
+			}
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func connect(t *testing.T, ctx context.Context, url, lastEventID string) *bufio.Reader {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+// waitSubscribers waits until topic has n subscribers
+func waitSubscribers(t *testing.T, b thebus.Bus, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		st, _ := b.Stats()
+		if st.PerTopic[topic].Subscribers == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("topic %s: want %d subscribers", topic, n)
+}
+
+func TestStream(t *testing.T) {
+	b, _ := thebus.New()
+	defer b.Close()
+	_ = b.DeclareTopic("orders", thebus.TopicOptions{Retention: 10})
+	srv := httptest.NewServer(NewHandler(b))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := connect(t, ctx, srv.URL+"?topic=orders", "")
+	waitSubscribers(t, b, "orders", 1)
+	_, _ = b.Publish("orders", []byte("first"))
+	_, _ = b.Publish("orders", []byte("second\nline"))
+
+	if ev := readEvent(t, r); ev.id != "1" || ev.name != "orders" || ev.data != "first" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if ev := readEvent(t, r); ev.id != "2" || ev.data != "second\nline" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	// the client leaves, its subscription ends
+	cancel()
+	waitSubscribers(t, b, "orders", 0)
+
+	// published while disconnected, replayed on reconnect
+	_, _ = b.Publish("orders", []byte("third"))
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	r = connect(t, ctx, srv.URL+"?topic=orders", "2")
+	if ev := readEvent(t, r); ev.id != "3" || ev.data != "third" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+}
+
+func TestStreamMultipleTopics(t *testing.T) {
+	b, _ := thebus.New()
+	defer b.Close()
+	_ = b.DeclareTopic("a", thebus.TopicOptions{Retention: 10})
+	_ = b.DeclareTopic("b", thebus.TopicOptions{Retention: 10})
+	srv := httptest.NewServer(NewHandler(b, WithHeartbeat(time.Millisecond)))
+	defer srv.Close()
+
+	_, _ = b.Publish("a", []byte("a1")) // retained
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := connect(t, ctx, srv.URL+"?topic=a&topic=b", "a=0&b=0")
+	if ev := readEvent(t, r); ev.name != "a" || ev.data != "a1" || ev.id != "a=1&b=0" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	waitSubscribers(t, b, "b", 1)
+	_, _ = b.Publish("b", []byte("b1"))
+	if ev := readEvent(t, r); ev.name != "b" || ev.data != "b1" || ev.id != "a=1&b=1" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	if cur := parseCursor("a=1&b=1", []string{"a", "b"}); cur["a"] != 1 || cur["b"] != 1 {
+		t.Fatalf("unexpected cursor %+v", cur)
+	}
+}
+
+func TestBadRequest(t *testing.T) {
+	b, _ := thebus.New()
+	defer b.Close()
+	h := NewHandler(b, WithAuthorizer(func(r *http.Request, topic string) error {
+		if topic == "secret" {
+			return http.ErrNoCookie
+		}
+		return nil
+	}))
+	for path, want := range map[string]int{"/": http.StatusBadRequest, "/?topic=secret": http.StatusForbidden} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: want %d, got %d", path, want, rec.Code)
+		}
+	}
+}
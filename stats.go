@@ -11,28 +11,145 @@ type Counters struct {
 	Delivered uint64
 	Failed    uint64
 	Dropped   uint64
+	Evicted   uint64 // buffered messages evicted by OverflowPolicyDropOldest/OverflowPolicyCoalesce
+	Coalesced uint64 // buffered messages replaced by a newer one (OverflowPolicyCoalesce)
+	Spilled   uint64 // messages written to disk (OverflowPolicySpillToDisk), Delivered once replayed
+	Expired   uint64 // messages older than the topic MessageTTL, not delivered
+	Filtered  uint64 // messages not matching the subscriber filters (see WithFilter)
+	Rejected  uint64 // messages rejected by an interceptor (see Reject)
+
+	SlowConsumerEvictions uint64 // subscribers evicted by SlowConsumerActionEvict
 }
 
 // StatsResults represents aggregated statistics of the bus.
 type StatsResults struct {
 	StartedAt   time.Time
+	At          time.Time // when the snapshot was taken, see Diff
 	Open        bool
 	Topics      int
 	Subscribers int
 	Totals      Counters
+	Rates       RateStats
 	PerTopic    map[string]TopicStats
 }
 
 // TopicStats represents statistics for a single topic.
 type TopicStats struct {
-	Subscribers int
-	Buffered    int
+	Subscribers   int
+	Buffered      int
+	Degraded      int                        // subscribers marked degraded by SlowConsumerActionDegrade
+	Subscriptions map[string]SubscriberStats // by subscription ID
+	Rates         RateStats
 	Counters
 }
 
+// SubscriberStats represents statistics for a single subscription.
+type SubscriberStats struct {
+	ID         string
+	Name       string // see WithSubscriberName
+	Strategy   SubscriptionStrategy
+	BufferSize int
+	Buffered   int // current fill of the buffer (spilled messages included)
+	CreatedAt  time.Time
+	Degraded   bool
+	Delivered  uint64
+	Dropped    uint64
+	Failed     uint64
+	Filtered   uint64
+	Rejected   uint64
+	// LastDeliveredSeq is the Seq of the last message delivered to the
+	// subscription, or skipped by its filters and interceptors.
+	LastDeliveredSeq uint64
+	// Lag is the number of messages published on the topic since LastDeliveredSeq.
+	Lag uint64
+}
+
 type atomicCounters struct {
 	Published atomic.Uint64
 	Delivered atomic.Uint64
 	Failed    atomic.Uint64
 	Dropped   atomic.Uint64
+	Evicted   atomic.Uint64
+	Coalesced atomic.Uint64
+	Spilled   atomic.Uint64
+	Expired   atomic.Uint64
+	Filtered  atomic.Uint64
+	Rejected  atomic.Uint64
+
+	SlowConsumerEvictions atomic.Uint64
+}
+
+// snapshot returns a plain copy of the counters
+func (c *atomicCounters) snapshot() Counters {
+	return Counters{
+		Published: c.Published.Load(),
+		Delivered: c.Delivered.Load(),
+		Failed:    c.Failed.Load(),
+		Dropped:   c.Dropped.Load(),
+		Evicted:   c.Evicted.Load(),
+		Coalesced: c.Coalesced.Load(),
+		Spilled:   c.Spilled.Load(),
+		Expired:   c.Expired.Load(),
+		Filtered:  c.Filtered.Load(),
+		Rejected:  c.Rejected.Load(),
+
+		SlowConsumerEvictions: c.SlowConsumerEvictions.Load(),
+	}
+}
+
+// subscriberCounters are the counters of a subscription
+type subscriberCounters struct {
+	Delivered atomic.Uint64
+	Dropped   atomic.Uint64
+	Failed    atomic.Uint64
+	Filtered  atomic.Uint64
+	Rejected  atomic.Uint64
+	lastSeq   atomic.Uint64
+}
+
+// record reports the delivery of the message seq
+func (c *subscriberCounters) record(status DeliveryStatus, seq uint64) {
+	switch status {
+	case DeliveryStatusDelivered:
+		c.Delivered.Add(1)
+	case DeliveryStatusFailed:
+		c.Failed.Add(1)
+	case DeliveryStatusFiltered:
+		c.Filtered.Add(1)
+	case DeliveryStatusRejected:
+		c.Rejected.Add(1)
+	case DeliveryStatusSpilled:
+		// counted once replayed or discarded
+		return
+	default:
+		c.Dropped.Add(1)
+		return
+	}
+	c.lastSeq.Store(seq)
+}
+
+// subscriberStats returns the stats of sub, topicSeq is the current Seq of its topic.
+func subscriberStats(sub *subscription, topicSeq uint64) SubscriberStats {
+	s := SubscriberStats{
+		ID:               sub.subscriptionID,
+		Name:             sub.cfg.Name,
+		Strategy:         sub.cfg.Strategy,
+		BufferSize:       sub.cfg.BufferSize,
+		Buffered:         len(sub.messageChan),
+		CreatedAt:        sub.createdAt,
+		Degraded:         sub.degraded.Load(),
+		Delivered:        sub.counters.Delivered.Load(),
+		Dropped:          sub.counters.Dropped.Load(),
+		Failed:           sub.counters.Failed.Load(),
+		Filtered:         sub.counters.Filtered.Load(),
+		Rejected:         sub.counters.Rejected.Load(),
+		LastDeliveredSeq: sub.counters.lastSeq.Load(),
+	}
+	if sub.spill != nil {
+		s.Buffered += sub.spill.Len()
+	}
+	if topicSeq > s.LastDeliveredSeq {
+		s.Lag = topicSeq - s.LastDeliveredSeq
+	}
+	return s
 }
@@ -0,0 +1,62 @@
+package thebus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSubscriberStats(t *testing.T) {
+	clock := NewManualClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	b, _ := New(WithSyncDelivery(true), WithClock(clock))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = b.Publish("t", []byte("before")) // no subscriber, not counted
+	fast, _ := b.Subscribe(ctx, "t", WithSubscriberName("fast"), WithBufferSize(8))
+	_, _ = b.Publish("t", []byte("1"))
+	clock.Advance(time.Minute)
+	slow, _ := b.Subscribe(ctx, "t", WithSubscriberName("slow"), WithBufferSize(1),
+		WithStrategy(SubscriptionStrategyPayloadClonedPerSubscriber))
+	for i := 0; i < 3; i++ {
+		_, _ = b.Publish("t", []byte("x"))
+	}
+
+	st, _ := b.Stats()
+	subs := st.PerTopic["t"].Subscriptions
+	if len(subs) != 2 {
+		t.Fatalf("want 2 subscriptions, got %+v", subs)
+	}
+	f := subs[fast.GetID()]
+	if f.Name != "fast" || f.BufferSize != 8 || f.Buffered != 4 || f.Delivered != 4 || f.Dropped != 0 ||
+		f.LastDeliveredSeq != 4 || f.Lag != 0 || f.Strategy != SubscriptionStrategyPayloadShared {
+		t.Fatalf("unexpected fast stats %+v", f)
+	}
+	s := subs[slow.GetID()]
+	if s.Name != "slow" || s.Buffered != 1 || s.Delivered != 1 || s.Dropped != 2 ||
+		s.LastDeliveredSeq != 2 || s.Lag != 2 || !s.CreatedAt.Equal(clock.Now()) ||
+		s.Strategy != SubscriptionStrategyPayloadClonedPerSubscriber {
+		t.Fatalf("unexpected slow stats %+v", s)
+	}
+}
+
+func TestReportFailure(t *testing.T) {
+	b, _ := New(WithSyncDelivery(true))
+	defer b.Close()
+	sub, _ := b.Subscribe(context.Background(), "t")
+	_, _ = b.Publish("t", []byte("x"))
+
+	reporter := b.(FailureReporter)
+	if err := reporter.ReportFailure("t", sub.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := reporter.ReportFailure("missing", "id"); err != ErrTopicNotFound {
+		t.Fatalf("want ErrTopicNotFound, got %v", err)
+	}
+	st, _ := b.Stats()
+	topic := st.PerTopic["t"]
+	if st.Totals.Failed != 2 || topic.Failed != 1 || topic.Delivered != 1 || topic.Subscriptions[sub.GetID()].Failed != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
@@ -73,13 +73,30 @@ type Subscription interface {
 	Read() <-chan Message
 	// Unsubscribe cancels the subscription.
 	Unsubscribe() error
+	// Done returns a channel closed when the subscription ended. At this point
+	// the channel returned by Read is closed too (remaining buffered messages
+	// can still be read).
+	Done() <-chan struct{}
+	// Err returns nil while the subscription is alive, then the reason it ended:
+	// the context error (context.Canceled, context.DeadlineExceeded), ErrUnsubscribed,
+	// ErrClosed when the bus was closed or ErrSlowConsumer when it was evicted.
+	Err() error
 }
 
 type SubscriptionConfig struct {
-	Strategy    SubscriptionStrategy
-	BufferSize  int
-	SendTimeout time.Duration
-	DropIfFull  bool
+	Name           string                `json:"name"` // label reported in the Stats, see WithSubscriberName
+	Strategy       SubscriptionStrategy  `json:"strategy"`
+	BufferSize     int                   `json:"bufferSize"`
+	SendTimeout    time.Duration         `json:"sendTimeout"`
+	DropIfFull     bool                  `json:"dropIfFull"`
+	ReplayFrom     uint64                `json:"replayFrom"`     // replay the retained messages with Seq >= ReplayFrom (0 = no replay)
+	Handler        Handler               `json:"-"`              // called for each message instead of the Read channel
+	OverflowPolicy OverflowPolicy        `json:"overflowPolicy"` // default: OverflowPolicyDropNewest
+	CoalesceKey    CoalesceKeyFunc       `json:"-"`              // used by OverflowPolicyCoalesce, default: topic
+	SpillDir       string                `json:"spillDir"`       // used by OverflowPolicySpillToDisk, default: os.TempDir()
+	Filter         Filter                `json:"-"`              // messages rejected by Filter are not delivered
+	HeaderFilters  []HeaderFilter        `json:"headerFilters"`  // all must match for the message to be delivered
+	Interceptors   []DeliveryInterceptor `json:"-"`
 }
 
 func (cfg SubscriptionConfig) Normalize() SubscriptionConfig {
@@ -92,6 +109,9 @@ func (cfg SubscriptionConfig) Normalize() SubscriptionConfig {
 	if cfg.SendTimeout <= 0 {
 		cfg.DropIfFull = true
 	}
+	if !cfg.OverflowPolicy.IsValid() {
+		cfg.OverflowPolicy = OverflowPolicyDropNewest
+	}
 	return cfg
 }
 
@@ -102,14 +122,46 @@ type subscription struct {
 	messageChan     chan Message
 	messages        <-chan Message
 	unsubscribeFunc func() error
+	spill           *spillQueue
+
+	// closing, see closeWithReason
+	mu        sync.RWMutex
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+	reason    error
+
+	// slow consumer detection, owned by the fan-out worker except degraded
+	slow     slowConsumerState
+	degraded atomic.Bool
+
+	createdAt time.Time
+	counters  subscriberCounters
+}
+
+func newSubscription(id string, topic string, cfg SubscriptionConfig) *subscription {
+	msgChan := make(chan Message, cfg.BufferSize)
+	sub := &subscription{
+		subscriptionID: id,
+		cfg:            cfg,
+		topic:          topic,
+		messageChan:    msgChan,
+		messages:       (<-chan Message)(msgChan),
+		done:           make(chan struct{}),
+	}
+	if cfg.OverflowPolicy == OverflowPolicySpillToDisk {
+		sub.spill = newSpillQueue(cfg.SpillDir, msgChan)
+	}
+	return sub
 }
 
 func DefaultSubscriptionConfig() SubscriptionConfig {
 	return SubscriptionConfig{
-		BufferSize:  128,
-		SendTimeout: 200 * time.Millisecond,
-		DropIfFull:  true,
-		Strategy:    SubscriptionStrategyPayloadShared,
+		BufferSize:     128,
+		SendTimeout:    200 * time.Millisecond,
+		DropIfFull:     true,
+		Strategy:       SubscriptionStrategyPayloadShared,
+		OverflowPolicy: OverflowPolicyDropNewest,
 	}
 }
 
@@ -134,6 +186,44 @@ func (s *subscription) Unsubscribe() error {
 	return s.unsubscribeFunc()
 }
 
+func (s *subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.reason
+	default:
+		return nil
+	}
+}
+
+// release frees the resources held by the subscription (spill file...)
+func (s *subscription) release() {
+	if s.spill != nil {
+		_ = s.spill.close()
+	}
+}
+
+// closeWithReason ends the subscription: it stops any in-flight delivery,
+// releases its resources and closes the message channel exactly once.
+// The subscription must already be removed from its topic.
+func (s *subscription) closeWithReason(reason error) {
+	s.closeOnce.Do(func() {
+		s.reason = reason
+		if s.done != nil {
+			close(s.done)
+		}
+		s.release()
+		// wait for the in-flight delivery (if any) before closing
+		s.mu.Lock()
+		s.closed = true
+		close(s.messageChan)
+		s.mu.Unlock()
+	})
+}
+
 // SubscribeOption -
 type SubscribeOption func(subCfg *SubscriptionConfig)
 
@@ -163,6 +253,83 @@ func WithDropIfFull(dropIfFull bool) SubscribeOption {
 	}
 }
 
+// Handler is a callback subscriber, see WithHandler.
+type Handler func(msg Message)
+
+// WithHandler makes a callback subscriber: handler is called for each message
+// by the goroutine delivering it (the topic fan-out worker, or the publisher in
+// sync mode) instead of sending it on the Read channel. It must be fast, must
+// not block and, in sync mode, must not publish on its own topic.
+// Panics are recovered (and counted as Failed) only if a PanicHandler is set.
+func WithHandler(handler Handler) SubscribeOption {
+	return func(subCfg *SubscriptionConfig) {
+		subCfg.Handler = handler
+	}
+}
+
+// WithReplay delivers first the retained messages of the topic with a Seq >= fromSeq
+// (see TopicOptions.Retention), then the live ones. Use 1 to replay the whole history.
+func WithReplay(fromSeq uint64) SubscribeOption {
+	return func(subCfg *SubscriptionConfig) {
+		subCfg.ReplayFrom = fromSeq
+	}
+}
+
+// WithOverflowPolicy sets what happens when the subscriber buffer is full.
+// See OverflowPolicy for the available policies.
+func WithOverflowPolicy(policy OverflowPolicy) SubscribeOption {
+	return func(subCfg *SubscriptionConfig) {
+		subCfg.OverflowPolicy = policy
+	}
+}
+
+// WithCoalesceKey sets the key used by OverflowPolicyCoalesce.
+func WithCoalesceKey(keyFunc CoalesceKeyFunc) SubscribeOption {
+	return func(subCfg *SubscriptionConfig) {
+		subCfg.CoalesceKey = keyFunc
+	}
+}
+
+// WithSpillDir sets the directory of the temporary files used by OverflowPolicySpillToDisk.
+func WithSpillDir(dir string) SubscribeOption {
+	return func(subCfg *SubscriptionConfig) {
+		subCfg.SpillDir = dir
+	}
+}
+
+// WithFilter only delivers the messages for which filter returns true.
+// It is called by the goroutine delivering the message and must be fast.
+// The rejected messages are counted as Filtered, not Dropped.
+func WithFilter(filter Filter) SubscribeOption {
+	return func(subCfg *SubscriptionConfig) {
+		subCfg.Filter = filter
+	}
+}
+
+// WithHeaderFilter only delivers the messages whose headers match all the filters.
+// It can be combined with WithFilter, the header filters are evaluated first.
+func WithHeaderFilter(filters ...HeaderFilter) SubscribeOption {
+	return func(subCfg *SubscriptionConfig) {
+		subCfg.HeaderFilters = append(subCfg.HeaderFilters, filters...)
+	}
+}
+
+// WithSubscriptionInterceptor appends delivery interceptors to the subscription.
+// They run after the ones of the bus (see WithDeliveryInterceptor), on the
+// live messages only: the replayed messages are not intercepted.
+func WithSubscriptionInterceptor(interceptors ...DeliveryInterceptor) SubscribeOption {
+	return func(subCfg *SubscriptionConfig) {
+		subCfg.Interceptors = append(subCfg.Interceptors, interceptors...)
+	}
+}
+
+// WithSubscriberName labels the subscription in the Stats (see SubscriberStats).
+func WithSubscriberName(name string) SubscribeOption {
+	return func(subCfg *SubscriptionConfig) {
+		subCfg.Name = name
+	}
+}
+
 func BuildSubscriptionConfig(opts ...SubscribeOption) SubscriptionConfig {
 	cfg := DefaultSubscriptionConfig()
 	for _, opt := range opts {
@@ -175,21 +342,38 @@ type topicState struct {
 	subs     map[string]*subscription
 	started  atomic.Bool
 	counters atomicCounters
+	rates    rateRecorder
 	inQueue  chan messageRef
 	seq      atomic.Uint64
 	wg       sync.WaitGroup
 	closed   atomic.Bool
+
+	// written under the bus Lock
+	cfg      TopicConfig
+	declared bool
+
+	// sync delivery, see publishSync
+	syncMu    sync.Mutex
+	syncTimer Timer
+
+	// retention, see retainLocked
+	retainMu sync.Mutex
+	retained []messageRef
+
+	// unix nano of the last publish or subscribe, used by the janitor
+	lastActivity atomic.Int64
 }
 
-func newTopicState(queueSize int) *topicState {
+func newTopicState(cfg TopicConfig) *topicState {
 	var queue chan messageRef
-	if queueSize <= 0 {
+	if cfg.QueueSize <= 0 {
 		queue = make(chan messageRef, DefaultTopicQueueSize)
 	} else {
-		queue = make(chan messageRef, queueSize)
+		queue = make(chan messageRef, cfg.QueueSize)
 	}
 	return &topicState{
 		subs:    make(map[string]*subscription),
 		inQueue: queue,
+		cfg:     cfg,
 	}
 }
@@ -0,0 +1,96 @@
+package thebus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSyncDeliveryAck(t *testing.T) {
+	b, _ := New(WithSyncDelivery(true))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ok, _ := b.Subscribe(ctx, "t", WithBufferSize(4))
+	full, _ := b.Subscribe(ctx, "t", WithBufferSize(1))
+	var handled []uint64
+	handler, _ := b.Subscribe(ctx, "t", WithHandler(func(msg Message) {
+		handled = append(handled, msg.Seq)
+	}))
+
+	_, _ = b.Publish("t", []byte("1"))
+	ack, err := b.Publish("t", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ack.Sync || !ack.Enqueued || ack.Subscribers != 3 || ack.Delivered != 2 || ack.Dropped != 1 {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	statuses := make(map[string]DeliveryStatus)
+	for _, d := range ack.Deliveries {
+		statuses[d.SubscriptionID] = d.Status
+	}
+	if statuses[ok.GetID()] != DeliveryStatusDelivered ||
+		statuses[full.GetID()] != DeliveryStatusDropped ||
+		statuses[handler.GetID()] != DeliveryStatusDelivered {
+		t.Fatalf("unexpected deliveries %+v", ack.Deliveries)
+	}
+	// already delivered when Publish returned
+	if len(ok.Read()) != 2 || len(handled) != 2 || handled[1] != 2 {
+		t.Fatalf("unexpected delivery: buffered=%d handled=%v", len(ok.Read()), handled)
+	}
+}
+
+func TestSyncDeliveryPerTopic(t *testing.T) {
+	b, _ := New()
+	defer b.Close()
+
+	sync := true
+	_ = b.DeclareTopic("fast", TopicOptions{SyncDelivery: &sync})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = b.Subscribe(ctx, "fast")
+	_, _ = b.Subscribe(ctx, "slow")
+
+	if ack, _ := b.Publish("fast", []byte("x")); !ack.Sync || ack.Delivered != 1 {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	if ack, _ := b.Publish("slow", []byte("x")); ack.Sync || ack.Delivered != 0 || !ack.Enqueued {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+}
+
+func TestHandlerPanicRecovered(t *testing.T) {
+	recovered := make(chan any, 1)
+	b, _ := New(WithPanicHandler(func(topic string, v any) {
+		recovered <- v
+	}))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, _ = b.Subscribe(ctx, "t", WithHandler(func(msg Message) {
+		panic("boom")
+	}))
+	_, _ = b.Publish("t", []byte("x"))
+	select {
+	case v := <-recovered:
+		if v != "boom" {
+			t.Fatalf("unexpected panic value %v", v)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("panic not recovered")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st, _ := b.Stats()
+		if st.Totals.Failed == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 1 failed, got %+v", st.Totals)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
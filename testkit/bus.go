@@ -0,0 +1,163 @@
+// Package testkit provides test helpers for code using thebus: a recording Bus,
+// a fake clock and assertion helpers.
+package testkit
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/sebundefined/thebus"
+)
+
+// Published is a recorded Publish call. Message.Seq and Message.ID are the
+// ones of the PublishAck.
+type Published struct {
+	Message thebus.Message
+	Ack     thebus.PublishAck
+	Err     error
+}
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+type config struct {
+	clock      Clock
+	busOptions []thebus.Option
+}
+
+type Option func(cfg *config)
+
+// WithSyncDelivery makes the bus deliver in the publisher goroutine (see
+// thebus.WithSyncDelivery): the messages are readable, and the handlers
+// called, as soon as Publish returns.
+func WithSyncDelivery() Option {
+	return func(cfg *config) {
+		cfg.busOptions = append(cfg.busOptions, thebus.WithSyncDelivery(true))
+	}
+}
+
+// WithClock sets the clock of the bus and of the recorded message timestamps.
+// See FakeClock.
+func WithClock(clock Clock) Option {
+	return func(cfg *config) {
+		cfg.clock = clock
+		cfg.busOptions = append(cfg.busOptions, thebus.WithClock(clock))
+	}
+}
+
+// WithBusOptions sets the options of the bus.
+func WithBusOptions(opts ...thebus.Option) Option {
+	return func(cfg *config) {
+		cfg.busOptions = append(cfg.busOptions, opts...)
+	}
+}
+
+// ##############################################################################
+// ##################################   BUS   ###################################
+// ##############################################################################
+
+// Bus is a thebus.Bus recording every Publish call in order.
+type Bus struct {
+	thebus.Bus
+
+	mu        sync.Mutex
+	cfg       config
+	published []Published
+}
+
+// New returns a recording Bus closed at the end of the test.
+func New(t testing.TB, opts ...Option) *Bus {
+	t.Helper()
+	cfg := config{clock: thebus.SystemClock()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	inner, err := thebus.New(cfg.busOptions...)
+	if err != nil {
+		t.Fatalf("testkit: cannot create the bus: %v", err)
+	}
+	b := &Bus{Bus: inner, cfg: cfg}
+	t.Cleanup(func() {
+		_ = b.Close()
+	})
+	return b
+}
+
+// Published returns a copy of the recorded Publish calls, in order.
+func (b *Bus) Published() []Published {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]Published, len(b.published))
+	copy(out, b.published)
+	return out
+}
+
+// PublishedOn returns the messages successfully published on topic, in order.
+func (b *Bus) PublishedOn(topic string) []thebus.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []thebus.Message
+	for _, p := range b.published {
+		if p.Err == nil && p.Message.Topic == topic {
+			out = append(out, p.Message)
+		}
+	}
+	return out
+}
+
+// Reset forgets the recorded Publish calls.
+func (b *Bus) Reset() {
+	b.mu.Lock()
+	b.published = nil
+	b.mu.Unlock()
+}
+
+func (b *Bus) Publish(topic string, data []byte, opts ...thebus.PublishOption) (thebus.PublishAck, error) {
+	return b.PublishContext(context.Background(), topic, data, opts...)
+}
+
+func (b *Bus) PublishContext(ctx context.Context, topic string, data []byte, opts ...thebus.PublishOption) (thebus.PublishAck, error) {
+	msg := b.newMessage(topic, data, opts)
+	ack, err := b.Bus.PublishContext(ctx, topic, data, opts...)
+	b.record(msg, ack, err)
+	return ack, err
+}
+
+// PublishConfirm records the call like Publish. With WithSyncDelivery the
+// returned Confirmation is already resolved, otherwise the ack is only known
+// once the fan-out is done and the recorded one is empty.
+func (b *Bus) PublishConfirm(topic string, data []byte, opts ...thebus.PublishOption) (*thebus.Confirmation, error) {
+	msg := b.newMessage(topic, data, opts)
+	conf, err := b.Bus.PublishConfirm(topic, data, opts...)
+	ack := thebus.PublishAck{Topic: topic}
+	if conf != nil {
+		select {
+		case <-conf.Done():
+			ack, _ = conf.Wait(context.Background())
+		default:
+		}
+	}
+	b.record(msg, ack, err)
+	return conf, err
+}
+
+func (b *Bus) newMessage(topic string, data []byte, opts []thebus.PublishOption) thebus.Message {
+	payload := make([]byte, len(data))
+	copy(payload, data)
+	return thebus.Message{
+		Topic:     topic,
+		Timestamp: b.cfg.clock.Now().UTC(),
+		Payload:   payload,
+		Headers:   thebus.BuildPublishConfig(opts...).Headers,
+	}
+}
+
+func (b *Bus) record(msg thebus.Message, ack thebus.PublishAck, err error) {
+	msg.Seq = ack.Seq
+	msg.ID = ack.MessageID
+	b.mu.Lock()
+	b.published = append(b.published, Published{Message: msg, Ack: ack, Err: err})
+	b.mu.Unlock()
+}
@@ -0,0 +1,154 @@
+package testkit_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+	"github.com/sebundefined/thebus/testkit"
+)
+
+func TestSyncDelivery(t *testing.T) {
+	clock := testkit.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	bus := testkit.New(t, testkit.WithSyncDelivery(), testkit.WithClock(clock))
+
+	sub, err := bus.Subscribe(context.Background(), "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	ack, err := bus.Publish("orders", []byte("created"))
+	if err != nil || !ack.Enqueued || ack.Subscribers != 1 {
+		t.Fatalf("unexpected ack %+v %v", ack, err)
+	}
+	// delivered before Publish returned
+	select {
+	case msg := <-sub.Read():
+		if msg.Seq != 1 || !msg.Timestamp.Equal(clock.Now()) || string(msg.Payload) != "created" {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	default:
+		t.Fatal("message should be delivered synchronously")
+	}
+
+	msg := bus.ExpectPublished(t, "orders", testkit.PayloadString("created"))
+	if msg.Seq != 1 {
+		t.Fatalf("want seq 1, got %d", msg.Seq)
+	}
+	bus.ExpectNotPublished(t, "orders", testkit.PayloadString("deleted"))
+
+	_ = sub.Unsubscribe()
+	<-sub.Done()
+	if !errors.Is(sub.Err(), thebus.ErrUnsubscribed) {
+		t.Fatalf("want ErrUnsubscribed, got %v", sub.Err())
+	}
+}
+
+func TestRecordingRealBus(t *testing.T) {
+	bus := testkit.New(t)
+
+	sub, err := bus.Subscribe(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = bus.Publish("t", []byte("a"))
+	_, _ = bus.Publish("", []byte("b"))
+
+	msg := testkit.WaitForMessage(t, sub, 2*time.Second)
+	if string(msg.Payload) != "a" {
+		t.Fatalf("unexpected payload %q", msg.Payload)
+	}
+	published := bus.Published()
+	if len(published) != 2 || !errors.Is(published[1].Err, thebus.ErrInvalidTopic) {
+		t.Fatalf("unexpected records %+v", published)
+	}
+	bus.Reset()
+	if len(bus.Published()) != 0 {
+		t.Fatal("records should be reset")
+	}
+}
+
+func TestPublishConfirm(t *testing.T) {
+	bus := testkit.New(t, testkit.WithSyncDelivery())
+	sub, _ := bus.Subscribe(context.Background(), "orders")
+
+	conf, err := bus.PublishConfirm("orders", []byte("created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := conf.Wait(context.Background())
+	if err != nil || ack.Seq != 1 || ack.Delivered != 1 || ack.MessageID == "" {
+		t.Fatalf("unexpected ack %+v %v", ack, err)
+	}
+	if msg := <-sub.Read(); msg.ID != ack.MessageID {
+		t.Fatalf("want message ID %q, got %q", ack.MessageID, msg.ID)
+	}
+	if got := bus.Published(); len(got) != 1 || got[0].Ack.MessageID != ack.MessageID {
+		t.Fatalf("unexpected records %+v", got)
+	}
+}
+
+func TestHeadersAndFilter(t *testing.T) {
+	bus := testkit.New(t, testkit.WithSyncDelivery())
+	sub, _ := bus.Subscribe(context.Background(), "orders", thebus.WithHeaderFilter(thebus.HeaderEquals("kind", "created")))
+
+	_, _ = bus.Publish("orders", []byte("1"), thebus.WithHeader("kind", "deleted"))
+	ack, _ := bus.Publish("orders", []byte("2"), thebus.WithHeader("kind", "created"))
+	if ack.Delivered != 1 || len(sub.Read()) != 1 {
+		t.Fatalf("unexpected ack %+v", ack)
+	}
+	msg := bus.ExpectPublished(t, "orders", testkit.PayloadString("1"))
+	if msg.Headers["kind"] != "deleted" {
+		t.Fatalf("unexpected headers %+v", msg.Headers)
+	}
+	if stats, _ := bus.Stats(); stats.Totals.Filtered != 1 {
+		t.Fatalf("unexpected counters %+v", stats.Totals)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	reject := func(msg thebus.Message, next thebus.PublishHandler) (thebus.PublishAck, error) {
+		if msg.Headers["auth"] == "" {
+			return thebus.PublishAck{}, thebus.Reject("unauthenticated")
+		}
+		return next(msg)
+	}
+	bus := testkit.New(t, testkit.WithSyncDelivery(), testkit.WithBusOptions(thebus.WithPublishInterceptor(reject)))
+	var got []string
+	_, _ = bus.Subscribe(context.Background(), "orders",
+		thebus.WithHandler(func(msg thebus.Message) { got = append(got, string(msg.Payload)) }),
+		thebus.WithSubscriptionInterceptor(func(id string, msg thebus.Message, next thebus.DeliverFunc) error {
+			msg.Payload = append([]byte("seen:"), msg.Payload...)
+			return next(msg)
+		}),
+	)
+
+	if _, err := bus.Publish("orders", []byte("1")); !errors.Is(err, thebus.ErrRejected) {
+		t.Fatalf("want ErrRejected, got %v", err)
+	}
+	ack, err := bus.Publish("orders", []byte("2"), thebus.WithHeader("auth", "token"))
+	if err != nil || ack.Delivered != 1 {
+		t.Fatalf("unexpected ack %+v %v", ack, err)
+	}
+	if len(got) != 1 || got[0] != "seen:2" {
+		t.Fatalf("unexpected deliveries %v", got)
+	}
+	if records := bus.Published(); len(records) != 2 || !errors.Is(records[0].Err, thebus.ErrRejected) || records[1].Ack.Delivered != 1 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+}
+
+func TestSubscriberStats(t *testing.T) {
+	bus := testkit.New(t, testkit.WithSyncDelivery())
+	sub, _ := bus.Subscribe(context.Background(), "orders", thebus.WithSubscriberName("billing"), thebus.WithBufferSize(1))
+	_, _ = bus.Publish("orders", []byte("1"))
+	_, _ = bus.Publish("orders", []byte("2"))
+
+	stats, _ := bus.Stats()
+	s := stats.PerTopic["orders"].Subscriptions[sub.GetID()]
+	if s.Name != "billing" || s.Delivered != 1 || s.Dropped != 1 || s.LastDeliveredSeq != 1 || s.Lag != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
@@ -0,0 +1,18 @@
+package testkit
+
+import (
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+// Clock gives the current time of the testkit Bus.
+type Clock = thebus.Clock
+
+// FakeClock is a Clock only moving when told so, see thebus.ManualClock.
+type FakeClock = thebus.ManualClock
+
+// NewFakeClock returns a FakeClock starting at start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return thebus.NewManualClock(start)
+}
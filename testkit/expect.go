@@ -0,0 +1,85 @@
+package testkit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+// Matcher tells if a message is the expected one.
+type Matcher func(msg thebus.Message) bool
+
+// Any matches every message.
+func Any() Matcher {
+	return func(thebus.Message) bool {
+		return true
+	}
+}
+
+// PayloadEquals matches the messages with exactly this payload.
+func PayloadEquals(payload []byte) Matcher {
+	return func(msg thebus.Message) bool {
+		return bytes.Equal(msg.Payload, payload)
+	}
+}
+
+// PayloadString matches the messages whose payload is s.
+func PayloadString(s string) Matcher {
+	return PayloadEquals([]byte(s))
+}
+
+// AllOf matches the messages matched by every matcher.
+func AllOf(matchers ...Matcher) Matcher {
+	return func(msg thebus.Message) bool {
+		for _, m := range matchers {
+			if !m(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// ExpectPublished fails the test unless a message matching matcher was
+// successfully published on topic. It returns the first matching message.
+func (b *Bus) ExpectPublished(t testing.TB, topic string, matcher Matcher) thebus.Message {
+	t.Helper()
+	published := b.PublishedOn(topic)
+	for _, msg := range published {
+		if matcher(msg) {
+			return msg
+		}
+	}
+	t.Fatalf("testkit: no matching message published on %q (%d published on this topic)", topic, len(published))
+	return thebus.Message{}
+}
+
+// ExpectNotPublished fails the test if a message matching matcher was published on topic.
+func (b *Bus) ExpectNotPublished(t testing.TB, topic string, matcher Matcher) {
+	t.Helper()
+	for _, msg := range b.PublishedOn(topic) {
+		if matcher(msg) {
+			t.Fatalf("testkit: unexpected message published on %q (seq %d)", topic, msg.Seq)
+		}
+	}
+}
+
+// WaitForMessage returns the next message of sub. It fails the test if none
+// is received within timeout or if the subscription ended.
+func WaitForMessage(t testing.TB, sub thebus.Subscription, timeout time.Duration) thebus.Message {
+	t.Helper()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-sub.Read():
+		if !ok {
+			t.Fatalf("testkit: subscription %s on %q ended: %v", sub.GetID(), sub.GetTopic(), sub.Err())
+		}
+		return msg
+	case <-timer.C:
+		t.Fatalf("testkit: no message on %q after %s", sub.GetTopic(), timeout)
+	}
+	return thebus.Message{}
+}
@@ -1,17 +1,132 @@
 package thebus_test
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+	"github.com/sebundefined/thebus/testkit"
+)
+
+// waitDone waits for the end of sub and returns its Err
+func waitDone(t *testing.T, sub thebus.Subscription) error {
+	t.Helper()
+	select {
+	case <-sub.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting the end of the subscription")
+	}
+	// Read must be closed as well
+	for range sub.Read() {
+	}
+	return sub.Err()
+}
 
 func TestNew(t *testing.T) {
 
 }
 
-func TestClose(t *testing.T) {}
+func TestClose(t *testing.T) {
+	b, _ := thebus.New()
+	sub, err := b.Subscribe(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Err() != nil {
+		t.Fatalf("expected nil Err on a live subscription, got %v", sub.Err())
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDone(t, sub); !errors.Is(err, thebus.ErrClosed) {
+		t.Fatalf("want ErrClosed, got %v", err)
+	}
+	// idempotent
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
 
-func TestPublishOK(t *testing.T)   {}
-func TestSubscribeOK(t *testing.T) {}
+func TestCloseBlockedFanOut(t *testing.T) {
+	b, _ := thebus.New()
+	// nobody reads and the fan-out waits on the full buffer
+	sub, err := b.Subscribe(context.Background(), "t",
+		thebus.WithBufferSize(1),
+		thebus.WithDropIfFull(false),
+		thebus.WithSendTimeout(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := b.Publish("t", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closed := make(chan error)
+	go func() { closed <- b.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for the SendTimeout")
+	}
+	if err := waitDone(t, sub); !errors.Is(err, thebus.ErrClosed) {
+		t.Fatalf("want ErrClosed, got %v", err)
+	}
+}
+
+func TestPublishOK(t *testing.T) {
+	b, _ := thebus.New()
+	defer b.Close()
 
-func TestIncrementSequence(t *testing.T) {}
+	// no subscriber, nothing enqueued
+	ack, err := b.Publish("t", []byte("x"))
+	if err != nil || ack.Enqueued || ack.Subscribers != 0 {
+		t.Fatalf("unexpected ack %+v %v", ack, err)
+	}
+	sub, _ := b.Subscribe(context.Background(), "t")
+	ack, err = b.Publish("t", []byte("x"))
+	if err != nil || !ack.Enqueued || ack.Subscribers != 1 {
+		t.Fatalf("unexpected ack %+v %v", ack, err)
+	}
+	testkit.WaitForMessage(t, sub, 2*time.Second)
+}
+
+func TestSubscribeOK(t *testing.T) {
+	b, _ := thebus.New()
+	defer b.Close()
+
+	sub, err := b.Subscribe(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.GetID() == "" || sub.GetTopic() != "t" {
+		t.Fatalf("unexpected subscription %s %s", sub.GetID(), sub.GetTopic())
+	}
+	if _, err := b.Subscribe(context.Background(), " "); !errors.Is(err, thebus.ErrInvalidTopic) {
+		t.Fatalf("want ErrInvalidTopic, got %v", err)
+	}
+}
+
+func TestIncrementSequence(t *testing.T) {
+	b, _ := thebus.New()
+	defer b.Close()
+
+	sub, _ := b.Subscribe(context.Background(), "t")
+	for i := 0; i < 3; i++ {
+		_, _ = b.Publish("t", []byte("x"))
+	}
+	for want := uint64(1); want <= 3; want++ {
+		if msg := testkit.WaitForMessage(t, sub, 2*time.Second); msg.Seq != want {
+			t.Fatalf("want seq %d, got %d", want, msg.Seq)
+		}
+	}
+}
 
 func TestNSubsSubOrder(t *testing.T) {}
 
@@ -39,13 +154,204 @@ func TestConfigAndLimits(t *testing.T) {
 }
 
 func TestUnsubscribe(t *testing.T) {
+	b, _ := thebus.New()
+	defer b.Close()
 
+	sub, err := b.Subscribe(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unsubscribe("t", sub.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDone(t, sub); !errors.Is(err, thebus.ErrUnsubscribed) {
+		t.Fatalf("want ErrUnsubscribed, got %v", err)
+	}
+	// redundant calls are ignored
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnsubscribeOnContextCancel(t *testing.T) {
+	b, _ := thebus.New()
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := b.Subscribe(ctx, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := waitDone(t, sub); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
 }
 
 func TestUnsubscribePendingFanout(t *testing.T) {
+	b, _ := thebus.New()
+	defer b.Close()
 
+	// a full subscriber with a long timeout blocks the fan-out
+	sub, err := b.Subscribe(context.Background(), "t",
+		thebus.WithBufferSize(1),
+		thebus.WithDropIfFull(false),
+		thebus.WithSendTimeout(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := b.Publish("t", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDone(t, sub); !errors.Is(err, thebus.ErrUnsubscribed) {
+		t.Fatalf("want ErrUnsubscribed, got %v", err)
+	}
 }
 
 func TestInheritedDefaults(t *testing.T) {
 
 }
+
+func TestShutdownDrained(t *testing.T) {
+	b, _ := thebus.New()
+	sub, err := b.Subscribe(context.Background(), "t", thebus.WithBufferSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := b.Publish("t", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		for range sub.Read() {
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	report, err := b.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Drained || report.Undelivered != 0 {
+		t.Fatalf("expected a drained report, got %+v", report)
+	}
+	if err := waitDone(t, sub); !errors.Is(err, thebus.ErrClosed) {
+		t.Fatalf("want ErrClosed, got %v", err)
+	}
+	if _, err := b.Publish("t", []byte("x")); !errors.Is(err, thebus.ErrClosed) {
+		t.Fatalf("want ErrClosed after shutdown, got %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	b, _ := thebus.New()
+	// nobody reads and the fan-out is blocked on the full buffer
+	sub, err := b.Subscribe(context.Background(), "t",
+		thebus.WithBufferSize(1),
+		thebus.WithDropIfFull(false),
+		thebus.WithSendTimeout(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := b.Publish("t", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := b.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	tr, ok := report.PerTopic["t"]
+	if !ok || report.Drained || tr.Buffered != 1 || tr.Queued+tr.Buffered != report.Undelivered {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if report.Undelivered < 4 {
+		t.Fatalf("want at least 4 undelivered, got %d", report.Undelivered)
+	}
+	_ = waitDone(t, sub)
+}
+
+func TestShutdownBlockingHandler(t *testing.T) {
+	b, _ := thebus.New()
+	release := make(chan struct{})
+	defer close(release)
+	called := make(chan struct{})
+	_, err := b.Subscribe(context.Background(), "t", thebus.WithHandler(func(thebus.Message) {
+		close(called)
+		<-release
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Publish("t", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	<-called
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	report, err := b.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Shutdown ignored its deadline: %v", elapsed)
+	}
+	if report.Running != 1 {
+		t.Fatalf("want 1 worker running, got %+v", report)
+	}
+}
+
+func TestShutdownConcurrentPublish(t *testing.T) {
+	b, _ := thebus.New()
+	sub, err := b.Subscribe(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range sub.Read() {
+		}
+	}()
+	started := make(chan struct{})
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for n := 0; ; n++ {
+				if n == 100 && i == 0 {
+					close(started)
+				}
+				_, err := b.Publish("t", []byte("x"))
+				if errors.Is(err, thebus.ErrClosed) {
+					return
+				}
+				if err != nil && !errors.Is(err, thebus.ErrQueueFull) {
+					t.Errorf("unexpected err: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
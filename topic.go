@@ -0,0 +1,300 @@
+package thebus
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// PublishPolicy defines what Publish does when the topic queue is full.
+//   - PublishPolicyFailIfFull (the default) returns ErrQueueFull
+//   - PublishPolicyDropIfFull drops the message silently (Enqueued is false, counted as Dropped)
+//   - PublishPolicyDropOldest evicts the oldest queued message to make room (counted as Dropped)
+type PublishPolicy string
+
+const (
+	PublishPolicyUnknown    PublishPolicy = "UNKNOWN"
+	PublishPolicyFailIfFull PublishPolicy = "FAIL_IF_FULL"
+	PublishPolicyDropIfFull PublishPolicy = "DROP_IF_FULL"
+	PublishPolicyDropOldest PublishPolicy = "DROP_OLDEST"
+)
+
+func (enum PublishPolicy) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(PublishPolicyUnknown)
+	}
+	return string(enum)
+}
+
+func PublishPolicyValues() []PublishPolicy {
+	return []PublishPolicy{
+		PublishPolicyFailIfFull,
+		PublishPolicyDropIfFull,
+		PublishPolicyDropOldest,
+	}
+}
+
+func (enum PublishPolicy) IsValid() bool {
+	if slices.Contains(PublishPolicyValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum PublishPolicy) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *PublishPolicy) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := PublishPolicy(tmp)
+	if !fs.IsValid() {
+		fs = PublishPolicyUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// ##############################################################################
+// ################################   CONFIG   ##################################
+// ##############################################################################
+
+// TopicOptions overrides the bus configuration for a topic.
+// Zero values inherit from the matching pattern defaults (see WithTopicDefaults),
+// then from the bus Config.
+type TopicOptions struct {
+	QueueSize      int           // topic queue size, only applied when the topic is created
+	MaxSubscribers int           // max subscribers of the topic
+	Retention      int           // number of messages kept for replay (see WithReplay)
+	CopyOnPublish  *bool         // copy the payload on publish
+	MessageTTL     time.Duration // messages older than this are expired instead of delivered
+	IdleTTL        time.Duration // the janitor deletes the topic once idle for this duration
+	PublishPolicy  PublishPolicy // what to do when the topic queue is full
+	SyncDelivery   *bool         // deliver in the publisher goroutine, see WithSyncDelivery
+}
+
+// TopicConfig is the effective configuration of a topic.
+type TopicConfig struct {
+	QueueSize      int           `json:"queueSize"`
+	MaxSubscribers int           `json:"maxSubscribers"`
+	Retention      int           `json:"retention"`
+	CopyOnPublish  bool          `json:"copyOnPublish"`
+	MessageTTL     time.Duration `json:"messageTTL"`
+	IdleTTL        time.Duration `json:"idleTTL"`
+	PublishPolicy  PublishPolicy `json:"publishPolicy"`
+	SyncDelivery   bool          `json:"syncDelivery"`
+}
+
+// TopicPattern applies Options to every topic matching Pattern (path.Match syntax).
+type TopicPattern struct {
+	Pattern string
+	Options TopicOptions
+}
+
+// TopicInfo describes a topic returned by Topics.
+type TopicInfo struct {
+	Name        string      `json:"name"`
+	Declared    bool        `json:"declared"`
+	Subscribers int         `json:"subscribers"`
+	Queued      int         `json:"queued"`
+	Retained    int         `json:"retained"`
+	Seq         uint64      `json:"seq"`
+	Config      TopicConfig `json:"config"`
+}
+
+// merge applies the non-zero options on top of cfg
+func (opts TopicOptions) merge(cfg TopicConfig) TopicConfig {
+	if opts.QueueSize > 0 {
+		cfg.QueueSize = opts.QueueSize
+	}
+	if opts.MaxSubscribers > 0 {
+		cfg.MaxSubscribers = opts.MaxSubscribers
+	}
+	if opts.Retention > 0 {
+		cfg.Retention = opts.Retention
+	}
+	if opts.CopyOnPublish != nil {
+		cfg.CopyOnPublish = *opts.CopyOnPublish
+	}
+	if opts.MessageTTL > 0 {
+		cfg.MessageTTL = opts.MessageTTL
+	}
+	if opts.IdleTTL > 0 {
+		cfg.IdleTTL = opts.IdleTTL
+	}
+	if opts.PublishPolicy.IsValid() {
+		cfg.PublishPolicy = opts.PublishPolicy
+	}
+	if opts.SyncDelivery != nil {
+		cfg.SyncDelivery = *opts.SyncDelivery
+	}
+	return cfg
+}
+
+// topicConfig resolves the effective configuration of topic:
+// bus Config, then the first matching TopicPattern, then opts (if any).
+func (b *bus) topicConfig(topic string, opts *TopicOptions) TopicConfig {
+	cfg := TopicConfig{
+		QueueSize:      b.cfg.TopicQueueSize,
+		MaxSubscribers: b.cfg.MaxSubscribersPerTopic,
+		CopyOnPublish:  b.cfg.CopyOnPublish,
+		IdleTTL:        b.cfg.TopicIdleTTL,
+		PublishPolicy:  PublishPolicyFailIfFull,
+		SyncDelivery:   b.cfg.SyncDelivery,
+	}
+	for _, p := range b.cfg.TopicPatterns {
+		if ok, _ := path.Match(p.Pattern, topic); ok {
+			cfg = p.Options.merge(cfg)
+			break
+		}
+	}
+	if opts != nil {
+		cfg = opts.merge(cfg)
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultTopicQueueSize
+	}
+	return cfg
+}
+
+// ##############################################################################
+// ###############################   TOPIC API   ################################
+// ##############################################################################
+
+// DeclareTopic creates the topic with the given options, or updates the options
+// of an existing one (QueueSize is only applied at creation). A declared topic
+// exists without subscribers: it is not deleted when its last subscriber leaves
+// and the janitor only deletes it if an IdleTTL is set in opts.
+func (b *bus) DeclareTopic(topic string, opts TopicOptions) error {
+	if len(strings.TrimSpace(topic)) == 0 {
+		return ErrInvalidTopic
+	}
+	if strings.HasPrefix(topic, SystemTopicPrefix) {
+		return ErrInvalidTopicNameReserved
+	}
+	if !b.open.Load() {
+		return ErrClosed
+	}
+	cfg := b.topicConfig(topic, &opts)
+	return b.withWriteState(topic, true, func(state *topicState) error {
+		if !b.open.Load() {
+			return ErrClosed
+		}
+		cfg.QueueSize = cap(state.inQueue)
+		if opts.IdleTTL <= 0 {
+			// declared topics only expire if asked explicitly
+			cfg.IdleTTL = 0
+		}
+		state.cfg = cfg
+		state.declared = true
+		return nil
+	})
+}
+
+// DeleteTopic removes the topic. Its subscriptions are closed with
+// ErrTopicDeleted and the queued messages are dropped. Deleting an unknown
+// topic is a no-op, deleting a system topic is refused.
+func (b *bus) DeleteTopic(topic string) error {
+	if len(strings.TrimSpace(topic)) == 0 {
+		return ErrInvalidTopic
+	}
+	if strings.HasPrefix(topic, SystemTopicPrefix) {
+		return ErrInvalidTopicNameReserved
+	}
+	b.mutex.Lock()
+	state, ok := b.subscriptions[topic]
+	if !ok {
+		b.mutex.Unlock()
+		return nil
+	}
+	delete(b.subscriptions, topic)
+	if state.closed.CompareAndSwap(false, true) {
+		close(state.inQueue)
+	}
+	subs := snapshotSubsLocked(state.subs)
+	b.mutex.Unlock()
+
+	for _, sub := range subs {
+		sub.closeWithReason(ErrTopicDeleted)
+	}
+	return nil
+}
+
+// Topics lists the topics, sorted by name, with their effective configuration.
+func (b *bus) Topics() []TopicInfo {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	topics := make([]TopicInfo, 0, len(b.subscriptions))
+	for name, st := range b.subscriptions {
+		st.retainMu.Lock()
+		retained := len(st.retained)
+		st.retainMu.Unlock()
+		topics = append(topics, TopicInfo{
+			Name:        name,
+			Declared:    st.declared,
+			Subscribers: len(st.subs),
+			Queued:      len(st.inQueue),
+			Retained:    retained,
+			Seq:         st.seq.Load(),
+			Config:      st.cfg,
+		})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+// ##############################################################################
+// ###############################   RETENTION   ################################
+// ##############################################################################
+
+// retainLocked keeps mr in the topic history. Caller must hold the bus RLock.
+func (st *topicState) retainLocked(mr messageRef) {
+	if st.cfg.Retention <= 0 {
+		return
+	}
+	st.retainMu.Lock()
+	st.retained = append(st.retained, mr)
+	if extra := len(st.retained) - st.cfg.Retention; extra > 0 {
+		st.retained = slices.Delete(st.retained, 0, extra)
+	}
+	st.retainMu.Unlock()
+}
+
+// replayLocked sends the retained messages with a Seq >= fromSeq to sub.
+// Caller must hold the bus Lock and sub must not be registered yet.
+// It returns the number of messages that did not fit in the buffer.
+func (st *topicState) replayLocked(topic string, sub *subscription, fromSeq uint64, now time.Time) int {
+	dropped := 0
+	for _, mr := range st.retained {
+		if mr.seq < fromSeq || st.expired(mr, now) {
+			continue
+		}
+		msg := makeMessage(topic, mr, sub)
+		if !sub.cfg.Accepts(msg) {
+			continue
+		}
+		select {
+		case sub.messageChan <- msg:
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func (st *topicState) expired(mr messageRef, now time.Time) bool {
+	return st.cfg.MessageTTL > 0 && now.Sub(mr.ts) > st.cfg.MessageTTL
+}
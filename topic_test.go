@@ -0,0 +1,199 @@
+package thebus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeclareTopicRetentionAndReplay(t *testing.T) {
+	b, _ := New()
+	defer b.Close()
+
+	if err := b.DeclareTopic("t", TopicOptions{Retention: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// retained even without subscribers
+	for i := 0; i < 5; i++ {
+		if _, err := b.Publish("t", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for b.Topics()[0].Retained != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 retained messages, got %+v", b.Topics())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	sub, err := b.Subscribe(context.Background(), "t", WithReplay(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []uint64{4, 5} {
+		if msg := <-sub.Read(); msg.Seq != want {
+			t.Fatalf("want seq %d, got %d", want, msg.Seq)
+		}
+	}
+	// declared topics survive their last subscriber
+	_ = sub.Unsubscribe()
+	if len(b.Topics()) != 1 {
+		t.Fatal("declared topic should not be auto deleted")
+	}
+}
+
+func TestTopicPatternDefaults(t *testing.T) {
+	copyOnPublish := true
+	b, _ := New(
+		WithTopicQueueSize(8),
+		WithTopicDefaults("orders.*", TopicOptions{QueueSize: 2, CopyOnPublish: &copyOnPublish}),
+	)
+	defer b.Close()
+
+	_ = b.DeclareTopic("orders.created", TopicOptions{MaxSubscribers: 1})
+	_ = b.DeclareTopic("users", TopicOptions{})
+	topics := b.Topics()
+	if len(topics) != 2 || topics[0].Name != "orders.created" {
+		t.Fatalf("unexpected topics %+v", topics)
+	}
+	want := TopicConfig{QueueSize: 2, MaxSubscribers: 1, CopyOnPublish: true, PublishPolicy: PublishPolicyFailIfFull}
+	if topics[0].Config != want {
+		t.Fatalf("want %+v, got %+v", want, topics[0].Config)
+	}
+	if topics[1].Config.QueueSize != 8 || topics[1].Config.CopyOnPublish {
+		t.Fatalf("unexpected config %+v", topics[1].Config)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := b.Subscribe(ctx, "orders.created"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe(ctx, "orders.created"); err == nil {
+		t.Fatal("expected max subscribers error")
+	}
+}
+
+func TestDeleteTopic(t *testing.T) {
+	b, _ := New()
+	defer b.Close()
+
+	sub, err := b.Subscribe(context.Background(), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteTopic("t"); err != nil {
+		t.Fatal(err)
+	}
+	<-sub.Done()
+	if !errors.Is(sub.Err(), ErrTopicDeleted) {
+		t.Fatalf("want ErrTopicDeleted, got %v", sub.Err())
+	}
+	if len(b.Topics()) != 0 {
+		t.Fatal("topic should be deleted")
+	}
+	if err := b.DeleteTopic("t"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the system topics stay
+	if _, err := b.Subscribe(context.Background(), SystemTopicSlowConsumer); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteTopic(SystemTopicSlowConsumer); !errors.Is(err, ErrInvalidTopicNameReserved) {
+		t.Fatalf("want ErrInvalidTopicNameReserved, got %v", err)
+	}
+}
+
+func TestEnqueuePublishPolicy(t *testing.T) {
+	b, _ := New()
+	defer b.Close()
+	bb := b.(*bus)
+
+	tests := []struct {
+		policy   PublishPolicy
+		enqueued bool
+		head     uint64
+	}{
+		{policy: PublishPolicyFailIfFull, enqueued: false, head: 1},
+		{policy: PublishPolicyDropIfFull, enqueued: false, head: 1},
+		{policy: PublishPolicyDropOldest, enqueued: true, head: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			// no worker started, the queue stays full
+			st := newTopicState(TopicConfig{QueueSize: 1, PublishPolicy: test.policy})
+			if !bb.enqueueLocked(st, messageRef{seq: 1}) {
+				t.Fatal("first message should be enqueued")
+			}
+			if got := bb.enqueueLocked(st, messageRef{seq: 2}); got != test.enqueued {
+				t.Fatalf("enqueued = %v, want %v", got, test.enqueued)
+			}
+			if head := (<-st.inQueue).seq; head != test.head {
+				t.Fatalf("head seq = %d, want %d", head, test.head)
+			}
+		})
+	}
+}
+
+func TestMessageTTLAndJanitor(t *testing.T) {
+	b, _ := New(WithTopicIdleTTL(time.Millisecond))
+	defer b.Close()
+	bb := b.(*bus)
+
+	_ = b.DeclareTopic("ttl", TopicOptions{MessageTTL: time.Millisecond, Retention: 1})
+	_ = bb.withWriteState("ttl", false, func(st *topicState) error {
+		st.inQueue <- messageRef{topic: "ttl", ts: time.Now().Add(-time.Second)}
+		return nil
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st, _ := b.Stats()
+		if st.Totals.Expired == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected an expired message")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// undeclared idle topic is swept, declared one is kept
+	_ = bb.withWriteState("idle", true, func(st *topicState) error { return nil })
+	if deleted := bb.sweepIdleTopics(time.Now().Add(time.Second)); deleted != 1 {
+		t.Fatalf("want 1 deleted topic, got %d", deleted)
+	}
+	if topics := b.Topics(); len(topics) != 1 || topics[0].Name != "ttl" {
+		t.Fatalf("unexpected topics %+v", topics)
+	}
+}
+
+func TestPurgeTopic(t *testing.T) {
+	b, _ := New()
+	defer b.Close()
+
+	inner := b.(*bus)
+	// a state without its fan-out worker, so nothing drains the queue while it is filled
+	st := newTopicState(inner.topicConfig("t", &TopicOptions{Retention: 10}))
+	inner.mutex.Lock()
+	inner.subscriptions["t"] = st
+	inner.mutex.Unlock()
+	inner.mutex.RLock()
+	for i := uint64(1); i <= 3; i++ {
+		inner.enqueueLocked(st, messageRef{topic: "t", seq: i})
+		st.retainLocked(messageRef{topic: "t", seq: i})
+	}
+	inner.mutex.RUnlock()
+
+	purged, err := b.(AdminBus).PurgeTopic("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 3 || len(st.inQueue) != 0 || len(st.retained) != 0 {
+		t.Fatalf("unexpected purge: purged=%d queued=%d retained=%d", purged, len(st.inQueue), len(st.retained))
+	}
+	if _, err := b.(AdminBus).PurgeTopic("unknown"); err != ErrTopicNotFound {
+		t.Fatalf("want ErrTopicNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package thebus
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// W3C Trace Context headers carried by the messages, see PublishContext.
+const (
+	HeaderTraceParent = "traceparent"
+	HeaderTraceState  = "tracestate"
+)
+
+var errInvalidTraceParent = errors.New("thebus.invalid.traceparent")
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// SpanOperation is the bus operation traced by a span, see Tracer.
+//   - SpanOperationPublish: the PublishContext call, interceptors included
+//   - SpanOperationEnqueue: the message enqueued in the topic queue
+//   - SpanOperationFanOut: the fan-out of a message to the subscribers
+//   - SpanOperationDeliver: the delivery to a subscriber (child of the fan-out)
+type SpanOperation string
+
+const (
+	SpanOperationUnknown SpanOperation = "UNKNOWN"
+	SpanOperationPublish SpanOperation = "PUBLISH"
+	SpanOperationEnqueue SpanOperation = "ENQUEUE"
+	SpanOperationFanOut  SpanOperation = "FAN_OUT"
+	SpanOperationDeliver SpanOperation = "DELIVER"
+)
+
+func (enum SpanOperation) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(SpanOperationUnknown)
+	}
+	return string(enum)
+}
+
+func SpanOperationValues() []SpanOperation {
+	return []SpanOperation{
+		SpanOperationPublish,
+		SpanOperationEnqueue,
+		SpanOperationFanOut,
+		SpanOperationDeliver,
+	}
+}
+
+func (enum SpanOperation) IsValid() bool {
+	if slices.Contains(SpanOperationValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum SpanOperation) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *SpanOperation) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := SpanOperation(tmp)
+	if !fs.IsValid() {
+		fs = SpanOperationUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// ##############################################################################
+// ##############################   SPAN CONTEXT   ##############################
+// ##############################################################################
+
+// SpanContext is the W3C Trace Context of a span.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte // 0x01 = sampled
+	TraceState string
+}
+
+// IsValid reports whether the trace and span IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent returns the traceparent header value (version 00).
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sc.Flags)
+}
+
+// ParseTraceParent parses a traceparent header value. The versions above 00
+// are accepted as long as they start with the version 00 fields.
+func ParseTraceParent(value string) (SpanContext, error) {
+	var sc SpanContext
+	if len(value) < 55 || (len(value) > 55 && value[55] != '-') {
+		return sc, errInvalidTraceParent
+	}
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' || strings.ToLower(value) != value {
+		return sc, errInvalidTraceParent
+	}
+	version, err := hex.DecodeString(value[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(value) != 55) {
+		return sc, errInvalidTraceParent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(value[3:35])); err != nil {
+		return sc, errInvalidTraceParent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(value[36:52])); err != nil {
+		return sc, errInvalidTraceParent
+	}
+	flags, err := hex.DecodeString(value[53:55])
+	if err != nil {
+		return sc, errInvalidTraceParent
+	}
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return SpanContext{}, errInvalidTraceParent
+	}
+	return sc, nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc. This is how
+// PublishContext finds the span context when no Tracer is configured.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context set by ContextWithSpanContext.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// WithSpanContext sets the traceparent and tracestate headers of the published message.
+func WithSpanContext(sc SpanContext) PublishOption {
+	return func(cfg *PublishConfig) {
+		if !sc.IsValid() {
+			return
+		}
+		cfg.setHeader(HeaderTraceParent, sc.TraceParent())
+		if sc.TraceState != "" {
+			cfg.setHeader(HeaderTraceState, sc.TraceState)
+		}
+	}
+}
+
+// SpanContext returns the span context carried by the message headers.
+func (m Message) SpanContext() (SpanContext, bool) {
+	sc, err := ParseTraceParent(m.Headers[HeaderTraceParent])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.TraceState = m.Headers[HeaderTraceState]
+	return sc, true
+}
+
+// TraceContext returns parent carrying the span context of the message (if
+// any), to continue the trace of the publisher on the consumer side.
+func (m Message) TraceContext(parent context.Context) context.Context {
+	if sc, ok := m.SpanContext(); ok {
+		return ContextWithSpanContext(parent, sc)
+	}
+	return parent
+}
+
+// ##############################################################################
+// #################################   TRACER   #################################
+// ##############################################################################
+
+// Tracer creates the spans of the bus operations (see WithTracer). The core
+// stays dependency-free: adapt it to OpenTelemetry or any other tracing
+// library. The parent of a span is found in ctx, either the span of the
+// library or the remote span context set by ContextWithSpanContext.
+type Tracer interface {
+	Start(ctx context.Context, op SpanOperation, topic string) (context.Context, Span)
+}
+
+// Span is a span created by a Tracer.
+type Span interface {
+	// SpanContext is propagated in the message headers for SpanOperationPublish.
+	SpanContext() SpanContext
+	SetAttribute(key, value string)
+	// End ends the span, err is the outcome of the operation (nil on success).
+	End(err error)
+}
+
+// startSpan starts a span if a Tracer is configured, else span is nil.
+func (b *bus) startSpan(ctx context.Context, op SpanOperation, topic string) (context.Context, Span) {
+	if b.cfg.Tracer == nil {
+		return ctx, nil
+	}
+	return b.cfg.Tracer.Start(ctx, op, topic)
+}
+
+func endSpan(span Span, err error) {
+	if span != nil {
+		span.End(err)
+	}
+}
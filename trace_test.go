@@ -0,0 +1,166 @@
+package thebus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceParent(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Flags != 1 || sc.TraceParent() != valid {
+		t.Fatalf("unexpected span context %+v", sc)
+	}
+	if _, err := ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future"); err != nil {
+		t.Fatalf("future versions must be accepted: %v", err)
+	}
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceParent(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestPublishContextPropagation(t *testing.T) {
+	b, _ := New(WithSyncDelivery(true))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, _ := b.Subscribe(ctx, "t")
+
+	sc, _ := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sc.TraceState = "vendor=value"
+	if _, err := b.PublishContext(ContextWithSpanContext(ctx, sc), "t", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-sub.Read()
+	if msg.Headers[HeaderTraceParent] != sc.TraceParent() || msg.Headers[HeaderTraceState] != "vendor=value" {
+		t.Fatalf("unexpected headers %+v", msg.Headers)
+	}
+	got, ok := SpanContextFromContext(msg.TraceContext(context.Background()))
+	if !ok || got != sc {
+		t.Fatalf("unexpected span context %+v", got)
+	}
+
+	// no span context, no header
+	_, _ = b.Publish("t", []byte("y"))
+	if msg := <-sub.Read(); msg.Headers != nil {
+		t.Fatalf("unexpected headers %+v", msg.Headers)
+	}
+}
+
+type recordedSpan struct {
+	tracer *recordingTracer
+	op     SpanOperation
+	sc     SpanContext
+	parent SpanContext
+	attrs  map[string]string
+	err    error
+	ended  bool
+}
+
+func (s *recordedSpan) SpanContext() SpanContext { return s.sc }
+
+func (s *recordedSpan) SetAttribute(key, value string) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End(err error) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.err = err
+	s.ended = true
+}
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	next  byte
+	spans []*recordedSpan
+}
+
+func (tr *recordingTracer) Start(ctx context.Context, op SpanOperation, topic string) (context.Context, Span) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.next++
+	span := &recordedSpan{tracer: tr, op: op, attrs: map[string]string{"topic": topic}}
+	span.parent, _ = SpanContextFromContext(ctx)
+	span.sc = span.parent
+	if !span.sc.IsValid() {
+		span.sc.TraceID[0] = 0xaa
+	}
+	span.sc.SpanID = [8]byte{tr.next}
+	tr.spans = append(tr.spans, span)
+	return ContextWithSpanContext(ctx, span.sc), span
+}
+
+func (tr *recordingTracer) find(op SpanOperation) []*recordedSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var spans []*recordedSpan
+	for _, s := range tr.spans {
+		if s.op == op {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func TestTracerSpans(t *testing.T) {
+	tracer := &recordingTracer{}
+	b, _ := New(WithSyncDelivery(true), WithTracer(tracer))
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, _ := b.Subscribe(ctx, "t")
+	_, _ = b.Subscribe(ctx, "t", WithHeaderFilter(HeaderExists("never")))
+
+	if _, err := b.PublishContext(ctx, "t", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	publish := tracer.find(SpanOperationPublish)
+	enqueue := tracer.find(SpanOperationEnqueue)
+	fanOut := tracer.find(SpanOperationFanOut)
+	deliver := tracer.find(SpanOperationDeliver)
+	if len(publish) != 1 || len(enqueue) != 1 || len(fanOut) != 1 || len(deliver) != 2 {
+		t.Fatalf("unexpected spans: publish=%d enqueue=%d fanOut=%d deliver=%d",
+			len(publish), len(enqueue), len(fanOut), len(deliver))
+	}
+	// the publish span is propagated in the message
+	msg := <-sub.Read()
+	if sc, _ := msg.SpanContext(); sc != publish[0].sc {
+		t.Fatalf("want span context %+v, got %+v", publish[0].sc, sc)
+	}
+	if enqueue[0].parent != publish[0].sc || fanOut[0].parent != publish[0].sc {
+		t.Fatal("enqueue and fan-out spans must be children of the publish span")
+	}
+	statuses := make(map[string]int)
+	for _, s := range deliver {
+		if s.parent != fanOut[0].sc || !s.ended {
+			t.Fatalf("unexpected deliver span %+v", s)
+		}
+		statuses[s.attrs["delivery.status"]]++
+	}
+	if statuses[DeliveryStatusDelivered.String()] != 1 || statuses[DeliveryStatusFiltered.String()] != 1 {
+		t.Fatalf("unexpected statuses %v", statuses)
+	}
+	if publish[0].attrs["message.seq"] != fmt.Sprint(1) || !publish[0].ended {
+		t.Fatalf("unexpected publish span %+v", publish[0])
+	}
+}
@@ -0,0 +1,150 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the LastError of the Stats while the deliveries wait for the circuit.
+var ErrCircuitOpen = errors.New("webhook: circuit open")
+
+// probePoll is how often a delivery checks the circuit while another one probes the endpoint
+const probePoll = 100 * time.Millisecond
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// CircuitState is the state of the circuit breaker of an endpoint.
+//   - CircuitStateClosed: the deliveries are attempted
+//   - CircuitStateOpen: the deliveries wait until the cooldown ends
+//   - CircuitStateHalfOpen: a single attempt probes the endpoint
+type CircuitState string
+
+const (
+	CircuitStateUnknown  CircuitState = "UNKNOWN"
+	CircuitStateClosed   CircuitState = "CLOSED"
+	CircuitStateOpen     CircuitState = "OPEN"
+	CircuitStateHalfOpen CircuitState = "HALF_OPEN"
+)
+
+func (enum CircuitState) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(CircuitStateUnknown)
+	}
+	return string(enum)
+}
+
+func CircuitStateValues() []CircuitState {
+	return []CircuitState{
+		CircuitStateClosed,
+		CircuitStateOpen,
+		CircuitStateHalfOpen,
+	}
+}
+
+func (enum CircuitState) IsValid() bool {
+	if slices.Contains(CircuitStateValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum CircuitState) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *CircuitState) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := CircuitState(tmp)
+	if !fs.IsValid() {
+		fs = CircuitStateUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// ##############################################################################
+// ################################   BREAKER   #################################
+// ##############################################################################
+
+// breaker opens after threshold consecutive failures, for cooldown. Then a
+// single attempt is let through: a success closes it, a failure opens it again.
+type breaker struct {
+	threshold int // 0 = never opens
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, state: CircuitStateClosed}
+}
+
+// allow reports whether an attempt can be made now.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitStateOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = CircuitStateHalfOpen
+		b.probing = true
+		return true
+	case CircuitStateHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record reports the outcome of an allowed attempt.
+func (b *breaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.state = CircuitStateClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == CircuitStateHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state = CircuitStateOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// retryIn returns when allow could let an attempt through.
+func (b *breaker) retryIn() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitStateOpen {
+		return max(b.cooldown-time.Since(b.openedAt), 0)
+	}
+	return probePoll
+}
+
+func (b *breaker) current() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
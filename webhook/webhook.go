@@ -0,0 +1,476 @@
+// Package webhook delivers the messages of a topic as HTTP POSTs to a URL.
+//
+//	sub, err := webhook.Subscribe(ctx, bus, "orders", "https://example.com/hooks/orders",
+//		webhook.WithSecret(secret),
+//		webhook.WithConcurrency(8),
+//		webhook.WithDeadLetter(webhook.DeadLetterTopic(bus, "orders.dead")),
+//	)
+//
+// The request body is the payload, the message is described by the Bus-*
+// headers (HeaderTopic, HeaderSeq...) and its headers are sent with the
+// HeaderPrefix. A 2xx response is a success. The network errors, 408, 425, 429
+// and 5xx responses are retried with an exponential backoff (honoring
+// Retry-After), the other responses fail the delivery right away.
+//
+// A circuit breaker protects the endpoint: after consecutive failures the
+// deliveries wait, without spending attempts, until a cooldown ends and a
+// single probe succeeds. The deliveries failing for good
+// are dead-lettered and counted as Failed in the bus stats (see
+// thebus.FailureReporter).
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+const (
+	DefaultConcurrency      = 4
+	DefaultMaxAttempts      = 5
+	DefaultMinBackoff       = 500 * time.Millisecond
+	DefaultMaxBackoff       = 30 * time.Second
+	DefaultTimeout          = 10 * time.Second
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// The headers of the requests.
+const (
+	HeaderTopic     = "Bus-Topic"
+	HeaderSeq       = "Bus-Seq"
+	HeaderID        = "Bus-Id" // only for the messages published with PublishConfirm
+	HeaderTimestamp = "Bus-Timestamp"
+	HeaderAttempt   = "Bus-Attempt"
+	HeaderSignature = "Bus-Signature" // see Sign and Verify
+	// HeaderPrefix is the prefix of the message headers ("Bus-Header-Tenant").
+	HeaderPrefix = "Bus-Header-"
+)
+
+// The headers added to the messages published by DeadLetterTopic.
+const (
+	HeaderDeadLetterTopic    = "Dead-Letter-Topic"
+	HeaderDeadLetterURL      = "Dead-Letter-Url"
+	HeaderDeadLetterAttempts = "Dead-Letter-Attempts"
+	HeaderDeadLetterError    = "Dead-Letter-Error"
+)
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+// DeadLetter is a delivery that failed for good.
+type DeadLetter struct {
+	Message  thebus.Message
+	URL      string
+	Attempts int
+	Err      error
+}
+
+// DeadLetterHandler receives the deliveries that failed for good.
+type DeadLetterHandler func(dl DeadLetter)
+
+// DeadLetterTopic returns a DeadLetterHandler publishing the dead letters on
+// topic of bus, with the Dead-Letter-* headers.
+func DeadLetterTopic(bus thebus.Bus, topic string) DeadLetterHandler {
+	return func(dl DeadLetter) {
+		headers := make(map[string]string, len(dl.Message.Headers)+4)
+		for key, value := range dl.Message.Headers {
+			headers[key] = value
+		}
+		headers[HeaderDeadLetterTopic] = dl.Message.Topic
+		headers[HeaderDeadLetterURL] = dl.URL
+		headers[HeaderDeadLetterAttempts] = strconv.Itoa(dl.Attempts)
+		headers[HeaderDeadLetterError] = dl.Err.Error()
+		_, _ = bus.Publish(topic, dl.Message.Payload, thebus.WithHeaders(headers))
+	}
+}
+
+type config struct {
+	secret           []byte
+	concurrency      int
+	maxAttempts      int
+	minBackoff       time.Duration
+	maxBackoff       time.Duration
+	timeout          time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	client           *http.Client
+	header           http.Header
+	contentType      string
+	deadLetter       DeadLetterHandler
+	subscribeOpts    []thebus.SubscribeOption
+	logger           thebus.Logger
+}
+
+// Option configures a Subscriber.
+type Option func(cfg *config)
+
+// WithSecret signs the requests with HMAC-SHA256 in HeaderSignature, see Sign.
+func WithSecret(secret []byte) Option {
+	return func(cfg *config) {
+		cfg.secret = secret
+	}
+}
+
+// WithConcurrency limits the requests in flight. The messages are delivered in
+// order with a concurrency of 1 only.
+func WithConcurrency(n int) Option {
+	return func(cfg *config) {
+		if n < 1 {
+			return
+		}
+		cfg.concurrency = n
+	}
+}
+
+// WithRetry sets the attempts of a delivery, the delay between two attempts
+// doubling (with jitter) from minBackoff up to maxBackoff.
+func WithRetry(maxAttempts int, minBackoff, maxBackoff time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxAttempts = max(maxAttempts, 1)
+		cfg.minBackoff = minBackoff
+		cfg.maxBackoff = maxBackoff
+	}
+}
+
+// WithCircuitBreaker opens the circuit of the endpoint after threshold
+// consecutive failed attempts (0 = never) for cooldown. The deliveries wait
+// while the circuit is open, it does not count as an attempt.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(cfg *config) {
+		cfg.breakerThreshold = threshold
+		cfg.breakerCooldown = cooldown
+	}
+}
+
+// WithTimeout sets the timeout of a request.
+func WithTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.timeout = timeout
+	}
+}
+
+// WithHTTPClient sets the client of the requests, http.DefaultClient by default.
+func WithHTTPClient(client *http.Client) Option {
+	return func(cfg *config) {
+		cfg.client = client
+	}
+}
+
+// WithHeader sets a header of the requests (e.g. Authorization).
+func WithHeader(key, value string) Option {
+	return func(cfg *config) {
+		cfg.header.Set(key, value)
+	}
+}
+
+// WithContentType sets the Content-Type of the requests, application/octet-stream by default.
+func WithContentType(contentType string) Option {
+	return func(cfg *config) {
+		cfg.contentType = contentType
+	}
+}
+
+// WithDeadLetter sets the handler of the deliveries that failed for good.
+func WithDeadLetter(handler DeadLetterHandler) Option {
+	return func(cfg *config) {
+		cfg.deadLetter = handler
+	}
+}
+
+// WithSubscribeOptions sets the options of the bus subscription, e.g. its
+// buffer size and overflow policy.
+func WithSubscribeOptions(opts ...thebus.SubscribeOption) Option {
+	return func(cfg *config) {
+		cfg.subscribeOpts = append(cfg.subscribeOpts, opts...)
+	}
+}
+
+// WithLogger sets the logger of the Subscriber.
+func WithLogger(logger thebus.Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = logger
+	}
+}
+
+// ##############################################################################
+// ###############################   SUBSCRIBER   ###############################
+// ##############################################################################
+
+// Stats are the counters of a Subscriber.
+type Stats struct {
+	Delivered uint64       `json:"delivered"`
+	Failed    uint64       `json:"failed"` // dead-lettered
+	Retries   uint64       `json:"retries"`
+	InFlight  int          `json:"inFlight"`
+	Circuit   CircuitState `json:"circuit"`
+	LastError string       `json:"lastError,omitempty"`
+}
+
+// Subscriber delivers the messages of a bus subscription to a URL.
+type Subscriber struct {
+	bus     thebus.Bus
+	url     string
+	cfg     config
+	sub     thebus.Subscription
+	ctx     context.Context
+	cancel  context.CancelFunc
+	breaker *breaker
+	sem     chan struct{}
+	wg      sync.WaitGroup
+	done    chan struct{}
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+// Subscribe subscribes to topic of bus and delivers its messages to url until
+// ctx is done, Close is called or the subscription ends.
+func Subscribe(ctx context.Context, bus thebus.Bus, topic, url string, opts ...Option) (*Subscriber, error) {
+	cfg := config{
+		concurrency:      DefaultConcurrency,
+		maxAttempts:      DefaultMaxAttempts,
+		minBackoff:       DefaultMinBackoff,
+		maxBackoff:       DefaultMaxBackoff,
+		timeout:          DefaultTimeout,
+		breakerThreshold: DefaultBreakerThreshold,
+		breakerCooldown:  DefaultBreakerCooldown,
+		client:           http.DefaultClient,
+		header:           make(http.Header),
+		contentType:      "application/octet-stream",
+		logger:           thebus.NoopLogger(),
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	subOpts := append([]thebus.SubscribeOption{thebus.WithSubscriberName(url)}, cfg.subscribeOpts...)
+	sub, err := bus.Subscribe(ctx, topic, subOpts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s := &Subscriber{
+		bus:     bus,
+		url:     url,
+		cfg:     cfg,
+		sub:     sub,
+		ctx:     ctx,
+		cancel:  cancel,
+		breaker: newBreaker(cfg.breakerThreshold, cfg.breakerCooldown),
+		sem:     make(chan struct{}, cfg.concurrency),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// GetID returns the ID of the bus subscription.
+func (s *Subscriber) GetID() string {
+	return s.sub.GetID()
+}
+
+func (s *Subscriber) GetTopic() string {
+	return s.sub.GetTopic()
+}
+
+func (s *Subscriber) URL() string {
+	return s.url
+}
+
+// Done returns a channel closed once the subscription ended and the
+// deliveries in flight returned.
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason of the end of the subscription, see thebus.Subscription.
+func (s *Subscriber) Err() error {
+	return s.sub.Err()
+}
+
+// Close unsubscribes, abandons the deliveries in flight (they are not
+// dead-lettered) and waits for them.
+func (s *Subscriber) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+func (s *Subscriber) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Circuit = s.breaker.current()
+	return stats
+}
+
+func (s *Subscriber) update(fn func(stats *Stats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.stats)
+}
+
+func (s *Subscriber) run() {
+	defer close(s.done)
+	defer s.wg.Wait()
+	for msg := range s.sub.Read() {
+		select {
+		case s.sem <- struct{}{}:
+		case <-s.ctx.Done():
+			return
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.wg.Add(1)
+		s.update(func(stats *Stats) { stats.InFlight++ })
+		go func() {
+			defer func() {
+				s.update(func(stats *Stats) { stats.InFlight-- })
+				<-s.sem
+				s.wg.Done()
+			}()
+			s.deliver(msg)
+		}()
+	}
+}
+
+// deliver posts msg until a success, a permanent failure or the last attempt.
+func (s *Subscriber) deliver(msg thebus.Message) {
+	backoff := s.cfg.minBackoff
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		if !s.waitCircuit() {
+			return // abandoned
+		}
+		var retryAfter time.Duration
+		var permanent bool
+		retryAfter, permanent, err = s.post(msg, attempt)
+		// a refused request is not an unavailable endpoint
+		s.breaker.record(err == nil || permanent)
+		if err == nil {
+			s.update(func(stats *Stats) { stats.Delivered++ })
+			return
+		}
+		if s.ctx.Err() != nil {
+			return // abandoned
+		}
+		s.update(func(stats *Stats) { stats.LastError = err.Error() })
+		if permanent || attempt >= s.cfg.maxAttempts {
+			break
+		}
+		s.cfg.logger.Debug("webhook delivery failed, retrying", "url", s.url, "topic", msg.Topic, "seq", msg.Seq, "attempt", attempt, "error", err)
+		s.update(func(stats *Stats) { stats.Retries++ })
+		wait := jitter(backoff)
+		if retryAfter > wait {
+			wait = min(retryAfter, s.cfg.maxBackoff)
+		}
+		if !sleep(s.ctx, wait) {
+			return
+		}
+		backoff = min(2*backoff, s.cfg.maxBackoff)
+	}
+
+	s.cfg.logger.Warn("webhook delivery failed", "url", s.url, "topic", msg.Topic, "seq", msg.Seq, "attempts", attempt, "error", err)
+	s.update(func(stats *Stats) { stats.Failed++ })
+	if s.cfg.deadLetter != nil {
+		s.cfg.deadLetter(DeadLetter{Message: msg, URL: s.url, Attempts: attempt, Err: err})
+	}
+	if reporter, ok := s.bus.(thebus.FailureReporter); ok {
+		_ = reporter.ReportFailure(msg.Topic, s.sub.GetID())
+	}
+}
+
+// waitCircuit waits until the breaker lets an attempt through, false if the
+// Subscriber was closed in the meantime.
+func (s *Subscriber) waitCircuit() bool {
+	for !s.breaker.allow() {
+		s.update(func(stats *Stats) { stats.LastError = ErrCircuitOpen.Error() })
+		if !sleep(s.ctx, s.breaker.retryIn()) {
+			return false
+		}
+	}
+	return true
+}
+
+// post makes an attempt, permanent reports an error not worth a retry.
+func (s *Subscriber) post(msg thebus.Message, attempt int) (retryAfter time.Duration, permanent bool, err error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return 0, true, err
+	}
+	for key, values := range s.cfg.header {
+		req.Header[key] = values
+	}
+	SetHeaders(req.Header, msg)
+	req.Header.Set("Content-Type", s.cfg.contentType)
+	req.Header.Set(HeaderAttempt, strconv.Itoa(attempt))
+	if s.cfg.secret != nil {
+		req.Header.Set(HeaderSignature, Sign(s.cfg.secret, time.Now(), msg.Payload))
+	}
+
+	resp, err := s.cfg.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return 0, false, nil
+	case code == http.StatusRequestTimeout, code == http.StatusTooEarly, code == http.StatusTooManyRequests, code >= 500:
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return retryAfter, false, fmt.Errorf("webhook: %s", resp.Status)
+	default:
+		return 0, true, fmt.Errorf("webhook: %s", resp.Status)
+	}
+}
+
+// SetHeaders sets the headers describing msg: HeaderTopic, HeaderSeq,
+// HeaderID, HeaderTimestamp and the message headers with HeaderPrefix.
+func SetHeaders(h http.Header, msg thebus.Message) {
+	for key, value := range msg.Headers {
+		h.Set(HeaderPrefix+key, value)
+	}
+	h.Set(HeaderTopic, msg.Topic)
+	h.Set(HeaderSeq, strconv.FormatUint(msg.Seq, 10))
+	if msg.ID != "" {
+		h.Set(HeaderID, msg.ID)
+	}
+	h.Set(HeaderTimestamp, msg.Timestamp.UTC().Format(time.RFC3339Nano))
+}
+
+// jitter returns a random delay between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	if d < 2 {
+		return d
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// sleep waits for d, false if ctx ended first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
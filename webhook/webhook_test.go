@@ -0,0 +1,261 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+var fastRetry = WithRetry(3, time.Millisecond, 5*time.Millisecond)
+
+func newBus(t *testing.T) thebus.Bus {
+	t.Helper()
+	bus, err := thebus.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = bus.Close() })
+	return bus
+}
+
+func subscribe(t *testing.T, bus thebus.Bus, url string, opts ...Option) *Subscriber {
+	t.Helper()
+	s, err := Subscribe(t.Context(), bus, "orders", url, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// statusServer answers the statuses in order, then the last one.
+func statusServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestDelivery(t *testing.T) {
+	secret := []byte("s3cr3t")
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := Verify(secret, r.Header.Get(HeaderSignature), body, time.Minute); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests <- r
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	bus := newBus(t)
+	s := subscribe(t, bus, srv.URL, WithSecret(secret), WithHeader("Authorization", "Bearer x"), WithContentType("application/json"))
+	if _, err := bus.Publish("orders", []byte(`{"id":1}`), thebus.WithHeader("Tenant", "acme")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-requests:
+		if r.Header.Get(HeaderTopic) != "orders" || r.Header.Get(HeaderSeq) != "1" || r.Header.Get(HeaderAttempt) != "1" ||
+			r.Header.Get(HeaderPrefix+"Tenant") != "acme" || r.Header.Get("Authorization") != "Bearer x" ||
+			r.Header.Get("Content-Type") != "application/json" || r.Header.Get(HeaderTimestamp) == "" {
+			t.Fatalf("unexpected headers: %v", r.Header)
+		}
+		if body := <-bodies; string(body) != `{"id":1}` {
+			t.Fatalf("unexpected body: %s", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no request")
+	}
+	eventually(t, func() bool { return s.Stats().Delivered == 1 })
+	if s.GetTopic() != "orders" || s.URL() != srv.URL || s.GetID() == "" {
+		t.Fatalf("unexpected subscriber: %s %s %s", s.GetTopic(), s.URL(), s.GetID())
+	}
+}
+
+func TestRetries(t *testing.T) {
+	srv, calls := statusServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNoContent)
+	bus := newBus(t)
+	s := subscribe(t, bus, srv.URL, WithRetry(5, time.Millisecond, 5*time.Millisecond))
+	_, _ = bus.Publish("orders", []byte("x"))
+
+	eventually(t, func() bool { return s.Stats().Delivered == 1 })
+	if stats := s.Stats(); calls.Load() != 3 || stats.Retries != 2 || stats.Failed != 0 || stats.Circuit != CircuitStateClosed {
+		t.Fatalf("unexpected stats: %d %+v", calls.Load(), stats)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	srv, calls := statusServer(t, http.StatusInternalServerError)
+	refusing, refusals := statusServer(t, http.StatusBadRequest)
+	bus := newBus(t)
+	dead, err := bus.Subscribe(t.Context(), "dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := subscribe(t, bus, srv.URL, fastRetry, WithDeadLetter(DeadLetterTopic(bus, "dead")))
+	refused := subscribe(t, bus, refusing.URL, fastRetry)
+	_, _ = bus.Publish("orders", []byte("x"), thebus.WithHeader("k", "v"))
+
+	select {
+	case msg := <-dead.Read():
+		if string(msg.Payload) != "x" || msg.Headers["k"] != "v" || msg.Headers[HeaderDeadLetterTopic] != "orders" ||
+			msg.Headers[HeaderDeadLetterURL] != srv.URL || msg.Headers[HeaderDeadLetterAttempts] != "3" ||
+			msg.Headers[HeaderDeadLetterError] != "webhook: 500 Internal Server Error" {
+			t.Fatalf("unexpected dead letter: %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no dead letter")
+	}
+	// a refused delivery is not retried
+	eventually(t, func() bool { return refused.Stats().Failed == 1 })
+	if calls.Load() != 3 || refusals.Load() != 1 {
+		t.Fatalf("unexpected calls: %d %d", calls.Load(), refusals.Load())
+	}
+
+	// counted as failed in the bus stats
+	eventually(t, func() bool {
+		stats, _ := bus.Stats()
+		return stats.PerTopic["orders"].Failed == 2
+	})
+	stats, _ := bus.Stats()
+	if sub := stats.PerTopic["orders"].Subscriptions[s.GetID()]; sub.Failed != 1 || sub.Delivered != 1 || sub.Name != srv.URL {
+		t.Fatalf("unexpected subscriber stats: %+v", sub)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	srv, calls := statusServer(t, http.StatusBadGateway)
+	bus := newBus(t)
+	var deadLetters atomic.Int32
+	s := subscribe(t, bus, srv.URL, WithRetry(4, time.Millisecond, time.Millisecond), WithCircuitBreaker(2, time.Hour),
+		WithDeadLetter(func(DeadLetter) { deadLetters.Add(1) }))
+	_, _ = bus.Publish("orders", []byte("x"))
+
+	// the open circuit holds the delivery, the attempts are not spent
+	eventually(t, func() bool { return s.Stats().LastError == ErrCircuitOpen.Error() })
+	time.Sleep(20 * time.Millisecond)
+	if stats := s.Stats(); calls.Load() != 2 || stats.Circuit != CircuitStateOpen || stats.Failed != 0 || stats.InFlight != 1 || deadLetters.Load() != 0 {
+		t.Fatalf("unexpected stats: %d %+v", calls.Load(), stats)
+	}
+
+	// the probe after the cooldown delivers it
+	recovering, probes := statusServer(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusNoContent)
+	r := subscribe(t, bus, recovering.URL, WithRetry(3, time.Millisecond, time.Millisecond), WithCircuitBreaker(2, 50*time.Millisecond))
+	_, _ = bus.Publish("orders", []byte("y"))
+	eventually(t, func() bool { return r.Stats().Delivered == 1 })
+	if stats := r.Stats(); probes.Load() != 3 || stats.Failed != 0 || stats.Circuit != CircuitStateClosed {
+		t.Fatalf("unexpected stats: %d %+v", probes.Load(), stats)
+	}
+
+	b := newBreaker(1, 10*time.Millisecond)
+	b.record(false)
+	if b.allow() || b.current() != CircuitStateOpen {
+		t.Fatal("expected an open circuit")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !b.allow() || b.allow() || b.current() != CircuitStateHalfOpen {
+		t.Fatal("expected a single probe")
+	}
+	b.record(true)
+	if !b.allow() || b.current() != CircuitStateClosed {
+		t.Fatal("expected a closed circuit")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	var inFlight, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		<-release
+		inFlight.Add(-1)
+	}))
+	defer srv.Close()
+	var once sync.Once
+	defer once.Do(func() { close(release) })
+
+	bus := newBus(t)
+	s := subscribe(t, bus, srv.URL, WithConcurrency(2))
+	for range 5 {
+		_, _ = bus.Publish("orders", []byte("x"))
+	}
+	eventually(t, func() bool { return s.Stats().InFlight == 2 })
+	time.Sleep(20 * time.Millisecond)
+	once.Do(func() { close(release) })
+	eventually(t, func() bool { return s.Stats().Delivered == 5 })
+	if peak.Load() != 2 {
+		t.Fatalf("expected 2 requests in flight at most, got %d", peak.Load())
+	}
+}
+
+func TestClose(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body) // the disconnect is noticed once the body is read
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	bus := newBus(t)
+	var deadLetters atomic.Int32
+	s, err := Subscribe(context.Background(), bus, "orders", srv.URL, WithDeadLetter(func(DeadLetter) { deadLetters.Add(1) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = bus.Publish("orders", []byte("x"))
+	eventually(t, func() bool { return s.Stats().InFlight == 1 })
+
+	_ = s.Close()
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("expected the subscriber done")
+	}
+	if s.Err() == nil || deadLetters.Load() != 0 || s.Stats().InFlight != 0 {
+		t.Fatalf("unexpected end: %v %d %+v", s.Err(), deadLetters.Load(), s.Stats())
+	}
+}
+
+func TestSignature(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte("payload")
+	header := Sign(secret, time.Now(), body)
+	if err := Verify(secret, header, body, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for name, err := range map[string]error{
+		"wrong secret": Verify([]byte("other"), header, body, 0),
+		"wrong body":   Verify(secret, header, []byte("other"), 0),
+		"too old":      Verify(secret, Sign(secret, time.Now().Add(-time.Hour), body), body, time.Minute),
+		"malformed":    Verify(secret, "v1=abc", body, 0),
+	} {
+		if err != ErrInvalidSignature {
+			t.Errorf("%s: expected ErrInvalidSignature, got %v", name, err)
+		}
+	}
+}
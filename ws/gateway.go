@@ -0,0 +1,477 @@
+// Package ws is a WebSocket gateway to a bus, implemented with the standard
+// library only (RFC 6455 framing, no extension).
+//
+// The clients exchange JSON envelopes (see Envelope) in text or binary frames:
+//
+//	-> {"op":"SUB","topic":"orders"}
+//	-> {"op":"PUB","topic":"orders","payload":"aGVsbG8=","headers":{"k":"v"}}
+//	<- {"op":"MSG","topic":"orders","seq":1,"ts":"...","payload":"aGVsbG8="}
+//	-> {"op":"UNSUB","topic":"orders"}
+//	<- {"op":"ERR","ref":"42","topic":"orders","error":"..."}
+//
+// The payloads are base64 encoded ([]byte in JSON). The backpressure of a
+// slow client is handled by its subscriptions, see WithSubscribeOptions.
+package ws
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sebundefined/thebus"
+)
+
+const (
+	DefaultMaxSubscriptions = 64
+	DefaultMaxMessageSize   = 1 << 20
+	DefaultPingInterval     = 30 * time.Second
+	DefaultWriteTimeout     = 10 * time.Second
+)
+
+// ##############################################################################
+// ##################################   ENUM   ##################################
+// ##############################################################################
+
+// Op is the operation of an Envelope.
+//   - OpSub, OpUnsub, OpPub: sent by the client
+//   - OpMsg, OpErr: sent by the gateway
+type Op string
+
+const (
+	OpUnknown Op = "UNKNOWN"
+	OpSub     Op = "SUB"
+	OpUnsub   Op = "UNSUB"
+	OpPub     Op = "PUB"
+	OpMsg     Op = "MSG"
+	OpErr     Op = "ERR"
+)
+
+func (enum Op) String() string {
+	if len(strings.TrimSpace(string(enum))) == 0 {
+		return string(OpUnknown)
+	}
+	return string(enum)
+}
+
+func OpValues() []Op {
+	return []Op{
+		OpSub,
+		OpUnsub,
+		OpPub,
+		OpMsg,
+		OpErr,
+	}
+}
+
+func (enum Op) IsValid() bool {
+	if slices.Contains(OpValues(), enum) {
+		return true
+	}
+	return false
+}
+
+func (enum Op) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, enum)), nil
+}
+
+func (enum *Op) UnmarshalJSON(data []byte) error {
+	var tmp string
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	fs := Op(tmp)
+	if !fs.IsValid() {
+		fs = OpUnknown
+	}
+	*enum = fs
+	return nil
+}
+
+// ##############################################################################
+// ################################   PROTOCOL   ################################
+// ##############################################################################
+
+// Envelope is the JSON message exchanged with the clients.
+type Envelope struct {
+	Op        Op                `json:"op"`
+	Ref       string            `json:"ref,omitempty"` // set by the client, echoed in the ERR envelopes
+	Topic     string            `json:"topic,omitempty"`
+	Seq       uint64            `json:"seq,omitempty"`
+	ID        string            `json:"id,omitempty"`
+	Timestamp time.Time         `json:"ts,omitzero"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Payload   []byte            `json:"payload,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// ##############################################################################
+// ###############################   OPTIONS   ##################################
+// ##############################################################################
+
+// Authorizer allows (nil) or denies (an error) a SUB or PUB of a client on topic.
+type Authorizer func(r *http.Request, op Op, topic string) error
+
+type config struct {
+	maxSubscriptions int
+	maxMessageSize   int64
+	pingInterval     time.Duration
+	writeTimeout     time.Duration
+	authorizer       Authorizer
+	subscribeOpts    []thebus.SubscribeOption
+}
+
+// Option configures the Handler.
+type Option func(cfg *config)
+
+// WithMaxSubscriptions limits the subscriptions of a connection.
+func WithMaxSubscriptions(max int) Option {
+	return func(cfg *config) {
+		cfg.maxSubscriptions = max
+	}
+}
+
+// WithMaxMessageSize limits the size of the messages sent by a client,
+// the connection is closed above.
+func WithMaxMessageSize(size int64) Option {
+	return func(cfg *config) {
+		cfg.maxMessageSize = size
+	}
+}
+
+// WithPingInterval sets the interval of the pings. A client silent for two
+// intervals is disconnected.
+func WithPingInterval(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.pingInterval = interval
+	}
+}
+
+// WithWriteTimeout sets the deadline of a write to a client, the connection is closed above.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.writeTimeout = timeout
+	}
+}
+
+// WithAuthorizer checks each SUB and PUB. A denied operation gets an ERR envelope.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(cfg *config) {
+		cfg.authorizer = authorizer
+	}
+}
+
+// WithSubscribeOptions sets the options of the subscriptions of the clients:
+// buffer size, SendTimeout, DropIfFull, OverflowPolicy... apply when a client
+// does not read fast enough.
+func WithSubscribeOptions(opts ...thebus.SubscribeOption) Option {
+	return func(cfg *config) {
+		cfg.subscribeOpts = append(cfg.subscribeOpts, opts...)
+	}
+}
+
+// ##############################################################################
+// ################################   HANDLER   #################################
+// ##############################################################################
+
+// Handler upgrades the requests to WebSocket connections bridged to the bus.
+type Handler struct {
+	bus thebus.Bus
+	cfg config
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+// NewHandler returns the WebSocket gateway of bus.
+func NewHandler(bus thebus.Bus, opts ...Option) *Handler {
+	h := &Handler{
+		bus: bus,
+		cfg: config{
+			maxSubscriptions: DefaultMaxSubscriptions,
+			maxMessageSize:   DefaultMaxMessageSize,
+			pingInterval:     DefaultPingInterval,
+			writeTimeout:     DefaultWriteTimeout,
+		},
+	}
+	for _, opt := range opts {
+		opt(&h.cfg)
+	}
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := checkHandshake(r)
+	if err != nil {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "ws: hijacking unsupported", http.StatusInternalServerError)
+		return
+	}
+	netConn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = fmt.Fprintf(rw.Writer, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err := rw.Writer.Flush(); err != nil {
+		_ = netConn.Close()
+		return
+	}
+	c := &conn{
+		handler: h,
+		request: r,
+		netConn: netConn,
+		reader:  rw.Reader,
+		writer:  rw.Writer,
+		subs:    make(map[string]thebus.Subscription),
+	}
+	c.serve()
+}
+
+// ##############################################################################
+// ###############################   CONNECTION   ###############################
+// ##############################################################################
+
+type conn struct {
+	handler *Handler
+	request *http.Request
+	netConn net.Conn
+	reader  *bufio.Reader
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	subs map[string]thebus.Subscription
+}
+
+func (c *conn) serve() {
+	// the hijacked request context is not tied to the connection anymore
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	defer func() {
+		c.cancel()
+		c.wg.Wait()
+		_ = c.netConn.Close()
+	}()
+	if c.handler.cfg.pingInterval > 0 {
+		c.wg.Add(1)
+		go c.ping()
+	}
+	code, reason := c.readLoop()
+	c.writeControl(opClose, closePayload(code, reason))
+}
+
+// readLoop handles the client frames until the connection ends, it returns the close status.
+func (c *conn) readLoop() (uint16, string) {
+	var message []byte
+	var messageOp byte
+	for {
+		if c.handler.cfg.pingInterval > 0 {
+			_ = c.netConn.SetReadDeadline(time.Now().Add(2 * c.handler.cfg.pingInterval))
+		}
+		f, err := readFrame(c.reader, c.handler.cfg.maxMessageSize)
+		switch {
+		case errors.Is(err, errTooBig):
+			return closeTooBig, err.Error()
+		case errors.Is(err, errProtocol):
+			return closeProtocolError, err.Error()
+		case err != nil:
+			return closeNormal, ""
+		}
+		switch f.opcode {
+		case opPing:
+			c.writeControl(opPong, f.payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return closeNormal, ""
+		case opText, opBinary:
+			if message != nil {
+				return closeProtocolError, "ws: expected a continuation frame"
+			}
+			messageOp = f.opcode
+			message = f.payload
+		case opContinuation:
+			if message == nil {
+				return closeProtocolError, "ws: unexpected continuation frame"
+			}
+			message = append(message, f.payload...)
+		default:
+			return closeProtocolError, "ws: unknown opcode"
+		}
+		if int64(len(message)) > c.handler.cfg.maxMessageSize {
+			return closeTooBig, errTooBig.Error()
+		}
+		if !f.fin {
+			continue
+		}
+		if messageOp == opText && !utf8.Valid(message) {
+			return closeInvalidData, "ws: invalid UTF-8"
+		}
+		c.handle(message)
+		message = nil
+	}
+}
+
+func (c *conn) handle(data []byte) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		c.sendError(env, fmt.Errorf("invalid envelope: %w", err))
+		return
+	}
+	switch env.Op {
+	case OpSub:
+		c.subscribe(env)
+	case OpUnsub:
+		c.unsubscribe(env)
+	case OpPub:
+		if err := c.authorize(OpPub, env.Topic); err != nil {
+			c.sendError(env, err)
+			return
+		}
+		if _, err := c.handler.bus.Publish(env.Topic, env.Payload, thebus.WithHeaders(env.Headers)); err != nil {
+			c.sendError(env, err)
+		}
+	default:
+		c.sendError(env, fmt.Errorf("unsupported op %s", env.Op))
+	}
+}
+
+func (c *conn) authorize(op Op, topic string) error {
+	if c.handler.cfg.authorizer == nil {
+		return nil
+	}
+	return c.handler.cfg.authorizer(c.request, op, topic)
+}
+
+func (c *conn) subscribe(env Envelope) {
+	if err := c.authorize(OpSub, env.Topic); err != nil {
+		c.sendError(env, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subs[env.Topic]; ok {
+		c.sendError(env, errors.New("already subscribed"))
+		return
+	}
+	if max := c.handler.cfg.maxSubscriptions; max > 0 && len(c.subs) >= max {
+		c.sendError(env, fmt.Errorf("too many subscriptions (max: %d)", max))
+		return
+	}
+	sub, err := c.handler.bus.Subscribe(c.ctx, env.Topic, c.handler.cfg.subscribeOpts...)
+	if err != nil {
+		c.sendError(env, err)
+		return
+	}
+	c.subs[env.Topic] = sub
+	c.wg.Add(1)
+	go c.forward(sub)
+}
+
+func (c *conn) unsubscribe(env Envelope) {
+	c.mu.Lock()
+	sub, ok := c.subs[env.Topic]
+	delete(c.subs, env.Topic)
+	c.mu.Unlock()
+	if !ok {
+		c.sendError(env, errors.New("not subscribed"))
+		return
+	}
+	_ = sub.Unsubscribe()
+}
+
+// forward sends the messages of sub to the client until the subscription ends.
+func (c *conn) forward(sub thebus.Subscription) {
+	defer c.wg.Done()
+	for msg := range sub.Read() {
+		err := c.send(Envelope{
+			Op:        OpMsg,
+			Topic:     msg.Topic,
+			Seq:       msg.Seq,
+			ID:        msg.ID,
+			Timestamp: msg.Timestamp,
+			Headers:   msg.Headers,
+			Payload:   msg.Payload,
+		})
+		if err != nil {
+			c.abort()
+			return
+		}
+	}
+	// ended by the bus (closed, topic deleted, evicted...) unless by the client
+	if err := sub.Err(); c.ctx.Err() == nil && !errors.Is(err, thebus.ErrUnsubscribed) {
+		c.mu.Lock()
+		if c.subs[sub.GetTopic()] == sub {
+			delete(c.subs, sub.GetTopic())
+		}
+		c.mu.Unlock()
+		c.sendError(Envelope{Topic: sub.GetTopic()}, fmt.Errorf("subscription ended: %w", err))
+	}
+}
+
+func (c *conn) ping() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.handler.cfg.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.writeControl(opPing, nil)
+		}
+	}
+}
+
+func (c *conn) sendError(env Envelope, err error) {
+	_ = c.send(Envelope{Op: OpErr, Ref: env.Ref, Topic: env.Topic, Error: err.Error()})
+}
+
+func (c *conn) send(env Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return c.write(opText, data)
+}
+
+func (c *conn) writeControl(opcode byte, payload []byte) {
+	if err := c.write(opcode, payload); err != nil {
+		c.abort()
+	}
+}
+
+// abort ends the connection after a failed write. Closing the socket wakes up
+// the readLoop, blocked in readFrame when there is no ping deadline.
+func (c *conn) abort() {
+	c.cancel()
+	_ = c.netConn.Close()
+}
+
+func (c *conn) write(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.handler.cfg.writeTimeout > 0 {
+		_ = c.netConn.SetWriteDeadline(time.Now().Add(c.handler.cfg.writeTimeout))
+	}
+	return writeFrame(c.writer, opcode, payload)
+}
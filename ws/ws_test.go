@@ -0,0 +1,306 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sebundefined/thebus"
+)
+
+// client is a minimal WebSocket client for the tests
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, srv *httptest.Server) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+key+"\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status: %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("accept: %q", got)
+	}
+	return &client{t: t, conn: conn, r: r}
+}
+
+func (c *client) writeFrame(fin bool, opcode byte, payload []byte) {
+	c.t.Helper()
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	header := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, 0x80|byte(n))
+	case n <= 0xffff:
+		header = append(header, 0x80|126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 0x80|127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+	if _, err := c.conn.Write(append(append(header, mask[:]...), masked...)); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+func (c *client) send(env Envelope) {
+	c.t.Helper()
+	data, _ := json.Marshal(env)
+	c.writeFrame(true, opText, data)
+}
+
+// readFrame reads an unmasked server frame
+func (c *client) readFrame() (byte, []byte) {
+	c.t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	length := int(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, _ = io.ReadFull(c.r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, _ = io.ReadFull(c.r, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// read returns the next envelope, answering the pings
+func (c *client) read() Envelope {
+	c.t.Helper()
+	for {
+		opcode, payload := c.readFrame()
+		switch opcode {
+		case opPing:
+			c.writeFrame(true, opPong, payload)
+		case opText:
+			var env Envelope
+			if err := json.Unmarshal(payload, &env); err != nil {
+				c.t.Fatalf("unmarshal: %v", err)
+			}
+			return env
+		default:
+			c.t.Fatalf("unexpected opcode %d", opcode)
+		}
+	}
+}
+
+func newServer(t *testing.T, opts ...Option) (thebus.Bus, *httptest.Server) {
+	t.Helper()
+	bus, err := thebus.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(bus, opts...))
+	t.Cleanup(func() {
+		srv.Close()
+		_ = bus.Close()
+	})
+	return bus, srv
+}
+
+// waitSubscribers waits for n subscribers on topic
+func waitSubscribers(t *testing.T, bus thebus.Bus, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		stats, _ := bus.Stats()
+		if stats.PerTopic[topic].Subscribers == n {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscribers on %s", n, topic)
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	_, srv := newServer(t)
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestSubscribePublish(t *testing.T) {
+	bus, srv := newServer(t)
+	c := dial(t, srv)
+
+	c.send(Envelope{Op: OpSub, Topic: "orders"})
+	waitSubscribers(t, bus, "orders", 1)
+
+	if _, err := bus.Publish("orders", []byte("hello"), thebus.WithHeader("k", "v")); err != nil {
+		t.Fatal(err)
+	}
+	env := c.read()
+	if env.Op != OpMsg || env.Topic != "orders" || string(env.Payload) != "hello" || env.Seq != 1 || env.Headers["k"] != "v" {
+		t.Fatalf("unexpected envelope: %+v", env)
+	}
+
+	// PUB from the client, received by its own subscription
+	c.send(Envelope{Op: OpPub, Topic: "orders", Payload: []byte("from ws")})
+	if env := c.read(); env.Op != OpMsg || string(env.Payload) != "from ws" {
+		t.Fatalf("unexpected envelope: %+v", env)
+	}
+
+	c.send(Envelope{Op: OpUnsub, Topic: "orders"})
+	waitSubscribers(t, bus, "orders", 0)
+	c.send(Envelope{Op: OpUnsub, Topic: "orders", Ref: "1"})
+	if env := c.read(); env.Op != OpErr || env.Ref != "1" {
+		t.Fatalf("expected ERR, got %+v", env)
+	}
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	bus, srv := newServer(t)
+	c := dial(t, srv)
+
+	data, _ := json.Marshal(Envelope{Op: OpSub, Topic: "frag"})
+	c.writeFrame(false, opText, data[:5])
+	c.writeFrame(true, opPing, []byte("p")) // control frames can be interleaved
+	c.writeFrame(true, opContinuation, data[5:])
+	if opcode, payload := c.readFrame(); opcode != opPong || string(payload) != "p" {
+		t.Fatalf("expected pong, got %d %q", opcode, payload)
+	}
+	waitSubscribers(t, bus, "frag", 1)
+}
+
+func TestErrors(t *testing.T) {
+	denied := errors.New("denied")
+	_, srv := newServer(t,
+		WithMaxSubscriptions(1),
+		WithAuthorizer(func(r *http.Request, op Op, topic string) error {
+			if topic == "secret" {
+				return denied
+			}
+			return nil
+		}),
+	)
+	c := dial(t, srv)
+
+	c.writeFrame(true, opText, []byte("{"))
+	if env := c.read(); env.Op != OpErr {
+		t.Fatalf("expected ERR, got %+v", env)
+	}
+	c.send(Envelope{Op: OpPub, Topic: "secret", Ref: "1"})
+	if env := c.read(); env.Op != OpErr || env.Ref != "1" || env.Error != "denied" {
+		t.Fatalf("expected denied, got %+v", env)
+	}
+	c.send(Envelope{Op: OpSub, Topic: "a"})
+	c.send(Envelope{Op: OpSub, Topic: "b", Ref: "2"})
+	if env := c.read(); env.Op != OpErr || env.Ref != "2" || !strings.Contains(env.Error, "too many") {
+		t.Fatalf("expected the limit, got %+v", env)
+	}
+	c.send(Envelope{Op: OpSub, Topic: "a", Ref: "3"})
+	if env := c.read(); env.Op != OpErr || env.Ref != "3" {
+		t.Fatalf("expected already subscribed, got %+v", env)
+	}
+}
+
+func TestCloseOnInvalidFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(c *client)
+		code uint16
+	}{
+		{"invalid utf8", func(c *client) { c.writeFrame(true, opText, []byte{0xff, 0xfe}) }, closeInvalidData},
+		{"too big", func(c *client) { c.writeFrame(true, opText, make([]byte, 200)) }, closeTooBig},
+		{"orphan continuation", func(c *client) { c.writeFrame(true, opContinuation, []byte("x")) }, closeProtocolError},
+		{"close", func(c *client) { c.writeFrame(true, opClose, closePayload(closeNormal, "")) }, closeNormal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newServer(t, WithMaxMessageSize(100))
+			c := dial(t, srv)
+			tt.send(c)
+			opcode, payload := c.readFrame()
+			if opcode != opClose || len(payload) < 2 {
+				t.Fatalf("expected close, got %d %q", opcode, payload)
+			}
+			if code := binary.BigEndian.Uint16(payload); code != tt.code {
+				t.Fatalf("expected %d, got %d", tt.code, code)
+			}
+		})
+	}
+}
+
+func TestPingAndSubscriptionsReleased(t *testing.T) {
+	bus, srv := newServer(t, WithPingInterval(20*time.Millisecond))
+	c := dial(t, srv)
+	c.send(Envelope{Op: OpSub, Topic: "t"})
+	if opcode, _ := c.readFrame(); opcode != opPing {
+		t.Fatalf("expected ping, got %d", opcode)
+	}
+	waitSubscribers(t, bus, "t", 1)
+
+	// the client stops answering: disconnected after two intervals
+	_ = c.conn.Close()
+	waitSubscribers(t, bus, "t", 0)
+}
+
+func TestWriteFailureClosesConnection(t *testing.T) {
+	bus, srv := newServer(t, WithPingInterval(0), WithWriteTimeout(50*time.Millisecond))
+	c := dial(t, srv)
+	c.send(Envelope{Op: OpSub, Topic: "t"})
+	waitSubscribers(t, bus, "t", 1)
+
+	// the client stops reading: a write times out and ends the connection
+	payload := make([]byte, 64<<10)
+	deadline := time.Now().Add(5 * time.Second)
+	for stats, _ := bus.Stats(); stats.PerTopic["t"].Subscribers == 1; stats, _ = bus.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatal("the write never failed")
+		}
+		_, _ = bus.Publish("t", payload)
+		time.Sleep(time.Millisecond)
+	}
+	// without a ping deadline the read side must be closed as well
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.Copy(io.Discard, c.conn); err != nil {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}